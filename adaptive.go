@@ -0,0 +1,485 @@
+package golangcouchdb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TunerConfig configures a BulkTuner
+type TunerConfig struct {
+	// MinBatch and MaxBatch bound the documents per request, default 10 and 10000
+	MinBatch, MaxBatch int
+	// InitialBatch default 100
+	InitialBatch int
+	// BatchStep is added to the batch size after a fast request, default 10
+	BatchStep int
+	// MaxConcurrency bounds the requests in flight, default 16. The minimum is 1.
+	MaxConcurrency int
+	// InitialConcurrency default 2
+	InitialConcurrency int
+	// TargetLatency is the slowest request that still counts as fast, default 2s
+	TargetLatency time.Duration
+	// Decrease multiplies batch size and concurrency when the cluster is overloaded, default 0.5
+	Decrease float64
+	// MaxRetries of a batch that failed with 429, 503 or a timeout, default 5. Writes are
+	// only retried after 429 and 503, after a timeout they may have been written.
+	MaxRetries int
+}
+
+// TunerMetrics are the current settings and counters of a BulkTuner
+type TunerMetrics struct {
+	BatchSize    int           `json:"batch_size"`
+	Concurrency  int           `json:"concurrency"`
+	InFlight     int           `json:"in_flight"`
+	Requests     int64         `json:"requests"`
+	Docs         int64         `json:"docs"`
+	Slow         int64         `json:"slow"`
+	TooLarge     int64         `json:"too_large"`
+	Overloaded   int64         `json:"overloaded"`
+	Decreases    int64         `json:"decreases"`
+	LastLatency  time.Duration `json:"last_latency_ns"`
+	DocsPerSec   float64       `json:"docs_per_sec"`
+	LastDecrease time.Time     `json:"last_decrease"`
+}
+
+// BulkTuner adjusts batch size and concurrency of BulkWrite and BulkRead with additive
+// increase and multiplicative decrease: every fast request grows the batch by BatchStep,
+// and a full round of fast requests adds one request in flight. Slow requests shrink the
+// batch, 413 halves it and lowers MaxBatch to that size, 429, 503 and timeouts shrink batch
+// and concurrency. Only one decrease is made per round, requests started before the last
+// decrease are not counted again.
+//
+// A BulkTuner is shared by all bulk calls of a CouchDBAPI, set it as CouchDBAPI.Tuner.
+// It implements expvar.Var, so it can be published with expvar.Publish.
+type BulkTuner struct {
+	cfg TunerConfig
+
+	mu          sync.Mutex
+	batch       float64
+	maxBatch    int
+	concurrency int
+	inFlight    int
+	fastInRound int
+	wake        chan struct{}
+	m           TunerMetrics
+}
+
+// NewBulkTuner returns a BulkTuner, zero values of cfg are set to their defaults
+func NewBulkTuner(cfg TunerConfig) *BulkTuner {
+	if cfg.MinBatch <= 0 {
+		cfg.MinBatch = 10
+	}
+	if cfg.MaxBatch <= 0 {
+		cfg.MaxBatch = 10000
+	}
+	if cfg.MaxBatch < cfg.MinBatch {
+		cfg.MaxBatch = cfg.MinBatch
+	}
+	if cfg.InitialBatch <= 0 {
+		cfg.InitialBatch = 100
+	}
+	if cfg.BatchStep <= 0 {
+		cfg.BatchStep = 10
+	}
+	if cfg.MaxConcurrency <= 0 {
+		cfg.MaxConcurrency = 16
+	}
+	if cfg.InitialConcurrency <= 0 {
+		cfg.InitialConcurrency = 2
+	}
+	if cfg.TargetLatency <= 0 {
+		cfg.TargetLatency = 2 * time.Second
+	}
+	if cfg.Decrease <= 0 || cfg.Decrease >= 1 {
+		cfg.Decrease = 0.5
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 5
+	}
+	t := &BulkTuner{cfg: cfg, maxBatch: cfg.MaxBatch, wake: make(chan struct{})}
+	t.batch = float64(clampInt(cfg.InitialBatch, cfg.MinBatch, cfg.MaxBatch))
+	t.concurrency = clampInt(cfg.InitialConcurrency, 1, cfg.MaxConcurrency)
+	return t
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// BatchSize returns the current number of documents per request
+func (t *BulkTuner) BatchSize() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return int(t.batch)
+}
+
+// Concurrency returns the current number of requests in flight
+func (t *BulkTuner) Concurrency() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.concurrency
+}
+
+// Metrics returns the current settings and counters
+func (t *BulkTuner) Metrics() TunerMetrics {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := t.m
+	m.BatchSize = int(t.batch)
+	m.Concurrency = t.concurrency
+	m.InFlight = t.inFlight
+	return m
+}
+
+// String returns the metrics as JSON for expvar
+func (t *BulkTuner) String() string {
+	return string(mustJSON(t.Metrics()))
+}
+
+// acquire waits until fewer than Concurrency requests are in flight
+func (t *BulkTuner) acquire(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		if t.inFlight < t.concurrency {
+			t.inFlight++
+			t.mu.Unlock()
+			return nil
+		}
+		wake := t.wake
+		t.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (t *BulkTuner) release() {
+	t.mu.Lock()
+	t.inFlight--
+	t.signal()
+	t.mu.Unlock()
+}
+
+// signal wakes all waiting acquires, t.mu must be held
+func (t *BulkTuner) signal() {
+	close(t.wake)
+	t.wake = make(chan struct{})
+}
+
+type verdict int
+
+const (
+	verdictOK verdict = iota
+	verdictTooLarge
+	verdictOverloaded
+	verdictFailed
+)
+
+// classify sorts the result of a bulk request
+func classify(err error) verdict {
+	if err == nil {
+		return verdictOK
+	}
+	if e, ok := err.(*Error); ok {
+		switch e.StatusCode {
+		case http.StatusRequestEntityTooLarge:
+			return verdictTooLarge
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return verdictOverloaded
+		}
+		return verdictFailed
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return verdictOverloaded
+	}
+	return verdictFailed
+}
+
+// rejected reports whether Couchdb refused a request without processing it, so that a
+// request that is not idempotent, like _bulk_docs, can be sent again
+func rejected(err error) bool {
+	e, ok := err.(*Error)
+	return ok && (e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable)
+}
+
+// observe adjusts the settings after a request with n documents started at start
+func (t *BulkTuner) observe(n int, start time.Time, err error) verdict {
+	v := classify(err)
+	latency := time.Since(start)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.m.Requests++
+	t.m.LastLatency = latency
+	// a decrease is made once per round, later answers of requests sent before it
+	// describe the load before the decrease
+	fresh := start.After(t.m.LastDecrease)
+	switch v {
+	case verdictOK:
+		t.m.Docs += int64(n)
+		if latency > 0 {
+			t.m.DocsPerSec = float64(n) / latency.Seconds() * float64(t.concurrency)
+		}
+		if latency > t.cfg.TargetLatency {
+			t.m.Slow++
+			if fresh {
+				t.decrease(false)
+			}
+			break
+		}
+		if n >= int(t.batch) {
+			t.batch += float64(t.cfg.BatchStep)
+		}
+		if t.batch > float64(t.maxBatch) {
+			t.batch = float64(t.maxBatch)
+		}
+		t.fastInRound++
+		if t.fastInRound >= t.concurrency && t.concurrency < t.cfg.MaxConcurrency {
+			t.concurrency++
+			t.fastInRound = 0
+			t.signal()
+		}
+	case verdictTooLarge:
+		t.m.TooLarge++
+		// the request size is a hard limit of the server, remember it
+		if limit := n / 2; limit >= 1 && limit < t.maxBatch {
+			t.maxBatch = limit
+		}
+		if t.batch > float64(t.maxBatch) {
+			t.batch = float64(t.maxBatch)
+		}
+	case verdictOverloaded:
+		t.m.Overloaded++
+		if fresh {
+			t.decrease(true)
+		}
+	}
+	return v
+}
+
+// decrease shrinks the batch and, if the cluster is overloaded, the concurrency. t.mu must be held.
+func (t *BulkTuner) decrease(overloaded bool) {
+	t.m.Decreases++
+	t.m.LastDecrease = time.Now()
+	t.fastInRound = 0
+	t.batch *= t.cfg.Decrease
+	if floor := float64(t.cfg.MinBatch); t.batch < floor {
+		t.batch = floor
+	}
+	if t.batch > float64(t.maxBatch) {
+		t.batch = float64(t.maxBatch)
+	}
+	if overloaded {
+		t.concurrency = int(float64(t.concurrency) * t.cfg.Decrease)
+		if t.concurrency < 1 {
+			t.concurrency = 1
+		}
+	}
+}
+
+// backoff waits before retry attempt (from 0) of an overloaded request
+func (t *BulkTuner) backoff(ctx context.Context, attempt int) error {
+	d := 100 * time.Millisecond << uint(attempt)
+	if d > 10*time.Second {
+		d = 10 * time.Second
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *CouchDBAPI) tuner() *BulkTuner {
+	if c.Tuner != nil {
+		return c.Tuner
+	}
+	return NewBulkTuner(TunerConfig{})
+}
+
+// tunedBatches runs fn for consecutive slices of n items, sized and run in parallel as the
+// tuner decides. fn is called holding a slot of the tuner, see tunedRequest.
+func tunedBatches(ctx context.Context, t *BulkTuner, n int, fn func(ctx context.Context, off, length int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+	fail := func(err error) {
+		once.Do(func() {
+			first = err
+			cancel()
+		})
+	}
+	for off := 0; off < n && ctx.Err() == nil; {
+		// the slot is taken before cutting the next batch, so that it gets the latest size
+		if err := t.acquire(ctx); err != nil {
+			break
+		}
+		length := t.BatchSize()
+		if off+length > n {
+			length = n - off
+		}
+		wg.Add(1)
+		go func(off, length int) {
+			defer wg.Done()
+			if err := fn(ctx, off, length); err != nil {
+				fail(err)
+			}
+		}(off, length)
+		off += length
+	}
+	wg.Wait()
+	if first != nil {
+		return first
+	}
+	return ctx.Err()
+}
+
+// tunedRequest runs one bulk request for length items with retries, if held the first
+// attempt uses the slot held by the caller. A batch that is too large, or larger than
+// the batch size after an overload, is split and sent again. Requests that are not
+// idempotent are only retried when they were rejected.
+func tunedRequest(ctx context.Context, t *BulkTuner, held, idempotent bool, off, length int, req func(ctx context.Context, off, length int) error) error {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 || !held {
+			if err := t.acquire(ctx); err != nil {
+				return err
+			}
+		}
+		start := time.Now()
+		err := req(ctx, off, length)
+		t.release()
+		switch t.observe(length, start, err) {
+		case verdictOK:
+			return nil
+		case verdictTooLarge:
+			if length == 1 {
+				return err
+			}
+			half := length / 2
+			if err := tunedRequest(ctx, t, false, idempotent, off, half, req); err != nil {
+				return err
+			}
+			return tunedRequest(ctx, t, false, idempotent, off+half, length-half, req)
+		case verdictOverloaded:
+			if attempt >= t.cfg.MaxRetries || (!idempotent && !rejected(err)) {
+				return err
+			}
+			if err := t.backoff(ctx, attempt); err != nil {
+				return err
+			}
+			if size := t.BatchSize(); length > size {
+				for end := off + length; off < end; off += size {
+					if off+size > end {
+						size = end - off
+					}
+					if err := tunedRequest(ctx, t, false, idempotent, off, size, req); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		default:
+			return err
+		}
+	}
+}
+
+// Error names of BulkWrite results for documents without an answer of Couchdb
+const (
+	// BulkNotSent marks documents that were never sent because an earlier request failed
+	BulkNotSent = "not_sent"
+	// BulkRequestFailed marks documents of a failed request. After a timeout they may
+	// have been written nevertheless.
+	BulkRequestFailed = "request_failed"
+)
+
+// BulkWrite writes any number of documents with _bulk_docs requests whose size and
+// concurrency are set by CouchDBAPI.Tuner (a new BulkTuner per call if it is nil).
+// The results are in the order of docs. Errors of single documents are returned in
+// their BulkResult, the error is for requests that failed after all retries. A request
+// is only sent again when Couchdb rejected it (429, 503), after a gateway timeout it may
+// have been written. With an error the results are returned as well, documents without
+// an answer have the Error BulkRequestFailed or BulkNotSent.
+func (c *CouchDBAPI) BulkWrite(ctx context.Context, db string, docs []any) ([]BulkResult, error) {
+	t := c.tuner()
+	res := make([]BulkResult, len(docs))
+	sent := make([]bool, len(docs))
+	err := tunedBatches(ctx, t, len(docs), func(ctx context.Context, off, length int) error {
+		return tunedRequest(ctx, t, true, false, off, length, func(ctx context.Context, off, length int) error {
+			for i := off; i < off+length; i++ {
+				sent[i] = true
+			}
+			out, err := c.BulkDocs(ctx, db, docs[off:off+length])
+			if err != nil {
+				return err
+			}
+			copy(res[off:off+length], out)
+			return nil
+		})
+	})
+	if err != nil {
+		for i := range res {
+			if res[i].ID != "" || res[i].Error != "" {
+				continue
+			}
+			res[i] = BulkResult{Error: BulkNotSent, Reason: err.Error()}
+			if sent[i] {
+				res[i].Error = BulkRequestFailed
+			}
+			res[i].ID, _ = docIDRev(mustJSON(docs[i]))
+		}
+	}
+	return res, err
+}
+
+// BulkRead reads any number of documents with _bulk_get requests whose size and concurrency
+// are set by CouchDBAPI.Tuner. fn is called for every document, never concurrently, but
+// in no particular order. Every batch is read completely before fn is called for it, so
+// that a retried batch reports no document twice.
+func (c *CouchDBAPI) BulkRead(ctx context.Context, db string, docs []BulkGetDoc, attachments bool, fn func(BulkGetResult) error) error {
+	t := c.tuner()
+	var mu sync.Mutex
+	return tunedBatches(ctx, t, len(docs), func(ctx context.Context, off, length int) error {
+		var results []BulkGetResult
+		err := tunedRequest(ctx, t, true, true, off, length, func(ctx context.Context, off, length int) error {
+			var batch []BulkGetResult
+			err := c.BulkGet(ctx, db, docs[off:off+length], attachments, func(res BulkGetResult) error {
+				batch = append(batch, res)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			results = append(results, batch...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, res := range results {
+			if err := fn(res); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
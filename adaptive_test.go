@@ -0,0 +1,292 @@
+package golangcouchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err  error
+		want verdict
+	}{
+		{nil, verdictOK},
+		{&Error{StatusCode: http.StatusRequestEntityTooLarge}, verdictTooLarge},
+		{&Error{StatusCode: http.StatusTooManyRequests}, verdictOverloaded},
+		{&Error{StatusCode: http.StatusServiceUnavailable}, verdictOverloaded},
+		{&Error{StatusCode: http.StatusGatewayTimeout}, verdictOverloaded},
+		{&Error{StatusCode: http.StatusInternalServerError}, verdictFailed},
+		{fmt.Errorf("post: %w", os.ErrDeadlineExceeded), verdictOverloaded},
+		{errors.New("connection refused"), verdictFailed},
+		{context.Canceled, verdictFailed},
+	}
+	for _, tt := range tests {
+		if got := classify(tt.err); got != tt.want {
+			t.Errorf("classify(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBulkTunerObserve(t *testing.T) {
+	tooLarge := &Error{StatusCode: http.StatusRequestEntityTooLarge}
+	overloaded := &Error{StatusCode: http.StatusServiceUnavailable}
+	tests := []struct {
+		name    string
+		n       int
+		latency time.Duration
+		before  bool // started before the last decrease
+		err     error
+		// settings afterwards
+		batch, concurrency, maxBatch int
+	}{
+		{"fast", 100, time.Millisecond, false, nil, 110, 2, 1000},
+		{"fast, round complete", 110, time.Millisecond, false, nil, 120, 3, 1000},
+		{"fast, smaller batch", 10, time.Millisecond, false, nil, 120, 3, 1000},
+		{"slow", 120, time.Second, false, nil, 60, 3, 1000},
+		{"slow, sent before the decrease", 120, time.Second, true, nil, 60, 3, 1000},
+		{"overloaded", 60, time.Millisecond, false, overloaded, 30, 1, 1000},
+		{"overloaded, sent before the decrease", 60, time.Millisecond, true, overloaded, 30, 1, 1000},
+		{"overloaded at the minimum", 30, time.Millisecond, false, overloaded, 20, 1, 1000},
+		{"fast grows concurrency", 20, time.Millisecond, false, nil, 30, 2, 1000},
+		{"too large", 30, time.Millisecond, false, tooLarge, 15, 2, 15},
+		{"fast at the limit", 15, time.Millisecond, false, nil, 15, 2, 15},
+		{"error", 15, time.Millisecond, false, &Error{StatusCode: 500}, 15, 2, 15},
+	}
+	tuner := NewBulkTuner(TunerConfig{MinBatch: 20, MaxBatch: 1000, TargetLatency: 100 * time.Millisecond})
+	for _, tt := range tests {
+		last := tuner.Metrics().LastDecrease
+		start := time.Now().Add(-tt.latency)
+		if tt.before {
+			start = last.Add(-tt.latency)
+		} else if !start.After(last) {
+			start = last.Add(time.Nanosecond)
+		}
+		tuner.observe(tt.n, start, tt.err)
+		if b, c := tuner.BatchSize(), tuner.Concurrency(); b != tt.batch || c != tt.concurrency || tuner.maxBatch != tt.maxBatch {
+			t.Errorf("%s: batch %d, concurrency %d, max %d, want %d, %d, %d", tt.name, b, c, tuner.maxBatch, tt.batch, tt.concurrency, tt.maxBatch)
+		}
+	}
+	m := tuner.Metrics()
+	if m.Requests != int64(len(tests)) || m.Slow != 2 || m.Overloaded != 3 || m.TooLarge != 1 || m.Decreases != 3 || m.Docs != 100+110+10+120+120+20+15 {
+		t.Errorf("metrics %+v", m)
+	}
+	var vars map[string]any
+	if err := json.Unmarshal([]byte(tuner.String()), &vars); err != nil || vars["batch_size"] != 15.0 {
+		t.Errorf("String %s, %v", tuner.String(), err)
+	}
+}
+
+// bulkDocsLimit lets _bulk_docs fail with the status returned by status, 0 passes the
+// request on to the fake server. It returns the ids of every request.
+func bulkDocsLimit(fc *fakeCouch, status func(request int, ids []string) int) func() [][]string {
+	var mu sync.Mutex
+	var requests [][]string
+	fc.handle(http.MethodPost, "/db/_bulk_docs", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var body struct {
+			Docs []struct {
+				ID string `json:"_id"`
+			} `json:"docs"`
+		}
+		json.Unmarshal(data, &body)
+		var ids []string
+		for _, doc := range body.Docs {
+			ids = append(ids, doc.ID)
+		}
+		mu.Lock()
+		requests = append(requests, ids)
+		n := len(requests)
+		mu.Unlock()
+		if code := status(n, ids); code != 0 {
+			writeJSONError(w, code, "failed", http.StatusText(code))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		fc.serve(w, r)
+	})
+	return func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func testDocs(n int) []any {
+	docs := make([]any, n)
+	for i := range docs {
+		docs[i] = map[string]any{"_id": fmt.Sprintf("d%02d", i)}
+	}
+	return docs
+}
+
+func TestBulkWrite(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"d03"}`)
+	// more than 8 documents are too large, the first request for d20 is overloaded
+	overloaded := false
+	requests := bulkDocsLimit(fc, func(_ int, ids []string) int {
+		if len(ids) > 8 {
+			return http.StatusRequestEntityTooLarge
+		}
+		if ids[0] == "d20" && !overloaded {
+			overloaded = true
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	})
+	api.Tuner = NewBulkTuner(TunerConfig{MinBatch: 4, InitialBatch: 10, MaxConcurrency: 1})
+	res, err := api.BulkWrite(context.Background(), "db", testDocs(25))
+	if err != nil || len(res) != 25 {
+		t.Fatalf("%d results, %v", len(res), err)
+	}
+	for i, r := range res {
+		wantErr := ""
+		if i == 3 {
+			wantErr = "conflict"
+		}
+		if r.ID != fmt.Sprintf("d%02d", i) || r.Error != wantErr || (wantErr == "" && r.Rev == "") {
+			t.Errorf("result %d: %+v", i, r)
+		}
+	}
+	var sizes []int
+	for _, ids := range requests() {
+		sizes = append(sizes, len(ids))
+	}
+	// 10 is split in 5+5, the limit is 5 from then on, 5 after the overload is split in 4+1
+	if got := fmt.Sprint(sizes); got != "[10 5 5 5 5 5 4 1]" {
+		t.Errorf("requests of %s documents", got)
+	}
+}
+
+func TestRejected(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&Error{StatusCode: http.StatusTooManyRequests}, true},
+		{&Error{StatusCode: http.StatusServiceUnavailable}, true},
+		{&Error{StatusCode: http.StatusGatewayTimeout}, false},
+		{fmt.Errorf("post: %w", os.ErrDeadlineExceeded), false},
+		{&Error{StatusCode: http.StatusInternalServerError}, false},
+	}
+	for _, tt := range tests {
+		if got := rejected(tt.err); got != tt.want {
+			t.Errorf("rejected(%v) = %v", tt.err, got)
+		}
+	}
+}
+
+func TestBulkWriteFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		n        int
+		status   int // of the second request
+		canceled bool
+		want     string // error of the results, . for written
+		requests int
+	}{
+		{"second request fails", 20, http.StatusInternalServerError, false, strings.Repeat(".", 10) + strings.Repeat("F", 10), 2},
+		{"gateway timeout is not retried", 20, http.StatusGatewayTimeout, false, strings.Repeat(".", 10) + strings.Repeat("F", 10), 2},
+		{"rejected is retried", 20, http.StatusServiceUnavailable, false, strings.Repeat(".", 20), 3},
+		{"canceled before", 10, http.StatusInternalServerError, true, strings.Repeat("N", 10), 0},
+	}
+	for _, tt := range tests {
+		fc, api := newFakeCouch(t, "db")
+		requests := bulkDocsLimit(fc, func(request int, ids []string) int {
+			if request == 2 {
+				return tt.status
+			}
+			return 0
+		})
+		api.Tuner = NewBulkTuner(TunerConfig{MinBatch: 10, InitialBatch: 10, MaxConcurrency: 1})
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.canceled {
+			cancel()
+		}
+		res, err := api.BulkWrite(ctx, "db", testDocs(tt.n))
+		cancel()
+		if n := len(requests()); n != tt.requests {
+			t.Errorf("%s: %d requests, want %d", tt.name, n, tt.requests)
+		}
+		if (err == nil) != (tt.want == strings.Repeat(".", tt.n)) || len(res) != tt.n {
+			t.Fatalf("%s: %d results, %v", tt.name, len(res), err)
+		}
+		var got strings.Builder
+		for i, r := range res {
+			switch {
+			case r.Error == "" && r.Rev != "":
+				got.WriteString(".")
+			case r.Error == BulkRequestFailed:
+				got.WriteString("F")
+			case r.Error == BulkNotSent:
+				got.WriteString("N")
+			default:
+				got.WriteString("?")
+			}
+			if r.ID != fmt.Sprintf("d%02d", i) || (r.Error != "" && (err == nil || r.Reason != err.Error())) {
+				t.Errorf("%s: result %d %+v", tt.name, i, r)
+			}
+		}
+		if got.String() != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got.String(), tt.want)
+		}
+	}
+}
+
+func TestBulkRead(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	docs := make([]BulkGetDoc, 25)
+	for i := range docs {
+		docs[i].ID = fmt.Sprintf("d%02d", i)
+		if i != 7 {
+			fc.put(t, "db", fmt.Sprintf(`{"_id":%q,"n":%d}`, docs[i].ID, i))
+		}
+	}
+	// the first request is overloaded and retried
+	var mu sync.Mutex
+	calls := 0
+	fc.handle(http.MethodPost, "/db/_bulk_get", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		first := calls == 1
+		mu.Unlock()
+		if first {
+			writeJSONError(w, http.StatusTooManyRequests, "too_many_requests", "slow down")
+			return
+		}
+		fc.serve(w, r)
+	})
+	api.Tuner = NewBulkTuner(TunerConfig{MinBatch: 5, InitialBatch: 10})
+	var got []string
+	err := api.BulkRead(context.Background(), "db", docs, false, func(res BulkGetResult) error {
+		if res.Err != nil {
+			got = append(got, res.ID+" "+res.Err.ErrorName)
+		} else {
+			got = append(got, res.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if len(got) != 25 || got[7] != "d07 not_found" || got[24] != "d24" {
+		t.Errorf("read %q", got)
+	}
+	// an error of fn ends the read
+	stop := errors.New("stop")
+	if err := api.BulkRead(context.Background(), "db", docs, false, func(BulkGetResult) error { return stop }); err != stop {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// AttachmentReader is the content of an attachment while it is downloaded
+type AttachmentReader struct {
+	io.ReadCloser
+	ContentType string
+	Length      int64
+	Digest      string // "md5-..." like the digest of the attachment stub
+}
+
+func attachmentPath(db, id, name string) string {
+	return docPath(db, id) + "/" + url.PathEscape(name)
+}
+
+// GetAttachment downloads an attachment as a stream, the caller must close it.
+// A download that stalls fails with a *StreamStalledError. Attachments offloaded into
+// a BlobStore are read from c.Blobs.
+func (c *CouchDBAPI) GetAttachment(ctx context.Context, db, id, name string) (*AttachmentReader, error) {
+	att, err := c.getAttachment(ctx, db, id, name)
+	if err != nil || c.Blobs == nil || att.ContentType != BlobRefContentType {
+		return att, err
+	}
+	return c.resolveBlobRef(ctx, att)
+}
+
+// getAttachment downloads an attachment as stored in Couchdb
+func (c *CouchDBAPI) getAttachment(ctx context.Context, db, id, name string) (*AttachmentReader, error) {
+	resp, err := c.doStream(ctx, http.MethodGet, attachmentPath(db, id, name), nil, nil, "*/*")
+	if err != nil {
+		return nil, err
+	}
+	etag := resp.Header.Get("ETag")
+	if len(etag) > 1 && etag[0] == '"' {
+		etag = "md5-" + etag[1:len(etag)-1]
+	}
+	return &AttachmentReader{
+		ReadCloser:  resp.Body,
+		ContentType: resp.Header.Get("Content-Type"),
+		Length:      resp.ContentLength,
+		Digest:      etag,
+	}, nil
+}
+
+// PutAttachment uploads an attachment from r and returns the new revision of the document.
+// rev is empty for a new document, length is -1 if unknown. The upload is not limited by
+// clientMaxWaitTime.
+func (c *CouchDBAPI) PutAttachment(ctx context.Context, db, id, name, rev, contentType string, r io.Reader, length int64) (string, error) {
+	var query url.Values
+	if rev != "" {
+		query = url.Values{"rev": {rev}}
+	}
+	path := attachmentPath(db, id, name)
+	req, err := c.newRequest(ctx, http.MethodPut, path, query, r)
+	if err != nil {
+		return "", err
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+	if length >= 0 {
+		req.ContentLength = length
+	}
+	resp, err := c.send(&http.Client{}, req, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	c.noteWrite(ctx, http.MethodPut, path)
+	var res struct {
+		Rev string `json:"rev"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	return res.Rev, nil
+}
@@ -0,0 +1,190 @@
+package golangcouchdb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // register the gif decoder for ImageSizeProcessor
+	_ "image/jpeg" // register the jpeg decoder for ImageSizeProcessor
+	_ "image/png"  // register the png decoder for ImageSizeProcessor
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// SHA256Processor computes the SHA-256 of an attachment as hex
+type SHA256Processor struct{}
+
+// Name implements AttachmentProcessor
+func (SHA256Processor) Name() string { return "sha256" }
+
+// Process implements AttachmentProcessor
+func (SHA256Processor) Process(ctx context.Context, name string, info AttachmentInfo, r io.Reader) (any, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// TextProcessor extracts the text of text/* and application/pdf attachments.
+// PDF extraction is best effort: it reads the text operators of the content streams,
+// which works for most generated documents but not for scanned ones.
+type TextProcessor struct {
+	// MaxBytes of extracted text, default 64 KiB
+	MaxBytes int
+	// MaxPDFBytes is the size of the largest PDF read, and of its largest inflated stream,
+	// default 32 MiB. Larger PDFs fail, text attachments are only read up to MaxBytes.
+	MaxPDFBytes int64
+}
+
+// TextResult is the result of the TextProcessor
+type TextResult struct {
+	Text      string `json:"text"`
+	Words     int    `json:"words"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// Name implements AttachmentProcessor
+func (TextProcessor) Name() string { return "text" }
+
+// Process implements AttachmentProcessor
+func (p TextProcessor) Process(ctx context.Context, name string, info AttachmentInfo, r io.Reader) (any, error) {
+	limit := p.MaxBytes
+	if limit <= 0 {
+		limit = 64 * 1024
+	}
+	var text string
+	if strings.HasPrefix(info.ContentType, "application/pdf") {
+		maxPDF := p.MaxPDFBytes
+		if maxPDF <= 0 {
+			maxPDF = 32 << 20
+		}
+		data, err := io.ReadAll(io.LimitReader(r, maxPDF+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > maxPDF {
+			return nil, fmt.Errorf("PDF larger than %d bytes", maxPDF)
+		}
+		text = pdfText(data, maxPDF)
+	} else {
+		data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(data) && len(data) <= limit {
+			return nil, errors.New("not UTF-8 text")
+		}
+		text = string(data)
+	}
+	res := TextResult{Words: len(strings.Fields(text))}
+	if len(text) > limit {
+		text = text[:limit]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+		res.Truncated = true
+	}
+	res.Text = text
+	return res, nil
+}
+
+var (
+	pdfStream   = regexp.MustCompile(`(?s)stream\r?\n(.*?)\r?\nendstream`)
+	pdfTextOp   = regexp.MustCompile(`(?s)\((.*?[^\\])\)\s*Tj|\[(.*?)\]\s*TJ`)
+	pdfTJString = regexp.MustCompile(`\((.*?[^\\])\)`)
+	pdfEscape   = strings.NewReplacer(`\(`, "(", `\)`, ")", `\\`, `\`, `\n`, "\n", `\r`, "", `\t`, "\t")
+)
+
+// pdfText collects the strings of the Tj and TJ operators of all (deflated) streams,
+// a stream is inflated up to max bytes
+func pdfText(data []byte, max int64) string {
+	var out strings.Builder
+	for _, m := range pdfStream.FindAllSubmatch(data, -1) {
+		content := m[1]
+		if zr, err := zlib.NewReader(bytes.NewReader(content)); err == nil {
+			if inflated, err := io.ReadAll(io.LimitReader(zr, max)); err == nil || len(inflated) > 0 {
+				content = inflated
+			}
+		}
+		for _, op := range pdfTextOp.FindAllSubmatch(content, -1) {
+			if len(op[1]) > 0 {
+				out.WriteString(pdfEscape.Replace(string(op[1])))
+			}
+			for _, s := range pdfTJString.FindAllSubmatch(op[2], -1) {
+				out.WriteString(pdfEscape.Replace(string(s[1])))
+			}
+			out.WriteByte(' ')
+		}
+	}
+	return strings.Join(strings.Fields(out.String()), " ")
+}
+
+// ImageSizeProcessor reads the dimensions of gif, jpeg and png images
+type ImageSizeProcessor struct{}
+
+// Name implements AttachmentProcessor
+func (ImageSizeProcessor) Name() string { return "image" }
+
+// Process implements AttachmentProcessor
+func (ImageSizeProcessor) Process(ctx context.Context, name string, info AttachmentInfo, r io.Reader) (any, error) {
+	cfg, format, err := image.DecodeConfig(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"width": cfg.Width, "height": cfg.Height, "format": format}, nil
+}
+
+// CommandProcessor pipes the attachment into a local command, e.g. a virus scanner like
+// "clamdscan -". The result contains the exit code and the output of the command.
+type CommandProcessor struct {
+	ProcessorName string
+	Command       []string
+	// MaxOutput is the number of output bytes kept, default 4096
+	MaxOutput int
+}
+
+// CommandResult is the result of a CommandProcessor
+type CommandResult struct {
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output"`
+}
+
+// Name implements AttachmentProcessor
+func (p CommandProcessor) Name() string { return p.ProcessorName }
+
+// Process implements AttachmentProcessor
+func (p CommandProcessor) Process(ctx context.Context, name string, info AttachmentInfo, r io.Reader) (any, error) {
+	if len(p.Command) == 0 {
+		return nil, errors.New("no command")
+	}
+	limit := p.MaxOutput
+	if limit <= 0 {
+		limit = 4096
+	}
+	cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+	cmd.Stdin = r
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	res := CommandResult{Output: out.String()}
+	if len(res.Output) > limit {
+		res.Output = res.Output[:limit]
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		res.ExitCode = exitErr.ExitCode()
+		return res, nil
+	}
+	return res, err
+}
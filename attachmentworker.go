@@ -0,0 +1,444 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AttachmentInfo is the stub of an attachment in a document
+type AttachmentInfo struct {
+	ContentType string `json:"content_type"`
+	Digest      string `json:"digest"`
+	Length      int64  `json:"length"`
+	RevPos      int    `json:"revpos,omitempty"`
+	Stub        bool   `json:"stub,omitempty"`
+}
+
+// AttachmentProcessor computes a result from the content of an attachment,
+// e.g. a checksum, the extracted text or the size of an image
+type AttachmentProcessor interface {
+	// Name is the key of the result in the document
+	Name() string
+	// Process reads the attachment from r, the result must be JSON encodable
+	Process(ctx context.Context, name string, info AttachmentInfo, r io.Reader) (any, error)
+}
+
+// AttachmentResult is written into the document for every processed attachment
+type AttachmentResult struct {
+	Digest    string                     `json:"digest"`
+	Processed time.Time                  `json:"processed"`
+	Results   map[string]json.RawMessage `json:"results"`
+	Errors    map[string]string          `json:"errors,omitempty"`
+}
+
+type registeredProcessor struct {
+	pattern   string
+	processor AttachmentProcessor
+}
+
+// AttachmentWorker follows the _changes feed of a database and runs new or changed
+// attachments through the processors registered for their content type. The results are
+// written into ResultField of the document, keyed by attachment name and digest, so an
+// attachment is processed only once per content. Errors of processors are stored with the
+// results and not retried until the content changes.
+type AttachmentWorker struct {
+	API *CouchDBAPI
+	DB  string
+	// ResultField of the documents, default "attachment_results"
+	ResultField string
+	// Name of the worker, the position in the feed is kept in _local/<Name>. Default "attachment-worker".
+	Name string
+	// Concurrency is the number of documents processed at the same time, default 4
+	Concurrency int
+	// CheckpointInterval is how often the position in the feed is saved, default 10s.
+	// The ids of documents that failed are saved with it and processed again after a restart.
+	CheckpointInterval time.Duration
+	// MaxAttempts of a failed document, it is tried once per run until then, default 3
+	MaxAttempts int
+	// OnError is called for errors of single documents and checkpoints, optional
+	OnError func(id string, err error)
+
+	processors []registeredProcessor
+}
+
+// Register adds a processor for a content type pattern like "application/pdf", "image/*" or "*/*"
+func (w *AttachmentWorker) Register(pattern string, p AttachmentProcessor) {
+	w.processors = append(w.processors, registeredProcessor{pattern: pattern, processor: p})
+}
+
+func (w *AttachmentWorker) resultField() string {
+	if w.ResultField != "" {
+		return w.ResultField
+	}
+	return "attachment_results"
+}
+
+func (w *AttachmentWorker) checkpointID() string {
+	if w.Name != "" {
+		return "_local/" + w.Name
+	}
+	return "_local/attachment-worker"
+}
+
+func (w *AttachmentWorker) processorsFor(contentType string) []AttachmentProcessor {
+	contentType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	var list []AttachmentProcessor
+	for _, r := range w.processors {
+		if ok, _ := path.Match(r.pattern, contentType); ok {
+			list = append(list, r.processor)
+		}
+	}
+	return list
+}
+
+// Run processes the feed until ctx is done. A stalled feed is followed again.
+func (w *AttachmentWorker) Run(ctx context.Context) error {
+	cp, err := loadFeedCheckpoint(ctx, w.API, w.DB, w.checkpointID())
+	if err != nil {
+		return err
+	}
+	defer cp.saveEvery(ctx, w.CheckpointInterval, w.OnError)()
+	concurrency := w.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	maxAttempts := w.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	for _, id := range cp.retries(maxAttempts) {
+		var doc json.RawMessage
+		err := w.API.GetDoc(ctx, w.DB, id, &doc)
+		if err == nil {
+			err = w.processDoc(ctx, id, doc)
+		} else if IsNotFound(err) {
+			err = nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		cp.retried(id, err)
+		if err != nil && w.OnError != nil {
+			w.OnError(id, err)
+		}
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	// the last checkpoint is saved when all started documents are done
+	defer wg.Wait()
+	since := cp.since()
+	for {
+		last, err := w.API.FollowChanges(ctx, w.DB, ChangesParams{Since: since, IncludeDocs: true}, func(ch Change) error {
+			item := cp.start(ch.Seq, ch.ID)
+			if ch.Deleted || strings.HasPrefix(ch.ID, "_design/") {
+				cp.finish(item, nil)
+				return nil
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				err := w.processDoc(ctx, ch.ID, ch.Doc)
+				cp.finish(item, err)
+				if err != nil && w.OnError != nil {
+					w.OnError(ch.ID, err)
+				}
+			}()
+			return nil
+		})
+		since = last
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && !IsStreamStalled(err) {
+			return err
+		}
+	}
+}
+
+// feedCheckpoint keeps the position of a worker in a _changes feed as
+// {"since": seq, "failed": {id: attempts}} in a _local document. Changes finish out of
+// order, the position only moves over finished changes and never passes a running one.
+// Failed changes are passed too, the ids of their documents are kept for retries.
+type feedCheckpoint struct {
+	api    *CouchDBAPI
+	db, id string
+
+	mu      sync.Mutex
+	rev     string
+	saved   Seq
+	safe    Seq
+	pending []*feedItem
+	failed  map[string]int // attempts of documents whose last change failed
+	dirty   bool           // failed changed since the last save
+}
+
+type feedItem struct {
+	seq  Seq
+	id   string
+	done bool
+}
+
+func loadFeedCheckpoint(ctx context.Context, api *CouchDBAPI, db, id string) (*feedCheckpoint, error) {
+	var doc struct {
+		Rev    string         `json:"_rev"`
+		Since  Seq            `json:"since"`
+		Failed map[string]int `json:"failed"`
+	}
+	if err := api.GetDoc(ctx, db, id, &doc); err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+	if doc.Failed == nil {
+		doc.Failed = map[string]int{}
+	}
+	return &feedCheckpoint{api: api, db: db, id: id, rev: doc.Rev, saved: doc.Since, safe: doc.Since, failed: doc.Failed}, nil
+}
+
+func (f *feedCheckpoint) since() Seq {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.safe
+}
+
+// start registers a change of the document id, in feed order
+func (f *feedCheckpoint) start(seq Seq, id string) *feedItem {
+	item := &feedItem{seq: seq, id: id}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = append(f.pending, item)
+	return item
+}
+
+// finish marks a change as done, records the result of its document and moves the position
+// over the finished changes
+func (f *feedCheckpoint) finish(item *feedItem, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item.done = true
+	f.record(item.id, err)
+	for len(f.pending) > 0 && f.pending[0].done {
+		f.safe = f.pending[0].seq
+		f.pending = f.pending[1:]
+	}
+}
+
+// record counts a failed attempt of a document or forgets it after a success
+func (f *feedCheckpoint) record(id string, err error) {
+	if f.failed == nil {
+		f.failed = map[string]int{}
+	}
+	if err != nil {
+		f.failed[id]++
+		f.dirty = true
+	} else if _, ok := f.failed[id]; ok {
+		delete(f.failed, id)
+		f.dirty = true
+	}
+}
+
+// retries returns the failed documents to try again, the ones that failed maxAttempts
+// times are given up
+func (f *feedCheckpoint) retries(maxAttempts int) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []string
+	for id, attempts := range f.failed {
+		if attempts >= maxAttempts {
+			delete(f.failed, id)
+			f.dirty = true
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// retried records the result of a retry
+func (f *feedCheckpoint) retried(id string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record(id, err)
+}
+
+// save writes the position and the failed documents if they changed. It is called with a
+// detached context, so the position reached when ctx ends is saved too.
+func (f *feedCheckpoint) save(ctx context.Context) error {
+	f.mu.Lock()
+	safe, rev, dirty := f.safe, f.rev, f.dirty
+	doc := map[string]any{"since": safe}
+	if len(f.failed) > 0 {
+		failed := make(map[string]int, len(f.failed))
+		for id, attempts := range f.failed {
+			failed[id] = attempts
+		}
+		doc["failed"] = failed
+	}
+	f.dirty = false
+	f.mu.Unlock()
+	if safe == f.saved && !dirty {
+		return nil
+	}
+	if rev != "" {
+		doc["_rev"] = rev
+	}
+	rev, err := f.api.PutDoc(detached{ctx}, f.db, f.id, doc)
+	if err != nil {
+		f.mu.Lock()
+		f.dirty = f.dirty || dirty
+		f.mu.Unlock()
+		return err
+	}
+	f.mu.Lock()
+	f.rev, f.saved = rev, safe
+	f.mu.Unlock()
+	return nil
+}
+
+// saveEvery saves the position every interval (default 10s) until the returned func is
+// called, which saves it a last time
+func (f *feedCheckpoint) saveEvery(ctx context.Context, interval time.Duration, onError func(id string, err error)) func() {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	var saveMu sync.Mutex
+	save := func() {
+		saveMu.Lock()
+		defer saveMu.Unlock()
+		if err := f.save(ctx); err != nil && onError != nil {
+			onError(f.id, err)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ticker.C:
+				save()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(stop)
+		<-done
+		save()
+	}
+}
+
+// processDoc runs the processors over every attachment whose digest has no result yet
+func (w *AttachmentWorker) processDoc(ctx context.Context, id string, doc json.RawMessage) error {
+	var d struct {
+		Attachments map[string]AttachmentInfo `json:"_attachments"`
+	}
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return err
+	}
+	field := w.resultField()
+	var done map[string]AttachmentResult
+	if raw, ok := lookupField(doc, field); ok {
+		json.Unmarshal(raw, &done)
+	}
+	results := map[string]AttachmentResult{}
+	for name, info := range d.Attachments {
+		processors := w.processorsFor(info.ContentType)
+		if len(processors) == 0 || done[name].Digest == info.Digest {
+			continue
+		}
+		res, err := w.processAttachment(ctx, id, name, info, processors)
+		if err != nil {
+			return err
+		}
+		results[name] = res
+	}
+	stale := false
+	for name := range done {
+		if _, ok := d.Attachments[name]; !ok {
+			stale = true
+		}
+	}
+	if len(results) == 0 && !stale {
+		return nil
+	}
+	_, err := w.API.UpdateDoc(ctx, w.DB, id, func(doc map[string]any) (bool, error) {
+		var current struct {
+			Attachments map[string]AttachmentInfo `json:"_attachments"`
+		}
+		json.Unmarshal(mustJSON(doc), &current)
+		stored := map[string]any{}
+		if m, ok := doc[field].(map[string]any); ok {
+			stored = m
+		}
+		for name := range stored {
+			if _, ok := current.Attachments[name]; !ok {
+				delete(stored, name)
+			}
+		}
+		for name, res := range results {
+			// the attachment may have changed while it was processed
+			if current.Attachments[name].Digest == res.Digest {
+				stored[name] = res
+			}
+		}
+		doc[field] = stored
+		return true, nil
+	})
+	return err
+}
+
+// processAttachment downloads the attachment once and feeds it to all processors at the same time
+func (w *AttachmentWorker) processAttachment(ctx context.Context, id, name string, info AttachmentInfo, processors []AttachmentProcessor) (AttachmentResult, error) {
+	res := AttachmentResult{Digest: info.Digest, Processed: time.Now().UTC(), Results: map[string]json.RawMessage{}}
+	att, err := w.API.GetAttachment(ctx, w.DB, id, name)
+	if err != nil {
+		return res, err
+	}
+	defer att.Close()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	writers := make([]io.Writer, len(processors))
+	pipes := make([]*io.PipeWriter, len(processors))
+	for i, p := range processors {
+		pr, pw := io.Pipe()
+		writers[i], pipes[i] = pw, pw
+		wg.Add(1)
+		go func(p AttachmentProcessor, pr *io.PipeReader) {
+			defer wg.Done()
+			out, err := p.Process(ctx, name, info, pr)
+			// the processor may stop early, the other processors still need the content
+			io.Copy(io.Discard, pr)
+			var data []byte
+			if err == nil {
+				data, err = json.Marshal(out)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if res.Errors == nil {
+					res.Errors = map[string]string{}
+				}
+				res.Errors[p.Name()] = err.Error()
+				return
+			}
+			res.Results[p.Name()] = data
+		}(p, pr)
+	}
+	_, err = io.Copy(io.MultiWriter(writers...), att)
+	for _, pw := range pipes {
+		pw.CloseWithError(err)
+	}
+	wg.Wait()
+	return res, err
+}
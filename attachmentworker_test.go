@@ -0,0 +1,265 @@
+package golangcouchdb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFeedCheckpoint(t *testing.T) {
+	fail := errors.New("fail")
+	tests := []struct {
+		name       string
+		starts     []Seq
+		finish     []int // indexes into starts, negative for a failure of -i-1
+		want       Seq
+		wantFailed map[string]int
+	}{
+		{"in order", []Seq{"1", "2", "3"}, []int{0, 1, 2}, "3", map[string]int{}},
+		{"out of order", []Seq{"1", "2", "3"}, []int{2, 1}, "0", map[string]int{}},
+		{"gap closed", []Seq{"1", "2", "3"}, []int{2, 1, 0}, "3", map[string]int{}},
+		{"running", []Seq{"1", "2", "3"}, []int{0, 2}, "1", map[string]int{}},
+		{"failed first", []Seq{"1", "2", "3"}, []int{-1, 1, 2}, "3", map[string]int{"d1": 1}},
+		{"failed later", []Seq{"1", "2", "3"}, []int{1, -3, 0}, "3", map[string]int{"d3": 1}},
+		{"failure is passed", []Seq{"1", "2", "3", "4"}, []int{-2, 0, 2}, "3", map[string]int{"d2": 1}},
+	}
+	for _, tt := range tests {
+		f := &feedCheckpoint{safe: "0"}
+		var items []*feedItem
+		for _, seq := range tt.starts {
+			items = append(items, f.start(seq, "d"+string(seq)))
+		}
+		for _, i := range tt.finish {
+			if i < 0 {
+				f.finish(items[-i-1], fail)
+			} else {
+				f.finish(items[i], nil)
+			}
+		}
+		if got := f.since(); got != tt.want {
+			t.Errorf("%s: since %s, want %s", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(f.failed, tt.wantFailed) {
+			t.Errorf("%s: failed %v, want %v", tt.name, f.failed, tt.wantFailed)
+		}
+	}
+}
+
+func TestFeedCheckpointRetries(t *testing.T) {
+	fail := errors.New("fail")
+	tests := []struct {
+		name    string
+		failed  map[string]int
+		results map[string]error // results of the retries
+		want    []string
+		after   map[string]int
+	}{
+		{"none", map[string]int{}, nil, nil, map[string]int{}},
+		{"retried", map[string]int{"a": 1, "b": 2}, map[string]error{"a": nil, "b": fail}, []string{"a", "b"}, map[string]int{"b": 3}},
+		{"given up", map[string]int{"a": 3, "b": 1}, map[string]error{"b": fail}, []string{"b"}, map[string]int{"b": 2}},
+	}
+	for _, tt := range tests {
+		f := &feedCheckpoint{failed: tt.failed}
+		got := f.retries(3)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: retries %v, want %v", tt.name, got, tt.want)
+		}
+		for _, id := range got {
+			f.retried(id, tt.results[id])
+		}
+		if !reflect.DeepEqual(f.failed, tt.after) {
+			t.Errorf("%s: failed %v, want %v", tt.name, f.failed, tt.after)
+		}
+	}
+}
+
+func attachmentDoc(id, contentType, data string) string {
+	return fmt.Sprintf(`{"_id":%q,"_attachments":{"file":{"content_type":%q,"data":%q}}}`, id, contentType, base64.StdEncoding.EncodeToString([]byte(data)))
+}
+
+func TestAttachmentWorker(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", attachmentDoc("good1", "text/plain", "hello world"), attachmentDoc("bad", "text/plain", "x"),
+		attachmentDoc("good2", "text/plain; charset=utf-8", "more words here"), attachmentDoc("other", "application/zip", "PK"))
+	fc.handle(http.MethodGet, "/db/bad/file", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusInternalServerError, "unknown_error", "broken")
+	})
+	var mu sync.Mutex
+	var failed []string
+	w := &AttachmentWorker{API: api, DB: "db", CheckpointInterval: 10 * time.Millisecond, OnError: func(id string, err error) {
+		mu.Lock()
+		failed = append(failed, id)
+		mu.Unlock()
+	}}
+	w.Register("text/*", TextProcessor{})
+	w.Register("*/*", SHA256Processor{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+	waitFor(t, "results", func() bool {
+		return fc.doc("db", "good2")["attachment_results"] != nil && fc.doc("db", "other")["attachment_results"] != nil
+	})
+	// the checkpoint is saved while running, it passes the failed document and keeps its id
+	failedIDs := func() any { return fc.local("db", "_local/attachment-worker")["failed"] }
+	waitFor(t, "checkpoint", func() bool {
+		info, err := api.DBInfo(context.Background(), "db")
+		cp := fc.local("db", "_local/attachment-worker")
+		return err == nil && cp["since"] == string(info.UpdateSeq) && reflect.DeepEqual(cp["failed"], map[string]any{"bad": 1.0})
+	})
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run returned %v", err)
+	}
+	mu.Lock()
+	if !reflect.DeepEqual(failed, []string{"bad"}) {
+		t.Errorf("failed %v", failed)
+	}
+	mu.Unlock()
+	results := fc.doc("db", "good1")["attachment_results"].(map[string]any)["file"].(map[string]any)["results"].(map[string]any)
+	if results["text"].(map[string]any)["words"] != 2.0 || results["sha256"] == nil {
+		t.Errorf("results %v", results)
+	}
+	if results := fc.doc("db", "other")["attachment_results"].(map[string]any)["file"].(map[string]any)["results"].(map[string]any); len(results) != 1 {
+		t.Errorf("zip got %v", results)
+	}
+
+	// a restart retries the failed document, processed documents are not changed again
+	fc.handle(http.MethodGet, "/db/bad/file", func(w http.ResponseWriter, r *http.Request) { fc.serve(w, r) })
+	rev := fc.doc("db", "good2")["_rev"]
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() { done <- w.Run(ctx) }()
+	waitFor(t, "retry", func() bool { return fc.doc("db", "bad")["attachment_results"] != nil })
+	waitFor(t, "checkpoint", func() bool { return failedIDs() == nil })
+	cancel()
+	<-done
+	if fc.doc("db", "good2")["_rev"] != rev {
+		t.Error("processed document was written again")
+	}
+}
+
+func TestAttachmentWorkerPoisonDocument(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", attachmentDoc("bad", "text/plain", "x"))
+	fc.handle(http.MethodGet, "/db/bad/file", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusInternalServerError, "unknown_error", "broken")
+	})
+	w := &AttachmentWorker{API: api, DB: "db", CheckpointInterval: time.Hour, MaxAttempts: 2}
+	w.Register("*/*", SHA256Processor{})
+	// the first run fails in the feed, the second on the retry, the third gives up
+	tests := []struct {
+		processed int // reads of the attachment after the run
+		failed    any
+	}{
+		{1, map[string]any{"bad": 1.0}},
+		{2, map[string]any{"bad": 2.0}},
+		{2, nil},
+	}
+	for run, tt := range tests {
+		feeds := fc.count(http.MethodPost, "/db/_changes")
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- w.Run(ctx) }()
+		waitFor(t, "feed", func() bool {
+			return fc.count(http.MethodPost, "/db/_changes") > feeds && fc.count(http.MethodGet, "/db/bad/file") == tt.processed
+		})
+		cancel()
+		<-done
+		cp := fc.local("db", "_local/attachment-worker")
+		if !reflect.DeepEqual(cp["failed"], tt.failed) {
+			t.Errorf("run %d: failed %v, want %v", run+1, cp["failed"], tt.failed)
+		}
+		if cp["since"] == nil {
+			t.Errorf("run %d: no position", run+1)
+		}
+	}
+	if n := fc.count(http.MethodGet, "/db/bad/file"); n != 2 {
+		t.Errorf("processed the poison document %d times, want 2", n)
+	}
+}
+
+func TestTextProcessor(t *testing.T) {
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write([]byte("BT (Hello) Tj [(Wor) -20 (ld)] TJ ET"))
+	zw.Close()
+	pdf := "%PDF-1.4\nstream\n" + deflated.String() + "\nendstream\n"
+	tests := []struct {
+		name, contentType, data string
+		p                       TextProcessor
+		want                    string // TextResult as JSON, empty for an error
+	}{
+		{"text", "text/plain", "one two  three", TextProcessor{}, `{"text":"one two  three","words":3}`},
+		{"truncated", "text/plain", "abcdef", TextProcessor{MaxBytes: 4}, `{"text":"abcd","words":1,"truncated":true}`},
+		{"not utf-8", "text/plain", "\xff\xfe", TextProcessor{}, ``},
+		{"pdf", "application/pdf", pdf, TextProcessor{}, `{"text":"Hello World","words":2}`},
+		{"pdf too large", "application/pdf", pdf, TextProcessor{MaxPDFBytes: 10}, ``},
+	}
+	for _, tt := range tests {
+		res, err := tt.p.Process(context.Background(), "f", AttachmentInfo{ContentType: tt.contentType}, strings.NewReader(tt.data))
+		got := ""
+		if err == nil {
+			got = string(mustJSON(res))
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestPDFTextInflateLimit(t *testing.T) {
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write([]byte("BT (Hello) Tj ET " + strings.Repeat(" ", 1<<20) + "BT (Hidden) Tj ET"))
+	zw.Close()
+	pdf := "stream\n" + deflated.String() + "\nendstream"
+	if got := pdfText([]byte(pdf), 1024); got != "Hello" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestOtherProcessors(t *testing.T) {
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 3, 2)))
+	tests := []struct {
+		p    AttachmentProcessor
+		data string
+		want string
+	}{
+		{SHA256Processor{}, "abc", `"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"`},
+		{ImageSizeProcessor{}, img.String(), `{"format":"png","height":2,"width":3}`},
+		{ImageSizeProcessor{}, "no image", ``},
+	}
+	if _, err := exec.LookPath("sh"); err == nil {
+		tests = append(tests, []struct {
+			p    AttachmentProcessor
+			data string
+			want string
+		}{
+			{CommandProcessor{ProcessorName: "wc", Command: []string{"sh", "-c", "wc -c; exit 3"}, MaxOutput: 1}, "abc", `{"exit_code":3,"output":"3"}`},
+			{CommandProcessor{ProcessorName: "none"}, "", ``},
+		}...)
+	}
+	for _, tt := range tests {
+		res, err := tt.p.Process(context.Background(), "f", AttachmentInfo{}, strings.NewReader(tt.data))
+		got := ""
+		if err == nil {
+			got = string(mustJSON(res))
+		}
+		if strings.TrimSpace(got) != tt.want {
+			t.Errorf("%s: got %s, %v, want %s", tt.p.Name(), got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package golangcouchdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BlobStore keeps attachment content outside of Couchdb, see OffloadAttachments
+type BlobStore interface {
+	// Put stores size bytes of r under key and returns the location of the blob
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error)
+	// Get opens the blob at location, the caller must close it
+	Get(ctx context.Context, location string) (io.ReadCloser, error)
+	// Delete removes the blob at location
+	Delete(ctx context.Context, location string) error
+}
+
+// checkBlobKey rejects keys that would leave the store
+func checkBlobKey(key string) error {
+	if key == "" || path.Clean("/"+key) != "/"+key || strings.Contains(key, "\\") {
+		return fmt.Errorf("couchdb: invalid blob key %q", key)
+	}
+	return nil
+}
+
+// digestReader fails at the end of r if the content does not have the md5 sum want, so a
+// store never publishes a blob with the wrong content
+type digestReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+}
+
+func newDigestReader(r io.Reader, want []byte) *digestReader {
+	return &digestReader{r: r, h: md5.New(), want: want}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(d.h.Sum(nil), d.want) {
+		err = fmt.Errorf("couchdb: content does not match digest md5-%s", base64.StdEncoding.EncodeToString(d.want))
+	}
+	return n, err
+}
+
+// FileBlobStore stores blobs as files below Dir, locations are "file:<key>"
+type FileBlobStore struct {
+	Dir string
+}
+
+func (s *FileBlobStore) file(location string) (string, error) {
+	key := strings.TrimPrefix(location, "file:")
+	if key == location {
+		return "", fmt.Errorf("couchdb: %q is no file blob", location)
+	}
+	if err := checkBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put implements BlobStore. The file is written under a temporary name, checked and then
+// linked to its name. An existing blob is kept, keys of OffloadAttachments name the content.
+func (s *FileBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	location := "file:" + key
+	name, err := s.file(location)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".blob-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("couchdb: blob %s has %d bytes, expected %d", key, n, size)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Link(tmp.Name(), name); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	return location, nil
+}
+
+// Get implements BlobStore
+func (s *FileBlobStore) Get(ctx context.Context, location string) (io.ReadCloser, error) {
+	name, err := s.file(location)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+// Delete implements BlobStore
+func (s *FileBlobStore) Delete(ctx context.Context, location string) error {
+	name, err := s.file(location)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// S3BlobStore stores blobs in a bucket of an S3 compatible server like MinIO.
+// Requests use path style urls and AWS signature version 4 with an unsigned payload.
+// Locations are "s3://<bucket>/<key>".
+type S3BlobStore struct {
+	Endpoint  string // e.g. "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9000"
+	Bucket    string
+	Region    string // default "us-east-1"
+	AccessKey string
+	SecretKey string
+	// Client is used for the requests, default http.DefaultClient
+	Client *http.Client
+}
+
+func (s *S3BlobStore) key(location string) (string, error) {
+	key := strings.TrimPrefix(location, "s3://"+s.Bucket+"/")
+	if key == location {
+		return "", fmt.Errorf("couchdb: %q is no blob of bucket %s", location, s.Bucket)
+	}
+	return key, checkBlobKey(key)
+}
+
+// s3Escape encodes a path like AWS: everything but unreserved characters and "/"
+func s3Escape(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// request builds a signed request for an object
+func (s *S3BlobStore) request(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	u, err := url.Parse(strings.TrimRight(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	escaped := s3Escape("/" + s.Bucket + "/" + key)
+	u.RawPath = u.Path + escaped
+	u.Path = u.Path + "/" + s.Bucket + "/" + key
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	canonical := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD",
+		"x-amz-date:" + amzDate,
+		"",
+		"host;x-amz-content-sha256;x-amz-date",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	scope := day + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	signingKey := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+s.SecretKey), day), region), "s3"), "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		s.AccessKey, scope, hex.EncodeToString(hmacSHA256(signingKey, toSign))))
+	return req, nil
+}
+
+func (s *S3BlobStore) do(req *http.Request) (*http.Response, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("couchdb: s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+// Put implements BlobStore, size must be known because S3 needs a Content-Length
+func (s *S3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	if err := checkBlobKey(key); err != nil {
+		return "", err
+	}
+	if size < 0 {
+		return "", errors.New("couchdb: s3 blobs need a known size")
+	}
+	req, err := s.request(ctx, http.MethodPut, key, r)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if d, ok := r.(*digestReader); ok {
+		// S3 rejects content with another md5 sum and keeps the existing object
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(d.want))
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return "s3://" + s.Bucket + "/" + key, nil
+}
+
+// Get implements BlobStore
+func (s *S3BlobStore) Get(ctx context.Context, location string) (io.ReadCloser, error) {
+	key, err := s.key(location)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.request(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete implements BlobStore
+func (s *S3BlobStore) Delete(ctx context.Context, location string) error {
+	key, err := s.key(location)
+	if err != nil {
+		return err
+	}
+	req, err := s.request(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,263 @@
+package golangcouchdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func md5Of(s string) []byte {
+	sum := md5.Sum([]byte(s))
+	return sum[:]
+}
+
+func TestDigestReader(t *testing.T) {
+	tests := []struct {
+		content string
+		want    []byte
+		ok      bool
+	}{
+		{"hello", md5Of("hello"), true},
+		{"", md5Of(""), true},
+		{"hello", md5Of("other"), false},
+	}
+	for _, tt := range tests {
+		_, err := io.ReadAll(newDigestReader(strings.NewReader(tt.content), tt.want))
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: %v", tt.content, err)
+		}
+	}
+}
+
+func TestFileBlobStore(t *testing.T) {
+	s := &FileBlobStore{Dir: t.TempDir()}
+	ctx := context.Background()
+	read := func(location string) string {
+		r, err := s.Get(ctx, location)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		defer r.Close()
+		data, _ := io.ReadAll(r)
+		return string(data)
+	}
+	if _, err := s.Put(ctx, "db/k", newDigestReader(strings.NewReader("good"), md5Of("good")), 4, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		key     string
+		r       io.Reader
+		size    int64
+		wantErr string
+		want    string // content of the key afterwards
+	}{
+		{"new", "db/new", strings.NewReader("abc"), 3, "", "abc"},
+		{"unknown size", "db/unsized", strings.NewReader("abc"), -1, "", "abc"},
+		{"wrong size", "db/short", strings.NewReader("abc"), 5, "expected 5", "error"},
+		{"wrong digest", "db/bad", newDigestReader(strings.NewReader("bad"), md5Of("good")), 3, "digest", "error"},
+		{"wrong digest of an existing blob", "db/k", newDigestReader(strings.NewReader("bad!"), md5Of("good")), 4, "digest", "good"},
+		{"existing blob", "db/k", strings.NewReader("good"), 4, "", "good"},
+		{"outside", "../x", strings.NewReader("x"), 1, "invalid blob key", "error"},
+	}
+	for _, tt := range tests {
+		location, err := s.Put(ctx, tt.key, tt.r, tt.size, "")
+		if (tt.wantErr == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.wantErr)
+		}
+		if err == nil && location != "file:"+tt.key {
+			t.Errorf("%s: location %s", tt.name, location)
+		}
+		if got := read("file:" + tt.key); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: content %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	// no temporary files are left
+	entries, _ := os.ReadDir(filepath.Join(s.Dir, "db"))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".blob-") {
+			t.Errorf("temporary file %s left", e.Name())
+		}
+	}
+	if err := s.Delete(ctx, "file:db/new"); err != nil || !strings.HasPrefix(read("file:db/new"), "error") {
+		t.Errorf("delete: %v", err)
+	}
+	if err := s.Delete(ctx, "file:db/new"); err != nil {
+		t.Errorf("delete of a missing blob: %v", err)
+	}
+}
+
+func TestS3BlobStorePut(t *testing.T) {
+	var headers http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		io.ReadAll(r.Body)
+		if r.URL.Path != "/bucket/db/k" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	s := &S3BlobStore{Endpoint: srv.URL, Bucket: "bucket", AccessKey: "a", SecretKey: "s"}
+	tests := []struct {
+		r       io.Reader
+		wantMD5 string
+	}{
+		{strings.NewReader("abc"), ""},
+		{newDigestReader(strings.NewReader("abc"), md5Of("abc")), base64.StdEncoding.EncodeToString(md5Of("abc"))},
+	}
+	for _, tt := range tests {
+		location, err := s.Put(context.Background(), "db/k", tt.r, 3, "text/plain")
+		if err != nil || location != "s3://bucket/db/k" {
+			t.Fatalf("put: %s, %v", location, err)
+		}
+		if got := headers.Get("Content-MD5"); got != tt.wantMD5 {
+			t.Errorf("Content-MD5 %q, want %q", got, tt.wantMD5)
+		}
+		if !strings.HasPrefix(headers.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=a/") {
+			t.Errorf("Authorization %q", headers.Get("Authorization"))
+		}
+	}
+	if _, err := s.Put(context.Background(), "db/k", strings.NewReader("abc"), -1, ""); err == nil {
+		t.Error("put without size")
+	}
+}
+
+func TestOffloadAttachments(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	big := strings.Repeat("b", 100)
+	fc.put(t, "db", attachmentDoc("big", "text/plain", big), attachmentDoc("small", "text/plain", "s"))
+	store := &FileBlobStore{Dir: t.TempDir()}
+	api.Blobs = store
+	ctx := context.Background()
+	key := "db/" + hex.EncodeToString(md5Of(big))
+	// a blob with the same key is kept as it is
+	os.MkdirAll(filepath.Join(store.Dir, "db"), 0o755)
+	os.WriteFile(filepath.Join(store.Dir, filepath.FromSlash(key)), []byte(big), 0o644)
+
+	stats, err := api.OffloadAttachments(ctx, "db", OffloadOptions{MinSize: 10, DryRun: true})
+	if err != nil || stats != (OffloadStats{Docs: 1, Attachments: 1, Bytes: 100}) || fc.doc("db", "big")["_attachments"] == nil {
+		t.Fatalf("dry run: %+v, %v", stats, err)
+	}
+	if stats, err = api.OffloadAttachments(ctx, "db", OffloadOptions{MinSize: 10}); err != nil || stats.Attachments != 1 {
+		t.Fatalf("offload: %+v, %v", stats, err)
+	}
+	if stats, _ = api.OffloadAttachments(ctx, "db", OffloadOptions{MinSize: 10}); stats.Attachments != 0 {
+		t.Errorf("moved again: %+v", stats)
+	}
+
+	att, err := api.GetAttachment(ctx, "db", "big", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(att)
+	att.Close()
+	if string(data) != big || att.ContentType != "text/plain" {
+		t.Errorf("attachment %s %q", att.ContentType, data)
+	}
+
+	// the JSON answer of _bulk_get has the blob inline
+	var doc string
+	err = api.BulkGet(ctx, "db", []BulkGetDoc{{ID: "big"}}, true, func(res BulkGetResult) error {
+		doc = string(res.Doc)
+		return nil
+	})
+	if err != nil || !strings.Contains(doc, base64.StdEncoding.EncodeToString([]byte(big))) || strings.Contains(doc, BlobRefContentType) {
+		t.Errorf("bulk get: %s, %v", doc, err)
+	}
+}
+
+func TestOffloadDigestMismatch(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	big := strings.Repeat("b", 100)
+	fc.put(t, "db", attachmentDoc("big", "text/plain", big))
+	// the download does not match the digest of the stub
+	fc.handle(http.MethodGet, "/db/big/file", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Repeat("x", 100)))
+	})
+	store := &FileBlobStore{Dir: t.TempDir()}
+	api.Blobs = store
+	key := "db/" + hex.EncodeToString(md5Of(big))
+	name := filepath.Join(store.Dir, filepath.FromSlash(key))
+	os.MkdirAll(filepath.Dir(name), 0o755)
+	os.WriteFile(name, []byte(big), 0o644)
+
+	var failed []string
+	stats, err := api.OffloadAttachments(context.Background(), "db", OffloadOptions{MinSize: 10, OnError: func(id, name string, err error) {
+		failed = append(failed, id+"/"+name+": "+err.Error())
+	}})
+	if err != nil || stats.Attachments != 0 || len(failed) != 1 || !strings.Contains(failed[0], "digest") {
+		t.Errorf("%+v, %v, %q", stats, err, failed)
+	}
+	// the blob that existed before is neither replaced nor deleted
+	if data, err := os.ReadFile(name); string(data) != big {
+		t.Errorf("existing blob %q, %v", data, err)
+	}
+}
+
+func TestBulkGetBlobRefMultipart(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	store := &FileBlobStore{Dir: t.TempDir()}
+	api.Blobs = store
+	if _, err := store.Put(context.Background(), "db/k", strings.NewReader("content"), 7, ""); err != nil {
+		t.Fatal(err)
+	}
+	ref := string(mustJSON(BlobRef{Location: "file:db/k", Digest: "md5-x", Length: 7, ContentType: "text/plain"}))
+	fc.handle(http.MethodPost, "/db/_bulk_get", func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		var related bytes.Buffer
+		rw := multipart.NewWriter(&related)
+		part, _ := rw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+		fmt.Fprintf(part, `{"_id":"a","_rev":"2-a","_attachments":{"f":{"content_type":%q,"length":%d,"follows":true},"g":{"content_type":"text/plain","length":1,"follows":true}}}`,
+			BlobRefContentType, len(ref))
+		part, _ = rw.CreatePart(textproto.MIMEHeader{"Content-Disposition": {`attachment; filename="f"`}})
+		part.Write([]byte(ref))
+		part, _ = rw.CreatePart(textproto.MIMEHeader{"Content-Disposition": {`attachment; filename="g"`}})
+		part.Write([]byte("g"))
+		rw.Close()
+		part, _ = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"multipart/related; boundary=" + rw.Boundary()}})
+		part.Write(related.Bytes())
+		mw.Close()
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+		w.Write(body.Bytes())
+	})
+	tests := []struct {
+		attachments bool
+		wantF       string
+	}{
+		{true, "content"},
+		{false, ref}, // without attachments nothing is resolved
+	}
+	for _, tt := range tests {
+		var got BulkGetResult
+		err := api.BulkGet(context.Background(), "db", []BulkGetDoc{{ID: "a"}}, tt.attachments, func(res BulkGetResult) error {
+			got = res
+			return nil
+		})
+		if err != nil || string(got.Attachments["f"]) != tt.wantF || string(got.Attachments["g"]) != "g" {
+			t.Errorf("attachments %v: %q, %v", tt.attachments, got.Attachments, err)
+		}
+		if tt.attachments && !strings.Contains(string(got.Doc), `"f":{"content_type":"text/plain","digest":"md5-x","follows":true,"length":7}`) {
+			t.Errorf("stub %s", got.Doc)
+		}
+	}
+	// a missing blob fails the read
+	store.Delete(context.Background(), "file:db/k")
+	err := api.BulkGet(context.Background(), "db", []BulkGetDoc{{ID: "a"}}, true, func(BulkGetResult) error { return nil })
+	if err == nil {
+		t.Error("missing blob")
+	}
+}
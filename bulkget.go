@@ -0,0 +1,170 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// BulkGetDoc names a document for BulkGet, an empty Rev is the winning revision
+type BulkGetDoc struct {
+	ID  string `json:"id"`
+	Rev string `json:"rev,omitempty"`
+}
+
+// BulkGetResult is one document of BulkGet
+type BulkGetResult struct {
+	ID          string
+	Doc         json.RawMessage
+	Attachments map[string][]byte // only if attachments were requested
+	Err         *Error
+}
+
+// BulkGet reads many documents with one multipart _bulk_get request and calls fn for every
+// document while the answer arrives. With attachments the content of all attachments of a
+// document is read with it, attachments offloaded into a BlobStore are read from c.Blobs.
+// A stalled answer fails with a *StreamStalledError.
+func (c *CouchDBAPI) BulkGet(ctx context.Context, db string, docs []BulkGetDoc, attachments bool, fn func(BulkGetResult) error) error {
+	query := url.Values{"revs": {"false"}}
+	if attachments {
+		query.Set("attachments", "true")
+	}
+	resp, err := c.doStream(ctx, http.MethodPost, dbPath(db)+"/_bulk_get", query, map[string]any{"docs": docs}, "multipart/mixed")
+	if err != nil {
+		return err
+	}
+	if c.Masking != nil {
+		unmasked := fn
+		fn = func(res BulkGetResult) error {
+			res.Doc = c.maskDoc(ctx, res.Doc)
+			return unmasked(res)
+		}
+	}
+	if attachments && c.Blobs != nil {
+		withRefs := fn
+		fn = func(res BulkGetResult) error {
+			if err := c.resolveBulkGetBlobs(ctx, &res); err != nil {
+				return err
+			}
+			return withRefs(res)
+		}
+	}
+	defer resp.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return decodeBulkGetJSON(resp.Body, fn)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		res, err := readBulkGetPart(part)
+		if err != nil {
+			return err
+		}
+		if err := fn(res); err != nil {
+			return err
+		}
+	}
+}
+
+// readBulkGetPart reads a part which is either a JSON document (or error) or a
+// multipart/related document followed by its attachments
+func readBulkGetPart(part *multipart.Part) (BulkGetResult, error) {
+	mediaType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if err != nil {
+		return BulkGetResult{}, err
+	}
+	if mediaType != "multipart/related" {
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return BulkGetResult{}, err
+		}
+		return bulkGetDoc(data), nil
+	}
+	mr := multipart.NewReader(part, params["boundary"])
+	var res BulkGetResult
+	for i := 0; ; i++ {
+		sub, err := mr.NextPart()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		data, err := io.ReadAll(sub)
+		if err != nil {
+			return res, err
+		}
+		if i == 0 {
+			res = bulkGetDoc(data)
+			res.Attachments = map[string][]byte{}
+			continue
+		}
+		_, disp, _ := mime.ParseMediaType(sub.Header.Get("Content-Disposition"))
+		res.Attachments[disp["filename"]] = data
+	}
+}
+
+func bulkGetDoc(data []byte) BulkGetResult {
+	var e struct {
+		ID     string `json:"id"`
+		DocID  string `json:"_id"`
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(data, &e)
+	if e.Error != "" && e.DocID == "" {
+		status := http.StatusInternalServerError
+		if e.Error == "not_found" {
+			status = http.StatusNotFound
+		}
+		return BulkGetResult{ID: e.ID, Err: &Error{StatusCode: status, ErrorName: e.Error, Reason: e.Reason}}
+	}
+	return BulkGetResult{ID: e.DocID, Doc: data}
+}
+
+// decodeBulkGetJSON reads the JSON answer of servers without multipart support
+func decodeBulkGetJSON(r io.Reader, fn func(BulkGetResult) error) error {
+	var res struct {
+		Results []struct {
+			ID   string `json:"id"`
+			Docs []struct {
+				OK    json.RawMessage `json:"ok"`
+				Error json.RawMessage `json:"error"`
+			} `json:"docs"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(r).Decode(&res); err != nil {
+		return err
+	}
+	for _, result := range res.Results {
+		for _, d := range result.Docs {
+			doc := d.OK
+			if doc == nil {
+				doc = d.Error
+			}
+			r := bulkGetDoc(doc)
+			if r.ID == "" {
+				r.ID = result.ID
+			}
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package golangcouchdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ChangesParams are the parameters of the _changes feed
+type ChangesParams struct {
+	Feed        string // normal or longpoll, FollowChanges always uses continuous
+	Since       Seq
+	Limit       int
+	Timeout     int // milliseconds, for longpoll
+	Heartbeat   int // milliseconds, for FollowChanges
+	IncludeDocs bool
+	Filter      string
+	Selector    map[string]any
+	DocIDs      []string
+	Style       string
+	Descending  bool
+}
+
+func (p ChangesParams) values() url.Values {
+	v := url.Values{}
+	if p.Feed != "" {
+		v.Set("feed", p.Feed)
+	}
+	if p.Since != "" {
+		v.Set("since", string(p.Since))
+	}
+	if p.Limit > 0 {
+		v.Set("limit", strconv.Itoa(p.Limit))
+	}
+	if p.Timeout > 0 {
+		v.Set("timeout", strconv.Itoa(p.Timeout))
+	}
+	if p.Heartbeat > 0 {
+		v.Set("heartbeat", strconv.Itoa(p.Heartbeat))
+	}
+	if p.IncludeDocs {
+		v.Set("include_docs", "true")
+	}
+	if p.Style != "" {
+		v.Set("style", p.Style)
+	}
+	if p.Descending {
+		v.Set("descending", "true")
+	}
+	switch {
+	case p.Selector != nil:
+		v.Set("filter", "_selector")
+	case p.DocIDs != nil:
+		v.Set("filter", "_doc_ids")
+	case p.Filter != "":
+		v.Set("filter", p.Filter)
+	}
+	return v
+}
+
+func (p ChangesParams) body() any {
+	switch {
+	case p.Selector != nil:
+		return map[string]any{"selector": p.Selector}
+	case p.DocIDs != nil:
+		return map[string]any{"doc_ids": p.DocIDs}
+	}
+	return map[string]any{}
+}
+
+// Change is one entry of the _changes feed
+type Change struct {
+	Seq     Seq    `json:"seq"`
+	ID      string `json:"id"`
+	Changes []struct {
+		Rev string `json:"rev"`
+	} `json:"changes"`
+	Deleted bool            `json:"deleted,omitempty"`
+	Doc     json.RawMessage `json:"doc,omitempty"`
+}
+
+// ChangesResult is the answer of a normal or longpoll _changes request
+type ChangesResult struct {
+	Results []Change `json:"results"`
+	LastSeq Seq      `json:"last_seq"`
+	Pending int64    `json:"pending"`
+}
+
+// Changes reads the _changes feed of a database
+func (c *CouchDBAPI) Changes(ctx context.Context, db string, params ChangesParams) (*ChangesResult, error) {
+	var res ChangesResult
+	if err := c.doJSON(ctx, http.MethodPost, dbPath(db)+"/_changes", params.values(), params.body(), &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// FollowChanges reads the continuous _changes feed and calls fn for every change until ctx
+// is done, fn fails or the feed ends. It returns the last sequence seen, so the feed can be
+// followed again from there. Heartbeats are requested at a third of StreamIdleTimeout,
+// a feed without heartbeats fails with a *StreamStalledError.
+func (c *CouchDBAPI) FollowChanges(ctx context.Context, db string, params ChangesParams, fn func(Change) error) (Seq, error) {
+	params.Feed = "continuous"
+	if params.Heartbeat <= 0 {
+		params.Heartbeat = int(c.streamIdleTimeout() / 3 / time.Millisecond)
+	}
+	last := params.Since
+	resp, err := c.doStream(ctx, http.MethodPost, dbPath(db)+"/_changes", params.values(), params.body(), "")
+	if err != nil {
+		return last, err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue // heartbeat
+		}
+		var ch struct {
+			Change
+			LastSeq Seq `json:"last_seq"`
+		}
+		if err := json.Unmarshal(line, &ch); err != nil {
+			return last, err
+		}
+		if ch.LastSeq != "" {
+			return ch.LastSeq, nil
+		}
+		ch.Doc = c.maskDoc(ctx, ch.Doc)
+		if err := fn(ch.Change); err != nil {
+			return last, err
+		}
+		last = ch.Seq
+	}
+	if err := scanner.Err(); err != nil {
+		return last, err
+	}
+	return last, ctx.Err()
+}
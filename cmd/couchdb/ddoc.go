@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	couchdb "github.com/spookieoli/golang_couchdb"
+)
+
+func init() {
+	register(command{
+		name:  "ddoc",
+		usage: "deploy, list, diff and roll back design documents (deploy|list|diff|rollback)",
+		run:   runDDoc,
+	})
+}
+
+func runDDoc(ctx context.Context, api *couchdb.CouchDBAPI, args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing sub command: deploy, list, diff or rollback")
+	}
+	fs := flag.NewFlagSet("ddoc "+args[0], flag.ExitOnError)
+	db := fs.String("db", "", "database")
+	name := fs.String("ddoc", "", "name of the design document")
+	history := fs.String("history", "ddoc_history", "database of the archived versions")
+	warmUp := fs.Bool("warmup", true, "build the indexes before the design document is replaced")
+	file := fs.String("file", "", "deploy: JSON file of the design document")
+	sha := fs.String("sha", os.Getenv("GIT_COMMIT"), "deploy: git commit of the design document")
+	message := fs.String("m", "", "deploy, rollback: message")
+	fs.Parse(args[1:])
+	if *db == "" {
+		return errors.New("-db is required")
+	}
+	h := &couchdb.DesignHistory{API: api, HistoryDB: *history, WarmUp: *warmUp}
+	meta := couchdb.DeployMeta{GitSHA: *sha, Deployer: deployer(), Message: *message}
+
+	switch args[0] {
+	case "deploy":
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		v, err := h.Deploy(ctx, *db, json.RawMessage(data), meta)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("deployed _design/%s as version %d\n", v.DDoc, v.Version)
+	case "list":
+		versions, err := h.Versions(ctx, *db, *name)
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			fmt.Printf("%4d  %s  %-12s %-10.10s %s\n", v.Version, v.Meta.Time.Format("2006-01-02 15:04:05"), v.Meta.Deployer, v.Meta.GitSHA, v.Meta.Message)
+		}
+	case "diff":
+		if fs.NArg() != 2 {
+			return errors.New("usage: ddoc diff -db DB -ddoc NAME FROM TO")
+		}
+		from, err1 := strconv.Atoi(fs.Arg(0))
+		to, err2 := strconv.Atoi(fs.Arg(1))
+		if err1 != nil || err2 != nil {
+			return errors.New("versions must be numbers")
+		}
+		diffs, err := h.Diff(ctx, *db, *name, from, to)
+		if err != nil {
+			return err
+		}
+		for _, d := range diffs {
+			fmt.Print(d.Unified())
+		}
+	case "rollback":
+		if fs.NArg() != 1 {
+			return errors.New("usage: ddoc rollback -db DB -ddoc NAME VERSION")
+		}
+		version, err := strconv.Atoi(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		v, err := h.Rollback(ctx, *db, *name, version, meta)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("rolled back _design/%s to version %d, deployed as version %d\n", v.DDoc, version, v.Version)
+	default:
+		return fmt.Errorf("unknown sub command %q", args[0])
+	}
+	return nil
+}
+
+func deployer() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
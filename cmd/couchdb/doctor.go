@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	couchdb "github.com/spookieoli/golang_couchdb"
+)
+
+func init() {
+	register(command{
+		name:  "doctor",
+		usage: "report conflicts, fragmentation, stale indexes and other problems of databases",
+		run:   runDoctor,
+	})
+}
+
+func runDoctor(ctx context.Context, api *couchdb.CouchDBAPI, args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	dbList := fs.String("db", "", "comma separated databases, default all except system databases")
+	queries := fs.String("queries", "", "JSON file with an array of _find queries to check for an index")
+	skipScan := fs.Bool("skip-doc-scan", false, "do not read all documents")
+	revsLimit := fs.Int("max-revs-limit", 1000, "highest acceptable revs_limit")
+	fs.Parse(args)
+
+	opts := couchdb.DoctorOptions{SkipDocScan: *skipScan, MaxRevsLimit: *revsLimit}
+	if *queries != "" {
+		data, err := os.ReadFile(*queries)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &opts.Queries); err != nil {
+			return fmt.Errorf("%s: %w", *queries, err)
+		}
+	}
+	var dbs []string
+	if *dbList != "" {
+		dbs = strings.Split(*dbList, ",")
+	} else {
+		all, err := api.AllDBs(ctx)
+		if err != nil {
+			return err
+		}
+		for _, db := range all {
+			if !strings.HasPrefix(db, "_") {
+				dbs = append(dbs, db)
+			}
+		}
+	}
+	critical := 0
+	for _, db := range dbs {
+		findings, err := api.Doctor(ctx, db, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", db, err)
+		}
+		if len(findings) == 0 {
+			fmt.Printf("%s: ok\n\n", db)
+			continue
+		}
+		fmt.Printf("%s:\n", db)
+		for _, f := range findings {
+			if f.Severity == couchdb.SeverityCritical {
+				critical++
+			}
+			printFinding(os.Stdout, f)
+		}
+		fmt.Println()
+	}
+	if critical > 0 {
+		return fmt.Errorf("%d critical findings", critical)
+	}
+	return nil
+}
+
+func printFinding(w io.Writer, f couchdb.Finding) {
+	fmt.Fprintf(w, "  [%s] %s: %s\n", strings.ToUpper(f.Severity.String()), f.Check, f.Message)
+	if f.Subject != "" {
+		fmt.Fprintf(w, "      subject: %s\n", f.Subject)
+	}
+	fmt.Fprintf(w, "      fix: %s\n", f.Remediation)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	couchdb "github.com/spookieoli/golang_couchdb"
+)
+
+func TestPrintFinding(t *testing.T) {
+	tests := []struct {
+		f    couchdb.Finding
+		want string
+	}{
+		{couchdb.Finding{Check: "security", Severity: couchdb.SeverityCritical, Message: "public", Remediation: "set members"},
+			"  [CRITICAL] security: public\n      fix: set members\n"},
+		{couchdb.Finding{Check: "conflicts", Severity: couchdb.SeverityWarning, Subject: "a, b", Message: "2 documents", Remediation: "merge"},
+			"  [WARNING] conflicts: 2 documents\n      subject: a, b\n      fix: merge\n"},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		printFinding(&b, tt.f)
+		if b.String() != tt.want {
+			t.Errorf("printFinding(%s) = %q, want %q", tt.f.Check, b.String(), tt.want)
+		}
+	}
+}
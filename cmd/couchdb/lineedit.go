@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+)
+
+// errInterrupted is returned by readLine for ctrl-c
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads lines with history and tab completion. The terminal is switched into
+// raw mode with stty only while a line is read. Without a terminal it reads plain lines.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	terminal bool
+	history  []string
+	// complete returns the candidates for the text before the cursor and where the
+	// completed word starts
+	complete func(before string) (start int, candidates []string)
+}
+
+func newLineEditor() *lineEditor {
+	e := &lineEditor{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	_, err := stty("-g")
+	e.terminal = err == nil
+	return e
+}
+
+// stty runs stty on the terminal of stdin
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// terminalRows returns the number of rows of the terminal, 0 if unknown
+func terminalRows() int {
+	size, err := stty("size")
+	if err != nil {
+		return 0
+	}
+	var rows, cols int
+	fmt.Sscan(size, &rows, &cols)
+	return rows
+}
+
+func (e *lineEditor) addHistory(line string) {
+	if line == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+}
+
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	if !e.terminal {
+		fmt.Fprint(e.out, prompt)
+		line, err := e.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return "", err
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return "", err
+	}
+	defer stty(saved)
+
+	var buf []rune
+	pos := 0
+	hist := len(e.history)
+	editing := ""
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(buf))
+		if back := len(buf) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	setLine := func(s string) {
+		buf = []rune(s)
+		pos = len(buf)
+	}
+	redraw()
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(buf), nil
+		case 3: // ctrl-c
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // ctrl-d
+			if len(buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 1: // ctrl-a
+			pos = 0
+		case 5: // ctrl-e
+			pos = len(buf)
+		case 21: // ctrl-u
+			buf = buf[pos:]
+			pos = 0
+		case 127, 8: // backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case '\t':
+			e.tab(&buf, &pos)
+		case 27: // escape sequences of the cursor keys
+			if b, _ := e.in.ReadByte(); b != '[' && b != 'O' {
+				continue
+			}
+			key, _ := e.in.ReadByte()
+			switch key {
+			case 'A', 'B':
+				if hist == len(e.history) {
+					editing = string(buf)
+				}
+				if key == 'A' && hist > 0 {
+					hist--
+				} else if key == 'B' && hist < len(e.history) {
+					hist++
+				}
+				if hist == len(e.history) {
+					setLine(editing)
+				} else {
+					setLine(e.history[hist])
+				}
+			case 'C':
+				if pos < len(buf) {
+					pos++
+				}
+			case 'D':
+				if pos > 0 {
+					pos--
+				}
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(buf)
+			case '3':
+				e.in.ReadByte() // '~'
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if r < ' ' || r == utf8.RuneError {
+				continue
+			}
+			buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+			pos++
+		}
+		redraw()
+	}
+}
+
+// tab completes the word before the cursor. One candidate is inserted, several are
+// completed to their common prefix or listed.
+func (e *lineEditor) tab(buf *[]rune, pos *int) {
+	if e.complete == nil {
+		return
+	}
+	before := string((*buf)[:*pos])
+	start, candidates := e.complete(before)
+	if len(candidates) == 0 {
+		return
+	}
+	word := before[start:]
+	insert := commonPrefix(candidates)
+	if len(candidates) == 1 && !strings.HasSuffix(insert, "/") {
+		insert += " "
+	}
+	if len(insert) > len(word) || (len(candidates) == 1 && insert != word) {
+		line := before[:start] + insert
+		rest := (*buf)[*pos:]
+		*buf = append([]rune(line), rest...)
+		*pos = utf8.RuneCountInString(line)
+		return
+	}
+	fmt.Fprint(e.out, "\r\n")
+	for i, c := range candidates {
+		if i == 50 {
+			fmt.Fprintf(e.out, "... %d more\r\n", len(candidates)-i)
+			break
+		}
+		fmt.Fprintf(e.out, "%s\r\n", c)
+	}
+}
+
+func commonPrefix(list []string) string {
+	prefix := list[0]
+	for _, s := range list[1:] {
+		for !strings.HasPrefix(s, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix
+}
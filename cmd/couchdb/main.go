@@ -0,0 +1,78 @@
+// Command couchdb is a tool box for Couchdb built on golangcouchdb.
+//
+// Usage:
+//
+//	couchdb [-url URL] [-user USER] [-password PASSWORD] <command> [arguments]
+//
+// The connection defaults to the environment variables COUCHDB_URL, COUCHDB_USER and
+// COUCHDB_PASSWORD. Run "couchdb help" for the list of commands.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+
+	couchdb "github.com/spookieoli/golang_couchdb"
+)
+
+// command is a sub command of couchdb
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, api *couchdb.CouchDBAPI, args []string) error
+}
+
+var commands = map[string]command{}
+
+func register(c command) {
+	commands[c.name] = c
+}
+
+func env(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: couchdb [-url URL] [-user USER] [-password PASSWORD] <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+}
+
+func main() {
+	url := flag.String("url", env("COUCHDB_URL", "http://localhost:5984"), "url of the Couchdb server")
+	user := flag.String("user", os.Getenv("COUCHDB_USER"), "user name")
+	password := flag.String("password", os.Getenv("COUCHDB_PASSWORD"), "password")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 || flag.Arg(0) == "help" {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "couchdb: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	api := &couchdb.CouchDBAPI{Url: *url, Username: *user, Passwort: *password}
+	if err := cmd.run(ctx, api, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "couchdb %s: %v\n", cmd.name, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	couchdb "github.com/spookieoli/golang_couchdb"
+)
+
+func init() {
+	register(command{
+		name:  "offload",
+		usage: "move big attachments into a directory or an S3 bucket",
+		run:   runOffload,
+	})
+}
+
+func runOffload(ctx context.Context, api *couchdb.CouchDBAPI, args []string) error {
+	fs := flag.NewFlagSet("offload", flag.ExitOnError)
+	db := fs.String("db", "", "database")
+	minSize := fs.Int64("min-size", 1<<20, "size in bytes from which attachments are moved")
+	dir := fs.String("dir", "", "directory of the blobs")
+	endpoint := fs.String("s3", "", "url of the S3 compatible server, instead of -dir")
+	bucket := fs.String("bucket", "", "S3 bucket")
+	region := fs.String("region", env("AWS_REGION", "us-east-1"), "S3 region")
+	dryRun := fs.Bool("dry-run", false, "only count the attachments")
+	fs.Parse(args)
+	if *db == "" {
+		return errors.New("-db is required")
+	}
+	switch {
+	case *dir != "":
+		api.Blobs = &couchdb.FileBlobStore{Dir: *dir}
+	case *endpoint != "" && *bucket != "":
+		api.Blobs = &couchdb.S3BlobStore{
+			Endpoint:  *endpoint,
+			Bucket:    *bucket,
+			Region:    *region,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}
+	default:
+		return errors.New("-dir or -s3 and -bucket are required")
+	}
+	failed := 0
+	stats, err := api.OffloadAttachments(ctx, *db, couchdb.OffloadOptions{
+		MinSize: *minSize,
+		DryRun:  *dryRun,
+		OnError: func(id, name string, err error) {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s/%s: %v\n", id, name, err)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	verb := "moved"
+	if *dryRun {
+		verb = "would move"
+	}
+	fmt.Printf("%s %d attachments (%d bytes) of %d documents, %d failed\n", verb, stats.Attachments, stats.Bytes, stats.Docs, failed)
+	return nil
+}
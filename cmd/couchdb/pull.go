@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	couchdb "github.com/spookieoli/golang_couchdb"
+)
+
+func init() {
+	register(command{
+		name:  "pull",
+		usage: "export design docs, indexes, security, replications, users and node config into files",
+		run:   runPull,
+	})
+}
+
+// the directories of the export, they are replaced on every pull
+var pullDirs = []string{"dbs", "nodes", "replicator", "users"}
+
+// user fields that are never exported
+var userSecrets = []string{"password", "password_sha", "password_scheme", "derived_key", "salt", "iterations", "pbkdf2_prf"}
+
+// ddoc fields holding functions by name, they are written as one file per function
+var ddocFunctions = []string{"updates", "shows", "lists", "filters"}
+
+// pull writes the state of a cluster as files. The layout is
+//
+//	dbs/<db>/security.json
+//	dbs/<db>/indexes.json
+//	dbs/<db>/_design/<ddoc>/ddoc.json           fields without functions
+//	dbs/<db>/_design/<ddoc>/views/<view>.map.js  and <view>.reduce.js
+//	dbs/<db>/_design/<ddoc>/<updates|shows|lists|filters>/<name>.js
+//	dbs/<db>/_design/<ddoc>/validate_doc_update.js
+//	replicator/<id>.json                        credentials redacted
+//	users/<name>.json                           without password hashes
+//	nodes/<node>.json                           selected config sections
+//
+// JSON is written with sorted keys, so the files diff well in git.
+type pull struct {
+	api      *couchdb.CouchDBAPI
+	out      string
+	sections []string
+}
+
+func runPull(ctx context.Context, api *couchdb.CouchDBAPI, args []string) error {
+	fs := flag.NewFlagSet("pull", flag.ExitOnError)
+	out := fs.String("out", "", "output directory")
+	dbList := fs.String("dbs", "", "comma separated databases, default all except system databases")
+	sections := fs.String("config", "couchdb,chttpd,chttpd_auth,cluster,cors,log,replicator,smoosh,query_server_config", "comma separated node config sections, empty for none")
+	fs.Parse(args)
+	if *out == "" {
+		return errors.New("-out is required")
+	}
+	p := &pull{api: api, out: *out}
+	if *sections != "" {
+		p.sections = strings.Split(*sections, ",")
+	}
+	for _, dir := range pullDirs {
+		if err := os.RemoveAll(filepath.Join(p.out, dir)); err != nil {
+			return err
+		}
+	}
+
+	var dbs []string
+	if *dbList != "" {
+		dbs = strings.Split(*dbList, ",")
+	} else {
+		all, err := api.AllDBs(ctx)
+		if err != nil {
+			return err
+		}
+		for _, db := range all {
+			if !strings.HasPrefix(db, "_") {
+				dbs = append(dbs, db)
+			}
+		}
+	}
+	for _, db := range dbs {
+		if err := p.database(ctx, db); err != nil {
+			return fmt.Errorf("%s: %w", db, err)
+		}
+	}
+	if err := p.replicator(ctx); err != nil {
+		return fmt.Errorf("_replicator: %w", err)
+	}
+	if err := p.users(ctx); err != nil {
+		return fmt.Errorf("_users: %w", err)
+	}
+	if len(p.sections) > 0 {
+		if err := p.nodes(ctx); err != nil {
+			return fmt.Errorf("nodes: %w", err)
+		}
+	}
+	fmt.Printf("pulled %d databases into %s\n", len(dbs), p.out)
+	return nil
+}
+
+// fileName escapes a name for the use as a file name
+func fileName(name string) string {
+	return url.PathEscape(name)
+}
+
+func (p *pull) write(data []byte, elem ...string) error {
+	name := filepath.Join(append([]string{p.out}, elem...)...)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0o644)
+}
+
+// writeJSON writes v indented with sorted keys
+func (p *pull) writeJSON(v any, elem ...string) error {
+	data, err := stableJSON(v)
+	if err != nil {
+		return err
+	}
+	return p.write(data, elem...)
+}
+
+// stableJSON re-encodes v through maps, numbers are kept as they are
+func stableJSON(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	data, err = json.MarshalIndent(generic, "", "  ")
+	return append(data, '\n'), err
+}
+
+func decodeDoc(raw json.RawMessage) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var doc map[string]any
+	err := dec.Decode(&doc)
+	return doc, err
+}
+
+func (p *pull) database(ctx context.Context, db string) error {
+	dir := []string{"dbs", fileName(db)}
+	sec, err := p.api.GetSecurity(ctx, db)
+	if err != nil {
+		return err
+	}
+	if err := p.writeJSON(sec, append(dir, "security.json")...); err != nil {
+		return err
+	}
+	indexes, err := p.api.Indexes(ctx, db)
+	if err != nil {
+		return err
+	}
+	var defs []couchdb.Index
+	for _, idx := range indexes {
+		if idx.Type != "special" {
+			defs = append(defs, idx)
+		}
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		if defs[i].DDoc != defs[j].DDoc {
+			return defs[i].DDoc < defs[j].DDoc
+		}
+		return defs[i].Name < defs[j].Name
+	})
+	if err := p.writeJSON(defs, append(dir, "indexes.json")...); err != nil {
+		return err
+	}
+	var rows []couchdb.ViewRow
+	err = p.api.StreamAllDocs(ctx, db, couchdb.ViewParams{StartKey: "_design/", EndKey: "_design0", IncludeDocs: true}, func(row couchdb.ViewRow) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		doc, err := decodeDoc(row.Doc)
+		if err != nil {
+			return err
+		}
+		// mango indexes are in indexes.json
+		if doc["language"] == "query" {
+			continue
+		}
+		name := strings.TrimPrefix(row.ID, "_design/")
+		if err := p.designDoc(doc, append(dir, "_design", fileName(name))); err != nil {
+			return fmt.Errorf("%s: %w", row.ID, err)
+		}
+	}
+	return nil
+}
+
+// designDoc splits the functions of a design document into .js files
+func (p *pull) designDoc(doc map[string]any, dir []string) error {
+	delete(doc, "_rev")
+	file := func(elem ...string) []string {
+		return append(append([]string(nil), dir...), elem...)
+	}
+	if views, ok := doc["views"].(map[string]any); ok {
+		for name, v := range views {
+			view, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+			for _, part := range []string{"map", "reduce"} {
+				if src, ok := view[part].(string); ok {
+					if err := p.write([]byte(src), file("views", fileName(name)+"."+part+".js")...); err != nil {
+						return err
+					}
+					delete(view, part)
+				}
+			}
+			if len(view) == 0 {
+				delete(views, name)
+			}
+		}
+		if len(views) == 0 {
+			delete(doc, "views")
+		}
+	}
+	for _, field := range ddocFunctions {
+		funcs, ok := doc[field].(map[string]any)
+		if !ok {
+			continue
+		}
+		for name, f := range funcs {
+			if src, ok := f.(string); ok {
+				if err := p.write([]byte(src), file(field, fileName(name)+".js")...); err != nil {
+					return err
+				}
+				delete(funcs, name)
+			}
+		}
+		if len(funcs) == 0 {
+			delete(doc, field)
+		}
+	}
+	if src, ok := doc["validate_doc_update"].(string); ok {
+		if err := p.write([]byte(src), file("validate_doc_update.js")...); err != nil {
+			return err
+		}
+		delete(doc, "validate_doc_update")
+	}
+	return p.writeJSON(doc, file("ddoc.json")...)
+}
+
+// docs calls fn for every document of db except design documents
+func (p *pull) docs(ctx context.Context, db string, fn func(id string, doc map[string]any) error) error {
+	err := p.api.StreamAllDocs(ctx, db, couchdb.ViewParams{IncludeDocs: true}, func(row couchdb.ViewRow) error {
+		if strings.HasPrefix(row.ID, "_design/") || len(row.Doc) == 0 {
+			return nil
+		}
+		doc, err := decodeDoc(row.Doc)
+		if err != nil {
+			return err
+		}
+		delete(doc, "_rev")
+		return fn(row.ID, doc)
+	})
+	if couchdb.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (p *pull) replicator(ctx context.Context) error {
+	return p.docs(ctx, "_replicator", func(id string, doc map[string]any) error {
+		// the state changes all the time and is no configuration
+		for field := range doc {
+			if strings.HasPrefix(field, "_replication_") {
+				delete(doc, field)
+			}
+		}
+		redact(doc)
+		return p.writeJSON(doc, "replicator", fileName(id)+".json")
+	})
+}
+
+// redact replaces passwords, authorization headers and credentials in urls
+func redact(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			switch strings.ToLower(k) {
+			case "password", "authorization", "token", "secret":
+				v[k] = "REDACTED"
+			default:
+				v[k] = redact(item)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redact(item)
+		}
+	case string:
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "REDACTED")
+				return u.String()
+			}
+		}
+	}
+	return v
+}
+
+func (p *pull) users(ctx context.Context) error {
+	return p.docs(ctx, "_users", func(id string, doc map[string]any) error {
+		for _, field := range userSecrets {
+			delete(doc, field)
+		}
+		return p.writeJSON(doc, "users", fileName(strings.TrimPrefix(id, "org.couchdb.user:"))+".json")
+	})
+}
+
+func (p *pull) nodes(ctx context.Context) error {
+	m, err := p.api.Membership(ctx)
+	if err != nil {
+		return err
+	}
+	for _, node := range m.ClusterNodes {
+		cfg, err := p.api.NodeConfig(ctx, node)
+		if err != nil {
+			return fmt.Errorf("%s: %w", node, err)
+		}
+		selected := map[string]map[string]string{}
+		for _, section := range p.sections {
+			// the admins section holds password hashes
+			if values, ok := cfg[section]; ok && section != "admins" {
+				for key := range values {
+					if k := strings.ToLower(key); strings.Contains(k, "password") || k == "secret" {
+						values[key] = "REDACTED"
+					}
+				}
+				selected[section] = values
+			}
+		}
+		if err := p.writeJSON(selected, "nodes", fileName(node)+".json"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	couchdb "github.com/spookieoli/golang_couchdb"
+)
+
+func init() {
+	register(command{
+		name:  "scan",
+		usage: "check a server for insecure settings, as text or SARIF, fails on critical findings",
+		run:   runScan,
+	})
+}
+
+func runScan(ctx context.Context, api *couchdb.CouchDBAPI, args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	format := fs.String("format", "text", "output format: text or sarif")
+	out := fs.String("o", "", "output file, default stdout")
+	fs.Parse(args)
+	if *format != "text" && *format != "sarif" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	findings, err := api.ScanSecurity(ctx)
+	if err != nil {
+		return err
+	}
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if *format == "sarif" {
+		data, err := couchdb.SARIF("couchdb scan", api.Url, findings)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", data); err != nil {
+			return err
+		}
+	} else if len(findings) == 0 {
+		fmt.Fprintf(w, "%s: ok\n", api.Url)
+	} else {
+		fmt.Fprintf(w, "%s:\n", api.Url)
+		for _, f := range findings {
+			printFinding(w, f)
+		}
+	}
+	critical := 0
+	for _, f := range findings {
+		if f.Severity == couchdb.SeverityCritical {
+			critical++
+		}
+	}
+	if critical > 0 {
+		return fmt.Errorf("%d critical findings", critical)
+	}
+	return nil
+}
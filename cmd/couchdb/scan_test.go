@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	couchdb "github.com/spookieoli/golang_couchdb"
+)
+
+// scanServer is a server with the given databases that every request may read
+func scanServer(t *testing.T, dbs string) *couchdb.CouchDBAPI {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/_session":
+			w.Write([]byte(`{"userCtx":{"name":"admin","roles":[]}}`))
+		case "/_all_dbs":
+			w.Write([]byte(dbs))
+		case "/_membership":
+			w.Write([]byte(`{"all_nodes":[],"cluster_nodes":[]}`))
+		case "/app":
+			w.Write([]byte(`{"db_name":"app"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return &couchdb.CouchDBAPI{Url: srv.URL, Username: "admin", Passwort: "pw"}
+}
+
+func TestRunScan(t *testing.T) {
+	tests := []struct {
+		name, dbs, format string
+		wantErr           string
+		wantOut           string
+	}{
+		{"clean", `[]`, "text", "", ": ok"},
+		{"critical", `["app"]`, "text", "1 critical findings", "[CRITICAL] public_database"},
+		{"critical sarif", `["app"]`, "sarif", "1 critical findings", `"ruleId": "public_database"`},
+		{"unknown format", `[]`, "xml", "unknown format", ""},
+	}
+	for _, tt := range tests {
+		out := filepath.Join(t.TempDir(), "out")
+		err := runScan(context.Background(), scanServer(t, tt.dbs), []string{"-format", tt.format, "-o", out})
+		if (tt.wantErr == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.wantErr)
+		}
+		data, _ := os.ReadFile(out)
+		if !strings.Contains(string(data), tt.wantOut) {
+			t.Errorf("%s: output %s", tt.name, data)
+		}
+	}
+}
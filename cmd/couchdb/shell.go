@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	couchdb "github.com/spookieoli/golang_couchdb"
+)
+
+func init() {
+	register(command{
+		name:  "shell",
+		usage: "interactive shell with completion: use, get, put, edit, find, view",
+		run:   runShell,
+	})
+}
+
+const shellHelp = `commands:
+  use <db>                     select the database
+  dbs                          list the databases
+  get <id>                     show a document
+  put <id> <json>              write a document, _rev is taken from the current version
+  edit <id>                    edit a document in $EDITOR
+  find <selector|query>        run a mango query, a JSON object with "selector" is a full query
+  view <ddoc>/<view> [params]  query a view, params is a JSON object like {"key": 1, "limit": 10}
+  format pretty|compact        JSON output
+  pager on|off                 page output longer than the terminal with $PAGER
+  help, quit`
+
+var shellCommands = []string{"use", "dbs", "get", "put", "edit", "find", "view", "format", "pager", "help", "quit"}
+
+var mangoOperators = []string{
+	"$and", "$or", "$nor", "$not", "$eq", "$ne", "$lt", "$lte", "$gt", "$gte", "$exists", "$type",
+	"$in", "$nin", "$size", "$mod", "$regex", "$elemMatch", "$allMatch", "$keyMapMatch", "$all", "$beginsWith",
+}
+
+type shell struct {
+	api     *couchdb.CouchDBAPI
+	db      string
+	pretty  bool
+	pager   bool
+	dbs     []string
+	editor  *lineEditor
+	history string
+}
+
+func runShell(_ context.Context, api *couchdb.CouchDBAPI, args []string) error {
+	s := &shell{api: api, pretty: true, pager: true, editor: newLineEditor()}
+	if len(args) > 0 {
+		s.db = args[0]
+	}
+	s.editor.complete = s.complete
+	if home, err := os.UserHomeDir(); err == nil {
+		s.history = filepath.Join(home, ".couchdb_history")
+		if data, err := os.ReadFile(s.history); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				s.editor.addHistory(line)
+			}
+		}
+	}
+	defer s.saveHistory()
+	for {
+		prompt := "couchdb> "
+		if s.db != "" {
+			prompt = "couchdb/" + s.db + "> "
+		}
+		line, err := s.editor.readLine(prompt)
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		s.editor.addHistory(line)
+		if line == "quit" || line == "exit" {
+			return nil
+		}
+		// every command gets its own context, ctrl-c aborts a slow request but not the shell
+		cmdCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		err = s.exec(cmdCtx, line)
+		stop()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+	}
+}
+
+func (s *shell) saveHistory() {
+	if s.history == "" {
+		return
+	}
+	lines := s.editor.history
+	if len(lines) > 1000 {
+		lines = lines[len(lines)-1000:]
+	}
+	os.WriteFile(s.history, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+}
+
+func (s *shell) exec(ctx context.Context, line string) error {
+	name, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+	switch name {
+	case "help":
+		fmt.Println(shellHelp)
+		return nil
+	case "use":
+		if rest == "" {
+			return errors.New("usage: use <db>")
+		}
+		if _, err := s.api.DBInfo(ctx, rest); err != nil {
+			return err
+		}
+		s.db = rest
+		return nil
+	case "dbs":
+		dbs, err := s.api.AllDBs(ctx)
+		if err != nil {
+			return err
+		}
+		s.dbs = dbs
+		return s.print(strings.Join(dbs, "\n") + "\n")
+	case "format":
+		if rest != "pretty" && rest != "compact" {
+			return errors.New("usage: format pretty|compact")
+		}
+		s.pretty = rest == "pretty"
+		return nil
+	case "pager":
+		if rest != "on" && rest != "off" {
+			return errors.New("usage: pager on|off")
+		}
+		s.pager = rest == "on"
+		return nil
+	}
+	if s.db == "" {
+		return errors.New("no database, use <db> first")
+	}
+	switch name {
+	case "get":
+		var doc json.RawMessage
+		if err := s.api.GetDoc(ctx, s.db, rest, &doc); err != nil {
+			return err
+		}
+		return s.printJSON(doc)
+	case "put":
+		id, data, _ := strings.Cut(rest, " ")
+		if id == "" || strings.TrimSpace(data) == "" {
+			return errors.New("usage: put <id> <json>")
+		}
+		return s.put(ctx, id, []byte(data))
+	case "edit":
+		if rest == "" {
+			return errors.New("usage: edit <id>")
+		}
+		return s.edit(ctx, rest)
+	case "find":
+		return s.find(ctx, rest)
+	case "view":
+		return s.view(ctx, rest)
+	}
+	return fmt.Errorf("unknown command %q, try help", name)
+}
+
+// put writes a document, a missing _rev is taken from the stored document
+func (s *shell) put(ctx context.Context, id string, data []byte) error {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if _, ok := doc["_rev"]; !ok {
+		var current struct {
+			Rev string `json:"_rev"`
+		}
+		if err := s.api.GetDoc(ctx, s.db, id, &current); err == nil {
+			doc["_rev"] = current.Rev
+		} else if !couchdb.IsNotFound(err) {
+			return err
+		}
+	}
+	rev, err := s.api.PutDoc(ctx, s.db, id, doc)
+	if err != nil {
+		return err
+	}
+	fmt.Println(rev)
+	return nil
+}
+
+func (s *shell) edit(ctx context.Context, id string) error {
+	var doc json.RawMessage
+	err := s.api.GetDoc(ctx, s.db, id, &doc)
+	if couchdb.IsNotFound(err) {
+		doc, err = json.Marshal(map[string]string{"_id": id})
+	}
+	if err != nil {
+		return err
+	}
+	var before bytes.Buffer
+	json.Indent(&before, doc, "", "  ")
+	before.WriteByte('\n')
+	f, err := os.CreateTemp("", "couchdb-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(before.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	args := append(strings.Fields(editor), f.Name())
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	after, err := os.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(before.Bytes(), after) {
+		fmt.Println("unchanged")
+		return nil
+	}
+	return s.put(ctx, id, after)
+}
+
+func (s *shell) find(ctx context.Context, arg string) error {
+	if arg == "" {
+		arg = "{}"
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(arg), &obj); err != nil {
+		return err
+	}
+	query := couchdb.FindQuery{Limit: 25}
+	if _, full := obj["selector"]; full {
+		if err := json.Unmarshal([]byte(arg), &query); err != nil {
+			return err
+		}
+	} else if err := json.Unmarshal([]byte(arg), &query.Selector); err != nil {
+		return err
+	}
+	res, err := s.api.Find(ctx, s.db, query)
+	if err != nil {
+		return err
+	}
+	if res.Warning != "" {
+		fmt.Fprintln(os.Stderr, "warning:", res.Warning)
+	}
+	return s.printList(res.Docs)
+}
+
+// viewArgs are the view parameters of the view command
+type viewArgs struct {
+	Key         any   `json:"key"`
+	Keys        []any `json:"keys"`
+	StartKey    any   `json:"start_key"`
+	EndKey      any   `json:"end_key"`
+	Limit       int   `json:"limit"`
+	Skip        int   `json:"skip"`
+	Descending  bool  `json:"descending"`
+	IncludeDocs bool  `json:"include_docs"`
+	Reduce      *bool `json:"reduce"`
+	Group       bool  `json:"group"`
+	GroupLevel  int   `json:"group_level"`
+}
+
+func (s *shell) view(ctx context.Context, arg string) error {
+	name, params, _ := strings.Cut(arg, " ")
+	ddoc, view, ok := strings.Cut(strings.TrimPrefix(name, "_design/"), "/")
+	if !ok {
+		return errors.New("usage: view <ddoc>/<view> [params]")
+	}
+	a := viewArgs{Limit: 25}
+	if params = strings.TrimSpace(params); params != "" {
+		if err := json.Unmarshal([]byte(params), &a); err != nil {
+			return err
+		}
+	}
+	res, err := s.api.View(ctx, s.db, ddoc, view, couchdb.ViewParams{
+		Key: a.Key, Keys: a.Keys, StartKey: a.StartKey, EndKey: a.EndKey, Limit: a.Limit, Skip: a.Skip,
+		Descending: a.Descending, IncludeDocs: a.IncludeDocs, Reduce: a.Reduce, Group: a.Group, GroupLevel: a.GroupLevel,
+	})
+	if err != nil {
+		return err
+	}
+	rows := make([]json.RawMessage, len(res.Rows))
+	for i, row := range res.Rows {
+		rows[i], _ = json.Marshal(row)
+	}
+	return s.printList(rows)
+}
+
+func (s *shell) format(data json.RawMessage) string {
+	var buf bytes.Buffer
+	if s.pretty {
+		json.Indent(&buf, data, "", "  ")
+	} else {
+		json.Compact(&buf, data)
+	}
+	return buf.String()
+}
+
+func (s *shell) printJSON(data json.RawMessage) error {
+	return s.print(s.format(data) + "\n")
+}
+
+// printList prints a JSON array pretty, or compact with one element per line
+func (s *shell) printList(items []json.RawMessage) error {
+	var out strings.Builder
+	if s.pretty {
+		data, _ := json.Marshal(items)
+		out.WriteString(s.format(data))
+		out.WriteByte('\n')
+	} else {
+		for _, item := range items {
+			out.WriteString(s.format(item))
+			out.WriteByte('\n')
+		}
+	}
+	fmt.Fprintf(&out, "(%d)\n", len(items))
+	return s.print(out.String())
+}
+
+// print writes the output through $PAGER if it does not fit on the terminal
+func (s *shell) print(text string) error {
+	rows := terminalRows()
+	if !s.pager || rows == 0 || strings.Count(text, "\n") < rows-1 {
+		_, err := fmt.Print(text)
+		return err
+	}
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less -FRX"
+	}
+	args := strings.Fields(pager)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		_, err = fmt.Print(text)
+		return err
+	}
+	return nil
+}
+
+// complete returns the completions of the word before the cursor
+func (s *shell) complete(before string) (int, []string) {
+	fields := strings.Fields(before)
+	arg := len(fields)
+	word := ""
+	if len(fields) > 0 && !strings.HasSuffix(before, " ") {
+		arg--
+		word = fields[arg]
+	}
+	start := len(before) - len(word)
+	if arg == 0 {
+		return start, withPrefix(shellCommands, word)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	switch fields[0] {
+	case "use":
+		if s.dbs == nil {
+			s.dbs, _ = s.api.AllDBs(ctx)
+		}
+		return start, withPrefix(s.dbs, word)
+	case "get", "put", "edit":
+		if arg == 1 && s.db != "" {
+			return start, s.docIDs(ctx, word)
+		}
+	case "view":
+		if arg == 1 && s.db != "" {
+			return start, withPrefix(s.viewNames(ctx), word)
+		}
+	case "find":
+		// operators are completed inside the quotes of a JSON key
+		i := strings.LastIndexAny(before, "\"{,: ")
+		if i >= 0 && before[i] == '"' && strings.HasPrefix(before[i+1:], "$") {
+			var ops []string
+			for _, op := range withPrefix(mangoOperators, before[i+1:]) {
+				ops = append(ops, op+`"`)
+			}
+			return i + 1, ops
+		}
+	case "format":
+		return start, withPrefix([]string{"pretty", "compact"}, word)
+	case "pager":
+		return start, withPrefix([]string{"on", "off"}, word)
+	}
+	return start, nil
+}
+
+func withPrefix(list []string, prefix string) []string {
+	var res []string
+	for _, s := range list {
+		if strings.HasPrefix(s, prefix) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// docIDs looks up ids starting with prefix with a range query on _all_docs
+func (s *shell) docIDs(ctx context.Context, prefix string) []string {
+	res, err := s.api.AllDocs(ctx, s.db, couchdb.ViewParams{StartKey: prefix, EndKey: prefix + "\ufff0", Limit: 100})
+	if err != nil {
+		return nil
+	}
+	ids := make([]string, len(res.Rows))
+	for i, row := range res.Rows {
+		ids[i] = row.ID
+	}
+	return ids
+}
+
+// viewNames returns "<ddoc>/<view>" of all views of the database
+func (s *shell) viewNames(ctx context.Context) []string {
+	res, err := s.api.AllDocs(ctx, s.db, couchdb.ViewParams{StartKey: "_design/", EndKey: "_design0", IncludeDocs: true})
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, row := range res.Rows {
+		var ddoc struct {
+			Views map[string]json.RawMessage `json:"views"`
+		}
+		json.Unmarshal(row.Doc, &ddoc)
+		for view := range ddoc.Views {
+			names = append(names, strings.TrimPrefix(row.ID, "_design/")+"/"+view)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	couchdb "github.com/spookieoli/golang_couchdb"
+)
+
+func TestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		list []string
+		want string
+	}{
+		{[]string{"abc"}, "abc"},
+		{[]string{"abc", "abd", "ab"}, "ab"},
+		{[]string{"x", "y"}, ""},
+		{[]string{"äb", "äc"}, "ä"},
+		{[]string{"ä", "å"}, ""}, // same first byte, different runes
+	}
+	for _, tt := range tests {
+		if got := commonPrefix(tt.list); got != tt.want {
+			t.Errorf("commonPrefix(%q) = %q, want %q", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestLineEditorTab(t *testing.T) {
+	candidates := map[string][]string{
+		"g":           {"get"},
+		"get do":      {"doc1", "doc2"},
+		"get doc":     {"doc1", "doc2"},
+		"use ap":      {"app/"},
+		"get nothing": nil,
+	}
+	tests := []struct {
+		before, after string // the line before and after tab, | is the cursor
+		listed        bool
+	}{
+		{"g|", "get |", false},
+		{"get do|", "get doc|", false},
+		{"get doc|", "get doc|", true},
+		{"use ap|", "use app/|", false},
+		{"get nothing|", "get nothing|", false},
+		{"g| rest", "get | rest", false},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		e := &lineEditor{out: &out, complete: func(before string) (int, []string) {
+			return strings.LastIndex(before, " ") + 1, candidates[before]
+		}}
+		line, rest, _ := strings.Cut(tt.before, "|")
+		buf := []rune(line + rest)
+		pos := len([]rune(line))
+		e.tab(&buf, &pos)
+		if got := string(buf[:pos]) + "|" + string(buf[pos:]); got != tt.after {
+			t.Errorf("tab %q = %q, want %q", tt.before, got, tt.after)
+		}
+		if listed := out.Len() > 0; listed != tt.listed {
+			t.Errorf("tab %q listed %q", tt.before, out.String())
+		}
+	}
+}
+
+func TestLineEditorPlain(t *testing.T) {
+	var out bytes.Buffer
+	e := &lineEditor{in: bufio.NewReader(strings.NewReader("one\r\ntwo\nlast")), out: &out}
+	var lines []string
+	for {
+		line, err := e.readLine("> ")
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+		e.addHistory(line)
+		e.addHistory(line)
+	}
+	if want := []string{"one", "two", "last"}; !reflect.DeepEqual(lines, want) || !reflect.DeepEqual(e.history, want) {
+		t.Errorf("lines %q, history %q", lines, e.history)
+	}
+	if out.String() != "> > > > " {
+		t.Errorf("prompts %q", out.String())
+	}
+}
+
+// shellServer serves _all_dbs and _all_docs of the database "app" with the ids in ids
+func shellServer(t *testing.T, ids []string, ddocs map[string]string) *couchdb.CouchDBAPI {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/app":
+			w.Write([]byte(`{"db_name":"app","update_seq":"1-x"}`))
+		case "/_all_dbs":
+			w.Write([]byte(`["_users","app","apples","other"]`))
+		case "/app/_all_docs":
+			var start, end string
+			json.Unmarshal([]byte(r.URL.Query().Get("start_key")), &start)
+			json.Unmarshal([]byte(r.URL.Query().Get("end_key")), &end)
+			var rows []map[string]any
+			for _, id := range ids {
+				if id >= start && id <= end {
+					row := map[string]any{"id": id, "key": id, "value": map[string]any{}}
+					if doc, ok := ddocs[id]; ok {
+						row["doc"] = json.RawMessage(doc)
+					}
+					rows = append(rows, row)
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]any{"rows": rows})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return &couchdb.CouchDBAPI{Url: srv.URL}
+}
+
+func TestShellComplete(t *testing.T) {
+	api := shellServer(t, []string{"_design/ui", "_design/x", "order:1", "order:2", "user:1"}, map[string]string{
+		"_design/ui": `{"views":{"by_date":{},"by_user":{}}}`,
+		"_design/x":  `{"language":"query"}`,
+	})
+	s := &shell{api: api, db: "app"}
+	tests := []struct {
+		before string
+		start  int
+		want   []string
+	}{
+		{"", 0, shellCommands},
+		{"p", 0, []string{"put", "pager"}},
+		{"use ap", 4, []string{"app", "apples"}},
+		{"get order", 4, []string{"order:1", "order:2"}},
+		{"get ", 4, []string{"_design/ui", "_design/x", "order:1", "order:2", "user:1"}},
+		{"get order:1 ", 12, nil},
+		{"view ui/by_", 5, []string{"ui/by_date", "ui/by_user"}},
+		{`find {"$o`, 7, []string{`$or"`}},
+		{`find {"age": {"$gt`, 15, []string{`$gt"`, `$gte"`}},
+		{`find {"ag`, 5, nil},
+		{"format c", 7, []string{"compact"}},
+	}
+	for _, tt := range tests {
+		start, got := s.complete(tt.before)
+		if start != tt.start || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("complete(%q) = %d, %q, want %d, %q", tt.before, start, got, tt.start, tt.want)
+		}
+	}
+}
+
+func TestShellExec(t *testing.T) {
+	s := &shell{api: shellServer(t, nil, nil)}
+	tests := []struct {
+		line    string
+		wantErr string
+	}{
+		{"get x", "no database"},
+		{"use missing", "not_found"},
+		{"format fancy", "usage"},
+		{"pager off", ""},
+		{"use app", ""},
+		{"put x", "usage"},
+		{"view nope", "usage"},
+		{"frobnicate", "unknown command"},
+	}
+	for _, tt := range tests {
+		err := s.exec(context.Background(), tt.line)
+		if (tt.wantErr == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: %v, want %q", tt.line, err, tt.wantErr)
+		}
+	}
+	if s.db != "app" || s.pager {
+		t.Errorf("state db %q, pager %v", s.db, s.pager)
+	}
+}
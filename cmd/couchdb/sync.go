@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	couchdb "github.com/spookieoli/golang_couchdb"
+)
+
+func init() {
+	register(command{
+		name:  "sync",
+		usage: "mirror a directory tree into a database or back (-pull)",
+		run:   runSync,
+	})
+}
+
+func runSync(ctx context.Context, api *couchdb.CouchDBAPI, args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	db := fs.String("db", "", "database")
+	dir := fs.String("dir", ".", "directory")
+	prefix := fs.String("prefix", "", "prefix of the document ids")
+	perDir := fs.Bool("per-dir", false, "one document per directory instead of one per file")
+	pull := fs.Bool("pull", false, "write the database into the directory")
+	del := fs.Bool("delete", false, "delete what is missing on the source side")
+	dryRun := fs.Bool("dry-run", false, "only print the changes")
+	ignore := fs.String("ignore", ".*", "comma separated patterns of names to skip")
+	fs.Parse(args)
+	if *db == "" {
+		return errors.New("-db is required")
+	}
+	s := &couchdb.DirSync{API: api, DB: *db, Dir: *dir, Prefix: *prefix, Delete: *del}
+	if *perDir {
+		s.Mode = couchdb.SyncPerDirectory
+	}
+	if *ignore != "" {
+		s.Ignore = strings.Split(*ignore, ",")
+	}
+
+	var changes []couchdb.SyncChange
+	var err error
+	switch {
+	case *dryRun && *pull:
+		changes, err = s.PlanPull(ctx)
+	case *dryRun:
+		changes, err = s.PlanPush(ctx)
+	case *pull:
+		changes, err = s.Pull(ctx)
+	default:
+		changes, err = s.Push(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	for _, ch := range changes {
+		fmt.Println(ch)
+	}
+	if *dryRun {
+		fmt.Printf("%d changes, nothing written\n", len(changes))
+	} else {
+		fmt.Printf("%d changes\n", len(changes))
+	}
+	return nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	couchdb "github.com/spookieoli/golang_couchdb"
+)
+
+func init() {
+	register(command{
+		name:  "top",
+		usage: "live monitor of nodes, active tasks and replication jobs",
+		run:   runTop,
+	})
+}
+
+// topColumn is a column of a pane, numeric columns sort by their value
+type topColumn struct {
+	name    string
+	width   int
+	numeric bool
+}
+
+type topCell struct {
+	text  string
+	value float64
+}
+
+// topPane is a table of the monitor that can be sorted by every column
+type topPane struct {
+	title   string
+	columns []topColumn
+	rows    [][]topCell
+	sortBy  int
+	asc     bool
+}
+
+func (p *topPane) sort() {
+	numeric := p.columns[p.sortBy].numeric
+	sort.SliceStable(p.rows, func(i, j int) bool {
+		a, b := p.rows[i][p.sortBy], p.rows[j][p.sortBy]
+		if !p.asc {
+			a, b = b, a
+		}
+		if numeric {
+			return a.value < b.value
+		}
+		return a.text < b.text
+	})
+}
+
+func (p *topPane) render(b *strings.Builder, focused bool, maxRows int) {
+	marker := " "
+	if focused {
+		marker = ">"
+	}
+	fmt.Fprintf(b, "%s %s (%d)\n", marker, p.title, len(p.rows))
+	for i, col := range p.columns {
+		name := col.name
+		if i == p.sortBy {
+			if p.asc {
+				name += "^"
+			} else {
+				name += "v"
+			}
+		}
+		if col.numeric {
+			fmt.Fprintf(b, "%*s ", col.width, name)
+		} else {
+			fmt.Fprintf(b, "%-*s ", col.width, name)
+		}
+	}
+	b.WriteString("\n")
+	for n, row := range p.rows {
+		if n == maxRows {
+			fmt.Fprintf(b, "  ... %d more\n", len(p.rows)-n)
+			break
+		}
+		for i, col := range p.columns {
+			text := row[i].text
+			if len(text) > col.width {
+				text = text[:col.width-1] + "~"
+			}
+			if col.numeric {
+				fmt.Fprintf(b, "%*s ", col.width, text)
+			} else {
+				fmt.Fprintf(b, "%-*s ", col.width, text)
+			}
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+}
+
+func textCell(s string) topCell { return topCell{text: s} }
+
+func numCell(v float64, format string) topCell {
+	return topCell{text: fmt.Sprintf(format, v), value: v}
+}
+
+// rates turns counters into rates per second by the delta to the last sample
+type rates struct {
+	last map[string]float64
+	at   time.Time
+	prev time.Time
+	next map[string]float64
+}
+
+func (r *rates) begin(now time.Time) {
+	r.prev, r.at = r.at, now
+	r.last, r.next = r.next, map[string]float64{}
+}
+
+// rate returns the change of a counter per second, 0 on the first sample or after a restart
+func (r *rates) rate(key string, value float64) float64 {
+	r.next[key] = value
+	old, ok := r.last[key]
+	dt := r.at.Sub(r.prev).Seconds()
+	if !ok || dt <= 0 || value < old {
+		return 0
+	}
+	return (value - old) / dt
+}
+
+type topNode struct {
+	name  string
+	stats couchdb.NodeStats
+	sys   *couchdb.NodeSystem
+	err   error
+}
+
+type monitor struct {
+	api   *couchdb.CouchDBAPI
+	panes []*topPane
+	focus int
+	rates rates
+	err   error
+}
+
+func runTop(ctx context.Context, api *couchdb.CouchDBAPI, args []string) error {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	interval := fs.Duration("interval", 2*time.Second, "refresh interval")
+	fs.Parse(args)
+
+	m := &monitor{api: api, panes: []*topPane{
+		{title: "NODES", sortBy: 1, columns: []topColumn{
+			{"node", 28, false}, {"req/s", 8, true}, {"reads/s", 8, true}, {"writes/s", 8, true},
+			{"5xx/s", 6, true}, {"runq", 5, true}, {"procs", 8, true}, {"mem MB", 8, true}, {"uptime", 9, true},
+		}},
+		{title: "ACTIVE TASKS", sortBy: 4, columns: []topColumn{
+			{"node", 20, false}, {"type", 18, false}, {"database", 24, false}, {"progress", 8, true},
+			{"changes/s", 9, true}, {"docs/s", 8, true}, {"ddoc/source", 30, false},
+		}},
+		{title: "REPLICATION JOBS", sortBy: 4, columns: []topColumn{
+			{"doc", 24, false}, {"state", 10, false}, {"node", 20, false}, {"pending", 8, true},
+			{"written/s", 9, true}, {"failures", 8, true}, {"source -> target", 40, false},
+		}},
+	}}
+
+	keys := make(chan byte, 16)
+	if saved, err := stty("-g"); err == nil {
+		// keys are read one by one, ctrl-c still ends the monitor
+		stty("-icanon", "-echo", "min", "1")
+		defer stty(saved)
+		go func() {
+			r := bufio.NewReader(os.Stdin)
+			for {
+				b, err := r.ReadByte()
+				if err != nil {
+					return
+				}
+				keys <- b
+			}
+		}()
+	}
+	defer fmt.Print("\x1b[?25h")
+	fmt.Print("\x1b[?25l")
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	m.poll(ctx)
+	m.draw()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			m.poll(ctx)
+		case key := <-keys:
+			if !m.key(key) {
+				return nil
+			}
+		}
+		m.draw()
+	}
+}
+
+// key handles a key press and reports false for quit
+func (m *monitor) key(key byte) bool {
+	p := m.panes[m.focus]
+	switch key {
+	case 'q':
+		return false
+	case '\t':
+		m.focus = (m.focus + 1) % len(m.panes)
+	case '>', '.', 'l':
+		p.sortBy = (p.sortBy + 1) % len(p.columns)
+	case '<', ',', 'h':
+		p.sortBy = (p.sortBy + len(p.columns) - 1) % len(p.columns)
+	case 'r':
+		p.asc = !p.asc
+	}
+	for _, p := range m.panes {
+		p.sort()
+	}
+	return true
+}
+
+func (m *monitor) draw() {
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&b, "couchdb top  %s  %s   tab: pane  </>: sort column  r: reverse  q: quit\n\n", m.api.Url, time.Now().Format("15:04:05"))
+	if m.err != nil {
+		fmt.Fprintf(&b, "error: %v\n\n", m.err)
+	}
+	maxRows := 15
+	if rows := terminalRows(); rows > 0 {
+		maxRows = (rows - 12 - len(m.panes[0].rows)) / 2
+		if maxRows < 3 {
+			maxRows = 3
+		}
+	}
+	for i, p := range m.panes {
+		limit := maxRows
+		if i == 0 {
+			limit = -1
+		}
+		p.render(&b, i == m.focus, limit)
+	}
+	fmt.Print(b.String())
+}
+
+// poll reads all endpoints, the nodes at the same time
+func (m *monitor) poll(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	m.err = nil
+	membership, err := m.api.Membership(ctx)
+	if err != nil {
+		m.err = err
+		return
+	}
+	nodes := make([]topNode, len(membership.ClusterNodes))
+	var wg sync.WaitGroup
+	for i, name := range membership.ClusterNodes {
+		wg.Add(1)
+		go func(n *topNode, name string) {
+			defer wg.Done()
+			n.name = name
+			if n.stats, n.err = m.api.NodeStats(ctx, name); n.err == nil {
+				n.sys, n.err = m.api.NodeSystem(ctx, name)
+			}
+		}(&nodes[i], name)
+	}
+	var tasks []couchdb.ActiveTask
+	var jobs []couchdb.SchedulerJob
+	var tasksErr, jobsErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); tasks, tasksErr = m.api.ActiveTasks(ctx) }()
+	go func() { defer wg.Done(); jobs, jobsErr = m.api.SchedulerJobs(ctx) }()
+	wg.Wait()
+
+	m.rates.begin(time.Now())
+	r := &m.rates
+	var rows [][]topCell
+	for _, n := range nodes {
+		if n.err != nil {
+			rows = append(rows, []topCell{textCell(n.name), textCell("error"), {}, {}, {}, {}, {}, {}, {}})
+			continue
+		}
+		var errors5xx float64
+		for _, code := range []string{"500", "501", "502", "503", "504"} {
+			errors5xx += n.stats.Value("couchdb.httpd_status_codes." + code)
+		}
+		rows = append(rows, []topCell{
+			textCell(n.name),
+			numCell(r.rate(n.name+"/req", n.stats.Value("couchdb.httpd.requests")), "%.1f"),
+			numCell(r.rate(n.name+"/reads", n.stats.Value("couchdb.database_reads")), "%.1f"),
+			numCell(r.rate(n.name+"/writes", n.stats.Value("couchdb.database_writes")), "%.1f"),
+			numCell(r.rate(n.name+"/5xx", errors5xx), "%.1f"),
+			numCell(float64(n.sys.RunQueue), "%.0f"),
+			numCell(float64(n.sys.ProcessCount), "%.0f"),
+			numCell(float64(n.sys.Memory["total"])/(1<<20), "%.0f"),
+			{text: (time.Duration(n.sys.Uptime) * time.Second).String(), value: float64(n.sys.Uptime)},
+		})
+	}
+	m.panes[0].rows = rows
+
+	rows = nil
+	for _, t := range tasks {
+		key := t.Node + t.PID
+		detail := t.DesignDocument
+		if t.Type == "replication" {
+			detail = t.Source + " -> " + t.Target
+		}
+		rows = append(rows, []topCell{
+			textCell(t.Node), textCell(t.Type), textCell(t.Database),
+			numCell(float64(t.Progress), "%.0f%%"),
+			numCell(r.rate(key+"/changes", float64(t.ChangesDone)), "%.1f"),
+			numCell(r.rate(key+"/docs", float64(t.DocsWritten)), "%.1f"),
+			textCell(detail),
+		})
+	}
+	m.panes[1].rows = rows
+
+	rows = nil
+	for _, j := range jobs {
+		rows = append(rows, []topCell{
+			textCell(j.DocID), textCell(j.State()), textCell(j.Node),
+			numCell(float64(j.Info.ChangesPending), "%.0f"),
+			numCell(r.rate(j.ID+"/written", float64(j.Info.DocsWritten)), "%.1f"),
+			numCell(float64(j.Info.DocWriteFailures), "%.0f"),
+			textCell(j.Source + " -> " + j.Target),
+		})
+	}
+	m.panes[2].rows = rows
+
+	for _, p := range m.panes {
+		p.sort()
+	}
+	switch {
+	case tasksErr != nil:
+		m.err = tasksErr
+	case jobsErr != nil:
+		m.err = jobsErr
+	}
+}
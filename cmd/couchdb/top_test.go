@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	couchdb "github.com/spookieoli/golang_couchdb"
+)
+
+func TestRates(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		after time.Duration
+		value float64
+		want  float64
+	}{
+		{0, 100, 0},                // first sample
+		{2 * time.Second, 110, 5},  // 10 in 2s
+		{4 * time.Second, 110, 0},  // unchanged
+		{5 * time.Second, 20, 0},   // counter reset by a restart
+		{10 * time.Second, 70, 10}, // 50 in 5s
+	}
+	var r rates
+	for _, tt := range tests {
+		r.begin(start.Add(tt.after))
+		if got := r.rate("k", tt.value); got != tt.want {
+			t.Errorf("after %v at %v: rate %v, want %v", tt.after, tt.value, got, tt.want)
+		}
+	}
+	// a key missing in a sample starts over
+	r.begin(start.Add(11 * time.Second))
+	r.begin(start.Add(12 * time.Second))
+	if got := r.rate("k", 80); got != 0 {
+		t.Errorf("rate after a gap %v", got)
+	}
+}
+
+func TestTopPane(t *testing.T) {
+	p := &topPane{title: "T", columns: []topColumn{{"name", 6, false}, {"n", 4, true}}, rows: [][]topCell{
+		{textCell("b"), numCell(10, "%.0f")},
+		{textCell("a-very-long-name"), numCell(2, "%.0f")},
+		{textCell("c"), numCell(3, "%.0f")},
+	}}
+	names := func() string {
+		var list []string
+		for _, row := range p.rows {
+			list = append(list, row[0].text)
+		}
+		return strings.Join(list, ",")
+	}
+	tests := []struct {
+		sortBy int
+		asc    bool
+		want   string
+	}{
+		{1, false, "b,c,a-very-long-name"},
+		{1, true, "a-very-long-name,c,b"},
+		{0, true, "a-very-long-name,b,c"},
+		{0, false, "c,b,a-very-long-name"},
+	}
+	for _, tt := range tests {
+		p.sortBy, p.asc = tt.sortBy, tt.asc
+		p.sort()
+		if got := names(); got != tt.want {
+			t.Errorf("sort by %d asc %v: %s, want %s", tt.sortBy, tt.asc, got, tt.want)
+		}
+	}
+	var b strings.Builder
+	p.render(&b, true, 2)
+	if want := "> T (3)\nnamev     n \nc         3 \nb        10 \n  ... 1 more\n\n"; b.String() != want {
+		t.Errorf("render:\n%q", b.String())
+	}
+	b.Reset()
+	p.render(&b, false, -1)
+	if !strings.Contains(b.String(), "a-ver~ ") {
+		t.Errorf("long text not cut:\n%s", b.String())
+	}
+}
+
+func TestMonitorKey(t *testing.T) {
+	m := &monitor{panes: []*topPane{
+		{columns: []topColumn{{"a", 1, false}, {"b", 1, true}}},
+		{columns: []topColumn{{"a", 1, false}, {"b", 1, true}, {"c", 1, true}}},
+	}}
+	for _, key := range []byte{'>', '\t', '<', '<', 'r'} {
+		if !m.key(key) {
+			t.Fatalf("key %q quit", key)
+		}
+	}
+	if m.focus != 1 || m.panes[0].sortBy != 1 || m.panes[1].sortBy != 1 || !m.panes[1].asc {
+		t.Errorf("focus %d, sort %d %d, asc %v", m.focus, m.panes[0].sortBy, m.panes[1].sortBy, m.panes[1].asc)
+	}
+	if m.key('q') {
+		t.Error("q did not quit")
+	}
+}
+
+func TestMonitorPoll(t *testing.T) {
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/_membership":
+			fmt.Fprint(w, `{"all_nodes":["n1","n2"],"cluster_nodes":["n1","n2"]}`)
+		case "/_node/n1/_stats":
+			n := atomic.AddInt64(&requests, 1000)
+			fmt.Fprintf(w, `{"couchdb":{"httpd":{"requests":{"value":%d}},"httpd_status_codes":{"500":{"value":1},"503":{"value":2}}}}`, n)
+		case "/_node/n1/_system":
+			fmt.Fprint(w, `{"uptime":90,"memory":{"total":10485760},"run_queue":3,"process_count":400}`)
+		case "/_active_tasks":
+			fmt.Fprint(w, `[{"node":"n1","pid":"<0.1.0>","type":"indexer","database":"db","design_document":"_design/a","progress":50,"changes_done":10},
+				{"node":"n1","pid":"<0.2.0>","type":"replication","source":"src","target":"tgt","progress":90}]`)
+		case "/_scheduler/jobs":
+			fmt.Fprint(w, `{"jobs":[{"id":"j1","doc_id":"rep","node":"n1","source":"s","target":"t","history":[{"type":"started"}],"info":{"changes_pending":7}}]}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"error":"unknown_error","reason":"down"}`)
+		}
+	}))
+	defer srv.Close()
+	m := &monitor{api: &couchdb.CouchDBAPI{Url: srv.URL}, panes: []*topPane{
+		{sortBy: 0, asc: true, columns: make([]topColumn, 9)},
+		{sortBy: 3, columns: make([]topColumn, 7)},
+		{sortBy: 0, columns: make([]topColumn, 7)},
+	}}
+	m.poll(context.Background())
+	time.Sleep(10 * time.Millisecond)
+	m.poll(context.Background())
+	if m.err != nil {
+		t.Fatal(m.err)
+	}
+	nodes := m.panes[0].rows
+	if len(nodes) != 2 || nodes[0][0].text != "n1" || nodes[1][1].text != "error" {
+		t.Fatalf("nodes %v", nodes)
+	}
+	n1 := nodes[0]
+	if n1[1].value <= 0 || n1[4].value != 0 || n1[5].text != "3" || n1[7].text != "10" || n1[8].text != "1m30s" {
+		t.Errorf("n1 %v", n1)
+	}
+	tasks := m.panes[1].rows
+	if len(tasks) != 2 || tasks[0][3].text != "90%" || tasks[0][6].text != "src -> tgt" || tasks[1][6].text != "_design/a" {
+		t.Errorf("tasks %v", tasks)
+	}
+	if jobs := m.panes[2].rows; len(jobs) != 1 || jobs[0][1].text != "started" || jobs[0][3].text != "7" {
+		t.Errorf("jobs %v", jobs)
+	}
+}
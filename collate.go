@@ -0,0 +1,164 @@
+package golangcouchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// collate compares two JSON values in the order Couchdb uses for view keys:
+// null < false < true < numbers < strings < arrays < objects.
+// Strings are compared case insensitive first with lower case before upper case,
+// which is close to the ICU collation of Couchdb for latin text.
+func collate(a, b json.RawMessage) int {
+	return collateValues(decodeOrdered(a), decodeOrdered(b))
+}
+
+// member is a key value pair of an object, objects keep their order for collation
+type member struct {
+	key   string
+	value any
+}
+
+func decodeOrdered(raw json.RawMessage) any {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	v, err := decodeValue(dec)
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+func decodeValue(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '[':
+			list := []any{}
+			for dec.More() {
+				v, err := decodeValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			_, err = dec.Token()
+			return list, err
+		case '{':
+			obj := []member{}
+			for dec.More() {
+				k, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				v, err := decodeValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				obj = append(obj, member{key: k.(string), value: v})
+			}
+			_, err = dec.Token()
+			return obj, err
+		}
+	}
+	return tok, nil
+}
+
+func collateRank(v any) int {
+	switch t := v.(type) {
+	case nil:
+		return 0
+	case bool:
+		if t {
+			return 2
+		}
+		return 1
+	case json.Number:
+		return 3
+	case string:
+		return 4
+	case []any:
+		return 5
+	}
+	return 6
+}
+
+func collateValues(a, b any) int {
+	ra, rb := collateRank(a), collateRank(b)
+	if ra != rb {
+		return compareInt(ra, rb)
+	}
+	switch x := a.(type) {
+	case json.Number:
+		fa, _ := x.Float64()
+		fb, _ := b.(json.Number).Float64()
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case string:
+		return collateStrings(x, b.(string))
+	case []any:
+		y := b.([]any)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := collateValues(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInt(len(x), len(y))
+	case []member:
+		y := b.([]member)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := collateStrings(x[i].key, y[i].key); c != 0 {
+				return c
+			}
+			if c := collateValues(x[i].value, y[i].value); c != 0 {
+				return c
+			}
+		}
+		return compareInt(len(x), len(y))
+	}
+	return 0
+}
+
+func collateStrings(a, b string) int {
+	if c := strings.Compare(strings.ToLower(a), strings.ToLower(b)); c != 0 {
+		return c
+	}
+	// same letters, lower case sorts first
+	for a != "" && b != "" {
+		ra, na := utf8.DecodeRuneInString(a)
+		rb, nb := utf8.DecodeRuneInString(b)
+		if ra != rb {
+			if unicode.IsLower(ra) {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[na:], b[nb:]
+	}
+	return 0
+}
+
+func compareInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,696 @@
+package golangcouchdb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ValidationError describes an invalid field of a document
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is returned by validators, the CRUD handlers answer it with 422
+type ValidationErrors []ValidationError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Field + ": " + e.Message
+	}
+	return "validation failed: " + strings.Join(msgs, ", ")
+}
+
+// Validator can be implemented by document types, it is called before every write
+type Validator interface {
+	Validate() error
+}
+
+// CRUDOptions configure a CRUDHandler
+type CRUDOptions struct {
+	// DB is the database of the documents
+	DB string
+	// Type is a value of the document type, e.g. Order{}
+	Type any
+	// BasePath is where the handler is mounted, e.g. "/orders", used for Location and OpenAPI
+	BasePath string
+	// TypeField and TypeValue mark the documents of this type, e.g. "type" and "order".
+	// Lists only return documents of the type and writes set the field.
+	TypeField string
+	TypeValue string
+	// Query is the allow list of list filters, see QuerySchema
+	Query *QuerySchema
+	// NewID creates ids for POST, default random hex
+	NewID func() string
+	// MaxBodyBytes is the size limit of request bodies, larger ones are answered with 413.
+	// Default 1 MiB.
+	MaxBodyBytes int64
+}
+
+// CRUDHandler is a http.Handler with REST routes for one document type:
+//
+//	GET    /       list, filtered by Query, paged by limit and bookmark
+//	POST   /       create
+//	GET    /{id}   read, ETag is the revision
+//	PUT    /{id}   replace, If-Match is the revision
+//	PATCH  /{id}   JSON merge patch, If-Match is optional
+//	DELETE /{id}   delete, If-Match is the revision
+//
+// Mount it with http.StripPrefix(BasePath, h).
+type CRUDHandler struct {
+	api  *CouchDBAPI
+	opts CRUDOptions
+	typ  reflect.Type
+}
+
+// NewCRUDHandler returns the REST handler of one document type
+func NewCRUDHandler(api *CouchDBAPI, opts CRUDOptions) *CRUDHandler {
+	typ := reflect.TypeOf(opts.Type)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if opts.NewID == nil {
+		opts.NewID = func() string {
+			b := make([]byte, 16)
+			rand.Read(b)
+			return hex.EncodeToString(b)
+		}
+	}
+	if opts.Query == nil {
+		opts.Query = &QuerySchema{}
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = 1 << 20
+	}
+	return &CRUDHandler{api: api, opts: opts, typ: typ}
+}
+
+func (h *CRUDHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, err := url.PathUnescape(strings.Trim(r.URL.Path, "/"))
+	if err != nil || strings.Contains(id, "/") || strings.HasPrefix(id, "_") {
+		writeJSONError(w, http.StatusNotFound, "not_found", "no such resource")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, h.opts.MaxBodyBytes)
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		h.list(w, r)
+	case id == "" && r.Method == http.MethodPost:
+		h.write(w, r, h.opts.NewID(), "", nil, nil)
+	case id != "" && r.Method == http.MethodGet:
+		h.get(w, r, id)
+	case id != "" && r.Method == http.MethodPut:
+		rev := ifMatch(r)
+		var current json.RawMessage
+		if rev != "" {
+			var ok bool
+			if current, ok = h.load(w, r, id); !ok {
+				return
+			}
+		}
+		h.write(w, r, id, rev, current, nil)
+	case id != "" && r.Method == http.MethodPatch:
+		h.patch(w, r, id)
+	case id != "" && r.Method == http.MethodDelete:
+		h.delete(w, r, id)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" is not allowed")
+	}
+}
+
+func (h *CRUDHandler) list(w http.ResponseWriter, r *http.Request) {
+	schema := *h.opts.Query
+	if h.opts.TypeField != "" {
+		base := map[string]any{h.opts.TypeField: h.opts.TypeValue}
+		for k, v := range h.opts.Query.Base {
+			base[k] = v
+		}
+		schema.Base = base
+	}
+	q, err := schema.Parse(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	res, err := h.api.Find(r.Context(), h.opts.DB, q)
+	if err != nil {
+		writeCouchError(w, err, false)
+		return
+	}
+	items := make([]json.RawMessage, 0, len(res.Docs))
+	for _, doc := range res.Docs {
+		shaped, err := h.shape(doc)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal", err.Error())
+			return
+		}
+		items = append(items, shaped)
+	}
+	body := map[string]any{"items": items}
+	if len(res.Docs) == q.Limit {
+		body["bookmark"] = res.Bookmark
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (h *CRUDHandler) get(w http.ResponseWriter, r *http.Request, id string) {
+	doc, ok := h.load(w, r, id)
+	if !ok {
+		return
+	}
+	_, rev := docIDRev(doc)
+	shaped, err := h.shape(doc)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	w.Header().Set("ETag", `"`+rev+`"`)
+	writeJSON(w, http.StatusOK, shaped)
+}
+
+// load reads a document of this type, documents of other types are not found
+func (h *CRUDHandler) load(w http.ResponseWriter, r *http.Request, id string) (json.RawMessage, bool) {
+	var doc json.RawMessage
+	if err := h.api.GetDoc(r.Context(), h.opts.DB, id, &doc); err != nil {
+		writeCouchError(w, err, false)
+		return nil, false
+	}
+	if h.opts.TypeField != "" {
+		if v, _ := lookupField(doc, h.opts.TypeField); joinKey(v) != joinKey(mustJSON(h.opts.TypeValue)) {
+			writeJSONError(w, http.StatusNotFound, "not_found", "missing")
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// write validates the body (or patched, if given) as the document type and stores it.
+// A replaced document keeps the attachments of current.
+func (h *CRUDHandler) write(w http.ResponseWriter, r *http.Request, id, rev string, current json.RawMessage, patched map[string]any) {
+	doc := patched
+	if doc == nil {
+		var err error
+		if doc, err = h.decode(r); err != nil {
+			writeWriteError(w, err)
+			return
+		}
+		if atts, ok := lookupField(current, "_attachments"); ok {
+			doc["_attachments"] = atts
+		}
+	}
+	created := r.Method == http.MethodPost
+	if r.Method == http.MethodPut && rev == "" {
+		// PUT without If-Match only creates
+		var existing json.RawMessage
+		if err := h.api.GetDoc(r.Context(), h.opts.DB, id, &existing); err == nil {
+			writeJSONError(w, http.StatusPreconditionRequired, "precondition_required", "If-Match is required to replace a document")
+			return
+		}
+		created = true
+	}
+	doc["_id"] = id
+	delete(doc, "_rev")
+	if rev != "" {
+		doc["_rev"] = rev
+	}
+	if h.opts.TypeField != "" {
+		doc[h.opts.TypeField] = h.opts.TypeValue
+	}
+	newRev, err := h.api.PutDoc(r.Context(), h.opts.DB, id, doc)
+	if err != nil {
+		writeCouchError(w, err, rev != "")
+		return
+	}
+	doc["_rev"] = newRev
+	shaped, err := h.shape(mustJSON(doc))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	w.Header().Set("ETag", `"`+newRev+`"`)
+	status := http.StatusOK
+	if created {
+		w.Header().Set("Location", strings.TrimRight(h.opts.BasePath, "/")+"/"+url.PathEscape(id))
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, shaped)
+}
+
+func (h *CRUDHandler) patch(w http.ResponseWriter, r *http.Request, id string) {
+	current, ok := h.load(w, r, id)
+	if !ok {
+		return
+	}
+	_, rev := docIDRev(current)
+	if m := ifMatch(r); m != "" && m != rev {
+		writeJSONError(w, http.StatusPreconditionFailed, "precondition_failed", "the document was changed")
+		return
+	}
+	var patch any
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeWriteError(w, bodyError(err))
+		return
+	}
+	p, ok := patch.(map[string]any)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "the patch must be an object")
+		return
+	}
+	// the fields of Couchdb, like _attachments and _deleted, cannot be patched
+	for k := range p {
+		if strings.HasPrefix(k, "_") {
+			delete(p, k)
+		}
+	}
+	var doc any
+	json.Unmarshal(current, &doc)
+	merged := mergePatch(doc, p).(map[string]any)
+	if err := h.validate(mustJSON(merged)); err != nil {
+		writeWriteError(w, err)
+		return
+	}
+	h.write(w, r, id, rev, nil, merged)
+}
+
+func (h *CRUDHandler) delete(w http.ResponseWriter, r *http.Request, id string) {
+	rev := ifMatch(r)
+	if rev == "" {
+		writeJSONError(w, http.StatusPreconditionRequired, "precondition_required", "If-Match is required to delete a document")
+		return
+	}
+	if _, ok := h.load(w, r, id); !ok {
+		return
+	}
+	if _, err := h.api.DeleteDoc(r.Context(), h.opts.DB, id, rev); err != nil {
+		writeCouchError(w, err, true)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// badRequest is an error of a body that is no JSON object, it is answered with 400
+type badRequest string
+
+func (e badRequest) Error() string {
+	return string(e)
+}
+
+// errBodyTooLarge is answered with 413
+var errBodyTooLarge = errors.New("the request body is too large")
+
+// bodyError returns the error of reading a request body. The error of http.MaxBytesReader
+// has no type before Go 1.19, so it is recognized by its text.
+func bodyError(err error) error {
+	if strings.Contains(err.Error(), "request body too large") {
+		return errBodyTooLarge
+	}
+	return badRequest("invalid JSON: " + err.Error())
+}
+
+// decode reads the body into the document type and returns it as map. The fields of
+// Couchdb (starting with an underscore) cannot be set by the client.
+func (h *CRUDHandler) decode(r *http.Request) (map[string]any, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return nil, bodyError(err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(raw, &doc); err != nil || doc == nil {
+		return nil, badRequest("the document must be an object")
+	}
+	if err := h.validate(raw); err != nil {
+		return nil, err
+	}
+	for k := range doc {
+		if strings.HasPrefix(k, "_") {
+			delete(doc, k)
+		}
+	}
+	return doc, nil
+}
+
+// validate decodes raw strictly into the document type and runs its Validator
+func (h *CRUDHandler) validate(raw json.RawMessage) error {
+	v := reflect.New(h.typ)
+	dec := json.NewDecoder(strings.NewReader(string(stripMeta(raw, h.opts.TypeField))))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v.Interface()); err != nil {
+		return ValidationErrors{{Field: jsonErrorField(err), Message: err.Error()}}
+	}
+	if val, ok := v.Interface().(Validator); ok {
+		return val.Validate()
+	}
+	return nil
+}
+
+// shape returns a stored document as the document type sees it, plus _id and _rev
+func (h *CRUDHandler) shape(raw json.RawMessage) (json.RawMessage, error) {
+	v := reflect.New(h.typ)
+	if err := json.Unmarshal(raw, v.Interface()); err != nil {
+		return nil, err
+	}
+	var out map[string]any
+	if err := json.Unmarshal(mustJSON(v.Interface()), &out); err != nil {
+		return nil, err
+	}
+	id, rev := docIDRev(raw)
+	out["_id"], out["_rev"] = id, rev
+	return mustJSON(out), nil
+}
+
+// stripMeta removes the fields of Couchdb, like _id, _rev and _attachments, and the type
+// field before strict decoding
+func stripMeta(raw json.RawMessage, typeField string) json.RawMessage {
+	var doc map[string]json.RawMessage
+	if json.Unmarshal(raw, &doc) != nil {
+		return raw
+	}
+	for k := range doc {
+		if strings.HasPrefix(k, "_") {
+			delete(doc, k)
+		}
+	}
+	if typeField != "" {
+		delete(doc, typeField)
+	}
+	return mustJSON(doc)
+}
+
+func jsonErrorField(err error) string {
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		return te.Field
+	}
+	if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+		return strings.Trim(strings.TrimPrefix(msg, "json: unknown field "), `"`)
+	}
+	return ""
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386)
+func mergePatch(doc, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]any)
+	if !ok {
+		d = map[string]any{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+		} else {
+			d[k] = mergePatch(d[k], v)
+		}
+	}
+	return d
+}
+
+func ifMatch(r *http.Request) string {
+	return strings.Trim(strings.TrimPrefix(r.Header.Get("If-Match"), "W/"), `"`)
+}
+
+func mustJSON(v any) json.RawMessage {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, name, reason string) {
+	writeJSON(w, status, map[string]string{"error": name, "reason": reason})
+}
+
+func writeWriteError(w http.ResponseWriter, err error) {
+	if e, ok := err.(badRequest); ok {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", e.Error())
+		return
+	}
+	if err == errBodyTooLarge {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "too_large", err.Error())
+		return
+	}
+	var verrs ValidationErrors
+	if errors.As(err, &verrs) {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"error": "validation", "fields": verrs})
+		return
+	}
+	writeJSONError(w, http.StatusUnprocessableEntity, "validation", err.Error())
+}
+
+// writeCouchError maps errors of Couchdb to answers, a conflict of a conditional
+// request is a failed precondition
+func writeCouchError(w http.ResponseWriter, err error, conditional bool) {
+	var e *Error
+	if !errors.As(err, &e) {
+		writeJSONError(w, http.StatusBadGateway, "bad_gateway", err.Error())
+		return
+	}
+	switch {
+	case e.StatusCode == http.StatusConflict && conditional:
+		writeJSONError(w, http.StatusPreconditionFailed, "precondition_failed", "the document was changed")
+	case e.StatusCode == http.StatusBadRequest && conditional && strings.Contains(e.Reason, "rev"):
+		writeJSONError(w, http.StatusPreconditionFailed, "precondition_failed", "invalid If-Match")
+	case e.StatusCode < 500:
+		writeJSONError(w, e.StatusCode, e.ErrorName, e.Reason)
+	default:
+		writeJSONError(w, http.StatusBadGateway, e.ErrorName, e.Reason)
+	}
+}
+
+// OpenAPI returns the OpenAPI 3 path items and the schemas of the handler by name, the
+// schema of the document type and of the named struct types it contains
+func (h *CRUDHandler) OpenAPI() (paths map[string]any, schemas map[string]any) {
+	name := h.typ.Name()
+	ref := map[string]any{"$ref": "#/components/schemas/" + name}
+	errRef := map[string]any{"$ref": "#/components/schemas/Error"}
+	response := func(desc string, s any) map[string]any {
+		r := map[string]any{"description": desc}
+		if s != nil {
+			r["content"] = map[string]any{"application/json": map[string]any{"schema": s}}
+		}
+		return r
+	}
+	body := map[string]any{"required": true, "content": map[string]any{"application/json": map[string]any{"schema": ref}}}
+	idParam := map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}
+	ifMatchParam := map[string]any{"name": "If-Match", "in": "header", "schema": map[string]any{"type": "string"}}
+	var listParams []any
+	for _, f := range h.opts.Query.Fields {
+		listParams = append(listParams, map[string]any{"name": f.Name, "in": "query", "schema": map[string]any{"type": openAPIQueryType(f.Type)}})
+		for _, op := range f.Operators {
+			listParams = append(listParams, map[string]any{"name": f.Name + "[" + op + "]", "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+	}
+	for _, p := range []string{"sort", "fields", "bookmark"} {
+		listParams = append(listParams, map[string]any{"name": p, "in": "query", "schema": map[string]any{"type": "string"}})
+	}
+	listParams = append(listParams, map[string]any{"name": "limit", "in": "query", "schema": map[string]any{"type": "integer"}})
+	base := strings.TrimRight(h.opts.BasePath, "/")
+	paths = map[string]any{
+		base: map[string]any{
+			"get": map[string]any{
+				"summary":    "List " + name,
+				"parameters": listParams,
+				"responses": map[string]any{
+					"200": response("list", map[string]any{"type": "object", "properties": map[string]any{
+						"items":    map[string]any{"type": "array", "items": ref},
+						"bookmark": map[string]any{"type": "string"},
+					}}),
+					"400": response("invalid filter", errRef),
+				},
+			},
+			"post": map[string]any{
+				"summary":     "Create " + name,
+				"requestBody": body,
+				"responses":   map[string]any{"201": response("created", ref), "400": response("invalid JSON", errRef), "413": response("body too large", errRef), "422": response("validation failed", nil)},
+			},
+		},
+		base + "/{id}": map[string]any{
+			"parameters": []any{idParam},
+			"get": map[string]any{
+				"summary":   "Get " + name,
+				"responses": map[string]any{"200": response("found", ref), "404": response("not found", errRef)},
+			},
+			"put": map[string]any{
+				"summary":     "Replace " + name,
+				"parameters":  []any{ifMatchParam},
+				"requestBody": body,
+				"responses":   map[string]any{"200": response("replaced", ref), "201": response("created", ref), "400": response("invalid JSON", errRef), "412": response("changed meanwhile", errRef), "413": response("body too large", errRef), "422": response("validation failed", nil)},
+			},
+			"patch": map[string]any{
+				"summary":     "Patch " + name,
+				"parameters":  []any{ifMatchParam},
+				"requestBody": map[string]any{"required": true, "content": map[string]any{"application/merge-patch+json": map[string]any{"schema": map[string]any{"type": "object"}}}},
+				"responses":   map[string]any{"200": response("patched", ref), "400": response("invalid JSON", errRef), "412": response("changed meanwhile", errRef), "413": response("body too large", errRef), "422": response("validation failed", nil)},
+			},
+			"delete": map[string]any{
+				"summary":    "Delete " + name,
+				"parameters": []any{ifMatchParam},
+				"responses":  map[string]any{"204": response("deleted", nil), "412": response("changed meanwhile", errRef)},
+			},
+		},
+	}
+	schemas = map[string]any{}
+	schema := jsonSchemaOf(h.typ, schemas)
+	if _, isRef := schema["$ref"]; isRef {
+		schema = schemas[name].(map[string]any)
+	}
+	if props, ok := schema["properties"].(map[string]any); ok {
+		props["_id"] = map[string]any{"type": "string", "readOnly": true}
+		props["_rev"] = map[string]any{"type": "string", "readOnly": true}
+	}
+	schemas[name] = schema
+	return paths, schemas
+}
+
+// OpenAPIDocument combines the routes of handlers into one OpenAPI 3 document
+func OpenAPIDocument(title, version string, handlers ...*CRUDHandler) map[string]any {
+	paths := map[string]any{}
+	schemas := map[string]any{
+		"Error": map[string]any{"type": "object", "properties": map[string]any{
+			"error":  map[string]any{"type": "string"},
+			"reason": map[string]any{"type": "string"},
+		}},
+	}
+	for _, h := range handlers {
+		p, s := h.OpenAPI()
+		for k, v := range p {
+			paths[k] = v
+		}
+		for name, schema := range s {
+			schemas[name] = schema
+		}
+	}
+	return map[string]any{
+		"openapi":    "3.0.3",
+		"info":       map[string]any{"title": title, "version": version},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas},
+	}
+}
+
+func openAPIQueryType(t QueryType) string {
+	switch t {
+	case QueryNumber:
+		return "number"
+	case QueryBool:
+		return "boolean"
+	}
+	return "string"
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchemaOf describes a Go type as JSON schema, following the json tags. Named struct
+// types are added to schemas and referenced with $ref, so recursive types end.
+func jsonSchemaOf(t reflect.Type, schemas map[string]any) map[string]any {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			// the entry is set before the fields are described, a cycle ends at the $ref
+			schemas[t.Name()] = map[string]any{}
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// structSchema describes the fields of a struct. The fields of embedded structs without
+// a json name are merged like encoding/json does, fields of the outer struct win.
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	props := map[string]any{}
+	var required []string
+	var embedded []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, hasTag := f.Tag.Lookup("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded = append(embedded, f)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if !hasTag || name == "" {
+			name = f.Name
+		}
+		if name == "_id" || name == "_rev" {
+			continue
+		}
+		props[name] = jsonSchemaOf(f.Type, schemas)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+	for _, f := range embedded {
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		inner := structSchema(ft, schemas)
+		innerProps := inner["properties"].(map[string]any)
+		innerRequired, _ := inner["required"].([]string)
+		// the fields of a nil embedded pointer are left out
+		for _, name := range innerRequired {
+			if _, ok := props[name]; !ok && f.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+		for name, prop := range innerProps {
+			if _, ok := props[name]; !ok {
+				props[name] = prop
+			}
+		}
+	}
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
@@ -0,0 +1,228 @@
+package golangcouchdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testOrder struct {
+	Item string `json:"item"`
+	Qty  int    `json:"qty"`
+}
+
+func (o testOrder) Validate() error {
+	if o.Qty <= 0 {
+		return ValidationErrors{{Field: "qty", Message: "must be positive"}}
+	}
+	return nil
+}
+
+func TestCRUDHandler(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"user1","type":"user","item":"x","qty":1}`)
+	n := 0
+	h := NewCRUDHandler(api, CRUDOptions{DB: "db", Type: testOrder{}, BasePath: "/orders", TypeField: "type", TypeValue: "order",
+		Query: &QuerySchema{Fields: []QueryField{{Name: "item"}}},
+		NewID: func() string { n++; return fmt.Sprintf("o%d", n) }, MaxBodyBytes: 100})
+	rev := func(id string) string {
+		if doc := fc.doc("db", id); doc != nil {
+			return doc["_rev"].(string)
+		}
+		return ""
+	}
+	tests := []struct {
+		name, method, path, body string
+		ifMatch                  string // "current" for the current revision of o1
+		want                     int
+		check                    func(t *testing.T, rec *httptest.ResponseRecorder)
+	}{
+		{"create", "POST", "/", `{"item":"a","qty":1}`, "", 201, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			if loc := rec.Header().Get("Location"); loc != "/orders/o1" {
+				t.Errorf("Location %q", loc)
+			}
+			if fc.doc("db", "o1")["type"] != "order" {
+				t.Error("type field not set")
+			}
+		}},
+		{"invalid JSON", "POST", "/", `{"item":`, "", 400, nil},
+		{"not an object", "POST", "/", `[1]`, "", 400, nil},
+		{"unknown field", "POST", "/", `{"item":"a","qty":1,"color":"red"}`, "", 422, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			if !strings.Contains(rec.Body.String(), `"field":"color"`) {
+				t.Errorf("body %s", rec.Body)
+			}
+		}},
+		{"validator", "POST", "/", `{"item":"a","qty":0}`, "", 422, nil},
+		{"couchdb fields are dropped", "POST", "/", `{"item":"b","qty":1,"_deleted":true}`, "", 201, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			if fc.doc("db", "o6") == nil {
+				t.Error("document o6 was not created")
+			}
+		}},
+		{"get", "GET", "/o1", "", "", 200, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			if rec.Header().Get("ETag") != `"`+rev("o1")+`"` {
+				t.Errorf("ETag %s", rec.Header().Get("ETag"))
+			}
+		}},
+		{"other type", "GET", "/user1", "", "", 404, nil},
+		{"missing", "GET", "/nope", "", "", 404, nil},
+		{"reserved id", "GET", "/_all_docs", "", "", 404, nil},
+		{"replace needs If-Match", "PUT", "/o1", `{"item":"a","qty":2}`, "", 428, nil},
+		{"replace stale", "PUT", "/o1", `{"item":"a","qty":2}`, "1-stale", 412, nil},
+		{"replace keeps attachments", "PUT", "/o1", `{"item":"a","qty":2}`, "current", 200, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			if _, ok := fc.doc("db", "o1")["_attachments"]; !ok {
+				t.Error("attachments lost")
+			}
+		}},
+		{"patch with attachments", "PATCH", "/o1", `{"qty":3}`, "", 200, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			doc := fc.doc("db", "o1")
+			if doc["qty"] != 3.0 || doc["_attachments"] == nil {
+				t.Errorf("patched %v", doc)
+			}
+		}},
+		{"patch invalid JSON", "PATCH", "/o1", `{`, "", 400, nil},
+		{"patch not an object", "PATCH", "/o1", `3`, "", 400, nil},
+		{"patch validation", "PATCH", "/o1", `{"qty":-1}`, "", 422, nil},
+		{"patch stale", "PATCH", "/o1", `{"qty":4}`, "1-stale", 412, nil},
+		{"patch cannot delete", "PATCH", "/o1", `{"_deleted":true,"qty":4}`, "", 200, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			if fc.doc("db", "o1") == nil {
+				t.Error("patch deleted the document")
+			}
+		}},
+		{"body too large", "POST", "/", `{"item":"` + strings.Repeat("x", 100) + `","qty":1}`, "", 413, nil},
+		{"patch too large", "PATCH", "/o1", `{"item":"` + strings.Repeat("x", 100) + `"}`, "", 413, nil},
+		{"list", "GET", "/?item=a", "", "", 200, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			var body struct {
+				Items []map[string]any `json:"items"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &body)
+			if len(body.Items) != 1 || body.Items[0]["_id"] != "o1" {
+				t.Errorf("items %v", body.Items)
+			}
+		}},
+		{"list filter not allowed", "GET", "/?qty=1", "", "", 400, nil},
+		{"delete needs If-Match", "DELETE", "/o1", "", "", 428, nil},
+		{"delete", "DELETE", "/o1", "", "current", 204, nil},
+		{"method", "POST", "/o2", "", "", 405, nil},
+	}
+	for _, tt := range tests {
+		if tt.name == "replace keeps attachments" {
+			// an attachment added beside the handler
+			req := httptest.NewRequest("PUT", "/db/o1/a.txt?rev="+rev("o1"), strings.NewReader("hello"))
+			fc.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.ifMatch == "current" {
+			req.Header.Set("If-Match", `"`+rev("o1")+`"`)
+		} else if tt.ifMatch != "" {
+			req.Header.Set("If-Match", tt.ifMatch)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+			continue
+		}
+		if tt.check != nil {
+			tt.check(t, rec)
+		}
+	}
+}
+
+type testNode struct {
+	Name     string     `json:"name"`
+	Children []testNode `json:"children,omitempty"`
+	Parent   *testNode  `json:"parent"`
+}
+
+type testBase struct {
+	Created string `json:"created"`
+	Note    string `json:"note,omitempty"`
+	Item    int    `json:"item"`
+}
+
+type testMeta struct {
+	Tags []string `json:"tags"`
+}
+
+type testEmbedding struct {
+	testBase
+	*testMeta
+	Item  string   `json:"item,omitempty"`
+	Named testMeta `json:"named"`
+}
+
+func TestCRUDOpenAPI(t *testing.T) {
+	tests := []struct {
+		typ  any
+		name string
+		want string // schemas as JSON
+	}{
+		{testOrder{}, "testOrder", `{"testOrder":{"properties":{"_id":{"readOnly":true,"type":"string"},"_rev":{"readOnly":true,"type":"string"},` +
+			`"item":{"type":"string"},"qty":{"type":"integer"}},"required":["item","qty"],"type":"object"}}`},
+		{map[string]any{}, "", `{"":{"additionalProperties":{},"type":"object"}}`},
+		{testNode{}, "testNode", `{"testNode":{"properties":{"_id":{"readOnly":true,"type":"string"},"_rev":{"readOnly":true,"type":"string"},` +
+			`"children":{"items":{"$ref":"#/components/schemas/testNode"},"type":"array"},"name":{"type":"string"},` +
+			`"parent":{"$ref":"#/components/schemas/testNode"}},"required":["name"],"type":"object"}}`},
+		{testEmbedding{}, "testEmbedding", `{"testEmbedding":{"properties":{"_id":{"readOnly":true,"type":"string"},"_rev":{"readOnly":true,"type":"string"},` +
+			`"created":{"type":"string"},"item":{"type":"string"},"named":{"$ref":"#/components/schemas/testMeta"},` +
+			`"note":{"type":"string"},"tags":{"items":{"type":"string"},"type":"array"}},"required":["named","created"],"type":"object"},` +
+			`"testMeta":{"properties":{"tags":{"items":{"type":"string"},"type":"array"}},"required":["tags"],"type":"object"}}`},
+	}
+	for _, tt := range tests {
+		h := NewCRUDHandler(&CouchDBAPI{}, CRUDOptions{DB: "db", Type: tt.typ, BasePath: "/things"})
+		paths, schemas := h.OpenAPI()
+		if _, ok := paths["/things/{id}"]; !ok {
+			t.Errorf("%T: paths %v", tt.typ, paths)
+		}
+		if got := string(mustJSON(schemas)); got != tt.want {
+			t.Errorf("%T: schemas\n%s\nwant\n%s", tt.typ, got, tt.want)
+		}
+	}
+	doc := OpenAPIDocument("api", "1", NewCRUDHandler(&CouchDBAPI{}, CRUDOptions{Type: testNode{}, BasePath: "/nodes"}))
+	schemas := doc["components"].(map[string]any)["schemas"].(map[string]any)
+	if schemas["Error"] == nil || schemas["testNode"] == nil {
+		t.Errorf("schemas %v", schemas)
+	}
+	if _, err := json.Marshal(doc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct{ doc, patch, want string }{
+		{`{"a":1}`, `{"b":2}`, `{"a":1,"b":2}`},
+		{`{"a":1,"b":2}`, `{"a":null}`, `{"b":2}`},
+		{`{"a":{"x":1,"y":2}}`, `{"a":{"y":null,"z":3}}`, `{"a":{"x":1,"z":3}}`},
+		{`{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{`{"a":1}`, `{"a":{"b":1}}`, `{"a":{"b":1}}`},
+	}
+	for _, tt := range tests {
+		var doc, patch any
+		json.Unmarshal([]byte(tt.doc), &doc)
+		json.Unmarshal([]byte(tt.patch), &patch)
+		if got := string(mustJSON(mergePatch(doc, patch))); got != tt.want {
+			t.Errorf("mergePatch(%s, %s) = %s, want %s", tt.doc, tt.patch, got, tt.want)
+		}
+	}
+}
+
+func TestWriteWriteError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{badRequest("invalid JSON"), 400},
+		{ValidationErrors{{Field: "a", Message: "b"}}, 422},
+		{errors.New("custom"), 422},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		writeWriteError(rec, tt.err)
+		if rec.Code != tt.want {
+			t.Errorf("%v: status %d, want %d", tt.err, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Seq is an update sequence of Couchdb, old versions send numbers, new versions strings
+type Seq string
+
+// UnmarshalJSON accepts numbers and strings
+func (s *Seq) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*s = Seq(str)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*s = Seq(n.String())
+	return nil
+}
+
+// Number returns the numeric prefix of the sequence, "42-g1AAAA" gives 42
+func (s Seq) Number() int64 {
+	str := string(s)
+	for i, r := range str {
+		if r < '0' || r > '9' {
+			str = str[:i]
+			break
+		}
+	}
+	n, _ := strconv.ParseInt(str, 10, 64)
+	return n
+}
+
+// DBInfo is the answer of GET /{db}
+type DBInfo struct {
+	DBName         string `json:"db_name"`
+	UpdateSeq      Seq    `json:"update_seq"`
+	PurgeSeq       Seq    `json:"purge_seq"`
+	DocCount       int64  `json:"doc_count"`
+	DocDelCount    int64  `json:"doc_del_count"`
+	CompactRunning bool   `json:"compact_running"`
+	Sizes          struct {
+		File     int64 `json:"file"`
+		External int64 `json:"external"`
+		Active   int64 `json:"active"`
+	} `json:"sizes"`
+}
+
+// DBInfo returns the information of a database
+func (c *CouchDBAPI) DBInfo(ctx context.Context, db string) (*DBInfo, error) {
+	var info DBInfo
+	if err := c.doJSON(ctx, http.MethodGet, dbPath(db), nil, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// CreateDB creates a database
+func (c *CouchDBAPI) CreateDB(ctx context.Context, db string) error {
+	return c.doJSON(ctx, http.MethodPut, dbPath(db), nil, nil, nil)
+}
+
+// DeleteDB deletes a database
+func (c *CouchDBAPI) DeleteDB(ctx context.Context, db string) error {
+	return c.doJSON(ctx, http.MethodDelete, dbPath(db), nil, nil, nil)
+}
+
+// AllDBs returns the names of all databases
+func (c *CouchDBAPI) AllDBs(ctx context.Context) ([]string, error) {
+	var dbs []string
+	if err := c.doJSON(ctx, http.MethodGet, "_all_dbs", nil, nil, &dbs); err != nil {
+		return nil, err
+	}
+	return dbs, nil
+}
+
+// SecurityGroup are the names and roles of admins or members of a database
+type SecurityGroup struct {
+	Names []string `json:"names"`
+	Roles []string `json:"roles"`
+}
+
+// Security is the security object of a database
+type Security struct {
+	Admins  SecurityGroup `json:"admins"`
+	Members SecurityGroup `json:"members"`
+}
+
+// IsPublic reports whether everybody may read the database
+func (s Security) IsPublic() bool {
+	return len(s.Members.Names) == 0 && len(s.Members.Roles) == 0
+}
+
+// GetSecurity returns the security object of a database
+func (c *CouchDBAPI) GetSecurity(ctx context.Context, db string) (*Security, error) {
+	var sec Security
+	if err := c.doJSON(ctx, http.MethodGet, dbPath(db)+"/_security", nil, nil, &sec); err != nil {
+		return nil, err
+	}
+	return &sec, nil
+}
+
+// PutSecurity replaces the security object of a database
+func (c *CouchDBAPI) PutSecurity(ctx context.Context, db string, sec Security) error {
+	return c.doJSON(ctx, http.MethodPut, dbPath(db)+"/_security", nil, sec, nil)
+}
+
+// Index is a mango index of a database
+type Index struct {
+	DDoc string          `json:"ddoc"`
+	Name string          `json:"name"`
+	Type string          `json:"type"`
+	Def  json.RawMessage `json:"def"`
+}
+
+// Indexes returns the mango indexes of a database, the special _all_docs index included
+func (c *CouchDBAPI) Indexes(ctx context.Context, db string) ([]Index, error) {
+	var res struct {
+		Indexes []Index `json:"indexes"`
+	}
+	if err := c.doJSON(ctx, http.MethodGet, dbPath(db)+"/_index", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Indexes, nil
+}
+
+// RevsLimit returns the number of revisions a database keeps per document
+func (c *CouchDBAPI) RevsLimit(ctx context.Context, db string) (int, error) {
+	var limit int
+	err := c.doJSON(ctx, http.MethodGet, dbPath(db)+"/_revs_limit", nil, nil, &limit)
+	return limit, err
+}
@@ -0,0 +1,281 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DeployMeta describes who deployed a design document from which commit
+type DeployMeta struct {
+	GitSHA   string    `json:"git_sha,omitempty"`
+	Deployer string    `json:"deployer,omitempty"`
+	Time     time.Time `json:"time"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// DesignVersion is an archived version of a design document
+type DesignVersion struct {
+	ID      string          `json:"_id"`
+	Rev     string          `json:"_rev,omitempty"`
+	DB      string          `json:"db"`
+	DDoc    string          `json:"ddoc"`
+	Version int             `json:"version"`
+	Doc     json.RawMessage `json:"doc"`
+	Meta    DeployMeta      `json:"meta"`
+	// Status is VersionPending while the version is written to db, empty once it is live
+	Status string `json:"status,omitempty"`
+}
+
+// VersionPending is the Status of a version archived before its write to the database. It
+// stays if the process stops during the deploy, the version may be live or not.
+const VersionPending = "pending"
+
+// DesignHistory deploys design documents and keeps every deployed version in a history
+// database, so old versions can be compared and rolled back.
+type DesignHistory struct {
+	API *CouchDBAPI
+	// HistoryDB is created on the first deploy, default "ddoc_history"
+	HistoryDB string
+	// WarmUp builds the indexes of a new version under a temporary id before it replaces
+	// the live design document, so queries never wait for an index build
+	WarmUp bool
+}
+
+func (h *DesignHistory) historyDB() string {
+	if h.HistoryDB != "" {
+		return h.HistoryDB
+	}
+	return "ddoc_history"
+}
+
+func designName(ddoc string) string {
+	return strings.TrimPrefix(ddoc, "_design/")
+}
+
+// versionEscaper escapes the separator of the parts of a version id
+var versionEscaper = strings.NewReplacer("%", "%25", ":", "%3A")
+
+func versionPrefix(db, ddoc string) string {
+	return versionEscaper.Replace(db) + ":" + versionEscaper.Replace(designName(ddoc)) + ":"
+}
+
+func versionID(db, ddoc string, version int) string {
+	return fmt.Sprintf("%s%06d", versionPrefix(db, ddoc), version)
+}
+
+// Versions returns the archived versions of a design document, oldest first. The history
+// is read from the primary and not from CouchDBAPI.Cache, new versions are numbered by it.
+func (h *DesignHistory) Versions(ctx context.Context, db, ddoc string) ([]DesignVersion, error) {
+	prefix := versionPrefix(db, ddoc)
+	params := ViewParams{StartKey: prefix, EndKey: prefix + "\ufff0", IncludeDocs: true}
+	res, err := h.API.queryView(WithPrimary(ctx), dbPath(h.historyDB())+"/_all_docs", params)
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]DesignVersion, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		var v DesignVersion
+		if err := json.Unmarshal(row.Doc, &v); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// Version returns one archived version
+func (h *DesignHistory) Version(ctx context.Context, db, ddoc string, version int) (*DesignVersion, error) {
+	var v DesignVersion
+	if err := h.API.GetDoc(WithPrimary(ctx), h.historyDB(), versionID(db, ddoc, version), &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Deploy writes a design document to db. The live version is archived first if it is not
+// in the history yet (e.g. it was deployed by hand). The new version is archived with meta
+// as VersionPending, written and then marked live, so a live design document always has
+// its version. It returns the archived version of the new design document. A failed write
+// removes the pending version again.
+func (h *DesignHistory) Deploy(ctx context.Context, db string, ddoc any, meta DeployMeta) (*DesignVersion, error) {
+	doc, err := designDocMap(ddoc)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := doc["_id"].(string)
+	if !strings.HasPrefix(id, "_design/") {
+		return nil, fmt.Errorf("couchdb: design document id %q must start with _design/", id)
+	}
+	if meta.Time.IsZero() {
+		meta.Time = time.Now().UTC()
+	}
+	if err := h.ensureHistoryDB(ctx); err != nil {
+		return nil, err
+	}
+	versions, err := h.Versions(ctx, db, id)
+	if err != nil {
+		return nil, err
+	}
+	next := 1
+	var latest json.RawMessage
+	if len(versions) > 0 {
+		next = versions[len(versions)-1].Version + 1
+		latest = versions[len(versions)-1].Doc
+	}
+
+	var live map[string]any
+	err = h.API.GetDoc(ctx, db, id, &live)
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+	rev := ""
+	if live != nil {
+		rev, _ = live["_rev"].(string)
+		delete(live, "_rev")
+		liveJSON, _ := json.Marshal(live)
+		if len(diffJSON(liveJSON, latest)) > 0 {
+			if _, err := h.archive(ctx, db, id, next, liveJSON, DeployMeta{Deployer: "unknown", Time: meta.Time, Message: "found live, not deployed by history"}); err != nil {
+				return nil, err
+			}
+			next++
+		}
+	}
+
+	delete(doc, "_rev")
+	docJSON, _ := json.Marshal(doc)
+	if h.WarmUp {
+		cleanup, err := h.API.warmUpDesignDoc(ctx, db, doc)
+		if err != nil {
+			return nil, err
+		}
+		// the temporary design document keeps the indexes until the live one uses them
+		defer cleanup()
+	}
+	v := &DesignVersion{ID: versionID(db, id, next), DB: db, DDoc: designName(id), Version: next, Doc: docJSON, Meta: meta, Status: VersionPending}
+	if v.Rev, err = h.API.PutDoc(ctx, h.historyDB(), v.ID, v); err != nil {
+		return nil, err
+	}
+	if rev != "" {
+		doc["_rev"] = rev
+	}
+	if _, err := h.API.PutDoc(ctx, db, id, doc); err != nil {
+		h.API.DeleteDoc(detached{ctx}, h.historyDB(), v.ID, v.Rev)
+		return nil, err
+	}
+	// the design document is live, the version is marked with a context that is not canceled
+	v.Status = ""
+	if v.Rev, err = h.API.PutDoc(detached{ctx}, h.historyDB(), v.ID, v); err != nil {
+		v.Status = VersionPending
+		return v, fmt.Errorf("couchdb: version %d is live but still pending: %w", next, err)
+	}
+	return v, nil
+}
+
+// Rollback deploys an archived version again, it is archived as a new version
+func (h *DesignHistory) Rollback(ctx context.Context, db, ddoc string, version int, meta DeployMeta) (*DesignVersion, error) {
+	v, err := h.Version(ctx, db, ddoc, version)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Message == "" {
+		meta.Message = fmt.Sprintf("rollback to version %d", version)
+	}
+	return h.Deploy(ctx, db, v.Doc, meta)
+}
+
+// Diff compares two archived versions field by field
+func (h *DesignHistory) Diff(ctx context.Context, db, ddoc string, from, to int) ([]FieldDiff, error) {
+	a, err := h.Version(ctx, db, ddoc, from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := h.Version(ctx, db, ddoc, to)
+	if err != nil {
+		return nil, err
+	}
+	return diffJSON(a.Doc, b.Doc, "_rev"), nil
+}
+
+func (h *DesignHistory) archive(ctx context.Context, db, ddoc string, version int, doc json.RawMessage, meta DeployMeta) (*DesignVersion, error) {
+	v := &DesignVersion{
+		ID:      versionID(db, ddoc, version),
+		DB:      db,
+		DDoc:    designName(ddoc),
+		Version: version,
+		Doc:     doc,
+		Meta:    meta,
+	}
+	rev, err := h.API.PutDoc(ctx, h.historyDB(), v.ID, v)
+	if err != nil {
+		return nil, err
+	}
+	v.Rev = rev
+	return v, nil
+}
+
+func (h *DesignHistory) ensureHistoryDB(ctx context.Context) error {
+	err := h.API.CreateDB(ctx, h.historyDB())
+	if e, ok := err.(*Error); ok && e.StatusCode == http.StatusPreconditionFailed {
+		return nil
+	}
+	return err
+}
+
+func designDocMap(ddoc any) (map[string]any, error) {
+	data, ok := ddoc.(json.RawMessage)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(ddoc); err != nil {
+			return nil, err
+		}
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// warmUpDesignDoc writes doc under a temporary id and queries every view, so the indexes
+// are built when doc replaces the live design document. Indexes are shared by signature,
+// so the returned cleanup deletes the temporary design document only after the swap.
+func (c *CouchDBAPI) warmUpDesignDoc(ctx context.Context, db string, doc map[string]any) (func(), error) {
+	views, _ := doc["views"].(map[string]any)
+	if len(views) == 0 || doc["language"] == "query" {
+		return func() {}, nil
+	}
+	id, _ := doc["_id"].(string)
+	tmpID := id + "__warmup"
+	tmp := map[string]any{}
+	for k, v := range doc {
+		tmp[k] = v
+	}
+	tmp["_id"] = tmpID
+	delete(tmp, "_rev")
+	var old struct {
+		Rev string `json:"_rev"`
+	}
+	if err := c.GetDoc(ctx, db, tmpID, &old); err == nil {
+		tmp["_rev"] = old.Rev
+	}
+	rev, err := c.PutDoc(ctx, db, tmpID, tmp)
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() { c.DeleteDoc(detached{ctx}, db, tmpID, rev) }
+	reduce := false
+	for name := range views {
+		if _, err := c.View(ctx, db, tmpID, name, ViewParams{Limit: 1, Reduce: &reduce}); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+	return cleanup, nil
+}
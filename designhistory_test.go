@@ -0,0 +1,235 @@
+package golangcouchdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ddocWithMap(mapFn string) map[string]any {
+	return map[string]any{"_id": "_design/app", "views": map[string]any{"v": map[string]any{"map": mapFn}}}
+}
+
+func TestDesignHistory(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	h := &DesignHistory{API: api}
+	ctx := context.Background()
+	if _, err := h.Deploy(ctx, "db", ddocWithMap("v1"), DeployMeta{GitSHA: "a1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Deploy(ctx, "db", ddocWithMap("v2"), DeployMeta{GitSHA: "a2"}); err != nil {
+		t.Fatal(err)
+	}
+	// a change by hand is archived before the next deploy
+	live := fc.doc("db", "_design/app")
+	fc.put(t, "db", fmt.Sprintf(`{"_id":"_design/app","_rev":%q,"views":{"v":{"map":"manual"}}}`, live["_rev"]))
+	v, err := h.Deploy(ctx, "db", ddocWithMap("v3"), DeployMeta{GitSHA: "a3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != 4 {
+		t.Errorf("deployed version %d, want 4", v.Version)
+	}
+	versions, err := h.Versions(ctx, "db", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range versions {
+		got = append(got, fmt.Sprintf("%d %s %s", v.Version, v.Meta.GitSHA, v.Doc))
+	}
+	want := []string{
+		`1 a1 {"_id":"_design/app","views":{"v":{"map":"v1"}}}`,
+		`2 a2 {"_id":"_design/app","views":{"v":{"map":"v2"}}}`,
+		`3  {"_id":"_design/app","views":{"v":{"map":"manual"}}}`,
+		`4 a3 {"_id":"_design/app","views":{"v":{"map":"v3"}}}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("versions\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	diffs, err := h.Diff(ctx, "db", "app", 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].Path != "views.v.map" || diffs[0].Old != "v1" || diffs[0].New != "v3" {
+		t.Errorf("diff %+v", diffs)
+	}
+	if _, err := h.Rollback(ctx, "db", "app", 1, DeployMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if m := fc.doc("db", "_design/app")["views"]; !reflect.DeepEqual(m, ddocWithMap("v1")["views"]) {
+		t.Errorf("live after rollback: %v", m)
+	}
+}
+
+func TestDesignHistoryFailedDeploy(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	h := &DesignHistory{API: api}
+	fc.handle(http.MethodPut, "/db/_design/app", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusForbidden, "forbidden", "validation failed")
+	})
+	if _, err := h.Deploy(context.Background(), "db", ddocWithMap("v1"), DeployMeta{}); err == nil {
+		t.Fatal("deploy succeeded")
+	}
+	versions, err := h.Versions(context.Background(), "db", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 0 {
+		t.Errorf("failed deploy archived %d versions", len(versions))
+	}
+}
+
+func TestDesignHistoryWarmUp(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	var queried []string
+	fc.handle(http.MethodGet, "/db/_design/app__warmup/_view/", func(w http.ResponseWriter, r *http.Request) {
+		queried = append(queried, r.URL.Path)
+		writeJSON(w, http.StatusOK, ViewResult{Rows: []ViewRow{}})
+	})
+	var liveAtDelete any
+	fc.handle(http.MethodDelete, "/db/_design/app__warmup", func(w http.ResponseWriter, r *http.Request) {
+		if live := fc.doc("db", "_design/app"); live != nil {
+			liveAtDelete = live["views"]
+		}
+		fc.serve(w, r)
+	})
+	h := &DesignHistory{API: api, WarmUp: true}
+	if _, err := h.Deploy(context.Background(), "db", ddocWithMap("v1"), DeployMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(queried, []string{"/db/_design/app__warmup/_view/v"}) {
+		t.Errorf("queried %v", queried)
+	}
+	if !reflect.DeepEqual(liveAtDelete, ddocWithMap("v1")["views"]) {
+		t.Errorf("warm-up deleted before the swap, live was %v", liveAtDelete)
+	}
+	if fc.doc("db", "_design/app__warmup") != nil {
+		t.Error("warm-up design document left")
+	}
+}
+
+func TestDesignHistoryPendingVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		failDDoc   bool // the write of the design document fails
+		failMark   bool // marking the version live fails
+		wantErr    bool
+		wantStatus []string // status of the versions after the deploy
+	}{
+		{"deployed", false, false, false, []string{""}},
+		{"write fails", true, false, true, nil},
+		{"mark fails", false, true, true, []string{VersionPending}},
+	}
+	for _, tt := range tests {
+		fc, api := newFakeCouch(t, "db")
+		h := &DesignHistory{API: api}
+		if tt.failDDoc {
+			fc.handle(http.MethodPut, "/db/_design/app", func(w http.ResponseWriter, r *http.Request) {
+				writeJSONError(w, http.StatusForbidden, "forbidden", "validation failed")
+			})
+		}
+		if tt.failMark {
+			fc.handle(http.MethodPut, "/ddoc_history/", func(w http.ResponseWriter, r *http.Request) {
+				// the version is written as pending before the design document is live
+				if fc.doc("db", "_design/app") != nil {
+					writeJSONError(w, http.StatusServiceUnavailable, "unavailable", "down")
+					return
+				}
+				fc.serve(w, r)
+			})
+		}
+		v, err := h.Deploy(context.Background(), "db", ddocWithMap("v1"), DeployMeta{})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		versions, err := h.Versions(context.Background(), "db", "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status []string
+		for _, v := range versions {
+			status = append(status, v.Status)
+		}
+		if !reflect.DeepEqual(status, tt.wantStatus) {
+			t.Errorf("%s: status %q, want %q", tt.name, status, tt.wantStatus)
+		}
+		if tt.failDDoc {
+			continue
+		}
+		if v == nil || v.Version != 1 || v.Status != tt.wantStatus[0] {
+			t.Errorf("%s: deployed %+v", tt.name, v)
+		}
+		// the live design document is in the history and the next deploy follows it
+		v, err = h.Deploy(context.Background(), "db", ddocWithMap("v2"), DeployMeta{})
+		if tt.failMark {
+			fc.handle(http.MethodPut, "/ddoc_history/", fc.serve)
+			if _, err = h.Rollback(context.Background(), "db", "app", 1, DeployMeta{}); err != nil {
+				t.Errorf("%s: rollback: %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || v.Version != 2 {
+			t.Errorf("%s: next deploy %+v, %v", tt.name, v, err)
+		}
+	}
+}
+
+func TestDesignHistoryVersionIDs(t *testing.T) {
+	tests := []struct {
+		db, ddoc string
+		want     string
+	}{
+		{"db", "_design/app", "db:app:000001"},
+		{"a:b", "c", "a%3Ab:c:000001"},
+		{"a", "b:c", "a:b%3Ac:000001"},
+		{"a%3Ab", "c", "a%253Ab:c:000001"},
+	}
+	for _, tt := range tests {
+		if got := versionID(tt.db, tt.ddoc, 1); got != tt.want {
+			t.Errorf("versionID(%q, %q) = %s, want %s", tt.db, tt.ddoc, got, tt.want)
+		}
+	}
+
+	// versions of a:b/c and a/b:c are kept apart
+	_, api := newFakeCouch(t, "a:b", "a")
+	h := &DesignHistory{API: api}
+	ctx := context.Background()
+	for _, d := range []struct{ db, ddoc string }{{"a:b", "c"}, {"a", "b:c"}} {
+		if _, err := h.Deploy(ctx, d.db, map[string]any{"_id": "_design/" + d.ddoc}, DeployMeta{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []struct{ db, ddoc string }{{"a:b", "c"}, {"a", "b:c"}} {
+		versions, err := h.Versions(ctx, d.db, d.ddoc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 1 || versions[0].DB != d.db {
+			t.Errorf("versions of %s/%s: %+v", d.db, d.ddoc, versions)
+		}
+	}
+}
+
+func TestDesignHistoryCached(t *testing.T) {
+	// a cached history would number the second deploy 1 again
+	_, api := newFakeCouch(t, "db")
+	api.Cache = NewQueryCache(CacheConfig{SeqTTL: time.Hour})
+	h := &DesignHistory{API: api}
+	for i, mapFn := range []string{"v1", "v2", "v3"} {
+		if _, err := h.Versions(context.Background(), "db", "app"); err != nil {
+			t.Fatal(err)
+		}
+		v, err := h.Deploy(context.Background(), "db", ddocWithMap(mapFn), DeployMeta{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Version != i+1 {
+			t.Errorf("deploy %d numbered %d", i+1, v.Version)
+		}
+	}
+}
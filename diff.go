@@ -0,0 +1,118 @@
+package golangcouchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FieldDiff is a difference of one field between two JSON documents
+type FieldDiff struct {
+	Path string // dotted path, e.g. "views.by_date.map"
+	Old  string // JSON or the text of a string value, empty if added
+	New  string // empty if removed
+}
+
+// Unified returns the difference as a line diff
+func (d FieldDiff) Unified() string {
+	return fmt.Sprintf("--- %s\n+++ %s\n%s", d.Path, d.Path, diffLines(d.Old, d.New))
+}
+
+// diffJSON compares two JSON documents field by field. Fields in ignore (like _rev) are skipped.
+func diffJSON(a, b json.RawMessage, ignore ...string) []FieldDiff {
+	fa, fb := map[string]string{}, map[string]string{}
+	flattenJSON("", a, fa)
+	flattenJSON("", b, fb)
+	skip := map[string]bool{}
+	for _, f := range ignore {
+		skip[f] = true
+	}
+	paths := map[string]bool{}
+	for p := range fa {
+		paths[p] = true
+	}
+	for p := range fb {
+		paths[p] = true
+	}
+	var diffs []FieldDiff
+	for p := range paths {
+		if skip[p] || fa[p] == fb[p] {
+			continue
+		}
+		diffs = append(diffs, FieldDiff{Path: p, Old: fa[p], New: fb[p]})
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+	return diffs
+}
+
+// flattenJSON collects the leaves of a JSON document by their dotted path.
+// Strings are stored as their text, so functions of design documents diff by line.
+func flattenJSON(prefix string, raw json.RawMessage, out map[string]string) {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(raw, &obj) == nil && obj != nil {
+		for k, v := range obj {
+			p := k
+			if prefix != "" {
+				p = prefix + "." + k
+			}
+			flattenJSON(p, v, out)
+		}
+		return
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		out[prefix] = s
+		return
+	}
+	var v any
+	if json.Unmarshal(raw, &v) == nil {
+		data, _ := json.Marshal(v)
+		out[prefix] = string(data)
+	}
+}
+
+// diffLines is a small LCS line diff, lines are prefixed with " ", "-" or "+"
+func diffLines(a, b string) string {
+	la, lb := splitLines(a), splitLines(b)
+	// lcs[i][j] is the length of the common subsequence of la[i:] and lb[j:]
+	lcs := make([][]int, len(la)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(lb)+1)
+	}
+	for i := len(la) - 1; i >= 0; i-- {
+		for j := len(lb) - 1; j >= 0; j-- {
+			if la[i] == lb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(la) || j < len(lb) {
+		switch {
+		case i < len(la) && j < len(lb) && la[i] == lb[j]:
+			out.WriteString(" " + la[i] + "\n")
+			i++
+			j++
+		case j < len(lb) && (i == len(la) || lcs[i][j+1] >= lcs[i+1][j]):
+			out.WriteString("+" + lb[j] + "\n")
+			j++
+		default:
+			out.WriteString("-" + la[i] + "\n")
+			i++
+		}
+	}
+	return out.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,429 @@
+package golangcouchdb
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SyncMode decides how files are grouped into documents
+type SyncMode int
+
+const (
+	// SyncPerFile stores every file in a document of its own
+	SyncPerFile SyncMode = iota
+	// SyncPerDirectory stores the files of a directory as attachments of one document
+	SyncPerDirectory
+)
+
+// SyncOp is the kind of a SyncChange
+type SyncOp string
+
+const (
+	SyncAdd    SyncOp = "add"
+	SyncUpdate SyncOp = "update"
+	SyncDelete SyncOp = "delete"
+)
+
+// SyncChange is one file that is written or deleted by a sync
+type SyncChange struct {
+	Op    SyncOp
+	Path  string // slash separated path relative to the directory
+	DocID string
+	Size  int64
+}
+
+func (c SyncChange) String() string {
+	return fmt.Sprintf("%-6s %s (%s)", c.Op, c.Path, c.DocID)
+}
+
+// SyncFile is the entry of a file in the files field of a synced document.
+// The attachment of the file has the same name as the entry.
+type SyncFile struct {
+	Path        string `json:"path"`
+	Digest      string `json:"digest"` // "sha256-<hex>"
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+// DirSync mirrors a directory tree into a database and back. Every document holds its
+// files as attachments and a files field with their paths and SHA-256 digests, which are
+// compared to find the changed files. Small files are written with _bulk_docs, bigger
+// ones are streamed as attachments.
+type DirSync struct {
+	API *CouchDBAPI
+	DB  string
+	Dir string
+	// Prefix of the document ids, the rest is the path of the file or directory
+	Prefix string
+	Mode   SyncMode
+	// Delete removes documents and files that are missing on the source side
+	Delete bool
+	// Ignore are patterns like ".*" or "*.tmp" matched against the names of files and directories
+	Ignore []string
+	// InlineLimit is the size up to which files are sent in _bulk_docs, default 64 KiB
+	InlineLimit int64
+	// BatchSize of _bulk_docs, default 100
+	BatchSize int
+}
+
+// syncDoc is the state of one document, local or remote
+type syncDoc struct {
+	ID    string              `json:"_id"`
+	Rev   string              `json:"_rev,omitempty"`
+	Path  string              `json:"path"`
+	Files map[string]SyncFile `json:"files"`
+}
+
+func (s *DirSync) ignored(name string) bool {
+	for _, pattern := range s.Ignore {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// docOf returns the document id, the document path and the attachment name of a file
+func (s *DirSync) docOf(rel string) (string, string, string) {
+	if s.Mode == SyncPerDirectory {
+		dir := path.Dir(rel)
+		return s.Prefix + dir, dir, path.Base(rel)
+	}
+	return s.Prefix + rel, rel, path.Base(rel)
+}
+
+// local reads the directory and computes the digests of all files
+func (s *DirSync) local() (map[string]*syncDoc, error) {
+	docs := map[string]*syncDoc{}
+	root := filepath.Clean(s.Dir)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		if s.ignored(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		id, docPath, name := s.docOf(rel)
+		if strings.HasPrefix(id, "_") {
+			return fmt.Errorf("couchdb: %s would get the invalid document id %q, use a prefix", rel, id)
+		}
+		digest, size, err := fileDigest(p)
+		if err != nil {
+			return err
+		}
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		doc := docs[id]
+		if doc == nil {
+			doc = &syncDoc{ID: id, Path: docPath, Files: map[string]SyncFile{}}
+			docs[id] = doc
+		}
+		doc.Files[name] = SyncFile{Path: rel, Digest: digest, Size: size, ContentType: contentType}
+		return nil
+	})
+	return docs, err
+}
+
+func fileDigest(name string) (string, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return "sha256-" + hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// remote reads the synced documents of the database
+func (s *DirSync) remote(ctx context.Context) (map[string]*syncDoc, error) {
+	docs := map[string]*syncDoc{}
+	params := ViewParams{StartKey: s.Prefix, EndKey: s.Prefix + "\ufff0", IncludeDocs: true}
+	err := s.API.pageView(ctx, dbPath(s.DB)+"/_all_docs", params, 500, func(row ViewRow) error {
+		if strings.HasPrefix(row.ID, "_") || len(row.Doc) == 0 {
+			return nil
+		}
+		var doc syncDoc
+		if json.Unmarshal(row.Doc, &doc) != nil || doc.Files == nil {
+			return nil
+		}
+		docs[doc.ID] = &doc
+		return nil
+	})
+	if IsNotFound(err) {
+		return docs, nil
+	}
+	return docs, err
+}
+
+// diff lists the changes that make dst equal to src
+func (s *DirSync) diff(src, dst map[string]*syncDoc) []SyncChange {
+	var changes []SyncChange
+	for id, doc := range src {
+		for name, f := range doc.Files {
+			var old SyncFile
+			var ok bool
+			if d := dst[id]; d != nil {
+				old, ok = d.Files[name]
+			}
+			switch {
+			case !ok:
+				changes = append(changes, SyncChange{Op: SyncAdd, Path: f.Path, DocID: id, Size: f.Size})
+			case old.Digest != f.Digest:
+				changes = append(changes, SyncChange{Op: SyncUpdate, Path: f.Path, DocID: id, Size: f.Size})
+			}
+		}
+	}
+	if s.Delete {
+		for id, doc := range dst {
+			for name, f := range doc.Files {
+				if d := src[id]; d != nil {
+					if _, ok := d.Files[name]; ok {
+						continue
+					}
+				}
+				changes = append(changes, SyncChange{Op: SyncDelete, Path: f.Path, DocID: id, Size: f.Size})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// PlanPush returns the changes Push would write, without writing them
+func (s *DirSync) PlanPush(ctx context.Context) ([]SyncChange, error) {
+	local, err := s.local()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := s.remote(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.diff(local, remote), nil
+}
+
+// PlanPull returns the changes Pull would write, without writing them
+func (s *DirSync) PlanPull(ctx context.Context) ([]SyncChange, error) {
+	local, err := s.local()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := s.remote(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.diff(remote, local), nil
+}
+
+// Push writes the changed files of the directory into the database and returns the changes
+func (s *DirSync) Push(ctx context.Context) ([]SyncChange, error) {
+	local, err := s.local()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := s.remote(ctx)
+	if err != nil {
+		return nil, err
+	}
+	changes := s.diff(local, remote)
+	changed := map[string]bool{}
+	for _, ch := range changes {
+		changed[ch.DocID] = true
+	}
+	inlineLimit := s.InlineLimit
+	if inlineLimit <= 0 {
+		inlineLimit = 64 * 1024
+	}
+
+	var bulk []any
+	ids := make([]string, 0, len(changed))
+	for id := range changed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		doc, old := local[id], remote[id]
+		if doc == nil {
+			if old != nil && s.Delete {
+				bulk = append(bulk, map[string]any{"_id": id, "_rev": old.Rev, "_deleted": true})
+			}
+			continue
+		}
+		rev := ""
+		if old != nil {
+			rev = old.Rev
+		}
+		files := map[string]SyncFile{}
+		atts := map[string]any{}
+		if old != nil && !s.Delete {
+			// files missing locally are kept
+			for name, f := range old.Files {
+				files[name] = f
+				atts[name] = map[string]any{"stub": true}
+			}
+		}
+		for name, f := range doc.Files {
+			files[name] = f
+			if old != nil && old.Files[name].Digest == f.Digest {
+				atts[name] = map[string]any{"stub": true}
+				continue
+			}
+			if f.Size <= inlineLimit {
+				data, err := os.ReadFile(filepath.Join(s.Dir, filepath.FromSlash(f.Path)))
+				if err != nil {
+					return nil, err
+				}
+				atts[name] = map[string]any{"content_type": f.ContentType, "data": base64.StdEncoding.EncodeToString(data)}
+				continue
+			}
+			// big files are streamed first, the document is written with their stubs. A new
+			// document is created without files before, so an interrupted push is resumed.
+			if rev == "" {
+				if rev, err = s.API.PutDoc(ctx, s.DB, id, map[string]any{"_id": id, "path": doc.Path, "files": map[string]SyncFile{}}); err != nil {
+					return nil, err
+				}
+			}
+			if rev, err = s.upload(ctx, id, name, rev, f); err != nil {
+				return nil, err
+			}
+			atts[name] = map[string]any{"stub": true}
+		}
+		stored := map[string]any{"_id": id, "path": doc.Path, "files": files, "_attachments": atts}
+		if rev != "" {
+			stored["_rev"] = rev
+		}
+		bulk = append(bulk, stored)
+	}
+	return changes, s.bulk(ctx, bulk)
+}
+
+func (s *DirSync) upload(ctx context.Context, id, name, rev string, f SyncFile) (string, error) {
+	file, err := os.Open(filepath.Join(s.Dir, filepath.FromSlash(f.Path)))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return s.API.PutAttachment(ctx, s.DB, id, name, rev, f.ContentType, file, f.Size)
+}
+
+func (s *DirSync) bulk(ctx context.Context, docs []any) error {
+	size := s.BatchSize
+	if size <= 0 {
+		size = 100
+	}
+	for len(docs) > 0 {
+		n := size
+		if n > len(docs) {
+			n = len(docs)
+		}
+		res, err := s.API.BulkDocs(ctx, s.DB, docs[:n])
+		if err != nil {
+			return err
+		}
+		for _, r := range res {
+			if err := r.Err(); err != nil {
+				return fmt.Errorf("%s: %w", r.ID, err)
+			}
+		}
+		docs = docs[n:]
+	}
+	return nil
+}
+
+// Pull writes the changed files of the database into the directory and returns the changes
+func (s *DirSync) Pull(ctx context.Context) ([]SyncChange, error) {
+	local, err := s.local()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := s.remote(ctx)
+	if err != nil {
+		return nil, err
+	}
+	changes := s.diff(remote, local)
+	for _, ch := range changes {
+		target := filepath.Join(s.Dir, filepath.FromSlash(ch.Path))
+		if !strings.HasPrefix(target, filepath.Clean(s.Dir)+string(filepath.Separator)) {
+			return nil, fmt.Errorf("couchdb: path %q leaves the directory", ch.Path)
+		}
+		if ch.Op == SyncDelete {
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+		doc := remote[ch.DocID]
+		for name, f := range doc.Files {
+			if f.Path == ch.Path {
+				if err := s.download(ctx, ch.DocID, name, f, target); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return changes, nil
+}
+
+// download streams an attachment into a temporary file and renames it when the digest matches
+func (s *DirSync) download(ctx context.Context, id, name string, f SyncFile, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	att, err := s.API.GetAttachment(ctx, s.DB, id, name)
+	if err != nil {
+		return err
+	}
+	defer att.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".sync-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), att)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if digest := "sha256-" + hex.EncodeToString(h.Sum(nil)); digest != f.Digest {
+		return fmt.Errorf("couchdb: %s has digest %s, expected %s", f.Path, digest, f.Digest)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
@@ -0,0 +1,186 @@
+package golangcouchdb
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		rel, _ := filepath.Rel(dir, p)
+		files[filepath.ToSlash(rel)] = string(data)
+		return err
+	})
+	return files
+}
+
+func changeList(changes []SyncChange) string {
+	var list []string
+	for _, ch := range changes {
+		list = append(list, string(ch.Op)+" "+ch.Path+" "+ch.DocID)
+	}
+	return strings.Join(list, ", ")
+}
+
+func TestDirSyncDiff(t *testing.T) {
+	doc := func(id string, files ...string) *syncDoc {
+		d := &syncDoc{ID: id, Files: map[string]SyncFile{}}
+		for _, f := range files {
+			name, digest, _ := strings.Cut(f, "=")
+			d.Files[name] = SyncFile{Path: id + "/" + name, Digest: digest}
+		}
+		return d
+	}
+	tests := []struct {
+		name     string
+		delete   bool
+		src, dst map[string]*syncDoc
+		want     string
+	}{
+		{"same", false, map[string]*syncDoc{"a": doc("a", "x=1")}, map[string]*syncDoc{"a": doc("a", "x=1")}, ""},
+		{"add and update", false, map[string]*syncDoc{"a": doc("a", "x=1", "y=2")}, map[string]*syncDoc{"a": doc("a", "x=0")},
+			"update a/x a, add a/y a"},
+		{"missing without Delete", false, map[string]*syncDoc{}, map[string]*syncDoc{"a": doc("a", "x=1")}, ""},
+		{"missing with Delete", true, map[string]*syncDoc{"b": doc("b", "x=1")}, map[string]*syncDoc{"a": doc("a", "x=1")},
+			"delete a/x a, add b/x b"},
+	}
+	for _, tt := range tests {
+		s := &DirSync{Delete: tt.delete}
+		if got := changeList(s.diff(tt.src, tt.dst)); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDirSync(t *testing.T) {
+	for _, mode := range []SyncMode{SyncPerFile, SyncPerDirectory} {
+		fc, api := newFakeCouch(t, "db")
+		src, dst := t.TempDir(), t.TempDir()
+		writeFiles(t, src, map[string]string{"index.html": "<p>hi</p>", "img/big.bin": strings.Repeat("x", 100),
+			"img/small.txt": "small", ".git/config": "ignored", "notes.tmp": "ignored"})
+		s := &DirSync{API: api, DB: "db", Dir: src, Prefix: "site/", Mode: mode, Ignore: []string{".*", "*.tmp"}, InlineLimit: 10}
+		ctx := context.Background()
+		changes, err := s.Push(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 3 {
+			t.Errorf("mode %d: pushed %s", mode, changeList(changes))
+		}
+		bigID, smallID := "site/img/big.bin", "site/img/small.txt"
+		if mode == SyncPerDirectory {
+			bigID, smallID = "site/img", "site/img"
+		}
+		if fc.doc("db", bigID) == nil {
+			t.Errorf("mode %d: no document %s", mode, bigID)
+		}
+		if changes, err := s.PlanPush(ctx); err != nil || len(changes) != 0 {
+			t.Errorf("mode %d: planned %s, %v after a push", mode, changeList(changes), err)
+		}
+
+		// a change and a deletion are pushed, files missing locally are kept without Delete
+		writeFiles(t, src, map[string]string{"img/small.txt": "changed"})
+		os.Remove(filepath.Join(src, "index.html"))
+		if changes, _ := s.PlanPush(ctx); changeList(changes) != "update img/small.txt "+smallID {
+			t.Errorf("mode %d: planned %s", mode, changeList(changes))
+		}
+		s.Delete = true
+		if changes, err = s.Push(ctx); err != nil || len(changes) != 2 {
+			t.Errorf("mode %d: pushed %s, %v", mode, changeList(changes), err)
+		}
+
+		// pulling into an empty directory gives the same files
+		p := &DirSync{API: api, DB: "db", Dir: dst, Prefix: "site/", Mode: mode}
+		if _, err := p.Pull(ctx); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"img/big.bin": strings.Repeat("x", 100), "img/small.txt": "changed"}
+		if got := readFiles(t, dst); !reflect.DeepEqual(got, want) {
+			t.Errorf("mode %d: pulled %v", mode, got)
+		}
+	}
+}
+
+func TestDirSyncInterruptedPush(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		prefix string // requests that fail during the first push
+	}{
+		{"first upload", http.MethodPut, "/db/site/img/a.bin"},
+		{"second upload", http.MethodPut, "/db/site/img/b.bin"},
+		{"bulk write", http.MethodPost, "/db/_bulk_docs"},
+	}
+	for _, tt := range tests {
+		fc, api := newFakeCouch(t, "db")
+		src, dst := t.TempDir(), t.TempDir()
+		files := map[string]string{"img/a.bin": strings.Repeat("a", 100), "img/b.bin": strings.Repeat("b", 100), "img/c.txt": "c"}
+		writeFiles(t, src, files)
+		s := &DirSync{API: api, DB: "db", Dir: src, Prefix: "site/", Mode: SyncPerDirectory, InlineLimit: 10}
+		fc.handle(tt.method, tt.prefix, func(w http.ResponseWriter, r *http.Request) {
+			writeJSONError(w, http.StatusInternalServerError, "crash", "interrupted")
+		})
+		if _, err := s.Push(context.Background()); err == nil {
+			t.Errorf("%s: push succeeded", tt.name)
+		}
+		fc.handle(tt.method, tt.prefix, fc.serve)
+		if changes, err := s.Push(context.Background()); err != nil || len(changes) != 3 {
+			t.Errorf("%s: resumed push %s, %v", tt.name, changeList(changes), err)
+			continue
+		}
+		p := &DirSync{API: api, DB: "db", Dir: dst, Prefix: "site/", Mode: SyncPerDirectory}
+		if _, err := p.Pull(context.Background()); err != nil {
+			t.Errorf("%s: pull: %v", tt.name, err)
+		}
+		if got := readFiles(t, dst); !reflect.DeepEqual(got, files) {
+			t.Errorf("%s: pulled %v", tt.name, got)
+		}
+	}
+}
+
+func TestDirSyncPullOutside(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"site/x","path":"x","files":{"x":{"path":"../x","digest":"sha256-00","size":1}}}`)
+	s := &DirSync{API: api, DB: "db", Dir: t.TempDir(), Prefix: "site/"}
+	if _, err := s.Pull(context.Background()); err == nil || !strings.Contains(err.Error(), "leaves the directory") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDirSyncPullDigest(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"site/x","path":"x","files":{"x":{"path":"x","digest":"sha256-00","size":1}},
+		"_attachments":{"x":{"content_type":"text/plain","data":"eA=="}}}`)
+	dir := t.TempDir()
+	s := &DirSync{API: api, DB: "db", Dir: dir, Prefix: "site/"}
+	if _, err := s.Pull(context.Background()); err == nil || !strings.Contains(err.Error(), "digest") {
+		t.Errorf("got %v", err)
+	}
+	if files := readFiles(t, dir); len(files) != 0 {
+		t.Errorf("files %v left after a failed download", files)
+	}
+}
@@ -0,0 +1,290 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Severity of a Finding
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityCritical:
+		return "critical"
+	case SeverityWarning:
+		return "warning"
+	}
+	return "info"
+}
+
+// Finding is a problem found by Doctor or ScanSecurity
+type Finding struct {
+	DB          string // empty for server wide findings
+	Check       string // e.g. "conflicts" or "revs_limit"
+	Severity    Severity
+	Subject     string // the document, design document or query concerned, if any
+	Message     string
+	Remediation string
+}
+
+// DoctorOptions configure Doctor, zero values are replaced by the defaults
+type DoctorOptions struct {
+	// MaxTombstoneRatio of deleted to all documents, default 0.5
+	MaxTombstoneRatio float64
+	// MaxFragmentation is the share of the file not used by live data, default 0.5.
+	// Files smaller than 16 MiB are not checked.
+	MaxFragmentation float64
+	// MaxRevsLimit default 1000, the default of Couchdb
+	MaxRevsLimit int
+	// MaxDocSize in bytes of JSON, default 1 MiB
+	MaxDocSize int
+	// MaxAttachmentSize default 10 MiB
+	MaxAttachmentSize int64
+	// MaxIndexLag is the number of updates an index may be behind, default 1000
+	MaxIndexLag int64
+	// SkipDocScan skips the checks that read all documents (conflicts and sizes)
+	SkipDocScan bool
+	// Queries are checked with _explain for using an index
+	Queries []FindQuery
+}
+
+func (o *DoctorOptions) defaults() {
+	if o.MaxTombstoneRatio <= 0 {
+		o.MaxTombstoneRatio = 0.5
+	}
+	if o.MaxFragmentation <= 0 {
+		o.MaxFragmentation = 0.5
+	}
+	if o.MaxRevsLimit <= 0 {
+		o.MaxRevsLimit = 1000
+	}
+	if o.MaxDocSize <= 0 {
+		o.MaxDocSize = 1 << 20
+	}
+	if o.MaxAttachmentSize <= 0 {
+		o.MaxAttachmentSize = 10 << 20
+	}
+	if o.MaxIndexLag <= 0 {
+		o.MaxIndexLag = 1000
+	}
+}
+
+// Doctor inspects a database and returns its findings, the most severe first
+func (c *CouchDBAPI) Doctor(ctx context.Context, db string, opts DoctorOptions) ([]Finding, error) {
+	opts.defaults()
+	var findings []Finding
+	add := func(check string, severity Severity, subject, remediation, format string, args ...any) {
+		findings = append(findings, Finding{DB: db, Check: check, Severity: severity, Subject: subject,
+			Message: fmt.Sprintf(format, args...), Remediation: remediation})
+	}
+
+	info, err := c.DBInfo(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if all := info.DocCount + info.DocDelCount; all > 0 {
+		if ratio := float64(info.DocDelCount) / float64(all); ratio > opts.MaxTombstoneRatio {
+			add("tombstones", SeverityWarning, "",
+				"replicate into a new database with a filter that drops deleted documents, or purge old tombstones with POST /"+db+"/_purge",
+				"%.0f%% of the documents are deleted (%d of %d), tombstones slow down replication and views", ratio*100, info.DocDelCount, all)
+		}
+	}
+	if file := info.Sizes.File; file >= 16<<20 && info.Sizes.Active > 0 {
+		if frag := float64(file-info.Sizes.Active) / float64(file); frag > opts.MaxFragmentation {
+			add("fragmentation", SeverityWarning, "",
+				"compact the database with POST /"+db+"/_compact, or tune the smoosh compaction daemon",
+				"%.0f%% of the %d MiB file are unused", frag*100, file>>20)
+		}
+	}
+
+	limit, err := c.RevsLimit(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if limit > opts.MaxRevsLimit {
+		add("revs_limit", SeverityWarning, "",
+			fmt.Sprintf("lower it with PUT /%s/_revs_limit and a body of %d", db, opts.MaxRevsLimit),
+			"revs_limit is %d, every document keeps that many revision ids", limit)
+	}
+
+	sec, err := c.GetSecurity(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if sec.IsPublic() {
+		add("security", SeverityCritical, "",
+			`set members with PUT /`+db+`/_security, e.g. {"admins":{"roles":["_admin"]},"members":{"roles":["<role>"]}}`,
+			"the database has no members, everybody who can reach the server may read it")
+	}
+
+	if !opts.SkipDocScan {
+		found, err := c.doctorScanDocs(ctx, db, opts)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, found...)
+	}
+	found, err := c.doctorDesignDocs(ctx, db, info, opts)
+	if err != nil {
+		return nil, err
+	}
+	findings = append(findings, found...)
+	for _, q := range opts.Queries {
+		f, err := c.doctorQuery(ctx, db, q)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			findings = append(findings, *f)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Severity > findings[j].Severity })
+	return findings, nil
+}
+
+// doctorScanDocs reads all documents with their conflicts and checks the sizes
+func (c *CouchDBAPI) doctorScanDocs(ctx context.Context, db string, opts DoctorOptions) ([]Finding, error) {
+	var findings []Finding
+	var conflicted []string
+	conflicts := 0
+	query := url.Values{"include_docs": {"true"}, "conflicts": {"true"}}
+	resp, err := c.doStream(ctx, http.MethodGet, dbPath(db)+"/_all_docs", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	err = decodeRows(json.NewDecoder(resp.Body), func(row ViewRow) error {
+		var doc struct {
+			Conflicts   []string                  `json:"_conflicts"`
+			Attachments map[string]AttachmentInfo `json:"_attachments"`
+		}
+		if json.Unmarshal(row.Doc, &doc) != nil {
+			return nil
+		}
+		if len(doc.Conflicts) > 0 {
+			conflicts++
+			if len(conflicted) < 5 {
+				conflicted = append(conflicted, row.ID)
+			}
+		}
+		if len(row.Doc) > opts.MaxDocSize {
+			findings = append(findings, Finding{DB: db, Check: "doc_size", Severity: SeverityWarning, Subject: row.ID,
+				Message:     fmt.Sprintf("the document has %d KiB of JSON", len(row.Doc)>>10),
+				Remediation: "split the document or move big values into attachments, big documents slow down every read, view and replication"})
+		}
+		for name, att := range doc.Attachments {
+			if att.Length > opts.MaxAttachmentSize {
+				findings = append(findings, Finding{DB: db, Check: "attachment_size", Severity: SeverityWarning, Subject: row.ID + "/" + name,
+					Message:     fmt.Sprintf("the attachment has %d MiB", att.Length>>20),
+					Remediation: "move it into a blob store, see OffloadAttachments and the offload command"})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if conflicts > 0 {
+		findings = append(findings, Finding{DB: db, Check: "conflicts", Severity: SeverityWarning, Subject: strings.Join(conflicted, ", "),
+			Message:     fmt.Sprintf("%d documents have conflicts", conflicts),
+			Remediation: "read them with ?conflicts=true, merge the revisions and delete the losing ones with _bulk_docs"})
+	}
+	return findings, nil
+}
+
+// doctorDesignDocs checks that the indexes of all design documents are current and that
+// every view can be queried
+func (c *CouchDBAPI) doctorDesignDocs(ctx context.Context, db string, info *DBInfo, opts DoctorOptions) ([]Finding, error) {
+	res, err := c.AllDocs(ctx, db, ViewParams{StartKey: "_design/", EndKey: "_design0", IncludeDocs: true})
+	if err != nil {
+		return nil, err
+	}
+	var findings []Finding
+	for _, row := range res.Rows {
+		var ddoc struct {
+			Views map[string]json.RawMessage `json:"views"`
+		}
+		json.Unmarshal(row.Doc, &ddoc)
+		if len(ddoc.Views) == 0 {
+			continue
+		}
+		name := strings.TrimPrefix(row.ID, "_design/")
+		var ddocInfo struct {
+			ViewIndex struct {
+				UpdateSeq      Seq  `json:"update_seq"`
+				UpdaterRunning bool `json:"updater_running"`
+			} `json:"view_index"`
+		}
+		if err := c.doJSON(ctx, http.MethodGet, docPath(db, row.ID)+"/_info", nil, nil, &ddocInfo); err != nil {
+			return nil, err
+		}
+		if lag := info.UpdateSeq.Number() - ddocInfo.ViewIndex.UpdateSeq.Number(); lag > opts.MaxIndexLag && !ddocInfo.ViewIndex.UpdaterRunning {
+			findings = append(findings, Finding{DB: db, Check: "stale_index", Severity: SeverityWarning, Subject: row.ID,
+				Message:     fmt.Sprintf("the index is %d updates behind and not updating, the next query waits for it", lag),
+				Remediation: fmt.Sprintf("build it now with GET /%s/_design/%s/_view/<view>?limit=0, and query it regularly or enable ken auto indexing", db, name)})
+		}
+		views := make([]string, 0, len(ddoc.Views))
+		for view := range ddoc.Views {
+			views = append(views, view)
+		}
+		sort.Strings(views)
+		// a view that fails to build or reduce fails the query, a slow build is not a failure.
+		// The views share one index, after a timeout the others would wait for it as well.
+		for _, view := range views {
+			qctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			_, err := c.View(qctx, db, name, view, ViewParams{Limit: 1})
+			cancel()
+			e, ok := err.(*Error)
+			if err != nil && !ok {
+				break
+			}
+			if ok {
+				findings = append(findings, Finding{DB: db, Check: "failing_index", Severity: SeverityCritical, Subject: row.ID + "/" + view,
+					Message:     fmt.Sprintf("querying the view fails: %s: %s", e.ErrorName, e.Reason),
+					Remediation: "fix the map or reduce function and deploy the design document again, see the couchdb log for the stack trace"})
+			}
+		}
+	}
+	return findings, nil
+}
+
+// doctorQuery reports a query that is answered from _all_docs
+func (c *CouchDBAPI) doctorQuery(ctx context.Context, db string, q FindQuery) (*Finding, error) {
+	if q.Selector == nil {
+		q.Selector = map[string]any{}
+	}
+	var explain struct {
+		Index struct {
+			Type string `json:"type"`
+		} `json:"index"`
+	}
+	if err := c.doJSON(ctx, http.MethodPost, dbPath(db)+"/_explain", nil, q, &explain); err != nil {
+		return nil, err
+	}
+	if explain.Index.Type != "special" {
+		return nil, nil
+	}
+	fields := make([]string, 0, len(q.Selector))
+	for field := range q.Selector {
+		if !strings.HasPrefix(field, "$") {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return &Finding{DB: db, Check: "unindexed_query", Severity: SeverityWarning, Subject: string(mustJSON(q.Selector)),
+		Message:     "the query uses no index and reads every document",
+		Remediation: fmt.Sprintf(`create an index with POST /%s/_index {"index":{"fields":%s}}`, db, mustJSON(fields))}, nil
+}
@@ -0,0 +1,129 @@
+package golangcouchdb
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func findingList(findings []Finding) string {
+	var list []string
+	for _, f := range findings {
+		list = append(list, f.Severity.String()+" "+f.Check+" "+f.Subject)
+	}
+	return strings.Join(list, ", ")
+}
+
+func TestDoctor(t *testing.T) {
+	answer := func(body any) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { writeJSON(w, http.StatusOK, body) }
+	}
+	failing := func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusInternalServerError, "query_parse_error", "bad reduce")
+	}
+	// healthy answers the requests of Doctor without findings
+	healthy := func(fc *fakeCouch) {
+		fc.handle(http.MethodGet, "/db/_security", answer(map[string]any{"members": map[string]any{"roles": []string{"r"}}}))
+		fc.handle(http.MethodGet, "/db/_revs_limit", answer(1000))
+		fc.handle(http.MethodGet, "/db/_design/app/_info", answer(map[string]any{"view_index": map[string]any{"update_seq": 3}}))
+		fc.handle(http.MethodGet, "/db/_design/app/_view/", fakeView(nil, nil))
+		fc.handle(http.MethodPost, "/db/_explain", answer(map[string]any{"index": map[string]any{"type": "json"}}))
+	}
+	tests := []struct {
+		name  string
+		setup func(fc *fakeCouch)
+		opts  DoctorOptions
+		want  string
+	}{
+		{"healthy", nil, DoctorOptions{}, ""},
+		{"public", func(fc *fakeCouch) {
+			fc.handle(http.MethodGet, "/db/_security", answer(map[string]any{}))
+		}, DoctorOptions{}, "critical security "},
+		{"tombstones and revs_limit", func(fc *fakeCouch) {
+			fc.put(t, "db", `{"_id":"d1","_deleted":true}`, `{"_id":"d2","_deleted":true}`)
+			fc.handle(http.MethodGet, "/db/_revs_limit", answer(5000))
+		}, DoctorOptions{}, "warning tombstones , warning revs_limit "},
+		{"fragmentation", func(fc *fakeCouch) {
+			fc.handle(http.MethodGet, "/db", func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/db" {
+					fc.serve(w, r)
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]any{"db_name": "db", "doc_count": 1, "update_seq": "3-x",
+					"sizes": map[string]int{"file": 64 << 20, "active": 8 << 20}})
+			})
+			healthy(fc) // again before the handler above
+		}, DoctorOptions{}, "warning fragmentation "},
+		{"sizes", func(fc *fakeCouch) {
+			fc.put(t, "db", attachmentDoc("att", "text/plain", "some content"))
+		}, DoctorOptions{MaxDocSize: 100, MaxAttachmentSize: 5}, "warning doc_size _design/app, warning doc_size att, warning attachment_size att/file"},
+		{"conflicts", func(fc *fakeCouch) {
+			fc.handle(http.MethodGet, "/db/_all_docs", func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("conflicts") != "true" {
+					fc.serve(w, r)
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]any{"rows": []any{
+					map[string]any{"id": "c1", "doc": map[string]any{"_id": "c1", "_conflicts": []string{"1-b"}}},
+					map[string]any{"id": "c2", "doc": map[string]any{"_id": "c2", "_conflicts": []string{"1-c"}}},
+				}})
+			})
+		}, DoctorOptions{}, "warning conflicts c1, c2"},
+		{"stale index", func(fc *fakeCouch) {
+			fc.handle(http.MethodGet, "/db/_design/app/_info", answer(map[string]any{"view_index": map[string]any{"update_seq": 0}}))
+		}, DoctorOptions{MaxIndexLag: 1}, "warning stale_index _design/app"},
+		{"stale index while updating", func(fc *fakeCouch) {
+			fc.handle(http.MethodGet, "/db/_design/app/_info", answer(map[string]any{"view_index": map[string]any{"update_seq": 0, "updater_running": true}}))
+		}, DoctorOptions{MaxIndexLag: 1}, ""},
+		{"failing map", func(fc *fakeCouch) {
+			fc.handle(http.MethodGet, "/db/_design/app/_view/", failing)
+		}, DoctorOptions{}, "critical failing_index _design/app/by_x, critical failing_index _design/app/count"},
+		{"failing reduce view", func(fc *fakeCouch) {
+			fc.handle(http.MethodGet, "/db/_design/app/_view/count", failing)
+		}, DoctorOptions{}, "critical failing_index _design/app/count"},
+		{"unindexed query", func(fc *fakeCouch) {
+			fc.handle(http.MethodPost, "/db/_explain", answer(map[string]any{"index": map[string]any{"type": "special"}}))
+		}, DoctorOptions{Queries: []FindQuery{{Selector: map[string]any{"b": 1, "a": 2}}}}, `warning unindexed_query {"a":2,"b":1}`},
+	}
+	for _, tt := range tests {
+		fc, api := newFakeCouch(t, "db")
+		fc.put(t, "db", `{"_id":"a","x":1}`, `{"_id":"_design/app","views":{"count":{"map":"function (doc) { emit(doc.x) }","reduce":"_count"},
+			"by_x":{"map":"function (doc) { emit(doc.x) }"}}}`)
+		healthy(fc)
+		if tt.setup != nil {
+			tt.setup(fc)
+		}
+		findings, err := api.Doctor(context.Background(), "db", tt.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := findingList(findings); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDoctorSlowIndex(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"_design/app","views":{"a":{"map":"function (doc) {}"},"b":{"map":"function (doc) {}"}}}`)
+	fc.handle(http.MethodGet, "/db/_security", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"members": map[string]any{"names": []string{"u"}}})
+	})
+	fc.handle(http.MethodGet, "/db/_revs_limit", func(w http.ResponseWriter, r *http.Request) { writeJSON(w, http.StatusOK, 1000) })
+	fc.handle(http.MethodGet, "/db/_design/app/_info", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"view_index": map[string]any{"update_seq": 1}})
+	})
+	// the build of the index does not answer, it is no failure and b is not queried
+	fc.handle(http.MethodGet, "/db/_design/app/_view/", func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	})
+	findings, err := api.Doctor(context.Background(), "db", DoctorOptions{})
+	if err != nil || len(findings) != 0 {
+		t.Errorf("%s, %v", findingList(findings), err)
+	}
+	if n := fc.count(http.MethodGet, "/db/_design/app/_view/b"); n != 0 {
+		t.Errorf("b queried %d times", n)
+	}
+}
@@ -0,0 +1,93 @@
+package golangcouchdb
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// GetDoc reads a document into out
+func (c *CouchDBAPI) GetDoc(ctx context.Context, db, id string, out any) error {
+	return c.doJSON(ctx, http.MethodGet, docPath(db, id), nil, nil, out)
+}
+
+// PutDoc creates or updates a document and returns the new revision.
+// Updates need the current _rev in doc.
+func (c *CouchDBAPI) PutDoc(ctx context.Context, db, id string, doc any) (string, error) {
+	var res struct {
+		Rev string `json:"rev"`
+	}
+	if err := c.doJSON(ctx, http.MethodPut, docPath(db, id), nil, doc, &res); err != nil {
+		return "", err
+	}
+	return res.Rev, nil
+}
+
+// DeleteDoc deletes revision rev of a document and returns the revision of the tombstone
+func (c *CouchDBAPI) DeleteDoc(ctx context.Context, db, id, rev string) (string, error) {
+	var res struct {
+		Rev string `json:"rev"`
+	}
+	if err := c.doJSON(ctx, http.MethodDelete, docPath(db, id), url.Values{"rev": {rev}}, nil, &res); err != nil {
+		return "", err
+	}
+	return res.Rev, nil
+}
+
+// BulkResult is the result of one document of BulkDocs
+type BulkResult struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev,omitempty"`
+	OK     bool   `json:"ok,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Err returns the error of the document or nil
+func (r BulkResult) Err() error {
+	if r.Error == "" {
+		return nil
+	}
+	status := http.StatusBadRequest
+	switch r.Error {
+	case "conflict":
+		status = http.StatusConflict
+	case "forbidden":
+		status = http.StatusForbidden
+	case "unauthorized":
+		status = http.StatusUnauthorized
+	}
+	return &Error{StatusCode: status, ErrorName: r.Error, Reason: r.Reason}
+}
+
+// BulkDocs writes many documents with one request. Errors of single documents are
+// returned in their BulkResult.
+func (c *CouchDBAPI) BulkDocs(ctx context.Context, db string, docs []any) ([]BulkResult, error) {
+	var res []BulkResult
+	if err := c.doJSON(ctx, http.MethodPost, dbPath(db)+"/_bulk_docs", nil, map[string]any{"docs": docs}, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// UpdateDoc reads a document, lets fn change it and writes it back. On a conflict the
+// document is read again and fn is called again, so fn must not have side effects.
+// If fn returns false nothing is written. It returns the new revision.
+func (c *CouchDBAPI) UpdateDoc(ctx context.Context, db, id string, fn func(doc map[string]any) (bool, error)) (string, error) {
+	for {
+		var doc map[string]any
+		if err := c.GetDoc(ctx, db, id, &doc); err != nil {
+			return "", err
+		}
+		changed, err := fn(doc)
+		if err != nil || !changed {
+			rev, _ := doc["_rev"].(string)
+			return rev, err
+		}
+		rev, err := c.PutDoc(ctx, db, id, doc)
+		if IsConflict(err) {
+			continue
+		}
+		return rev, err
+	}
+}
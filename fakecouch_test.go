@@ -0,0 +1,951 @@
+package golangcouchdb
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCouch is an in memory Couchdb for tests. It knows databases, documents with
+// revisions and attachments, _all_docs, _find with a subset of mango, _changes in all
+// feed modes, _bulk_docs, _bulk_get, _local documents and _security. Handlers set with
+// handle answer requests before it, e.g. views or injected errors.
+type fakeCouch struct {
+	mu       sync.Mutex
+	dbs      map[string]*fakeDB
+	handlers []fakeHandler
+	requests []string
+	changed  chan struct{} // closed and replaced on every write
+}
+
+type fakeHandler struct {
+	method, prefix string
+	fn             http.HandlerFunc
+}
+
+type fakeDB struct {
+	seq      int
+	docs     map[string]*fakeDoc
+	local    map[string]map[string]any
+	security map[string]any
+}
+
+type fakeDoc struct {
+	id      string
+	rev     string
+	seq     int
+	deleted bool
+	body    map[string]any // without _id, _rev and _attachments
+	atts    map[string]*fakeAtt
+}
+
+type fakeAtt struct {
+	contentType string
+	data        []byte
+	revpos      int
+}
+
+// newFakeCouch starts a fake server with the given databases and returns it with a client
+func newFakeCouch(t *testing.T, dbs ...string) (*fakeCouch, *CouchDBAPI) {
+	t.Helper()
+	fc := &fakeCouch{dbs: map[string]*fakeDB{}, changed: make(chan struct{})}
+	for _, db := range dbs {
+		fc.dbs[db] = newFakeDB()
+	}
+	return fc, newTestAPI(t, fc)
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{docs: map[string]*fakeDoc{}, local: map[string]map[string]any{}, security: map[string]any{}}
+}
+
+// handle answers requests whose method (empty for all) and path prefix match with fn
+func (fc *fakeCouch) handle(method, prefix string, fn http.HandlerFunc) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.handlers = append(fc.handlers, fakeHandler{method: method, prefix: prefix, fn: fn})
+}
+
+// put stores documents given as JSON, it fails the test on errors
+func (fc *fakeCouch) put(t *testing.T, db string, docs ...string) {
+	t.Helper()
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for _, doc := range docs {
+		var body map[string]any
+		if err := json.Unmarshal([]byte(doc), &body); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fc.write(db, body, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// doc returns the current body of a document with _id and _rev, nil if it does not exist
+func (fc *fakeCouch) doc(db, id string) map[string]any {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	d := fc.dbs[db]
+	if d == nil || d.docs[id] == nil || d.docs[id].deleted {
+		return nil
+	}
+	return d.docs[id].json(false)
+}
+
+// local returns a _local document, nil if it does not exist
+func (fc *fakeCouch) local(db, id string) map[string]any {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if d := fc.dbs[db]; d != nil {
+		return d.local[id]
+	}
+	return nil
+}
+
+// count returns the number of requests with method and path prefix
+func (fc *fakeCouch) count(method, prefix string) int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	n := 0
+	for _, r := range fc.requests {
+		if strings.HasPrefix(r, method+" "+prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *fakeDoc) json(attachments bool) map[string]any {
+	out := map[string]any{"_id": d.id, "_rev": d.rev}
+	if d.deleted {
+		out["_deleted"] = true
+		return out
+	}
+	for k, v := range d.body {
+		out[k] = v
+	}
+	if len(d.atts) > 0 {
+		atts := map[string]any{}
+		for name, a := range d.atts {
+			sum := md5.Sum(a.data)
+			stub := map[string]any{"content_type": a.contentType, "digest": "md5-" + base64.StdEncoding.EncodeToString(sum[:]),
+				"length": len(a.data), "revpos": a.revpos}
+			if attachments {
+				stub["data"] = base64.StdEncoding.EncodeToString(a.data)
+			} else {
+				stub["stub"] = true
+			}
+			atts[name] = stub
+		}
+		out["_attachments"] = atts
+	}
+	return out
+}
+
+type fakeError struct {
+	status       int
+	name, reason string
+}
+
+func (e *fakeError) Error() string { return e.name + ": " + e.reason }
+
+// write stores a document, fc.mu must be held. With newEdits false the revision of the
+// document is taken as it is.
+func (fc *fakeCouch) write(db string, body map[string]any, replicated bool) (*fakeDoc, error) {
+	d := fc.dbs[db]
+	if d == nil {
+		return nil, &fakeError{http.StatusNotFound, "not_found", "Database does not exist."}
+	}
+	id, _ := body["_id"].(string)
+	if id == "" {
+		id = fmt.Sprintf("%032x", time.Now().UnixNano())
+	}
+	rev, _ := body["_rev"].(string)
+	old := d.docs[id]
+	for k := range body {
+		if strings.HasPrefix(k, "_") && k != "_id" && k != "_rev" && k != "_deleted" && k != "_attachments" && k != "_revisions" {
+			return nil, &fakeError{http.StatusBadRequest, "doc_validation", "Bad special document member: " + k}
+		}
+	}
+	if !replicated {
+		live := old != nil && !old.deleted
+		if (live && rev != old.rev) || (!live && rev != "" && (old == nil || rev != old.rev)) {
+			return nil, &fakeError{http.StatusConflict, "conflict", "Document update conflict."}
+		}
+	}
+	gen := 1
+	if old != nil {
+		gen, _ = strconv.Atoi(strings.SplitN(old.rev, "-", 2)[0])
+		gen++
+	}
+	data, _ := json.Marshal(body)
+	sum := md5.Sum(data)
+	newRev := fmt.Sprintf("%d-%x", gen, sum[:8])
+	if replicated {
+		newRev = rev
+		gen, _ = strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	}
+	doc := &fakeDoc{id: id, rev: newRev, body: map[string]any{}, atts: map[string]*fakeAtt{}}
+	deleted, _ := body["_deleted"].(bool)
+	doc.deleted = deleted
+	for k, v := range body {
+		if !strings.HasPrefix(k, "_") {
+			doc.body[k] = v
+		}
+	}
+	if atts, ok := body["_attachments"].(map[string]any); ok && !deleted {
+		for name, v := range atts {
+			a, _ := v.(map[string]any)
+			if stub, _ := a["stub"].(bool); stub {
+				if old == nil || old.atts[name] == nil {
+					return nil, &fakeError{http.StatusPreconditionFailed, "missing_stub", "Invalid attachment stub for " + name}
+				}
+				doc.atts[name] = old.atts[name]
+				continue
+			}
+			data, err := base64.StdEncoding.DecodeString(fmt.Sprint(a["data"]))
+			if err != nil {
+				return nil, &fakeError{http.StatusBadRequest, "bad_request", "Invalid attachment data for " + name}
+			}
+			ct, _ := a["content_type"].(string)
+			doc.atts[name] = &fakeAtt{contentType: ct, data: data, revpos: gen}
+		}
+	}
+	fc.store(d, doc)
+	return doc, nil
+}
+
+// store makes doc the current revision, fc.mu must be held
+func (fc *fakeCouch) store(d *fakeDB, doc *fakeDoc) {
+	d.seq++
+	doc.seq = d.seq
+	d.docs[doc.id] = doc
+	close(fc.changed)
+	fc.changed = make(chan struct{})
+}
+
+func (fc *fakeCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fc.mu.Lock()
+	fc.requests = append(fc.requests, r.Method+" "+r.URL.Path)
+	handlers := append([]fakeHandler(nil), fc.handlers...)
+	fc.mu.Unlock()
+	for i := len(handlers) - 1; i >= 0; i-- {
+		h := handlers[i]
+		if (h.method == "" || h.method == r.Method) && strings.HasPrefix(r.URL.Path, h.prefix) {
+			h.fn(w, r)
+			return
+		}
+	}
+	fc.serve(w, r)
+}
+
+// serve answers a request like Couchdb, handlers may call it to pass a request on
+func (fc *fakeCouch) serve(w http.ResponseWriter, r *http.Request) {
+	var segs []string
+	for _, s := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		u, _ := url.PathUnescape(s)
+		segs = append(segs, u)
+	}
+	if segs[0] == "_all_dbs" {
+		fc.mu.Lock()
+		names := make([]string, 0, len(fc.dbs))
+		for name := range fc.dbs {
+			names = append(names, name)
+		}
+		fc.mu.Unlock()
+		sort.Strings(names)
+		writeJSON(w, http.StatusOK, names)
+		return
+	}
+	if len(segs) == 1 {
+		fc.serveDB(w, r, segs[0])
+		return
+	}
+	db := segs[0]
+	fc.mu.Lock()
+	exists := fc.dbs[db] != nil
+	fc.mu.Unlock()
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Database does not exist.")
+		return
+	}
+	switch segs[1] {
+	case "_all_docs":
+		fc.serveAllDocs(w, r, db)
+	case "_find":
+		fc.serveFind(w, r, db)
+	case "_changes":
+		fc.serveChanges(w, r, db)
+	case "_bulk_docs":
+		fc.serveBulkDocs(w, r, db)
+	case "_bulk_get":
+		fc.serveBulkGet(w, r, db)
+	case "_security":
+		fc.serveSecurity(w, r, db)
+	case "_local":
+		fc.serveLocal(w, r, db, "_local/"+strings.Join(segs[2:], "/"))
+	case "_design":
+		if len(segs) < 3 {
+			writeJSONError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		fc.serveDoc(w, r, db, "_design/"+segs[2], segs[3:])
+	default:
+		if strings.HasPrefix(segs[1], "_") {
+			writeJSONError(w, http.StatusNotFound, "not_found", "unknown endpoint "+segs[1])
+			return
+		}
+		fc.serveDoc(w, r, db, segs[1], segs[2:])
+	}
+}
+
+func (fc *fakeCouch) serveDB(w http.ResponseWriter, r *http.Request, db string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	d := fc.dbs[db]
+	switch r.Method {
+	case http.MethodPut:
+		if d != nil {
+			writeJSONError(w, http.StatusPreconditionFailed, "file_exists", "The database could not be created, the file already exists.")
+			return
+		}
+		fc.dbs[db] = newFakeDB()
+		writeJSON(w, http.StatusCreated, map[string]bool{"ok": true})
+	case http.MethodDelete:
+		if d == nil {
+			writeJSONError(w, http.StatusNotFound, "not_found", "Database does not exist.")
+			return
+		}
+		delete(fc.dbs, db)
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	default:
+		if d == nil {
+			writeJSONError(w, http.StatusNotFound, "not_found", "Database does not exist.")
+			return
+		}
+		live, deleted := 0, 0
+		for _, doc := range d.docs {
+			if doc.deleted {
+				deleted++
+			} else if !strings.HasPrefix(doc.id, "_design/") {
+				live++
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"db_name": db, "doc_count": live, "doc_del_count": deleted,
+			"update_seq": fmt.Sprintf("%d-fake", d.seq), "sizes": map[string]int{"file": 1 << 10, "active": 1 << 9}})
+	}
+}
+
+func (fc *fakeCouch) serveDoc(w http.ResponseWriter, r *http.Request, db, id string, rest []string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	d := fc.dbs[db]
+	doc := d.docs[id]
+	if len(rest) > 0 {
+		fc.serveAttachment(w, r, d, id, strings.Join(rest, "/"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if doc == nil || doc.deleted {
+			writeJSONError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		writeJSON(w, http.StatusOK, doc.json(r.URL.Query().Get("attachments") == "true"))
+	case http.MethodPut:
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "invalid UTF-8 JSON")
+			return
+		}
+		body["_id"] = id
+		if rev := r.URL.Query().Get("rev"); rev != "" {
+			body["_rev"] = rev
+		}
+		fc.answerWrite(w, db, body)
+	case http.MethodDelete:
+		fc.answerWrite(w, db, map[string]any{"_id": id, "_rev": r.URL.Query().Get("rev"), "_deleted": true})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+	}
+}
+
+// answerWrite writes body and answers like PUT /{db}/{id}, fc.mu must be held
+func (fc *fakeCouch) answerWrite(w http.ResponseWriter, db string, body map[string]any) {
+	doc, err := fc.write(db, body, false)
+	if e, ok := err.(*fakeError); ok {
+		writeJSONError(w, e.status, e.name, e.reason)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"ok": true, "id": doc.id, "rev": doc.rev})
+}
+
+func (fc *fakeCouch) serveAttachment(w http.ResponseWriter, r *http.Request, d *fakeDB, id, name string) {
+	doc := d.docs[id]
+	switch r.Method {
+	case http.MethodGet:
+		if doc == nil || doc.deleted || doc.atts[name] == nil {
+			writeJSONError(w, http.StatusNotFound, "not_found", "Document is missing attachment")
+			return
+		}
+		a := doc.atts[name]
+		w.Header().Set("Content-Type", a.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(a.data)))
+		w.Write(a.data)
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		rev := r.URL.Query().Get("rev")
+		if (doc != nil && !doc.deleted && rev != doc.rev) || ((doc == nil || doc.deleted) && rev != "") {
+			writeJSONError(w, http.StatusConflict, "conflict", "Document update conflict.")
+			return
+		}
+		next := &fakeDoc{id: id, body: map[string]any{}, atts: map[string]*fakeAtt{}}
+		gen := 1
+		if doc != nil && !doc.deleted {
+			for k, v := range doc.body {
+				next.body[k] = v
+			}
+			for k, v := range doc.atts {
+				next.atts[k] = v
+			}
+			gen, _ = strconv.Atoi(strings.SplitN(doc.rev, "-", 2)[0])
+			gen++
+		}
+		sum := md5.Sum(data)
+		next.rev = fmt.Sprintf("%d-%x", gen, sum[:8])
+		next.atts[name] = &fakeAtt{contentType: r.Header.Get("Content-Type"), data: data, revpos: gen}
+		fc.store(d, next)
+		writeJSON(w, http.StatusCreated, map[string]any{"ok": true, "id": id, "rev": next.rev})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+	}
+}
+
+func (fc *fakeCouch) serveLocal(w http.ResponseWriter, r *http.Request, db, id string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	d := fc.dbs[db]
+	switch r.Method {
+	case http.MethodGet:
+		doc, ok := d.local[id]
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		writeJSON(w, http.StatusOK, doc)
+	case http.MethodPut:
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		old, ok := d.local[id]
+		if rev, _ := body["_rev"].(string); ok && rev != old["_rev"] {
+			writeJSONError(w, http.StatusConflict, "conflict", "Document update conflict.")
+			return
+		}
+		n := 1
+		if ok {
+			n, _ = strconv.Atoi(strings.TrimPrefix(old["_rev"].(string), "0-"))
+			n++
+		}
+		body["_id"], body["_rev"] = id, fmt.Sprintf("0-%d", n)
+		d.local[id] = body
+		writeJSON(w, http.StatusCreated, map[string]any{"ok": true, "id": id, "rev": body["_rev"]})
+	case http.MethodDelete:
+		delete(d.local, id)
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	}
+}
+
+func (fc *fakeCouch) serveSecurity(w http.ResponseWriter, r *http.Request, db string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	d := fc.dbs[db]
+	if r.Method == http.MethodPut {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		d.security = body
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+		return
+	}
+	writeJSON(w, http.StatusOK, d.security)
+}
+
+// queryParams returns the query of a request, POST bodies of _all_docs and views add keys
+func decodeJSONParam(q url.Values, name string) (json.RawMessage, bool) {
+	v := q.Get(name)
+	if v == "" {
+		return nil, false
+	}
+	return json.RawMessage(v), true
+}
+
+func (fc *fakeCouch) serveAllDocs(w http.ResponseWriter, r *http.Request, db string) {
+	q := r.URL.Query()
+	var body struct {
+		Keys []string `json:"keys"`
+	}
+	if r.Method == http.MethodPost {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	fc.mu.Lock()
+	d := fc.dbs[db]
+	docs := make([]*fakeDoc, 0, len(d.docs))
+	for _, doc := range d.docs {
+		if !doc.deleted {
+			docs = append(docs, doc)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].id < docs[j].id })
+	includeDocs := q.Get("include_docs") == "true"
+	attachments := q.Get("attachments") == "true"
+	row := func(doc *fakeDoc) ViewRow {
+		key, _ := json.Marshal(doc.id)
+		value, _ := json.Marshal(map[string]string{"rev": doc.rev})
+		row := ViewRow{ID: doc.id, Key: key, Value: value}
+		if includeDocs {
+			row.Doc = mustJSON(doc.json(attachments))
+		}
+		return row
+	}
+	var rows []ViewRow
+	offset := 0
+	if body.Keys != nil {
+		for _, id := range body.Keys {
+			key, _ := json.Marshal(id)
+			if doc := d.docs[id]; doc != nil && !doc.deleted {
+				rows = append(rows, row(doc))
+			} else {
+				rows = append(rows, ViewRow{Key: key, Error: "not_found"})
+			}
+		}
+	} else {
+		start, hasStart := decodeJSONParam(q, "start_key")
+		end, hasEnd := decodeJSONParam(q, "end_key")
+		key, hasKey := decodeJSONParam(q, "key")
+		desc := q.Get("descending") == "true"
+		if desc {
+			for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+				docs[i], docs[j] = docs[j], docs[i]
+			}
+		}
+		inclusive := q.Get("inclusive_end") != "false"
+		for _, doc := range docs {
+			id, _ := json.Marshal(doc.id)
+			before := func(bound json.RawMessage) int {
+				c := strings.Compare(doc.id, decodeString(bound))
+				if desc {
+					c = -c
+				}
+				return c
+			}
+			if hasKey && collate(id, key) != 0 {
+				continue
+			}
+			if hasStart && before(start) < 0 {
+				offset++
+				continue
+			}
+			if hasEnd && (before(end) > 0 || (before(end) == 0 && !inclusive)) {
+				continue
+			}
+			rows = append(rows, row(doc))
+		}
+	}
+	fc.mu.Unlock()
+	total := len(docs)
+	if body.Keys != nil {
+		total = len(rows)
+	}
+	if skip, _ := strconv.Atoi(q.Get("skip")); skip > 0 {
+		if skip > len(rows) {
+			skip = len(rows)
+		}
+		rows = rows[skip:]
+	}
+	if limit, _ := strconv.Atoi(q.Get("limit")); limit > 0 && limit < len(rows) {
+		rows = rows[:limit]
+	}
+	if rows == nil {
+		rows = []ViewRow{}
+	}
+	writeJSON(w, http.StatusOK, ViewResult{TotalRows: total, Offset: offset, Rows: rows})
+}
+
+func decodeString(raw json.RawMessage) string {
+	var s string
+	json.Unmarshal(raw, &s)
+	return s
+}
+
+func (fc *fakeCouch) serveFind(w http.ResponseWriter, r *http.Request, db string) {
+	var query struct {
+		Selector map[string]any `json:"selector"`
+		Fields   []string       `json:"fields"`
+		Limit    *int           `json:"limit"`
+		Skip     int            `json:"skip"`
+		Bookmark string         `json:"bookmark"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil || query.Selector == nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", "invalid selector")
+		return
+	}
+	fc.mu.Lock()
+	d := fc.dbs[db]
+	var docs []map[string]any
+	ids := make([]string, 0, len(d.docs))
+	for id := range d.docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		doc := d.docs[id]
+		if doc.deleted || strings.HasPrefix(id, "_design/") {
+			continue
+		}
+		body := doc.json(false)
+		if matchSelector(body, query.Selector) {
+			docs = append(docs, body)
+		}
+	}
+	fc.mu.Unlock()
+	offset := query.Skip
+	if strings.HasPrefix(query.Bookmark, "b") {
+		offset, _ = strconv.Atoi(query.Bookmark[1:])
+	}
+	limit := 25
+	if query.Limit != nil {
+		limit = *query.Limit
+	}
+	if offset > len(docs) {
+		offset = len(docs)
+	}
+	end := offset + limit
+	if end > len(docs) {
+		end = len(docs)
+	}
+	out := []map[string]any{}
+	for _, doc := range docs[offset:end] {
+		if len(query.Fields) > 0 {
+			projected := map[string]any{}
+			for _, f := range query.Fields {
+				if v, ok := fieldValue(doc, f); ok {
+					setField(projected, f, v)
+				}
+			}
+			doc = projected
+		}
+		out = append(out, doc)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"docs": out, "bookmark": fmt.Sprintf("b%d", end)})
+}
+
+func setField(doc map[string]any, path string, v any) {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		next, ok := doc[name].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			doc[name] = next
+		}
+		doc = next
+	}
+	doc[names[len(names)-1]] = v
+}
+
+func fieldValue(doc any, path string) (any, bool) {
+	v := doc
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// matchSelector implements the mango operators used in this package
+func matchSelector(doc map[string]any, sel map[string]any) bool {
+	for field, cond := range sel {
+		switch field {
+		case "$and":
+			for _, s := range cond.([]any) {
+				if !matchSelector(doc, s.(map[string]any)) {
+					return false
+				}
+			}
+			continue
+		case "$or":
+			ok := false
+			for _, s := range cond.([]any) {
+				ok = ok || matchSelector(doc, s.(map[string]any))
+			}
+			if !ok {
+				return false
+			}
+			continue
+		case "$not":
+			if matchSelector(doc, cond.(map[string]any)) {
+				return false
+			}
+			continue
+		}
+		v, exists := fieldValue(doc, field)
+		if !matchCondition(v, exists, cond) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchCondition(v any, exists bool, cond any) bool {
+	ops, ok := cond.(map[string]any)
+	isOps := ok
+	for k := range ops {
+		isOps = isOps && strings.HasPrefix(k, "$")
+	}
+	if !isOps {
+		return exists && collate(mustJSON(v), mustJSON(cond)) == 0
+	}
+	for op, arg := range ops {
+		c := collate(mustJSON(v), mustJSON(arg))
+		var ok bool
+		switch op {
+		case "$eq":
+			ok = exists && c == 0
+		case "$ne":
+			ok = !exists || c != 0
+		case "$gt":
+			ok = exists && c > 0
+		case "$gte":
+			ok = exists && c >= 0
+		case "$lt":
+			ok = exists && c < 0
+		case "$lte":
+			ok = exists && c <= 0
+		case "$exists":
+			ok = exists == arg.(bool)
+		case "$in", "$nin":
+			for _, a := range arg.([]any) {
+				ok = ok || (exists && collate(mustJSON(v), mustJSON(a)) == 0)
+			}
+			if op == "$nin" {
+				ok = !ok
+			}
+		case "$size":
+			list, isList := v.([]any)
+			ok = isList && float64(len(list)) == arg.(float64)
+		case "$type":
+			ok = exists && jsonType(v) == arg
+		case "$not":
+			ok = !matchCondition(v, exists, arg)
+		case "$regex":
+			s, isString := v.(string)
+			ok = isString && regexp.MustCompile(arg.(string)).MatchString(s)
+		case "$elemMatch":
+			list, _ := v.([]any)
+			for _, e := range list {
+				obj, isObj := e.(map[string]any)
+				ok = ok || (isObj && matchSelector(obj, arg.(map[string]any))) || (!isObj && matchCondition(e, true, arg))
+			}
+		default:
+			panic("fakeCouch: unsupported operator " + op)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	}
+	return "object"
+}
+
+func (fc *fakeCouch) serveChanges(w http.ResponseWriter, r *http.Request, db string) {
+	q := r.URL.Query()
+	var body struct {
+		Selector map[string]any `json:"selector"`
+		DocIDs   []string       `json:"doc_ids"`
+	}
+	if r.Method == http.MethodPost {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	since := 0
+	if s := q.Get("since"); s == "now" {
+		fc.mu.Lock()
+		since = fc.dbs[db].seq
+		fc.mu.Unlock()
+	} else if s != "" {
+		since = int(Seq(s).Number())
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	includeDocs := q.Get("include_docs") == "true"
+	feed := q.Get("feed")
+	heartbeat := time.Minute
+	if ms, _ := strconv.Atoi(q.Get("heartbeat")); ms > 0 {
+		heartbeat = time.Duration(ms) * time.Millisecond
+	}
+	timeout := time.Minute
+	if ms, _ := strconv.Atoi(q.Get("timeout")); ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	// collect returns the changes after since and a channel that is closed on the next write
+	collect := func() ([]map[string]any, int, <-chan struct{}) {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		d := fc.dbs[db]
+		if d == nil {
+			return nil, since, fc.changed
+		}
+		var docs []*fakeDoc
+		for _, doc := range d.docs {
+			if doc.seq > since {
+				docs = append(docs, doc)
+			}
+		}
+		sort.Slice(docs, func(i, j int) bool { return docs[i].seq < docs[j].seq })
+		var out []map[string]any
+		last := since
+		for _, doc := range docs {
+			if limit > 0 && len(out) >= limit {
+				break
+			}
+			last = doc.seq
+			if body.Selector != nil && (doc.deleted || !matchSelector(doc.json(false), body.Selector)) {
+				continue
+			}
+			if body.DocIDs != nil && !containsString(body.DocIDs, doc.id) {
+				continue
+			}
+			ch := map[string]any{"seq": fmt.Sprintf("%d-fake", doc.seq), "id": doc.id, "changes": []map[string]string{{"rev": doc.rev}}}
+			if doc.deleted {
+				ch["deleted"] = true
+			}
+			if includeDocs {
+				ch["doc"] = doc.json(false)
+			}
+			out = append(out, ch)
+		}
+		return out, last, fc.changed
+	}
+	if feed != "continuous" {
+		changes, last, changed := collect()
+		if len(changes) == 0 && feed == "longpoll" {
+			select {
+			case <-changed:
+				changes, last, _ = collect()
+			case <-time.After(timeout):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if changes == nil {
+			changes = []map[string]any{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"results": changes, "last_seq": fmt.Sprintf("%d-fake", last), "pending": 0})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	sent := 0
+	for {
+		changes, last, changed := collect()
+		for _, ch := range changes {
+			enc.Encode(ch)
+			sent++
+		}
+		since = last
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if limit > 0 && sent >= limit {
+			enc.Encode(map[string]any{"last_seq": fmt.Sprintf("%d-fake", last), "pending": 0})
+			return
+		}
+		select {
+		case <-changed:
+		case <-time.After(heartbeat):
+			w.Write([]byte("\n"))
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (fc *fakeCouch) serveBulkDocs(w http.ResponseWriter, r *http.Request, db string) {
+	var body struct {
+		Docs     []map[string]any `json:"docs"`
+		NewEdits *bool            `json:"new_edits"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	replicated := body.NewEdits != nil && !*body.NewEdits
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	res := []map[string]any{}
+	for _, doc := range body.Docs {
+		id, _ := doc["_id"].(string)
+		written, err := fc.write(db, doc, replicated)
+		if e, ok := err.(*fakeError); ok {
+			res = append(res, map[string]any{"id": id, "error": e.name, "reason": e.reason})
+			continue
+		}
+		if !replicated {
+			res = append(res, map[string]any{"ok": true, "id": written.id, "rev": written.rev})
+		}
+	}
+	writeJSON(w, http.StatusCreated, res)
+}
+
+func (fc *fakeCouch) serveBulkGet(w http.ResponseWriter, r *http.Request, db string) {
+	var body struct {
+		Docs []BulkGetDoc `json:"docs"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	attachments := r.URL.Query().Get("attachments") == "true"
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	d := fc.dbs[db]
+	var results []map[string]any
+	for _, ref := range body.Docs {
+		doc := d.docs[ref.ID]
+		var entry map[string]any
+		if doc == nil || doc.deleted || (ref.Rev != "" && ref.Rev != doc.rev) {
+			entry = map[string]any{"error": map[string]any{"id": ref.ID, "rev": ref.Rev, "error": "not_found", "reason": "missing"}}
+		} else {
+			entry = map[string]any{"ok": doc.json(attachments)}
+		}
+		results = append(results, map[string]any{"id": ref.ID, "docs": []any{entry}})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"results": results})
+}
@@ -0,0 +1,3 @@
+module github.com/spookieoli/golang_couchdb
+
+go 1.18
@@ -1,9 +1,522 @@
 package golangcouchdb
 
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // Type for Connection to Couchdb
 type CouchDBAPI struct {
 	Url               string
 	Username          string
 	Passwort          string
 	clientMaxWaitTime int64
+
+	// Scheduler limits the requests in flight by priority, see WithPriority. Optional.
+	Scheduler *Scheduler
+	// Replicas routes reads to replica clusters, see ReplicaRouter. Optional.
+	Replicas *ReplicaRouter
+	// Masking masks fields of documents read for a UserCtx, see Masking. Optional.
+	Masking *Masking
+	// Tuner sets batch size and concurrency of BulkWrite and BulkRead. Optional.
+	Tuner *BulkTuner
+	// Cache serves View, AllDocs and Find from memory while the database is unchanged. Optional.
+	Cache *QueryCache
+	// Blobs resolves attachments moved out of Couchdb, see OffloadAttachments. Optional.
+	Blobs BlobStore
+	// StreamIdleTimeout aborts streaming responses that send no headers or data for this long,
+	// default 60s. Streams are not limited by clientMaxWaitTime.
+	StreamIdleTimeout time.Duration
+}
+
+// Error is returned for every non 2xx answer of Couchdb
+type Error struct {
+	StatusCode int
+	ErrorName  string `json:"error"`
+	Reason     string `json:"reason"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("couchdb: %d %s: %s", e.StatusCode, e.ErrorName, e.Reason)
+}
+
+// IsNotFound reports whether err is a 404 of Couchdb
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a 409 of Couchdb
+func IsConflict(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusConflict
+}
+
+// client returns the http client, clientMaxWaitTime is given in seconds
+func (c *CouchDBAPI) client() *http.Client {
+	return &http.Client{Timeout: time.Duration(c.clientMaxWaitTime) * time.Second}
+}
+
+// do sends a request to Couchdb. body is sent as JSON unless it is an io.Reader.
+// Answers with a status >= 400 are turned into an *Error.
+func (c *CouchDBAPI) do(ctx context.Context, method, path string, query url.Values, body any) (*http.Response, error) {
+	if target := c.route(ctx, method, path); target != c {
+		return target.do(ctx, method, path, query, body)
+	}
+	req, err := c.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(c.client(), req, nil)
+	if err == nil {
+		c.noteWrite(ctx, method, path)
+	}
+	return resp, err
+}
+
+func (c *CouchDBAPI) newRequest(ctx context.Context, method, path string, query url.Values, body any) (*http.Request, error) {
+	u := strings.TrimRight(c.Url, "/") + "/" + strings.TrimLeft(path, "/")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var r io.Reader
+	contentType := ""
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		r = b
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		if c.Masking != nil && isDocWrite(method, path) && c.Masking.isMaskedWrite(ctx, method, path, data) {
+			return nil, ErrMaskedWrite
+		}
+		r = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Passwort)
+	}
+	return req, nil
+}
+
+// send sends a request with a slot of the Scheduler. A stream passes its idle watch,
+// which also limits the wait for the headers once the slot is held. Streams give the
+// slot back when the headers arrived, other requests when the body is closed.
+func (c *CouchDBAPI) send(client *http.Client, req *http.Request, watch *idleWatch) (*http.Response, error) {
+	release := func() {}
+	if c.Scheduler != nil {
+		r, err := c.Scheduler.acquire(req.Context(), PriorityFrom(req.Context()))
+		if err != nil {
+			return nil, err
+		}
+		release = r
+	}
+	if watch != nil {
+		watch.timer.Reset(watch.idle)
+	}
+	resp, err := client.Do(req)
+	if watch != nil {
+		watch.timer.Stop()
+		err = watch.err(err)
+	}
+	if err != nil || watch != nil {
+		release()
+		release = func() {}
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		e := &Error{StatusCode: resp.StatusCode}
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, e) != nil || e.ErrorName == "" {
+			e.ErrorName = http.StatusText(resp.StatusCode)
+			e.Reason = strings.TrimSpace(string(data))
+		}
+		return nil, e
+	}
+	return resp, nil
+}
+
+// doJSON sends a request and decodes the JSON answer into out (if not nil)
+func (c *CouchDBAPI) doJSON(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	resp, err := c.do(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	if c.Masking != nil {
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(c.Masking.mask(ctx, data), out)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// dbPath escapes a database name for the use in an url path
+func dbPath(db string) string {
+	return url.PathEscape(db)
+}
+
+// docPath builds the path of a document, design documents keep their slash
+func docPath(db, id string) string {
+	for _, prefix := range []string{"_design/", "_local/"} {
+		if strings.HasPrefix(id, prefix) {
+			return dbPath(db) + "/" + prefix + url.PathEscape(strings.TrimPrefix(id, prefix))
+		}
+	}
+	return dbPath(db) + "/" + url.PathEscape(id)
+}
+
+// ViewParams are the query parameters of views and _all_docs
+type ViewParams struct {
+	Key           any
+	Keys          []any
+	StartKey      any
+	EndKey        any
+	StartKeyDocID string
+	EndKeyDocID   string
+	Limit         int
+	Skip          int
+	Descending    bool
+	IncludeDocs   bool
+	InclusiveEnd  *bool
+	Reduce        *bool
+	Group         bool
+	GroupLevel    int
+	Update        string
+}
+
+func (p ViewParams) values() url.Values {
+	v := url.Values{}
+	setJSON := func(name string, value any) {
+		if value != nil {
+			data, _ := json.Marshal(value)
+			v.Set(name, string(data))
+		}
+	}
+	setJSON("key", p.Key)
+	setJSON("start_key", p.StartKey)
+	setJSON("end_key", p.EndKey)
+	if p.StartKeyDocID != "" {
+		v.Set("start_key_doc_id", p.StartKeyDocID)
+	}
+	if p.EndKeyDocID != "" {
+		v.Set("end_key_doc_id", p.EndKeyDocID)
+	}
+	if p.Limit > 0 {
+		v.Set("limit", strconv.Itoa(p.Limit))
+	}
+	if p.Skip > 0 {
+		v.Set("skip", strconv.Itoa(p.Skip))
+	}
+	if p.Descending {
+		v.Set("descending", "true")
+	}
+	if p.IncludeDocs {
+		v.Set("include_docs", "true")
+	}
+	if p.InclusiveEnd != nil {
+		v.Set("inclusive_end", strconv.FormatBool(*p.InclusiveEnd))
+	}
+	if p.Reduce != nil {
+		v.Set("reduce", strconv.FormatBool(*p.Reduce))
+	}
+	if p.Group {
+		v.Set("group", "true")
+	}
+	if p.GroupLevel > 0 {
+		v.Set("group_level", strconv.Itoa(p.GroupLevel))
+	}
+	if p.Update != "" {
+		v.Set("update", p.Update)
+	}
+	return v
+}
+
+// ViewRow is one row of a view or _all_docs
+type ViewRow struct {
+	ID    string          `json:"id"`
+	Key   json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value"`
+	Doc   json.RawMessage `json:"doc,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// ViewResult is the answer of a view or _all_docs
+type ViewResult struct {
+	TotalRows int       `json:"total_rows"`
+	Offset    int       `json:"offset"`
+	Rows      []ViewRow `json:"rows"`
+}
+
+// View queries the view of a design document
+func (c *CouchDBAPI) View(ctx context.Context, db, ddoc, view string, params ViewParams) (*ViewResult, error) {
+	return c.cachedView(ctx, db, viewPath(db, ddoc, view), params)
+}
+
+// AllDocs queries _all_docs of a database
+func (c *CouchDBAPI) AllDocs(ctx context.Context, db string, params ViewParams) (*ViewResult, error) {
+	return c.cachedView(ctx, db, dbPath(db)+"/_all_docs", params)
+}
+
+// cachedView answers from c.Cache if it is set
+func (c *CouchDBAPI) cachedView(ctx context.Context, db, path string, params ViewParams) (*ViewResult, error) {
+	if c.Cache == nil {
+		return c.queryView(ctx, path, params)
+	}
+	var res ViewResult
+	err := c.Cache.query(ctx, c, db, viewCacheKey(path, params), params.Update == "lazy", &res, func(ctx context.Context, out any) error {
+		r, err := c.queryView(ctx, path, params)
+		if err == nil {
+			*out.(*ViewResult) = *r
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func viewPath(db, ddoc, view string) string {
+	ddoc = strings.TrimPrefix(ddoc, "_design/")
+	return dbPath(db) + "/_design/" + url.PathEscape(ddoc) + "/_view/" + url.PathEscape(view)
+}
+
+func (c *CouchDBAPI) queryView(ctx context.Context, path string, params ViewParams) (*ViewResult, error) {
+	var res ViewResult
+	var err error
+	if len(params.Keys) > 0 {
+		err = c.doJSON(ctx, http.MethodPost, path, params.values(), map[string]any{"keys": params.Keys}, &res)
+	} else {
+		err = c.doJSON(ctx, http.MethodGet, path, params.values(), nil, &res)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// pageView reads a view or _all_docs in pages of pageSize rows and calls fn for every row.
+// Paging is done with start_key and start_key_doc_id, so it is stable for big results.
+// With Keys the keys are sent in chunks of pageSize, the rows of a chunk are not limited.
+// Like findAll it does not use c.Cache.
+func (c *CouchDBAPI) pageView(ctx context.Context, path string, params ViewParams, pageSize int, fn func(ViewRow) error) error {
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+	if len(params.Keys) > 0 {
+		return c.pageViewKeys(ctx, path, params, pageSize, fn)
+	}
+	limit := params.Limit
+	seen := 0
+	for {
+		p := params
+		p.Limit = pageSize + 1
+		res, err := c.queryView(ctx, path, p)
+		if err != nil {
+			return err
+		}
+		rows := res.Rows
+		more := len(rows) > pageSize
+		if more {
+			rows = rows[:pageSize]
+		}
+		for _, row := range rows {
+			if limit > 0 && seen >= limit {
+				return nil
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+			seen++
+		}
+		if !more {
+			return nil
+		}
+		next := res.Rows[pageSize]
+		if params.Key != nil {
+			// the later pages are the range of the key, starting at the next row
+			params.EndKey = params.Key
+			params.InclusiveEnd = nil
+			params.EndKeyDocID = ""
+			params.Key = nil
+		}
+		params.StartKey = next.Key
+		params.StartKeyDocID = next.ID
+		params.Skip = 0
+	}
+}
+
+// pageViewKeys reads the rows of params.Keys in chunks of pageSize keys, Skip and Limit
+// are applied to all rows
+func (c *CouchDBAPI) pageViewKeys(ctx context.Context, path string, params ViewParams, pageSize int, fn func(ViewRow) error) error {
+	skip, limit := params.Skip, params.Limit
+	seen := 0
+	keys := params.Keys
+	for start := 0; start < len(keys); start += pageSize {
+		end := start + pageSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		p := params
+		p.Keys, p.Skip, p.Limit = keys[start:end], 0, 0
+		res, err := c.queryView(ctx, path, p)
+		if err != nil {
+			return err
+		}
+		for _, row := range res.Rows {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if limit > 0 && seen >= limit {
+				return nil
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+			seen++
+		}
+	}
+	return nil
+}
+
+// FindQuery is the body of a _find request
+type FindQuery struct {
+	Selector map[string]any `json:"selector"`
+	Fields   []string       `json:"fields,omitempty"`
+	Sort     []any          `json:"sort,omitempty"`
+	Limit    int            `json:"limit,omitempty"`
+	Skip     int            `json:"skip,omitempty"`
+	UseIndex any            `json:"use_index,omitempty"`
+	Bookmark string         `json:"bookmark,omitempty"`
+	Update   *bool          `json:"update,omitempty"`
+	Stable   *bool          `json:"stable,omitempty"`
+}
+
+// FindResult is the answer of a _find request
+type FindResult struct {
+	Docs     []json.RawMessage `json:"docs"`
+	Bookmark string            `json:"bookmark"`
+	Warning  string            `json:"warning,omitempty"`
+}
+
+// Find runs a mango query against db
+func (c *CouchDBAPI) Find(ctx context.Context, db string, query FindQuery) (*FindResult, error) {
+	return c.find(ctx, db, query, c.Cache)
+}
+
+// find runs a mango query, answered from cache if it is not nil
+func (c *CouchDBAPI) find(ctx context.Context, db string, query FindQuery, cache *QueryCache) (*FindResult, error) {
+	if query.Selector == nil {
+		query.Selector = map[string]any{}
+	}
+	var added []string
+	if c.Masking != nil && len(query.Fields) > 0 {
+		query.Fields, added = c.Masking.projection(query.Fields)
+	}
+	var res FindResult
+	fetch := func(ctx context.Context, out any) error {
+		return c.doJSON(ctx, http.MethodPost, dbPath(db)+"/_find", nil, query, out)
+	}
+	var err error
+	if cache != nil {
+		lazy := query.Update != nil && !*query.Update
+		err = cache.query(ctx, c, db, findCacheKey(db, query), lazy, &res, fetch)
+	} else {
+		err = fetch(ctx, &res)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stripFields(res.Docs, added)
+	return &res, nil
+}
+
+// findAll pages through a mango query with bookmarks and calls fn for every document.
+// The pages are not cached, they would only push out other results.
+func (c *CouchDBAPI) findAll(ctx context.Context, db string, query FindQuery, pageSize int, fn func(json.RawMessage) error) error {
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+	limit := query.Limit
+	seen := 0
+	for {
+		q := query
+		q.Limit = pageSize
+		if limit > 0 && limit-seen < pageSize {
+			q.Limit = limit - seen
+		}
+		res, err := c.find(ctx, db, q, nil)
+		if err != nil {
+			return err
+		}
+		for _, doc := range res.Docs {
+			if err := fn(doc); err != nil {
+				return err
+			}
+			seen++
+		}
+		if len(res.Docs) < q.Limit || (limit > 0 && seen >= limit) || res.Bookmark == "" || res.Bookmark == query.Bookmark {
+			return nil
+		}
+		query.Bookmark = res.Bookmark
+		query.Skip = 0
+	}
+}
+
+// lookupField returns the value of a dotted field path like "address.city" of a JSON document
+func lookupField(doc json.RawMessage, path string) (json.RawMessage, bool) {
+	value := doc
+	for _, name := range strings.Split(path, ".") {
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(value, &obj) != nil {
+			return nil, false
+		}
+		v, ok := obj[name]
+		if !ok {
+			return nil, false
+		}
+		value = v
+	}
+	return value, true
+}
+
+// docIDRev returns _id and _rev of a JSON document
+func docIDRev(doc json.RawMessage) (string, string) {
+	var meta struct {
+		ID  string `json:"_id"`
+		Rev string `json:"_rev"`
+	}
+	json.Unmarshal(doc, &meta)
+	return meta.ID, meta.Rev
 }
@@ -0,0 +1,90 @@
+package golangcouchdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// newTestAPI returns a CouchDBAPI talking to a test server running h
+func newTestAPI(t *testing.T, h http.Handler) *CouchDBAPI {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return &CouchDBAPI{Url: srv.URL, clientMaxWaitTime: 10}
+}
+
+// fakeView answers view requests from rows like Couchdb does for key, keys, start_key,
+// start_key_doc_id, end_key, inclusive_end, skip and limit. Rows are sorted by key and id.
+// The queries are appended to queries if it is not nil.
+func fakeView(rows []ViewRow, queries *[]string) http.HandlerFunc {
+	sorted := append([]ViewRow(nil), rows...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if c := collate(sorted[i].Key, sorted[j].Key); c != 0 {
+			return c < 0
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if queries != nil {
+			*queries = append(*queries, r.Method+" "+q.Encode())
+		}
+		var out []ViewRow
+		if r.Method == http.MethodPost {
+			var body struct {
+				Keys []json.RawMessage `json:"keys"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			for _, key := range body.Keys {
+				for _, row := range sorted {
+					if collate(row.Key, key) == 0 {
+						out = append(out, row)
+					}
+				}
+			}
+		} else {
+			inclusive := q.Get("inclusive_end") != "false"
+			for _, row := range sorted {
+				if key := q.Get("key"); key != "" && collate(row.Key, json.RawMessage(key)) != 0 {
+					continue
+				}
+				if start := q.Get("start_key"); start != "" {
+					c := collate(row.Key, json.RawMessage(start))
+					if c < 0 || (c == 0 && row.ID < q.Get("start_key_doc_id")) {
+						continue
+					}
+				}
+				if end := q.Get("end_key"); end != "" {
+					c := collate(row.Key, json.RawMessage(end))
+					if c > 0 || (c == 0 && !inclusive) {
+						continue
+					}
+				}
+				out = append(out, row)
+			}
+		}
+		total := len(out)
+		if skip, _ := strconv.Atoi(q.Get("skip")); skip > 0 {
+			if skip > len(out) {
+				skip = len(out)
+			}
+			out = out[skip:]
+		}
+		if limit, _ := strconv.Atoi(q.Get("limit")); limit > 0 && limit < len(out) {
+			out = out[:limit]
+		}
+		if out == nil {
+			out = []ViewRow{}
+		}
+		writeJSON(w, http.StatusOK, ViewResult{TotalRows: total, Rows: out})
+	}
+}
+
+// viewRow returns a row with key and value given as JSON
+func viewRow(id, key, value string) ViewRow {
+	return ViewRow{ID: id, Key: json.RawMessage(key), Value: json.RawMessage(value)}
+}
@@ -0,0 +1,582 @@
+package golangcouchdb
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JoinRow is one row of a JoinSource, Key is the value the rows are joined on
+type JoinRow struct {
+	Key json.RawMessage `json:"k"`
+	Doc json.RawMessage `json:"d"`
+}
+
+// JoinSource delivers the rows of one side of a join
+type JoinSource interface {
+	Rows(ctx context.Context, fn func(JoinRow) error) error
+}
+
+// FindSource reads the documents of a mango query, the join key is taken from KeyField
+type FindSource struct {
+	API      *CouchDBAPI
+	DB       string
+	Query    FindQuery
+	KeyField string
+	PageSize int
+}
+
+// Rows implements JoinSource
+func (s *FindSource) Rows(ctx context.Context, fn func(JoinRow) error) error {
+	return s.API.findAll(ctx, s.DB, s.Query, s.PageSize, func(doc json.RawMessage) error {
+		key, _ := lookupField(doc, s.KeyField)
+		return fn(JoinRow{Key: key, Doc: doc})
+	})
+}
+
+// ViewSource reads the rows of a view. The join key is the view key unless KeyField is set,
+// then it is taken from the included document.
+type ViewSource struct {
+	API      *CouchDBAPI
+	DB       string
+	DDoc     string
+	View     string
+	Params   ViewParams
+	KeyField string
+	PageSize int
+}
+
+// Rows implements JoinSource
+func (s *ViewSource) Rows(ctx context.Context, fn func(JoinRow) error) error {
+	return s.API.pageView(ctx, viewPath(s.DB, s.DDoc, s.View), s.Params, s.PageSize, func(row ViewRow) error {
+		return fn(joinRowOf(row, row.Key, s.KeyField))
+	})
+}
+
+// AllDocsSource reads _all_docs. The join key is the document id unless KeyField is set,
+// then it is taken from the included document.
+type AllDocsSource struct {
+	API      *CouchDBAPI
+	DB       string
+	Params   ViewParams
+	KeyField string
+	PageSize int
+}
+
+// Rows implements JoinSource
+func (s *AllDocsSource) Rows(ctx context.Context, fn func(JoinRow) error) error {
+	return s.API.pageView(ctx, dbPath(s.DB)+"/_all_docs", s.Params, s.PageSize, func(row ViewRow) error {
+		id, _ := json.Marshal(row.ID)
+		return fn(joinRowOf(row, id, s.KeyField))
+	})
+}
+
+func joinRowOf(row ViewRow, key json.RawMessage, keyField string) JoinRow {
+	doc := row.Doc
+	if len(doc) == 0 || string(doc) == "null" {
+		doc = row.Value
+	}
+	if keyField != "" {
+		key, _ = lookupField(row.Doc, keyField)
+	}
+	return JoinRow{Key: key, Doc: doc}
+}
+
+// JoinStrategy selects the algorithm of a join
+type JoinStrategy int
+
+const (
+	// HashJoin builds a hash table of the right side and probes it with the left side
+	HashJoin JoinStrategy = iota
+	// MergeJoin sorts both sides by key and merges them
+	MergeJoin
+)
+
+// JoinType selects which rows are part of the result
+type JoinType int
+
+const (
+	// InnerJoin only returns rows with a match on both sides
+	InnerJoin JoinType = iota
+	// LeftJoin returns every left row, Right is nil if there is no match
+	LeftJoin
+)
+
+// JoinOptions configure a join
+type JoinOptions struct {
+	Strategy JoinStrategy
+	Type     JoinType
+	// MaxMemoryRows is the number of rows kept in memory before spilling to disk, default 100000
+	MaxMemoryRows int
+	// TempDir for spill files, default os.TempDir()
+	TempDir string
+}
+
+// JoinResult is one row of a join
+type JoinResult struct {
+	Key   json.RawMessage
+	Left  json.RawMessage
+	Right json.RawMessage
+}
+
+const (
+	spillPartitions = 16
+	maxSpillDepth   = 3
+)
+
+// Join joins the rows of left and right on their keys and calls fn for every result.
+// Rows without a key or with a null key never match.
+func Join(ctx context.Context, left, right JoinSource, opts JoinOptions, fn func(JoinResult) error) error {
+	if opts.MaxMemoryRows <= 0 {
+		opts.MaxMemoryRows = 100000
+	}
+	l := func(f func(JoinRow) error) error { return left.Rows(ctx, f) }
+	r := func(f func(JoinRow) error) error { return right.Rows(ctx, f) }
+	if opts.Strategy == MergeJoin {
+		return mergeJoin(ctx, l, r, opts, fn)
+	}
+	return hashJoin(ctx, l, r, opts, 0, fn)
+}
+
+type rowFunc func(func(JoinRow) error) error
+
+// joinKey returns a canonical string of a key, "" for keys that never match. Keys have the
+// same string if collateValues finds them equal, so both strategies match the same rows:
+// numbers by value and objects in the order of their members.
+func joinKey(key json.RawMessage) string {
+	v := decodeOrdered(key)
+	if v == nil {
+		return ""
+	}
+	var b strings.Builder
+	writeJoinKey(&b, v)
+	return b.String()
+}
+
+func writeJoinKey(b *strings.Builder, v any) {
+	switch x := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(x))
+	case json.Number:
+		f, _ := x.Float64()
+		if f == 0 {
+			f = 0 // -0 collates equal to 0
+		}
+		b.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	case string:
+		b.WriteString(strconv.Quote(x))
+	case []any:
+		b.WriteByte('[')
+		for i, e := range x {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJoinKey(b, e)
+		}
+		b.WriteByte(']')
+	case []member:
+		b.WriteByte('{')
+		for i, m := range x {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strconv.Quote(m.key))
+			b.WriteByte(':')
+			writeJoinKey(b, m.value)
+		}
+		b.WriteByte('}')
+	}
+}
+
+func partitionOf(key string, depth int) int {
+	h := fnv.New32a()
+	h.Write([]byte(strconv.Itoa(depth)))
+	h.Write([]byte(key))
+	return int(h.Sum32() % spillPartitions)
+}
+
+func emitLeft(l JoinRow, matches []JoinRow, typ JoinType, fn func(JoinResult) error) error {
+	if len(matches) == 0 {
+		if typ == LeftJoin {
+			return fn(JoinResult{Key: l.Key, Left: l.Doc})
+		}
+		return nil
+	}
+	for _, r := range matches {
+		if err := fn(JoinResult{Key: l.Key, Left: l.Doc, Right: r.Doc}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashJoin is a grace hash join: if the right side does not fit into memory both sides
+// are partitioned by key into spill files and every partition is joined on its own.
+func hashJoin(ctx context.Context, left, right rowFunc, opts JoinOptions, depth int, fn func(JoinResult) error) error {
+	table := map[string][]JoinRow{}
+	n := 0
+	var rightParts, leftParts []*spillFile
+	defer func() {
+		closeSpillFiles(rightParts)
+		closeSpillFiles(leftParts)
+	}()
+	err := right(func(r JoinRow) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		k := joinKey(r.Key)
+		if k == "" {
+			return nil
+		}
+		if rightParts != nil {
+			return rightParts[partitionOf(k, depth)].write(r)
+		}
+		table[k] = append(table[k], r)
+		n++
+		if n <= opts.MaxMemoryRows || depth >= maxSpillDepth {
+			return nil
+		}
+		parts, err := newSpillFiles(opts.TempDir, spillPartitions)
+		if err != nil {
+			return err
+		}
+		rightParts = parts
+		for k, rows := range table {
+			for _, r := range rows {
+				if err := rightParts[partitionOf(k, depth)].write(r); err != nil {
+					return err
+				}
+			}
+		}
+		table = nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if rightParts == nil {
+		return left(func(l JoinRow) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return emitLeft(l, table[joinKey(l.Key)], opts.Type, fn)
+		})
+	}
+	if leftParts, err = newSpillFiles(opts.TempDir, spillPartitions); err != nil {
+		return err
+	}
+	err = left(func(l JoinRow) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		k := joinKey(l.Key)
+		if k == "" {
+			return emitLeft(l, nil, opts.Type, fn)
+		}
+		return leftParts[partitionOf(k, depth)].write(l)
+	})
+	if err != nil {
+		return err
+	}
+	for i := range rightParts {
+		if err := hashJoin(ctx, leftParts[i].rows, rightParts[i].rows, opts, depth+1, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeJoin sorts both sides with an external merge sort and merges them.
+// All right rows of one key are held in memory while the matching left rows are read.
+func mergeJoin(ctx context.Context, left, right rowFunc, opts JoinOptions, fn func(JoinResult) error) error {
+	li, err := externalSort(ctx, left, opts)
+	if err != nil {
+		return err
+	}
+	defer li.close()
+	ri, err := externalSort(ctx, right, opts)
+	if err != nil {
+		return err
+	}
+	defer ri.close()
+
+	l, lok, err := li.next()
+	if err != nil {
+		return err
+	}
+	r, rok, err := ri.next()
+	if err != nil {
+		return err
+	}
+	for lok {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c := -1
+		if rok && joinKey(l.row.Key) != "" {
+			c = collateValues(l.key, r.key)
+		}
+		switch {
+		case c < 0:
+			if err := emitLeft(l.row, nil, opts.Type, fn); err != nil {
+				return err
+			}
+			if l, lok, err = li.next(); err != nil {
+				return err
+			}
+		case c > 0:
+			if r, rok, err = ri.next(); err != nil {
+				return err
+			}
+		default:
+			group := []JoinRow{r.row}
+			key := r.key
+			for {
+				if r, rok, err = ri.next(); err != nil {
+					return err
+				}
+				if !rok || collateValues(key, r.key) != 0 {
+					break
+				}
+				group = append(group, r.row)
+			}
+			for lok && collateValues(key, l.key) == 0 {
+				if err := emitLeft(l.row, group, opts.Type, fn); err != nil {
+					return err
+				}
+				if l, lok, err = li.next(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// keyedRow is a row with its decoded key for sorting
+type keyedRow struct {
+	row JoinRow
+	key any
+}
+
+type rowIter interface {
+	next() (keyedRow, bool, error)
+	close()
+}
+
+type sliceIter struct {
+	rows []keyedRow
+}
+
+func (it *sliceIter) next() (keyedRow, bool, error) {
+	if len(it.rows) == 0 {
+		return keyedRow{}, false, nil
+	}
+	r := it.rows[0]
+	it.rows = it.rows[1:]
+	return r, true, nil
+}
+
+func (it *sliceIter) close() {}
+
+func sortRows(rows []keyedRow) {
+	sort.SliceStable(rows, func(i, j int) bool { return collateValues(rows[i].key, rows[j].key) < 0 })
+}
+
+// externalSort sorts rows by key, runs of MaxMemoryRows rows are sorted in memory and
+// spilled to disk, then merged.
+func externalSort(ctx context.Context, rows rowFunc, opts JoinOptions) (rowIter, error) {
+	var buf []keyedRow
+	var runs []*spillFile
+	flush := func() error {
+		sortRows(buf)
+		f, err := newSpillFile(opts.TempDir)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, f)
+		for _, r := range buf {
+			if err := f.write(r.row); err != nil {
+				return err
+			}
+		}
+		buf = buf[:0]
+		return nil
+	}
+	err := rows(func(r JoinRow) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		buf = append(buf, keyedRow{row: r, key: decodeOrdered(r.Key)})
+		if len(buf) >= opts.MaxMemoryRows {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil && len(runs) > 0 && len(buf) > 0 {
+		err = flush()
+	}
+	if err != nil {
+		closeSpillFiles(runs)
+		return nil, err
+	}
+	if len(runs) == 0 {
+		sortRows(buf)
+		return &sliceIter{rows: buf}, nil
+	}
+	m := &mergeIter{runs: runs}
+	for i, f := range runs {
+		dec, err := f.reader()
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		m.decoders = append(m.decoders, dec)
+		if err := m.fill(i); err != nil {
+			m.close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// mergeIter merges sorted spill files with a heap
+type mergeIter struct {
+	runs     []*spillFile
+	decoders []*json.Decoder
+	heads    mergeHeap
+}
+
+type mergeHead struct {
+	keyedRow
+	run int
+}
+
+type mergeHeap []mergeHead
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if c := collateValues(h[i].key, h[j].key); c != 0 {
+		return c < 0
+	}
+	return h[i].run < h[j].run
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(mergeHead)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func (m *mergeIter) fill(run int) error {
+	var r JoinRow
+	if err := m.decoders[run].Decode(&r); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	heap.Push(&m.heads, mergeHead{keyedRow: keyedRow{row: r, key: decodeOrdered(r.Key)}, run: run})
+	return nil
+}
+
+func (m *mergeIter) next() (keyedRow, bool, error) {
+	if len(m.heads) == 0 {
+		return keyedRow{}, false, nil
+	}
+	h := heap.Pop(&m.heads).(mergeHead)
+	return h.keyedRow, true, m.fill(h.run)
+}
+
+func (m *mergeIter) close() {
+	closeSpillFiles(m.runs)
+}
+
+// spillFile is a temporary file of JSON encoded rows
+type spillFile struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func newSpillFile(dir string) (*spillFile, error) {
+	f, err := os.CreateTemp(dir, "couchdb-spill-*")
+	if err != nil {
+		return nil, err
+	}
+	return &spillFile{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func newSpillFiles(dir string, n int) ([]*spillFile, error) {
+	files := make([]*spillFile, 0, n)
+	for i := 0; i < n; i++ {
+		f, err := newSpillFile(dir)
+		if err != nil {
+			closeSpillFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func (s *spillFile) write(r JoinRow) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	return s.w.WriteByte('\n')
+}
+
+func (s *spillFile) reader() (*json.Decoder, error) {
+	if err := s.w.Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return json.NewDecoder(bufio.NewReader(s.f)), nil
+}
+
+func (s *spillFile) rows(fn func(JoinRow) error) error {
+	dec, err := s.reader()
+	if err != nil {
+		return err
+	}
+	for {
+		var r JoinRow
+		if err := dec.Decode(&r); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *spillFile) close() {
+	s.f.Close()
+	os.Remove(s.f.Name())
+}
+
+func closeSpillFiles(files []*spillFile) {
+	for _, f := range files {
+		f.close()
+	}
+}
@@ -0,0 +1,219 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCollate(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{`null`, `false`, -1},
+		{`false`, `true`, -1},
+		{`true`, `0`, -1},
+		{`2`, `10`, -1},
+		{`1.5`, `1.5`, 0},
+		{`10`, `"a"`, -1},
+		{`"a"`, `"B"`, -1},
+		{`"a"`, `"A"`, -1},
+		{`"b"`, `"A"`, 1},
+		{`"z"`, `[]`, -1},
+		{`[1]`, `[1,0]`, -1},
+		{`[1,"a"]`, `[1,"b"]`, -1},
+		{`[]`, `{}`, -1},
+		{`{"a":1}`, `{"a":2}`, -1},
+		{`{"a":1}`, `{"b":0}`, -1},
+		{`{"a":1}`, `{"a":1}`, 0},
+	}
+	for _, tt := range tests {
+		if got := collate(json.RawMessage(tt.a), json.RawMessage(tt.b)); got != tt.want {
+			t.Errorf("collate(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := collate(json.RawMessage(tt.b), json.RawMessage(tt.a)); got != -tt.want {
+			t.Errorf("collate(%s, %s) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestPageView(t *testing.T) {
+	var rows []ViewRow
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 4; j++ {
+			rows = append(rows, viewRow(fmt.Sprintf("d%d%d", i, j), fmt.Sprint(i), "null"))
+		}
+	}
+	tests := []struct {
+		name   string
+		params ViewParams
+		want   []string
+	}{
+		{"all", ViewParams{}, idsOf(rows)},
+		{"limit", ViewParams{Limit: 5}, idsOf(rows[:5])},
+		{"key spans pages", ViewParams{Key: 2}, []string{"d20", "d21", "d22", "d23"}},
+		{"key with skip", ViewParams{Key: 1, Skip: 1}, []string{"d11", "d12", "d13"}},
+		{"range", ViewParams{StartKey: 1, EndKey: 2}, idsOf(rows[4:12])},
+		{"keys in chunks", ViewParams{Keys: []any{4, 0, 3}}, append(append(idsOf(rows[16:20]), idsOf(rows[0:4])...), idsOf(rows[12:16])...)},
+		{"keys with skip and limit", ViewParams{Keys: []any{4, 0, 3}, Skip: 3, Limit: 6}, []string{"d43", "d00", "d01", "d02", "d03", "d30"}},
+		{"missing keys", ViewParams{Keys: []any{7, 8}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI(t, fakeView(rows, nil))
+			var got []string
+			err := api.pageView(context.Background(), "db/_all_docs", tt.params, 3, func(row ViewRow) error {
+				got = append(got, row.ID)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func idsOf(rows []ViewRow) []string {
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = row.ID
+	}
+	return ids
+}
+
+// sliceSource is a JoinSource of fixed rows
+type sliceSource []JoinRow
+
+func (s sliceSource) Rows(ctx context.Context, fn func(JoinRow) error) error {
+	for _, row := range s {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func joinRows(pairs ...string) sliceSource {
+	var rows sliceSource
+	for i := 0; i < len(pairs); i += 2 {
+		rows = append(rows, JoinRow{Key: json.RawMessage(pairs[i]), Doc: json.RawMessage(pairs[i+1])})
+	}
+	return rows
+}
+
+func TestJoin(t *testing.T) {
+	left := joinRows(`1`, `"l1"`, `2`, `"l2"`, `2`, `"l2b"`, `null`, `"lnull"`, `4`, `"l4"`)
+	right := joinRows(`2`, `"r2"`, `1`, `"r1"`, `null`, `"rnull"`, `3`, `"r3"`, `2`, `"r2b"`)
+	inner := []string{`1 "l1" "r1"`, `2 "l2" "r2"`, `2 "l2" "r2b"`, `2 "l2b" "r2"`, `2 "l2b" "r2b"`}
+	outer := append([]string{`4 "l4" `, `null "lnull" `}, inner...)
+	tests := []struct {
+		name string
+		opts JoinOptions
+		want []string
+	}{
+		{"hash inner", JoinOptions{Strategy: HashJoin}, inner},
+		{"hash left", JoinOptions{Strategy: HashJoin, Type: LeftJoin}, outer},
+		{"hash spilled", JoinOptions{Strategy: HashJoin, MaxMemoryRows: 1, TempDir: t.TempDir()}, inner},
+		{"merge inner", JoinOptions{Strategy: MergeJoin}, inner},
+		{"merge left", JoinOptions{Strategy: MergeJoin, Type: LeftJoin}, outer},
+		{"merge spilled", JoinOptions{Strategy: MergeJoin, Type: LeftJoin, MaxMemoryRows: 2, TempDir: t.TempDir()}, outer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			err := Join(context.Background(), left, right, tt.opts, func(r JoinResult) error {
+				got = append(got, fmt.Sprintf("%s %s %s", r.Key, r.Left, string(r.Right)))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			want := append([]string(nil), tt.want...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestJoinKeys(t *testing.T) {
+	tests := []struct {
+		left, right string
+		match       bool
+	}{
+		{`1`, `1.0`, true},
+		{`-0`, `0`, true},
+		{`1`, `"1"`, false},
+		{`"a"`, `"A"`, false},
+		{`[1,"a"]`, `[1.0,"a"]`, true},
+		{`{"a":1,"b":2}`, `{"a":1.0,"b":2}`, true},
+		// Couchdb collates objects in the order of their members
+		{`{"a":1,"b":2}`, `{"b":2,"a":1}`, false},
+		{`{"a":[1,{"b":2,"c":3}]}`, `{"a":[1,{"c":3,"b":2}]}`, false},
+	}
+	strategies := []JoinOptions{
+		{Strategy: HashJoin},
+		{Strategy: HashJoin, MaxMemoryRows: 1, TempDir: t.TempDir()},
+		{Strategy: MergeJoin},
+	}
+	for _, tt := range tests {
+		if got := joinKey(json.RawMessage(tt.left)) == joinKey(json.RawMessage(tt.right)); got != tt.match {
+			t.Errorf("joinKey(%s) == joinKey(%s) is %v", tt.left, tt.right, got)
+		}
+		if got := collate(json.RawMessage(tt.left), json.RawMessage(tt.right)) == 0; got != tt.match {
+			t.Errorf("collate(%s, %s) == 0 is %v", tt.left, tt.right, got)
+		}
+		for _, opts := range strategies {
+			// a second right row makes the spilled hash join spill
+			right := joinRows(tt.right, `"r"`, `"other"`, `"o"`)
+			n := 0
+			err := Join(context.Background(), joinRows(tt.left, `"l"`), right, opts, func(JoinResult) error {
+				n++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (n == 1) != tt.match {
+				t.Errorf("strategy %d, max rows %d: %s and %s joined %d rows", opts.Strategy, opts.MaxMemoryRows, tt.left, tt.right, n)
+			}
+		}
+	}
+}
+
+func TestAllDocsSourceKeyField(t *testing.T) {
+	rows := []ViewRow{
+		{ID: "a", Key: json.RawMessage(`"a"`), Doc: json.RawMessage(`{"_id":"a","ref":"x"}`)},
+		{ID: "b", Key: json.RawMessage(`"b"`), Doc: json.RawMessage(`{"_id":"b","ref":"y"}`)},
+	}
+	api := newTestAPI(t, fakeView(rows, nil))
+	tests := []struct {
+		keyField string
+		want     []string
+	}{
+		{"", []string{`"a"`, `"b"`}},
+		{"ref", []string{`"x"`, `"y"`}},
+	}
+	for _, tt := range tests {
+		src := &AllDocsSource{API: api, DB: "db", KeyField: tt.keyField, PageSize: 1}
+		var got []string
+		if err := src.Rows(context.Background(), func(r JoinRow) error {
+			got = append(got, string(r.Key))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("KeyField %q: got %v, want %v", tt.keyField, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// LiveEventType is the kind of a LiveEvent
+type LiveEventType int
+
+const (
+	// LiveAdded is sent when a document enters the result set
+	LiveAdded LiveEventType = iota
+	// LiveChanged is sent when a document of the result set got a new revision
+	LiveChanged
+	// LiveRemoved is sent when a document leaves the result set
+	LiveRemoved
+)
+
+// LiveEvent is a change of the result set of a LiveQuery
+type LiveEvent struct {
+	Type LiveEventType
+	ID   string
+	Doc  json.RawMessage
+	// Index is the position in the result set, for LiveRemoved the old position
+	Index int
+}
+
+// LiveQuery is a mango query whose result set is kept current with the _changes feed
+type LiveQuery struct {
+	api    *CouchDBAPI
+	db     string
+	query  FindQuery
+	sort   []sortField
+	events chan LiveEvent
+
+	mu     sync.Mutex
+	docs   map[string]json.RawMessage // every matching document
+	window []string                   // ids of the sorted and limited result set
+	last   map[string]json.RawMessage // documents of the window as they were published
+	err    error
+}
+
+type sortField struct {
+	field string
+	desc  bool
+}
+
+// parseSort reads the sort syntax of _find: "field" or {"field": "desc"}
+func parseSort(spec []any) []sortField {
+	var fields []sortField
+	for _, s := range spec {
+		switch v := s.(type) {
+		case string:
+			fields = append(fields, sortField{field: v})
+		case map[string]string:
+			for f, dir := range v {
+				fields = append(fields, sortField{field: f, desc: dir == "desc"})
+			}
+		case map[string]any:
+			for f, dir := range v {
+				fields = append(fields, sortField{field: f, desc: dir == "desc"})
+			}
+		}
+	}
+	return fields
+}
+
+// LiveFind runs query against db and keeps following the _changes feed of db.
+// Sort, Skip and Limit of the query are applied on the client, so every matching
+// document is held in memory. Every change of the result set is sent to Events,
+// the channel is closed when ctx is done or the feed fails, see Err.
+//
+// The feed is read without the selector filter, because a filtered feed hides documents
+// that stop matching. Changed documents are checked in batches with the same selector
+// by _find instead.
+func (c *CouchDBAPI) LiveFind(ctx context.Context, db string, query FindQuery) (*LiveQuery, error) {
+	info, err := c.DBInfo(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	q := &LiveQuery{
+		api:    c,
+		db:     db,
+		query:  query,
+		sort:   parseSort(query.Sort),
+		events: make(chan LiveEvent, 64),
+		docs:   map[string]json.RawMessage{},
+	}
+	err = c.findAll(ctx, db, q.serverQuery(query.Selector), 0, func(doc json.RawMessage) error {
+		id, _ := docIDRev(doc)
+		q.docs[id] = doc
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	go q.follow(ctx, info.UpdateSeq)
+	return q, nil
+}
+
+// serverQuery is the query sent to _find, sorting and limits are done on the client
+func (q *LiveQuery) serverQuery(selector map[string]any) FindQuery {
+	sq := FindQuery{Selector: selector, UseIndex: q.query.UseIndex}
+	if len(q.query.Fields) > 0 {
+		sq.Fields = append([]string{"_id", "_rev"}, q.query.Fields...)
+		for _, s := range q.sort {
+			sq.Fields = append(sq.Fields, s.field)
+		}
+	}
+	return sq
+}
+
+// Events returns the channel of result set changes
+func (q *LiveQuery) Events() <-chan LiveEvent {
+	return q.events
+}
+
+// Results returns the result set as it was last sent to Events
+func (q *LiveQuery) Results() []json.RawMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	res := make([]json.RawMessage, 0, len(q.window))
+	for _, id := range q.window {
+		// the documents may already be changed or removed by apply before the next publish
+		res = append(res, q.last[id])
+	}
+	return res
+}
+
+// Err returns the error that ended the query after Events was closed
+func (q *LiveQuery) Err() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+func (q *LiveQuery) follow(ctx context.Context, since Seq) {
+	defer close(q.events)
+	err := q.publish(ctx)
+	for err == nil {
+		var res *ChangesResult
+		res, err = q.api.Changes(ctx, q.db, ChangesParams{Feed: "longpoll", Since: since, Timeout: 60000, Limit: 500})
+		if err != nil {
+			break
+		}
+		since = res.LastSeq
+		if len(res.Results) == 0 {
+			continue
+		}
+		if err = q.apply(ctx, res.Results); err == nil {
+			err = q.publish(ctx)
+		}
+	}
+	q.mu.Lock()
+	q.err = err
+	q.mu.Unlock()
+}
+
+// apply rechecks the changed documents against the selector
+func (q *LiveQuery) apply(ctx context.Context, changes []Change) error {
+	var ids []any
+	q.mu.Lock()
+	for _, ch := range changes {
+		if ch.Deleted {
+			delete(q.docs, ch.ID)
+		} else {
+			ids = append(ids, ch.ID)
+		}
+	}
+	q.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	selector := map[string]any{"$and": []any{q.query.Selector, map[string]any{"_id": map[string]any{"$in": ids}}}}
+	matched := map[string]json.RawMessage{}
+	err := q.api.findAll(ctx, q.db, q.serverQuery(selector), 0, func(doc json.RawMessage) error {
+		id, _ := docIDRev(doc)
+		matched[id] = doc
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, id := range ids {
+		if doc, ok := matched[id.(string)]; ok {
+			q.docs[id.(string)] = doc
+		} else {
+			delete(q.docs, id.(string))
+		}
+	}
+	return nil
+}
+
+// publish computes the new result set and sends the difference to the old one
+func (q *LiveQuery) publish(ctx context.Context) error {
+	q.mu.Lock()
+	oldIndex := map[string]int{}
+	for i, id := range q.window {
+		oldIndex[id] = i
+	}
+	window := q.compute()
+	newIndex := map[string]int{}
+	for i, id := range window {
+		newIndex[id] = i
+	}
+	var events []LiveEvent
+	for _, id := range q.window {
+		if _, ok := newIndex[id]; !ok {
+			events = append(events, LiveEvent{Type: LiveRemoved, ID: id, Doc: q.last[id], Index: oldIndex[id]})
+		}
+	}
+	for i, id := range window {
+		doc := q.docs[id]
+		if _, ok := oldIndex[id]; !ok {
+			events = append(events, LiveEvent{Type: LiveAdded, ID: id, Doc: doc, Index: i})
+		} else if _, rev := docIDRev(doc); rev != lastRev(q.last[id]) {
+			events = append(events, LiveEvent{Type: LiveChanged, ID: id, Doc: doc, Index: i})
+		}
+	}
+	q.window = window
+	q.last = map[string]json.RawMessage{}
+	for _, id := range window {
+		q.last[id] = q.docs[id]
+	}
+	q.mu.Unlock()
+
+	for _, ev := range events {
+		select {
+		case q.events <- ev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func lastRev(doc json.RawMessage) string {
+	_, rev := docIDRev(doc)
+	return rev
+}
+
+// compute sorts the matching documents and applies Skip and Limit
+func (q *LiveQuery) compute() []string {
+	ids := make([]string, 0, len(q.docs))
+	keys := map[string][]any{}
+	for id, doc := range q.docs {
+		ids = append(ids, id)
+		for _, s := range q.sort {
+			v, _ := lookupField(doc, s.field)
+			keys[id] = append(keys[id], decodeOrdered(v))
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		for n, s := range q.sort {
+			c := collateValues(keys[ids[i]][n], keys[ids[j]][n])
+			if s.desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return ids[i] < ids[j]
+	})
+	if q.query.Skip > 0 {
+		if q.query.Skip >= len(ids) {
+			return nil
+		}
+		ids = ids[q.query.Skip:]
+	}
+	if q.query.Limit > 0 && len(ids) > q.query.Limit {
+		ids = ids[:q.query.Limit]
+	}
+	return ids
+}
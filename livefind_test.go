@@ -0,0 +1,130 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		spec []any
+		want []sortField
+	}{
+		{nil, nil},
+		{[]any{"a", "b"}, []sortField{{field: "a"}, {field: "b"}}},
+		{[]any{map[string]any{"a": "desc"}, map[string]string{"b": "asc"}}, []sortField{{field: "a", desc: true}, {field: "b"}}},
+		{[]any{42}, nil},
+	}
+	for _, tt := range tests {
+		if got := parseSort(tt.spec); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSort(%v) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestLiveQueryCompute(t *testing.T) {
+	docs := map[string]json.RawMessage{
+		"a": json.RawMessage(`{"_id":"a","n":2,"s":"x"}`),
+		"b": json.RawMessage(`{"_id":"b","n":1,"s":"y"}`),
+		"c": json.RawMessage(`{"_id":"c","n":2,"s":"a"}`),
+		"d": json.RawMessage(`{"_id":"d","s":"b"}`),
+	}
+	tests := []struct {
+		name  string
+		query FindQuery
+		want  []string
+	}{
+		{"by id", FindQuery{}, []string{"a", "b", "c", "d"}},
+		{"missing field first", FindQuery{Sort: []any{"n"}}, []string{"d", "b", "a", "c"}},
+		{"desc", FindQuery{Sort: []any{map[string]any{"n": "desc"}}}, []string{"a", "c", "b", "d"}},
+		{"two fields", FindQuery{Sort: []any{"n", map[string]any{"s": "desc"}}}, []string{"d", "b", "a", "c"}},
+		{"skip and limit", FindQuery{Sort: []any{"s"}, Skip: 1, Limit: 2}, []string{"d", "a"}},
+		{"skip past end", FindQuery{Skip: 4}, nil},
+	}
+	for _, tt := range tests {
+		q := &LiveQuery{query: tt.query, sort: parseSort(tt.query.Sort), docs: docs}
+		if got := q.compute(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLiveQueryResults(t *testing.T) {
+	published := map[string]json.RawMessage{
+		"a": json.RawMessage(`{"_id":"a","_rev":"1-a"}`),
+		"b": json.RawMessage(`{"_id":"b","_rev":"1-b"}`),
+	}
+	tests := []struct {
+		name string
+		docs map[string]json.RawMessage // documents after apply, before publish
+	}{
+		{"published", published},
+		{"removed", map[string]json.RawMessage{"a": published["a"]}},
+		{"changed", map[string]json.RawMessage{"a": json.RawMessage(`{"_id":"a","_rev":"2-a"}`), "b": published["b"]}},
+		{"not fetched", map[string]json.RawMessage{}},
+	}
+	for _, tt := range tests {
+		q := &LiveQuery{docs: tt.docs, window: []string{"a", "b"}, last: published}
+		var got []string
+		for _, doc := range q.Results() {
+			got = append(got, string(doc))
+		}
+		if want := []string{string(published["a"]), string(published["b"])}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Results %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestLiveFind(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"a","type":"x","n":3}`, `{"_id":"b","type":"x","n":1}`, `{"_id":"c","type":"y","n":2}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q, err := api.LiveFind(ctx, "db", FindQuery{Selector: map[string]any{"type": "x"}, Sort: []any{"n"}, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(want ...string) {
+		t.Helper()
+		for _, w := range want {
+			select {
+			case ev, ok := <-q.Events():
+				if !ok {
+					t.Fatalf("events closed: %v", q.Err())
+				}
+				if got := fmt.Sprintf("%d %s %d", ev.Type, ev.ID, ev.Index); got != w {
+					t.Fatalf("got event %q, want %q", got, w)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no event, want %q", w)
+			}
+		}
+	}
+	added, changed, removed := int(LiveAdded), int(LiveChanged), int(LiveRemoved)
+	expect(fmt.Sprint(added, " b 0"), fmt.Sprint(added, " a 1"))
+
+	fc.put(t, "db", `{"_id":"d","type":"x","n":2}`)
+	expect(fmt.Sprint(removed, " a 1"), fmt.Sprint(added, " d 1"))
+
+	b := fc.doc("db", "b")
+	fc.put(t, "db", fmt.Sprintf(`{"_id":"b","_rev":%q,"type":"x","n":0}`, b["_rev"]))
+	expect(fmt.Sprint(changed, " b 0"))
+
+	d := fc.doc("db", "d")
+	fc.put(t, "db", fmt.Sprintf(`{"_id":"d","_rev":%q,"type":"y","n":2}`, d["_rev"]))
+	expect(fmt.Sprint(removed, " d 1"), fmt.Sprint(added, " a 1"))
+
+	if got := len(q.Results()); got != 2 {
+		t.Errorf("Results has %d documents, want 2", got)
+	}
+	cancel()
+	for range q.Events() {
+	}
+	if q.Err() == nil {
+		t.Error("Err is nil after cancel")
+	}
+}
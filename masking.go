@@ -0,0 +1,350 @@
+package golangcouchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ErrMaskedWrite is returned for writes of documents that were masked on read
+var ErrMaskedWrite = errors.New("couchdb: masked documents cannot be written")
+
+// maskedField marks masked documents and lists their masked fields. Couchdb rejects
+// documents with unknown fields starting with "_", so masked documents cannot be
+// written back even by other clients.
+const maskedField = "_masked"
+
+// UserCtx is the user a request is made for, see WithUserCtx
+type UserCtx struct {
+	Name  string
+	Roles []string
+}
+
+type userCtxKey struct{}
+
+// WithUserCtx returns a context whose reads are masked for user
+func WithUserCtx(ctx context.Context, user UserCtx) context.Context {
+	return context.WithValue(ctx, userCtxKey{}, user)
+}
+
+// UserCtxFrom returns the user of ctx, the zero UserCtx has no roles
+func UserCtxFrom(ctx context.Context) UserCtx {
+	u, _ := ctx.Value(userCtxKey{}).(UserCtx)
+	return u
+}
+
+// MaskFunc masks the value of a field, it returns false to remove the field
+type MaskFunc func(value any) (any, bool)
+
+// HideField removes the field
+func HideField(any) (any, bool) { return nil, false }
+
+// Redact replaces the value with text
+func Redact(text string) MaskFunc {
+	return func(any) (any, bool) { return text, true }
+}
+
+// ShowLast keeps the last n characters of strings and replaces the others with "*".
+// Other values are removed.
+func ShowLast(n int) MaskFunc {
+	return func(value any) (any, bool) {
+		s, ok := value.(string)
+		if !ok {
+			return nil, false
+		}
+		r := []rune(s)
+		if len(r) <= n {
+			return strings.Repeat("*", len(r)), true
+		}
+		return strings.Repeat("*", len(r)-n) + string(r[len(r)-n:]), true
+	}
+}
+
+// MaskRule masks a field of documents of a type for users without one of the roles
+type MaskRule struct {
+	// Type is the value of the type field of the documents, "*" for all documents
+	Type string
+	// Field is a dotted path like "ssn" or "bank.iban", arrays are not entered
+	Field string
+	// Roles may see the field unmasked
+	Roles []string
+	// Mask is applied to the field, default HideField
+	Mask MaskFunc
+}
+
+// Masking masks fields of all documents read through a CouchDBAPI depending on the
+// UserCtx of the request. Object values of view rows are masked like documents, by their
+// own type field. Masked documents get a "_masked" field with the masked paths and writing
+// them fails with ErrMaskedWrite. The marker is lost when a document is decoded into a
+// struct, so the last 10000 masked revisions are remembered as well and writing one of
+// them fails too, unless the user of the write may see all its masked fields.
+type Masking struct {
+	// TypeField of the documents, default "type"
+	TypeField string
+	Rules     []MaskRule
+
+	revs maskedRevs
+}
+
+// maxMaskedRevs is the number of masked revisions remembered by a Masking
+const maxMaskedRevs = 10000
+
+// maskedRevs are the revisions masked on read with the rules that masked them
+type maskedRevs struct {
+	mu    sync.Mutex
+	rules map[string][]int // by id and rev
+	order []string
+}
+
+func (r *maskedRevs) add(id, rev string, rules []int) {
+	key := id + "\x00" + rev
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rules == nil {
+		r.rules = map[string][]int{}
+	}
+	if _, ok := r.rules[key]; !ok {
+		r.order = append(r.order, key)
+		if len(r.order) > maxMaskedRevs {
+			delete(r.rules, r.order[0])
+			r.order = r.order[1:]
+		}
+	}
+	r.rules[key] = rules
+}
+
+func (r *maskedRevs) get(id, rev string) ([]int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rules, ok := r.rules[id+"\x00"+rev]
+	return rules, ok
+}
+
+func (m *Masking) typeField() string {
+	if m.TypeField != "" {
+		return m.TypeField
+	}
+	return "type"
+}
+
+func hasRole(user UserCtx, roles []string) bool {
+	for _, r := range user.Roles {
+		if containsString(roles, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply masks a decoded document, it reports whether it changed
+func (m *Masking) apply(user UserCtx, doc map[string]any) bool {
+	docType, _ := doc[m.typeField()].(string)
+	var masked []any
+	var applied []int
+	for i, rule := range m.Rules {
+		if (rule.Type != "*" && rule.Type != docType) || hasRole(user, rule.Roles) {
+			continue
+		}
+		parent := doc
+		path := strings.Split(rule.Field, ".")
+		for _, name := range path[:len(path)-1] {
+			if parent, _ = parent[name].(map[string]any); parent == nil {
+				break
+			}
+		}
+		name := path[len(path)-1]
+		value, ok := parent[name]
+		if parent == nil || !ok {
+			continue
+		}
+		mask := rule.Mask
+		if mask == nil {
+			mask = HideField
+		}
+		if v, keep := mask(value); keep {
+			parent[name] = v
+		} else {
+			delete(parent, name)
+		}
+		masked = append(masked, rule.Field)
+		applied = append(applied, i)
+	}
+	if len(masked) == 0 {
+		return false
+	}
+	doc[maskedField] = masked
+	id, _ := doc["_id"].(string)
+	if rev, _ := doc["_rev"].(string); id != "" && rev != "" {
+		m.revs.add(id, rev, applied)
+	}
+	return true
+}
+
+// walk masks every object with an _id and the object values of view rows in a decoded
+// JSON value, so documents are found in rows, docs and results of all kinds of answers
+func (m *Masking) walk(user UserCtx, v any) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]any:
+		if _, isDoc := v["_id"].(string); isDoc && m.apply(user, v) {
+			changed = true
+		}
+		// the value of a view row may hold fields of the document
+		if _, isRow := v["id"].(string); isRow {
+			if value, ok := v["value"].(map[string]any); ok {
+				if _, isDoc := value["_id"]; !isDoc && m.apply(user, value) {
+					changed = true
+				}
+			}
+		}
+		for k, item := range v {
+			if k != maskedField && m.walk(user, item) {
+				changed = true
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if m.walk(user, item) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// mask masks the documents in a JSON answer, it is returned unchanged if nothing is masked
+func (m *Masking) mask(ctx context.Context, data []byte) []byte {
+	if len(data) == 0 || (data[0] != '{' && data[0] != '[') {
+		return data
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if dec.Decode(&v) != nil || !m.walk(UserCtxFrom(ctx), v) {
+		return data
+	}
+	masked, err := json.Marshal(v)
+	if err != nil {
+		return data
+	}
+	return masked
+}
+
+// maskDoc masks a single document of a streamed answer
+func (c *CouchDBAPI) maskDoc(ctx context.Context, doc json.RawMessage) json.RawMessage {
+	if c.Masking == nil || len(doc) == 0 {
+		return doc
+	}
+	return c.Masking.mask(ctx, doc)
+}
+
+// projection adds _id and the type field to the fields of a _find query, without them
+// the documents and their type are not found. It returns the fields that were added.
+func (m *Masking) projection(fields []string) ([]string, []string) {
+	var added []string
+	for _, f := range []string{"_id", m.typeField()} {
+		if !containsString(fields, f) && !containsString(added, f) {
+			added = append(added, f)
+		}
+	}
+	return append(append([]string(nil), fields...), added...), added
+}
+
+// stripFields removes the fields added by projection from masked documents
+func stripFields(docs []json.RawMessage, fields []string) {
+	for i, doc := range docs {
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(doc, &obj) != nil {
+			continue
+		}
+		for _, f := range fields {
+			delete(obj, f)
+		}
+		docs[i] = mustJSON(obj)
+	}
+}
+
+// isDocWrite reports whether a request writes documents: a PUT of a document or a POST
+// to a database or its _bulk_docs
+func isDocWrite(method, path string) bool {
+	db, rest := splitDBPath(path)
+	if db == "" {
+		return false
+	}
+	second, _, _ := strings.Cut(rest, "/")
+	switch method {
+	case http.MethodPost:
+		return rest == "" || rest == "_bulk_docs"
+	case http.MethodPut:
+		return second != "" && (!strings.HasPrefix(second, "_") || second == "_design" || second == "_local")
+	}
+	return false
+}
+
+// maskRow masks the document and the value of a streamed row
+func (c *CouchDBAPI) maskRow(ctx context.Context, row ViewRow) ViewRow {
+	if c.Masking == nil {
+		return row
+	}
+	data := mustJSON(row)
+	out := c.Masking.mask(ctx, data)
+	var masked ViewRow
+	if bytes.Equal(out, data) || json.Unmarshal(out, &masked) != nil {
+		return row
+	}
+	return masked
+}
+
+// isMasked reports whether a JSON request body contains a masked document
+func isMasked(body []byte) bool {
+	return bytes.Contains(body, []byte(`"`+maskedField+`":`))
+}
+
+// isMaskedWrite reports whether a document write contains a document with the "_masked"
+// marker or a revision that was masked for a user other than the one of ctx
+func (m *Masking) isMaskedWrite(ctx context.Context, method, path string, body []byte) bool {
+	if isMasked(body) {
+		return true
+	}
+	var docs []map[string]any
+	var bulk struct {
+		Docs []map[string]any `json:"docs"`
+	}
+	_, rest := splitDBPath(path)
+	if rest == "_bulk_docs" {
+		json.Unmarshal(body, &bulk)
+		docs = bulk.Docs
+	} else {
+		var doc map[string]any
+		json.Unmarshal(body, &doc)
+		if doc == nil {
+			return false
+		}
+		if _, ok := doc["_id"]; !ok && method == http.MethodPut {
+			if id, err := url.PathUnescape(rest); err == nil {
+				doc["_id"] = id
+			}
+		}
+		docs = append(docs, doc)
+	}
+	user := UserCtxFrom(ctx)
+	for _, doc := range docs {
+		id, _ := doc["_id"].(string)
+		rev, _ := doc["_rev"].(string)
+		rules, ok := m.revs.get(id, rev)
+		if !ok {
+			continue
+		}
+		for _, i := range rules {
+			if i >= len(m.Rules) || !hasRole(user, m.Rules[i].Roles) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var testMasking = &Masking{Rules: []MaskRule{
+	{Type: "person", Field: "ssn", Roles: []string{"hr"}},
+	{Type: "person", Field: "bank.iban", Mask: ShowLast(4)},
+	{Type: "*", Field: "secret", Mask: Redact("xxx")},
+}}
+
+func TestMaskingApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		roles []string
+		doc   string
+		want  string
+	}{
+		{"hidden", nil, `{"type":"person","ssn":"1","name":"a"}`, `{"_masked":["ssn"],"name":"a","type":"person"}`},
+		{"role sees the field", []string{"hr"}, `{"type":"person","ssn":"1"}`, `{"ssn":"1","type":"person"}`},
+		{"nested", nil, `{"type":"person","bank":{"iban":"DE1234567"}}`, `{"_masked":["bank.iban"],"bank":{"iban":"*****4567"},"type":"person"}`},
+		{"nested parent missing", nil, `{"type":"person","bank":"none"}`, `{"bank":"none","type":"person"}`},
+		{"other type", nil, `{"type":"order","ssn":"1"}`, `{"ssn":"1","type":"order"}`},
+		{"all types", nil, `{"secret":"s"}`, `{"_masked":["secret"],"secret":"xxx"}`},
+	}
+	for _, tt := range tests {
+		var doc map[string]any
+		json.Unmarshal([]byte(tt.doc), &doc)
+		testMasking.apply(UserCtx{Roles: tt.roles}, doc)
+		if got := string(mustJSON(doc)); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShowLast(t *testing.T) {
+	tests := []struct {
+		value any
+		want  string // JSON, empty for removed
+	}{
+		{"abcdef", `"**cdef"`},
+		{"äbc", `"***"`},
+		{12345, ``},
+	}
+	for _, tt := range tests {
+		v, keep := ShowLast(4)(tt.value)
+		got := ""
+		if keep {
+			got = string(mustJSON(v))
+		}
+		if got != tt.want {
+			t.Errorf("ShowLast(4)(%v) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestIsDocWrite(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{"PUT", "db/doc", true},
+		{"PUT", "db/_design/app", true},
+		{"PUT", "db/_local/cp", true},
+		{"POST", "db", true},
+		{"POST", "db/_bulk_docs", true},
+		{"PUT", "_users/org.couchdb.user:a", true},
+		{"POST", "db/_find", false},
+		{"POST", "db/_bulk_get", false},
+		{"PUT", "db/_security", false},
+		{"PUT", "db", false},
+		{"GET", "db/doc", false},
+	}
+	for _, tt := range tests {
+		if got := isDocWrite(tt.method, tt.path); got != tt.want {
+			t.Errorf("isDocWrite(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestMaskingReads(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"p1","type":"person","name":"a","ssn":"111","bank":{"iban":"DE0012345"}}`,
+		`{"_id":"o1","type":"order","ssn":"not masked"}`)
+	fc.handle(http.MethodGet, "/db/_design/app/_view/v", fakeView([]ViewRow{
+		viewRow("p1", `"a"`, `{"type":"person","ssn":"111"}`),
+		viewRow("o1", `"b"`, `"111"`),
+	}, nil))
+	api.Masking = testMasking
+	ctx := WithUserCtx(context.Background(), UserCtx{Name: "u"})
+	hr := WithUserCtx(context.Background(), UserCtx{Name: "h", Roles: []string{"hr"}})
+	// every read returns the JSON of p1 (or its fields)
+	reads := []struct {
+		name string
+		read func(ctx context.Context) (string, error)
+	}{
+		{"get", func(ctx context.Context) (string, error) {
+			var doc json.RawMessage
+			err := api.GetDoc(ctx, "db", "p1", &doc)
+			return string(doc), err
+		}},
+		{"find", func(ctx context.Context) (string, error) {
+			res, err := api.Find(ctx, "db", FindQuery{Selector: map[string]any{"name": "a"}})
+			if err != nil || len(res.Docs) != 1 {
+				return "", err
+			}
+			return string(res.Docs[0]), nil
+		}},
+		{"find with fields", func(ctx context.Context) (string, error) {
+			res, err := api.Find(ctx, "db", FindQuery{Selector: map[string]any{"name": "a"}, Fields: []string{"ssn", "bank.iban"}})
+			if err != nil || len(res.Docs) != 1 {
+				return "", err
+			}
+			return string(res.Docs[0]), nil
+		}},
+		{"all_docs", func(ctx context.Context) (string, error) {
+			res, err := api.AllDocs(ctx, "db", ViewParams{Key: "p1", IncludeDocs: true})
+			if err != nil || len(res.Rows) != 1 {
+				return "", err
+			}
+			return string(res.Rows[0].Doc), nil
+		}},
+		{"view value", func(ctx context.Context) (string, error) {
+			res, err := api.View(ctx, "db", "app", "v", ViewParams{Key: "a"})
+			if err != nil || len(res.Rows) != 1 {
+				return "", err
+			}
+			return string(res.Rows[0].Value), nil
+		}},
+		{"streamed view value", func(ctx context.Context) (string, error) {
+			var value string
+			err := api.StreamView(ctx, "db", "app", "v", ViewParams{Key: "a"}, func(row ViewRow) error {
+				value = string(row.Value)
+				return nil
+			})
+			return value, err
+		}},
+		{"changes", func(ctx context.Context) (string, error) {
+			res, err := api.Changes(ctx, "db", ChangesParams{IncludeDocs: true})
+			if err != nil {
+				return "", err
+			}
+			for _, ch := range res.Results {
+				if ch.ID == "p1" {
+					return string(ch.Doc), nil
+				}
+			}
+			return "", nil
+		}},
+		{"bulk_get", func(ctx context.Context) (string, error) {
+			var doc string
+			err := api.BulkGet(ctx, "db", []BulkGetDoc{{ID: "p1"}}, false, func(res BulkGetResult) error {
+				doc = string(res.Doc)
+				return nil
+			})
+			return doc, err
+		}},
+	}
+	for _, r := range reads {
+		got, err := r.read(ctx)
+		if err != nil {
+			t.Fatalf("%s: %v", r.name, err)
+		}
+		if strings.Contains(got, "111") || strings.Contains(got, "DE0012345") || !strings.Contains(got, `"_masked"`) {
+			t.Errorf("%s: not masked: %s", r.name, got)
+		}
+		if got, _ := r.read(hr); !strings.Contains(got, "111") {
+			t.Errorf("%s: masked for hr: %s", r.name, got)
+		}
+	}
+	// the fields added for the masking are not returned
+	res, _ := api.Find(ctx, "db", FindQuery{Selector: map[string]any{"name": "a"}, Fields: []string{"name"}})
+	if got := string(res.Docs[0]); got != `{"name":"a"}` {
+		t.Errorf("projection %s", got)
+	}
+}
+
+func TestMaskingWrites(t *testing.T) {
+	_, api := newFakeCouch(t, "db")
+	masked := map[string]any{"_masked": []string{"ssn"}, "ssn": nil}
+	// without Masking the check is off
+	if _, err := api.Find(context.Background(), "db", FindQuery{Selector: map[string]any{"_masked": map[string]any{"$exists": true}}}); err != nil {
+		t.Errorf("find: %v", err)
+	}
+	api.Masking = testMasking
+	tests := []struct {
+		name  string
+		write func() error
+		want  error
+	}{
+		{"put", func() error { _, err := api.PutDoc(context.Background(), "db", "a", masked); return err }, ErrMaskedWrite},
+		{"bulk", func() error { _, err := api.BulkDocs(context.Background(), "db", []any{masked}); return err }, ErrMaskedWrite},
+		{"find selector", func() error {
+			_, err := api.Find(context.Background(), "db", FindQuery{Selector: map[string]any{"_masked": map[string]any{"$exists": true}}})
+			return err
+		}, nil},
+		{"unmasked", func() error {
+			_, err := api.PutDoc(context.Background(), "db", "b", map[string]any{"x": 1})
+			return err
+		}, nil},
+	}
+	for _, tt := range tests {
+		if err := tt.write(); err != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+type maskedPerson struct {
+	ID   string `json:"_id"`
+	Rev  string `json:"_rev,omitempty"`
+	Type string `json:"type"`
+	SSN  string `json:"ssn,omitempty"`
+	Name string `json:"name"`
+}
+
+func TestMaskingStructWrites(t *testing.T) {
+	user := WithUserCtx(context.Background(), UserCtx{Name: "u"})
+	hr := WithUserCtx(context.Background(), UserCtx{Name: "h", Roles: []string{"hr"}})
+	tests := []struct {
+		name        string
+		read, write context.Context
+		bulk        bool
+		want        error
+	}{
+		{"masked read, put", user, user, false, ErrMaskedWrite},
+		{"masked read, bulk", user, user, true, ErrMaskedWrite},
+		{"masked read, written without a user", user, context.Background(), false, ErrMaskedWrite},
+		{"masked read, written by a user with the role", user, hr, false, nil},
+		{"unmasked read", hr, user, false, nil},
+	}
+	for _, tt := range tests {
+		fc, api := newFakeCouch(t, "db")
+		fc.put(t, "db", `{"_id":"p","type":"person","ssn":"123-45","name":"a"}`)
+		api.Masking = &Masking{Rules: testMasking.Rules}
+		// the marker is lost in the struct
+		var p maskedPerson
+		if err := api.GetDoc(tt.read, "db", "p", &p); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		p.Name = "b"
+		var err error
+		if tt.bulk {
+			_, err = api.BulkDocs(tt.write, "db", []any{p})
+		} else {
+			_, err = api.PutDoc(tt.write, "db", p.ID, p)
+		}
+		if err != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+		if ssn := fc.doc("db", "p")["ssn"]; tt.want != nil && ssn != "123-45" {
+			t.Errorf("%s: ssn is %v", tt.name, ssn)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mismatch is a difference between the clusters found by a shadow read or a failed
+// mirrored write
+type Mismatch struct {
+	DB  string
+	Op  string // e.g. "get", "find", "view", "put"
+	Key string // document id or a description of the query
+	// Diffs are the differences, Old is the authoritative cluster
+	Diffs []FieldDiff
+	// Err is the error of the shadow request, or the other error if only one failed
+	Err error
+}
+
+func (m Mismatch) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "couchdb migration: %s %s %s", m.Op, m.DB, m.Key)
+	if m.Err != nil {
+		fmt.Fprintf(&b, ": %v", m.Err)
+	}
+	for _, d := range m.Diffs {
+		b.WriteString("\n")
+		b.WriteString(d.Unified())
+	}
+	return b.String()
+}
+
+// Migration writes to two clusters and shadows reads to the one that is not
+// authoritative. Until a database is cut over, Old is authoritative: its answers are
+// returned and its revisions are copied to New with new_edits=false, so both clusters
+// keep the same revision trees. After Cutover the roles are switched, which can be
+// undone at runtime with Rollback.
+type Migration struct {
+	Old *CouchDBAPI
+	New *CouchDBAPI
+	// OnMismatch is called for every difference, default log.Print
+	OnMismatch func(Mismatch)
+	// ShadowTimeout limits a shadow read, default 10s
+	ShadowTimeout time.Duration
+	// MaxShadow is the number of shadow reads running at the same time, further reads
+	// are not shadowed. Default 16.
+	MaxShadow int
+
+	mu      sync.RWMutex
+	cutover map[string]bool
+	once    sync.Once
+	shadows chan struct{}
+}
+
+// Cutover makes New authoritative for db
+func (m *Migration) Cutover(db string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cutover == nil {
+		m.cutover = map[string]bool{}
+	}
+	m.cutover[db] = true
+}
+
+// Rollback makes Old authoritative for db again
+func (m *Migration) Rollback(db string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.cutover, db)
+}
+
+// IsCutover reports whether New is authoritative for db
+func (m *Migration) IsCutover(db string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cutover[db]
+}
+
+// Primary returns the authoritative cluster of db, for requests the Migration does not wrap
+func (m *Migration) Primary(db string) *CouchDBAPI {
+	primary, _ := m.clusters(db)
+	return primary
+}
+
+func (m *Migration) clusters(db string) (primary, shadow *CouchDBAPI) {
+	if m.IsCutover(db) {
+		return m.New, m.Old
+	}
+	return m.Old, m.New
+}
+
+func (m *Migration) report(mm Mismatch) {
+	if m.OnMismatch != nil {
+		m.OnMismatch(mm)
+		return
+	}
+	log.Print(mm)
+}
+
+// shadow runs read against the shadow cluster in the background and reports a
+// difference to want. Reads are dropped when MaxShadow are running.
+func (m *Migration) shadow(ctx context.Context, mm Mismatch, want json.RawMessage, wantErr error, read func(ctx context.Context) (json.RawMessage, error)) {
+	m.once.Do(func() {
+		n := m.MaxShadow
+		if n <= 0 {
+			n = 16
+		}
+		m.shadows = make(chan struct{}, n)
+	})
+	select {
+	case m.shadows <- struct{}{}:
+	default:
+		return
+	}
+	timeout := m.ShadowTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	// the shadow read must not be canceled with the request it shadows
+	values := ctx
+	go func() {
+		defer func() { <-m.shadows }()
+		ctx, cancel := context.WithTimeout(detached{values}, timeout)
+		defer cancel()
+		got, err := read(ctx)
+		switch {
+		case err != nil && wantErr != nil:
+			if sameError(err, wantErr) {
+				return
+			}
+			mm.Err = err
+		case err != nil || wantErr != nil:
+			if err == nil {
+				err = wantErr
+			}
+			mm.Err = err
+		default:
+			if mm.Diffs = diffJSON(want, got); len(mm.Diffs) == 0 {
+				return
+			}
+		}
+		m.report(mm)
+	}()
+}
+
+// detached keeps the values of a context but not its deadline and cancellation
+type detached struct{ context.Context }
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+func sameError(a, b error) bool {
+	ea, okA := a.(*Error)
+	eb, okB := b.(*Error)
+	return okA && okB && ea.StatusCode == eb.StatusCode && ea.ErrorName == eb.ErrorName
+}
+
+// GetDoc reads a document from the authoritative cluster into out
+func (m *Migration) GetDoc(ctx context.Context, db, id string, out any) error {
+	primary, shadow := m.clusters(db)
+	var raw json.RawMessage
+	err := primary.GetDoc(ctx, db, id, &raw)
+	m.shadow(ctx, Mismatch{DB: db, Op: "get", Key: id}, raw, err, func(ctx context.Context) (json.RawMessage, error) {
+		var got json.RawMessage
+		err := shadow.GetDoc(ctx, db, id, &got)
+		return got, err
+	})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// Find runs a query on the authoritative cluster. The shadow compares the documents by _id.
+func (m *Migration) Find(ctx context.Context, db string, query FindQuery) (*FindResult, error) {
+	primary, shadow := m.clusters(db)
+	res, err := primary.Find(ctx, db, query)
+	var want json.RawMessage
+	if err == nil {
+		want = docsByID(res.Docs)
+	}
+	m.shadow(ctx, Mismatch{DB: db, Op: "find", Key: string(mustJSON(query.Selector))}, want, err, func(ctx context.Context) (json.RawMessage, error) {
+		got, err := shadow.Find(ctx, db, query)
+		if err != nil {
+			return nil, err
+		}
+		return docsByID(got.Docs), nil
+	})
+	return res, err
+}
+
+// View queries a view on the authoritative cluster. The shadow compares the rows by position.
+func (m *Migration) View(ctx context.Context, db, ddoc, view string, params ViewParams) (*ViewResult, error) {
+	return m.queryView(ctx, db, "view", ddoc+"/"+view, params, func(c *CouchDBAPI, ctx context.Context) (*ViewResult, error) {
+		return c.View(ctx, db, ddoc, view, params)
+	})
+}
+
+// AllDocs reads _all_docs of the authoritative cluster
+func (m *Migration) AllDocs(ctx context.Context, db string, params ViewParams) (*ViewResult, error) {
+	return m.queryView(ctx, db, "all_docs", "_all_docs", params, func(c *CouchDBAPI, ctx context.Context) (*ViewResult, error) {
+		return c.AllDocs(ctx, db, params)
+	})
+}
+
+func (m *Migration) queryView(ctx context.Context, db, op, key string, params ViewParams, query func(*CouchDBAPI, context.Context) (*ViewResult, error)) (*ViewResult, error) {
+	primary, shadow := m.clusters(db)
+	res, err := query(primary, ctx)
+	var want json.RawMessage
+	if err == nil {
+		want = rowsByPosition(res.Rows)
+	}
+	key += "?" + params.values().Encode()
+	m.shadow(ctx, Mismatch{DB: db, Op: op, Key: key}, want, err, func(ctx context.Context) (json.RawMessage, error) {
+		got, err := query(shadow, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return rowsByPosition(got.Rows), nil
+	})
+	return res, err
+}
+
+// docsByID turns a list of documents into an object keyed by _id, so diffs name the documents
+func docsByID(docs []json.RawMessage) json.RawMessage {
+	obj := make(map[string]json.RawMessage, len(docs))
+	for i, doc := range docs {
+		id, _ := docIDRev(doc)
+		if id == "" {
+			id = strconv.Itoa(i)
+		}
+		obj[id] = doc
+	}
+	return mustJSON(obj)
+}
+
+func rowsByPosition(rows []ViewRow) json.RawMessage {
+	obj := make(map[string]ViewRow, len(rows))
+	for i, row := range rows {
+		obj[strconv.Itoa(i)] = row
+	}
+	return mustJSON(obj)
+}
+
+// PutDoc writes a document to the authoritative cluster and copies the new revision to the other
+func (m *Migration) PutDoc(ctx context.Context, db, id string, doc any) (string, error) {
+	primary, _ := m.clusters(db)
+	var fields map[string]any
+	if err := json.Unmarshal(mustJSON(doc), &fields); err != nil {
+		return "", err
+	}
+	prev, _ := fields["_rev"].(string)
+	rev, err := primary.PutDoc(ctx, db, id, doc)
+	if err != nil {
+		return "", err
+	}
+	fields["_id"] = id
+	m.mirror(ctx, db, "put", []mirroredDoc{{fields: fields, prev: prev, rev: rev}})
+	return rev, nil
+}
+
+// DeleteDoc deletes a document on the authoritative cluster and copies the tombstone to the other
+func (m *Migration) DeleteDoc(ctx context.Context, db, id, rev string) (string, error) {
+	primary, _ := m.clusters(db)
+	newRev, err := primary.DeleteDoc(ctx, db, id, rev)
+	if err != nil {
+		return "", err
+	}
+	tombstone := map[string]any{"_id": id, "_deleted": true}
+	m.mirror(ctx, db, "delete", []mirroredDoc{{fields: tombstone, prev: rev, rev: newRev}})
+	return newRev, nil
+}
+
+// BulkDocs writes documents to the authoritative cluster and copies the written revisions to the other
+func (m *Migration) BulkDocs(ctx context.Context, db string, docs []any) ([]BulkResult, error) {
+	primary, _ := m.clusters(db)
+	res, err := primary.BulkDocs(ctx, db, docs)
+	if err != nil {
+		return nil, err
+	}
+	var written []mirroredDoc
+	for i, r := range res {
+		if r.Err() != nil || i >= len(docs) {
+			continue
+		}
+		var fields map[string]any
+		if json.Unmarshal(mustJSON(docs[i]), &fields) != nil {
+			continue
+		}
+		prev, _ := fields["_rev"].(string)
+		fields["_id"] = r.ID
+		written = append(written, mirroredDoc{fields: fields, prev: prev, rev: r.Rev})
+	}
+	m.mirror(ctx, db, "bulk_docs", written)
+	return res, nil
+}
+
+type mirroredDoc struct {
+	fields    map[string]any
+	prev, rev string
+}
+
+// mirror writes revisions created on the authoritative cluster with new_edits=false to
+// the other one. Failures are reported as mismatches, the write itself succeeded.
+func (m *Migration) mirror(ctx context.Context, db, op string, docs []mirroredDoc) {
+	if len(docs) == 0 {
+		return
+	}
+	_, shadow := m.clusters(db)
+	body := make([]any, 0, len(docs))
+	for _, d := range docs {
+		start, hash := splitRev(d.rev)
+		ids := []string{hash}
+		if _, prevHash := splitRev(d.prev); d.prev != "" {
+			ids = append(ids, prevHash)
+		}
+		d.fields["_rev"] = d.rev
+		d.fields["_revisions"] = map[string]any{"start": start, "ids": ids}
+		body = append(body, d.fields)
+	}
+	var res []BulkResult
+	err := shadow.doJSON(ctx, http.MethodPost, dbPath(db)+"/_bulk_docs", nil, map[string]any{"docs": body, "new_edits": false}, &res)
+	if err != nil {
+		m.report(Mismatch{DB: db, Op: op, Key: docs[0].fields["_id"].(string), Err: err})
+		return
+	}
+	for _, r := range res {
+		if err := r.Err(); err != nil {
+			m.report(Mismatch{DB: db, Op: op, Key: r.ID, Err: err})
+		}
+	}
+}
+
+// splitRev splits "3-abc" into 3 and "abc"
+func splitRev(rev string) (int, string) {
+	n, hash, _ := strings.Cut(rev, "-")
+	start, _ := strconv.Atoi(n)
+	return start, hash
+}
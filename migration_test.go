@@ -0,0 +1,201 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSplitRev(t *testing.T) {
+	tests := []struct {
+		rev   string
+		start int
+		hash  string
+	}{
+		{"3-abc", 3, "abc"},
+		{"12-x-y", 12, "x-y"},
+		{"", 0, ""},
+		{"bad", 0, ""},
+	}
+	for _, tt := range tests {
+		if start, hash := splitRev(tt.rev); start != tt.start || hash != tt.hash {
+			t.Errorf("splitRev(%q) = %d, %q, want %d, %q", tt.rev, start, hash, tt.start, tt.hash)
+		}
+	}
+}
+
+func TestSameError(t *testing.T) {
+	notFound := &Error{StatusCode: 404, ErrorName: "not_found", Reason: "missing"}
+	tests := []struct {
+		a, b error
+		want bool
+	}{
+		{notFound, &Error{StatusCode: 404, ErrorName: "not_found", Reason: "deleted"}, true},
+		{notFound, &Error{StatusCode: 404, ErrorName: "other"}, false},
+		{notFound, &Error{StatusCode: 500, ErrorName: "not_found"}, false},
+		{notFound, errors.New("not_found"), false},
+	}
+	for _, tt := range tests {
+		if got := sameError(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameError(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDocsByID(t *testing.T) {
+	got := docsByID([]json.RawMessage{json.RawMessage(`{"_id":"b","x":1}`), json.RawMessage(`{"y":2}`)})
+	if want := `{"1":{"y":2},"b":{"_id":"b","x":1}}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// newTestMigration returns a Migration between two fake clusters with the databases dbs
+// and a func that waits for the running shadow reads and returns the mismatches so far
+func newTestMigration(t *testing.T, dbs ...string) (*fakeCouch, *fakeCouch, *Migration, func() []Mismatch) {
+	oldFC, oldAPI := newFakeCouch(t, dbs...)
+	newFC, newAPI := newFakeCouch(t, dbs...)
+	var mu sync.Mutex
+	var found []Mismatch
+	m := &Migration{Old: oldAPI, New: newAPI, OnMismatch: func(mm Mismatch) {
+		mu.Lock()
+		found = append(found, mm)
+		mu.Unlock()
+	}}
+	mismatches := func() []Mismatch {
+		waitFor(t, "shadow reads", func() bool { return m.shadows == nil || len(m.shadows) == 0 })
+		mu.Lock()
+		defer mu.Unlock()
+		list := found
+		found = nil
+		return list
+	}
+	return oldFC, newFC, m, mismatches
+}
+
+func TestMigrationWrites(t *testing.T) {
+	oldFC, newFC, m, mismatches := newTestMigration(t, "db")
+	ctx := context.Background()
+	same := func(what, id string) {
+		t.Helper()
+		o, n := oldFC.doc("db", id), newFC.doc("db", id)
+		if string(mustJSON(o)) != string(mustJSON(n)) {
+			t.Errorf("%s: old %v, new %v", what, o, n)
+		}
+	}
+	rev, err := m.PutDoc(ctx, "db", "a", map[string]any{"x": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	same("create", "a")
+	if rev, err = m.PutDoc(ctx, "db", "a", map[string]any{"_rev": rev, "x": 2}); err != nil {
+		t.Fatal(err)
+	}
+	same("update", "a")
+	if _, err := m.BulkDocs(ctx, "db", []any{map[string]any{"_id": "b"}, map[string]any{"_id": "a", "_rev": "1-stale"}}); err != nil {
+		t.Fatal(err)
+	}
+	same("bulk", "b")
+	same("bulk conflict", "a")
+	if _, err := m.DeleteDoc(ctx, "db", "a", rev); err != nil {
+		t.Fatal(err)
+	}
+	if oldFC.doc("db", "a") != nil || newFC.doc("db", "a") != nil {
+		t.Error("delete was not mirrored")
+	}
+	if got := mismatches(); len(got) != 0 {
+		t.Errorf("mismatches %v", got)
+	}
+
+	// after the cutover New is written first
+	m.Cutover("db")
+	if m.Primary("db") != m.New {
+		t.Error("Primary is not New after Cutover")
+	}
+	if _, err := m.PutDoc(ctx, "db", "c", map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	same("cutover", "c")
+	m.Rollback("db")
+	if m.IsCutover("db") {
+		t.Error("Rollback did not switch back")
+	}
+
+	// a mirror failure is reported, the write succeeds
+	newFC.handle("POST", "/db/_bulk_docs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusInternalServerError, "unknown_error", "down")
+	})
+	if _, err := m.PutDoc(ctx, "db", "d", map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := mismatches(); len(got) != 1 || got[0].Op != "put" || got[0].Key != "d" || got[0].Err == nil {
+		t.Errorf("mismatches %v", got)
+	}
+}
+
+func TestMigrationShadowReads(t *testing.T) {
+	oldFC, newFC, m, mismatches := newTestMigration(t, "db")
+	ctx := context.Background()
+	oldFC.put(t, "db", `{"_id":"a","x":1}`, `{"_id":"b","x":1}`, `{"_id":"old"}`)
+	newFC.put(t, "db", `{"_id":"a","x":1}`, `{"_id":"b","x":2}`, `{"_id":"new"}`)
+	read := func(op, id string) error {
+		switch op {
+		case "get":
+			var doc map[string]any
+			return m.GetDoc(ctx, "db", id, &doc)
+		case "find":
+			_, err := m.Find(ctx, "db", FindQuery{Selector: map[string]any{"_id": id}})
+			return err
+		default:
+			_, err := m.AllDocs(ctx, "db", ViewParams{Key: id})
+			return err
+		}
+	}
+	tests := []struct {
+		name, op, id string
+		wantErr      bool
+		want         string // the mismatch, empty for none
+	}{
+		{"same", "get", "a", false, ""},
+		{"different", "get", "b", false, "_rev,x"},
+		{"missing in both", "get", "nope", true, ""},
+		{"missing in new", "get", "old", false, "error"},
+		{"missing in old", "get", "new", true, "error"},
+		{"find same", "find", "a", false, ""},
+		{"find different", "find", "b", false, "b._rev,b.x"},
+		{"all_docs different", "all_docs", "b", false, "0.value.rev"},
+	}
+	for _, tt := range tests {
+		if err := read(tt.op, tt.id); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v", tt.name, err)
+		}
+		got := ""
+		if list := mismatches(); len(list) > 1 {
+			t.Errorf("%s: mismatches %v", tt.name, list)
+		} else if len(list) == 1 && list[0].Err != nil {
+			got = "error"
+		} else if len(list) == 1 {
+			var paths []string
+			for _, d := range list[0].Diffs {
+				paths = append(paths, d.Path)
+			}
+			got = strings.Join(paths, ",")
+		}
+		if got != tt.want {
+			t.Errorf("%s: mismatch %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// after the cutover the answers of New are returned and Old is shadowed
+	m.Cutover("db")
+	var doc map[string]any
+	if err := m.GetDoc(ctx, "db", "b", &doc); err != nil || doc["x"] != 2.0 {
+		t.Errorf("got %v, %v", doc, err)
+	}
+	if got := mismatches(); len(got) != 1 || !strings.Contains(got[0].String(), "get db b") {
+		t.Errorf("mismatches %v", got)
+	}
+}
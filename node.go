@@ -0,0 +1,149 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// Membership are the nodes of a cluster
+type Membership struct {
+	AllNodes     []string `json:"all_nodes"`
+	ClusterNodes []string `json:"cluster_nodes"`
+}
+
+// Membership returns the nodes of the cluster
+func (c *CouchDBAPI) Membership(ctx context.Context) (*Membership, error) {
+	var m Membership
+	if err := c.doJSON(ctx, http.MethodGet, "_membership", nil, nil, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// nodePath is the path of a node endpoint, node "_local" is the node answering the request
+func nodePath(node, endpoint string) string {
+	return "_node/" + url.PathEscape(node) + "/" + endpoint
+}
+
+// NodeConfig returns the configuration of a node by section and key
+func (c *CouchDBAPI) NodeConfig(ctx context.Context, node string) (map[string]map[string]string, error) {
+	var cfg map[string]map[string]string
+	if err := c.doJSON(ctx, http.MethodGet, nodePath(node, "_config"), nil, nil, &cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ActiveTask is an entry of _active_tasks, fields that only some task types have are empty otherwise
+type ActiveTask struct {
+	Node           string `json:"node"`
+	PID            string `json:"pid"`
+	Type           string `json:"type"`
+	Database       string `json:"database"`
+	DesignDocument string `json:"design_document"`
+	Progress       int    `json:"progress"`
+	ChangesDone    int64  `json:"changes_done"`
+	TotalChanges   int64  `json:"total_changes"`
+	DocsRead       int64  `json:"docs_read"`
+	DocsWritten    int64  `json:"docs_written"`
+	Source         string `json:"source"`
+	Target         string `json:"target"`
+	ReplicationID  string `json:"replication_id"`
+	StartedOn      int64  `json:"started_on"`
+	UpdatedOn      int64  `json:"updated_on"`
+}
+
+// ActiveTasks returns the running tasks of all nodes
+func (c *CouchDBAPI) ActiveTasks(ctx context.Context) ([]ActiveTask, error) {
+	var tasks []ActiveTask
+	if err := c.doJSON(ctx, http.MethodGet, "_active_tasks", nil, nil, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// SchedulerJob is a replication job of _scheduler/jobs
+type SchedulerJob struct {
+	ID        string `json:"id"`
+	Database  string `json:"database"`
+	DocID     string `json:"doc_id"`
+	Node      string `json:"node"`
+	Source    string `json:"source"`
+	Target    string `json:"target"`
+	StartTime string `json:"start_time"`
+	History   []struct {
+		Type      string `json:"type"`
+		Timestamp string `json:"timestamp"`
+		Reason    string `json:"reason,omitempty"`
+	} `json:"history"`
+	Info struct {
+		DocsRead         int64 `json:"docs_read"`
+		DocsWritten      int64 `json:"docs_written"`
+		DocWriteFailures int64 `json:"doc_write_failures"`
+		ChangesPending   int64 `json:"changes_pending"`
+	} `json:"info"`
+}
+
+// State is the type of the latest history entry, like "started" or "crashed"
+func (j SchedulerJob) State() string {
+	if len(j.History) == 0 {
+		return ""
+	}
+	return j.History[0].Type
+}
+
+// SchedulerJobs returns the replication jobs of the cluster
+func (c *CouchDBAPI) SchedulerJobs(ctx context.Context) ([]SchedulerJob, error) {
+	var res struct {
+		Jobs []SchedulerJob `json:"jobs"`
+	}
+	if err := c.doJSON(ctx, http.MethodGet, "_scheduler/jobs", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Jobs, nil
+}
+
+// NodeStats are the statistics of a node as sent by _node/{node}/_stats
+type NodeStats json.RawMessage
+
+// Value returns the value of a statistic by dotted path, like "couchdb.httpd.requests"
+func (s NodeStats) Value(path string) float64 {
+	raw, ok := lookupField(json.RawMessage(s), path+".value")
+	if !ok {
+		return 0
+	}
+	var v float64
+	json.Unmarshal(raw, &v)
+	return v
+}
+
+// NodeStats returns the statistics of a node
+func (c *CouchDBAPI) NodeStats(ctx context.Context, node string) (NodeStats, error) {
+	var stats json.RawMessage
+	if err := c.doJSON(ctx, http.MethodGet, nodePath(node, "_stats"), nil, nil, &stats); err != nil {
+		return nil, err
+	}
+	return NodeStats(stats), nil
+}
+
+// NodeSystem is the state of the Erlang VM of a node
+type NodeSystem struct {
+	Uptime       int64            `json:"uptime"`
+	Memory       map[string]int64 `json:"memory"`
+	RunQueue     int64            `json:"run_queue"`
+	ProcessCount int64            `json:"process_count"`
+	ProcessLimit int64            `json:"process_limit"`
+	// MessageQueues are the message queue lengths of named processes, some are objects with details
+	MessageQueues map[string]json.RawMessage `json:"message_queues"`
+}
+
+// NodeSystem returns the VM state of a node
+func (c *CouchDBAPI) NodeSystem(ctx context.Context, node string) (*NodeSystem, error) {
+	var sys NodeSystem
+	if err := c.doJSON(ctx, http.MethodGet, nodePath(node, "_system"), nil, nil, &sys); err != nil {
+		return nil, err
+	}
+	return &sys, nil
+}
@@ -0,0 +1,188 @@
+package golangcouchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// BlobRefContentType is the content type of attachments that were moved into a BlobStore
+const BlobRefContentType = "application/vnd.couchdb.blob-ref+json"
+
+// BlobRef replaces the content of an offloaded attachment. GetAttachment resolves it
+// when CouchDBAPI.Blobs is set.
+type BlobRef struct {
+	Location    string `json:"location"`
+	Digest      string `json:"digest"` // digest of the original attachment, "md5-..."
+	Length      int64  `json:"length"`
+	ContentType string `json:"content_type"`
+}
+
+// resolveBlobRef opens the blob of a reference attachment
+func (c *CouchDBAPI) resolveBlobRef(ctx context.Context, att *AttachmentReader) (*AttachmentReader, error) {
+	defer att.Close()
+	var ref BlobRef
+	if err := json.NewDecoder(io.LimitReader(att, 64*1024)).Decode(&ref); err != nil {
+		return nil, fmt.Errorf("couchdb: invalid blob reference: %w", err)
+	}
+	r, err := c.Blobs.Get(ctx, ref.Location)
+	if err != nil {
+		return nil, err
+	}
+	return &AttachmentReader{ReadCloser: r, ContentType: ref.ContentType, Length: ref.Length, Digest: ref.Digest}, nil
+}
+
+// resolveBulkGetBlobs replaces the BlobRef attachments of a BulkGet result by their blobs,
+// in Attachments as well as inline data of the document
+func (c *CouchDBAPI) resolveBulkGetBlobs(ctx context.Context, res *BulkGetResult) error {
+	var doc map[string]json.RawMessage
+	var atts map[string]map[string]any
+	if json.Unmarshal(res.Doc, &doc) != nil || json.Unmarshal(doc["_attachments"], &atts) != nil {
+		return nil
+	}
+	changed := false
+	for name, stub := range atts {
+		if stub["content_type"] != BlobRefContentType {
+			continue
+		}
+		data, ok := res.Attachments[name]
+		inline, isInline := stub["data"].(string)
+		if !ok && !isInline {
+			continue
+		}
+		if !ok {
+			data, _ = base64.StdEncoding.DecodeString(inline)
+		}
+		var ref BlobRef
+		if err := json.Unmarshal(data, &ref); err != nil {
+			return fmt.Errorf("couchdb: invalid blob reference %s/%s: %w", res.ID, name, err)
+		}
+		r, err := c.Blobs.Get(ctx, ref.Location)
+		if err != nil {
+			return err
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if ok {
+			res.Attachments[name] = content
+		}
+		if isInline {
+			stub["data"] = base64.StdEncoding.EncodeToString(content)
+		}
+		stub["content_type"], stub["length"], stub["digest"] = ref.ContentType, ref.Length, ref.Digest
+		changed = true
+	}
+	if changed {
+		doc["_attachments"] = mustJSON(atts)
+		res.Doc = mustJSON(doc)
+	}
+	return nil
+}
+
+// OffloadOptions configure OffloadAttachments
+type OffloadOptions struct {
+	// MinSize is the size from which attachments are moved, default 1 MiB
+	MinSize int64
+	// DryRun only counts the attachments
+	DryRun bool
+	// OnError is called for attachments that could not be moved, they stay in Couchdb.
+	// Without OnError the first error ends the run.
+	OnError func(id, name string, err error)
+}
+
+// OffloadStats is the result of OffloadAttachments
+type OffloadStats struct {
+	Docs        int
+	Attachments int
+	Bytes       int64
+}
+
+// OffloadAttachments moves attachments of db of at least MinSize into c.Blobs and
+// replaces them with a BlobRef attachment of the same name. Blobs are stored under
+// "<db>/<md5 hex>", so equal content is stored once. The content is checked against the
+// digest of the attachment before the reference is written; documents changed in the
+// meantime are skipped and picked up by the next run. Blobs are not deleted when
+// documents are deleted.
+func (c *CouchDBAPI) OffloadAttachments(ctx context.Context, db string, opts OffloadOptions) (OffloadStats, error) {
+	var stats OffloadStats
+	if c.Blobs == nil {
+		return stats, fmt.Errorf("couchdb: no blob store")
+	}
+	minSize := opts.MinSize
+	if minSize <= 0 {
+		minSize = 1 << 20
+	}
+	fail := func(id, name string, err error) error {
+		if opts.OnError == nil {
+			return fmt.Errorf("%s/%s: %w", id, name, err)
+		}
+		opts.OnError(id, name, err)
+		return nil
+	}
+	err := c.pageView(ctx, dbPath(db)+"/_all_docs", ViewParams{IncludeDocs: true}, 200, func(row ViewRow) error {
+		var doc struct {
+			ID          string                    `json:"_id"`
+			Rev         string                    `json:"_rev"`
+			Attachments map[string]AttachmentInfo `json:"_attachments"`
+		}
+		if json.Unmarshal(row.Doc, &doc) != nil {
+			return nil
+		}
+		moved := false
+		rev := doc.Rev
+		for name, info := range doc.Attachments {
+			if info.Length < minSize || info.ContentType == BlobRefContentType {
+				continue
+			}
+			if !opts.DryRun {
+				newRev, err := c.offload(ctx, db, doc.ID, name, rev, info)
+				if IsConflict(err) {
+					// the document changed, the next run sees the new version
+					break
+				}
+				if err != nil {
+					if err := fail(doc.ID, name, err); err != nil {
+						return err
+					}
+					continue
+				}
+				rev = newRev
+			}
+			stats.Attachments++
+			stats.Bytes += info.Length
+			moved = true
+		}
+		if moved {
+			stats.Docs++
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// offload moves one attachment and returns the new revision of the document
+func (c *CouchDBAPI) offload(ctx context.Context, db, id, name, rev string, info AttachmentInfo) (string, error) {
+	att, err := c.getAttachment(ctx, db, id, name)
+	if err != nil {
+		return "", err
+	}
+	defer att.Close()
+	digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(info.Digest, "md5-"))
+	if err != nil || !strings.HasPrefix(info.Digest, "md5-") {
+		return "", fmt.Errorf("couchdb: unsupported digest %q", info.Digest)
+	}
+	location, err := c.Blobs.Put(ctx, db+"/"+hex.EncodeToString(digest), newDigestReader(att, digest), info.Length, info.ContentType)
+	if err != nil {
+		return "", err
+	}
+	ref := mustJSON(BlobRef{Location: location, Digest: info.Digest, Length: info.Length, ContentType: info.ContentType})
+	return c.PutAttachment(ctx, db, id, name, rev, BlobRefContentType, bytes.NewReader(ref), int64(len(ref)))
+}
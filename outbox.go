@@ -0,0 +1,402 @@
+package golangcouchdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutboxMessage is a message waiting in the outbox of a document. It is written in the
+// same revision as the change it announces, so the message exists exactly when the
+// change does.
+type OutboxMessage struct {
+	// ID identifies the message for clearing and for deduplication by the receiver
+	ID      string            `json:"id"`
+	Topic   string            `json:"topic,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Payload json.RawMessage   `json:"payload,omitempty"`
+
+	// DocID and DocRev are the document the message was read from, set by the relay
+	DocID  string `json:"-"`
+	DocRev string `json:"-"`
+}
+
+// NewOutboxMessage returns a message with a random id and payload as JSON
+func NewOutboxMessage(topic string, payload any) (OutboxMessage, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return OutboxMessage{}, err
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return OutboxMessage{ID: hex.EncodeToString(b), Topic: topic, Payload: data}, nil
+}
+
+// OutboxSink delivers messages. The relay delivers at least once, a message whose clearing
+// failed is delivered again, so sinks or their receivers should deduplicate by ID.
+type OutboxSink interface {
+	Send(ctx context.Context, msg OutboxMessage) error
+}
+
+// OutboxSinkFunc is a function used as OutboxSink
+type OutboxSinkFunc func(ctx context.Context, msg OutboxMessage) error
+
+func (f OutboxSinkFunc) Send(ctx context.Context, msg OutboxMessage) error {
+	return f(ctx, msg)
+}
+
+// WebhookSink posts the payload of every message to URL. The message id is sent as
+// Idempotency-Key, the topic as X-Outbox-Topic, and Headers of the message are added.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client // default http.DefaultClient
+}
+
+func (s *WebhookSink) Send(ctx context.Context, msg OutboxMessage) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(msg.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", msg.ID)
+	if msg.Topic != "" {
+		req.Header.Set("X-Outbox-Topic", msg.Topic)
+	}
+	for name, value := range msg.Headers {
+		req.Header.Set(name, value)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// OutboxRelay follows the _changes feed of a database for documents with messages in their
+// outbox, sends the messages to the sink of their topic and removes the sent messages from
+// the document. Messages of a document are sent in order, a message that fails is retried
+// and, after MaxAttempts, left in the outbox with the messages after it. Left messages are
+// tried again every RetryInterval while the relay runs, when the document changes and by
+// the Sweep at the next start.
+//
+// Removing re-reads the document on a conflict and removes only the sent messages by id,
+// so messages added in the meantime stay.
+type OutboxRelay struct {
+	API *CouchDBAPI
+	DB  string
+	// Field of the outbox array, default "outbox". Couchdb rejects unknown top level fields
+	// that start with an underscore, so "_outbox" can only be used nested, e.g. "meta._outbox".
+	Field string
+	// Sinks by topic, the sink of "" gets messages of topics without a sink
+	Sinks map[string]OutboxSink
+	// Name of the relay, the position in the feed is kept in _local/<Name>. Default "outbox-relay".
+	Name string
+	// MaxAttempts to send a message before it is left in the outbox, default 5
+	MaxAttempts int
+	// RetryDelay before the first retry, it doubles with every attempt. Default 1s.
+	RetryDelay time.Duration
+	// RetryInterval is how often documents with left messages are tried again, default 1m
+	RetryInterval time.Duration
+	// CheckpointInterval is how often the position in the feed is saved, default 10s
+	CheckpointInterval time.Duration
+	// OnError is called for messages that could not be sent or removed and for checkpoints
+	// that could not be saved, optional
+	OnError func(msg OutboxMessage, err error)
+}
+
+func (r *OutboxRelay) field() string {
+	if r.Field != "" {
+		return r.Field
+	}
+	return "outbox"
+}
+
+func (r *OutboxRelay) checkpointID() string {
+	if r.Name != "" {
+		return "_local/" + r.Name
+	}
+	return "_local/outbox-relay"
+}
+
+// selector matches documents with a non empty outbox
+func (r *OutboxRelay) selector() map[string]any {
+	return map[string]any{r.field(): map[string]any{"$type": "array", "$not": map[string]any{"$size": 0}}}
+}
+
+// Run sweeps the database and then relays the feed until ctx is done. A stalled feed is followed again.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	cp, err := loadFeedCheckpoint(ctx, r.API, r.DB, r.checkpointID())
+	if err != nil {
+		return err
+	}
+	defer cp.saveEvery(ctx, r.CheckpointInterval, func(id string, err error) {
+		r.report(OutboxMessage{DocID: id}, fmt.Errorf("saving checkpoint: %w", err))
+	})()
+	left := &outboxRetries{docs: map[string]bool{}}
+	if err := r.sweep(ctx, left); err != nil {
+		return err
+	}
+	// the sweep relayed the documents of failed changes, they need no retries of their own
+	cp.retries(0)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.retryLeft(ctx, left, stop)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	since := cp.since()
+	for {
+		params := ChangesParams{Since: since, IncludeDocs: true, Selector: r.selector()}
+		last, err := r.API.FollowChanges(ctx, r.DB, params, func(ch Change) error {
+			item := cp.start(ch.Seq, ch.ID)
+			err := left.relay(ctx, r, ch.ID, ch.Doc, ch.Deleted)
+			cp.finish(item, err)
+			return err
+		})
+		since = last
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && !IsStreamStalled(err) {
+			return err
+		}
+	}
+}
+
+// outboxRetries are the documents of a running relay with messages left in their outbox
+type outboxRetries struct {
+	mu   sync.Mutex // one document is relayed at a time
+	docs map[string]bool
+}
+
+// relay sends the messages of a document and keeps it for a retry if messages are left
+func (o *outboxRetries) relay(ctx context.Context, r *OutboxRelay, id string, doc json.RawMessage, deleted bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if deleted {
+		delete(o.docs, id)
+		return nil
+	}
+	left, err := r.relayDoc(ctx, id, doc)
+	if err != nil {
+		return err
+	}
+	if left {
+		o.docs[id] = true
+	} else {
+		delete(o.docs, id)
+	}
+	return nil
+}
+
+func (o *outboxRetries) ids() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ids := make([]string, 0, len(o.docs))
+	for id := range o.docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// retryLeft reads the documents with left messages every RetryInterval and relays them again
+func (r *OutboxRelay) retryLeft(ctx context.Context, left *outboxRetries, stop <-chan struct{}) {
+	interval := r.RetryInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		for _, id := range left.ids() {
+			var doc json.RawMessage
+			err := r.API.GetDoc(ctx, r.DB, id, &doc)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil && !IsNotFound(err) {
+				r.report(OutboxMessage{DocID: id}, fmt.Errorf("reading document for a retry: %w", err))
+				continue
+			}
+			if left.relay(ctx, r, id, doc, err != nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// Sweep sends the messages of all documents with a non empty outbox, e.g. messages left
+// by failed attempts. Without an index on the field it reads the whole database.
+func (r *OutboxRelay) Sweep(ctx context.Context) error {
+	return r.sweep(ctx, &outboxRetries{docs: map[string]bool{}})
+}
+
+func (r *OutboxRelay) sweep(ctx context.Context, left *outboxRetries) error {
+	return r.API.findAll(ctx, r.DB, FindQuery{Selector: r.selector()}, 0, func(doc json.RawMessage) error {
+		id, _ := docIDRev(doc)
+		return left.relay(ctx, r, id, doc, false)
+	})
+}
+
+// relayDoc sends the messages of one document and removes the sent ones. It reports whether
+// messages are left in the outbox, an error is only returned when ctx is done.
+func (r *OutboxRelay) relayDoc(ctx context.Context, id string, doc json.RawMessage) (bool, error) {
+	raw, ok := lookupField(doc, r.field())
+	if !ok {
+		return false, nil
+	}
+	var entries []json.RawMessage
+	if json.Unmarshal(raw, &entries) != nil {
+		return false, nil
+	}
+	_, rev := docIDRev(doc)
+	sent := map[string]bool{}
+	for _, entry := range entries {
+		var msg OutboxMessage
+		if err := json.Unmarshal(entry, &msg); err != nil {
+			r.report(OutboxMessage{DocID: id, DocRev: rev}, err)
+			break
+		}
+		msg.DocID, msg.DocRev = id, rev
+		if err := r.send(ctx, msg); err != nil {
+			if ctx.Err() != nil {
+				return true, ctx.Err()
+			}
+			r.report(msg, err)
+			break
+		}
+		sent[outboxKey(entry)] = true
+	}
+	left := len(sent) < len(entries)
+	if len(sent) == 0 {
+		return left, nil
+	}
+	_, err := r.API.UpdateDoc(ctx, r.DB, id, func(doc map[string]any) (bool, error) {
+		entries, _ := lookupPath(doc, r.field()).([]any)
+		kept := make([]any, 0, len(entries))
+		for _, entry := range entries {
+			if !sent[outboxKey(mustJSON(entry))] {
+				kept = append(kept, entry)
+			}
+		}
+		left = len(kept) > 0
+		if len(kept) == len(entries) {
+			return false, nil
+		}
+		return true, setPath(doc, r.field(), kept)
+	})
+	if err != nil && !IsNotFound(err) {
+		if ctx.Err() != nil {
+			return true, ctx.Err()
+		}
+		r.report(OutboxMessage{DocID: id, DocRev: rev}, fmt.Errorf("removing sent messages: %w", err))
+		return true, nil
+	}
+	return left && err == nil, nil
+}
+
+// send delivers a message with retries
+func (r *OutboxRelay) send(ctx context.Context, msg OutboxMessage) error {
+	sink, ok := r.Sinks[msg.Topic]
+	if !ok {
+		sink, ok = r.Sinks[""]
+	}
+	if !ok {
+		return fmt.Errorf("no sink for topic %q", msg.Topic)
+	}
+	attempts := r.MaxAttempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+	delay := r.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		err := sink.Send(ctx, msg)
+		if err == nil || attempt >= attempts {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func (r *OutboxRelay) report(msg OutboxMessage, err error) {
+	if r.OnError != nil {
+		r.OnError(msg, err)
+	}
+}
+
+// outboxKey identifies an outbox entry by its id, entries without an id by their JSON
+func outboxKey(entry json.RawMessage) string {
+	var msg struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal(entry, &msg) == nil && msg.ID != "" {
+		return "id:" + msg.ID
+	}
+	var v any
+	json.Unmarshal(entry, &v)
+	return "json:" + string(mustJSON(v))
+}
+
+// lookupPath returns the value of a dotted path in a decoded document
+func lookupPath(doc map[string]any, path string) any {
+	var value any = doc
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = obj[name]
+	}
+	return value
+}
+
+// setPath sets the value of a dotted path in a decoded document
+func setPath(doc map[string]any, path string, value any) error {
+	names := strings.Split(path, ".")
+	obj := doc
+	for _, name := range names[:len(names)-1] {
+		next, ok := obj[name].(map[string]any)
+		if !ok {
+			return fmt.Errorf("couchdb: %s is not an object", name)
+		}
+		obj = next
+	}
+	obj[names[len(names)-1]] = value
+	return nil
+}
@@ -0,0 +1,233 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutboxKey(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  string
+	}{
+		{`{"id":"m1","topic":"a"}`, "id:m1"},
+		{`{"topic":"a","id":"m1","payload":{"x":1}}`, "id:m1"},
+		{`{"topic":"a","payload":{"b":2,"a":1}}`, `json:{"payload":{"a":1,"b":2},"topic":"a"}`},
+		{`{"id":"","topic":"a"}`, `json:{"id":"","topic":"a"}`},
+		{`"text"`, `json:"text"`},
+	}
+	for _, tt := range tests {
+		if got := outboxKey(json.RawMessage(tt.entry)); got != tt.want {
+			t.Errorf("outboxKey(%s) = %s, want %s", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestOutboxPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		path    string
+		value   any
+		want    string // document after setPath
+		wantErr bool
+	}{
+		{"top level", `{"outbox":[1]}`, "outbox", []any{}, `{"outbox":[]}`, false},
+		{"nested", `{"meta":{"_outbox":[1],"v":1}}`, "meta._outbox", []any{}, `{"meta":{"_outbox":[],"v":1}}`, false},
+		{"missing", `{}`, "outbox", []any{}, `{"outbox":[]}`, false},
+		{"not an object", `{"meta":1}`, "meta._outbox", []any{}, ``, true},
+		{"missing parent", `{}`, "meta._outbox", []any{}, ``, true},
+	}
+	for _, tt := range tests {
+		var doc map[string]any
+		json.Unmarshal([]byte(tt.doc), &doc)
+		if err := setPath(doc, tt.path, tt.value); (err != nil) != tt.wantErr {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got := string(mustJSON(doc)); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+		if got := string(mustJSON(lookupPath(doc, tt.path))); got != "[]" {
+			t.Errorf("%s: lookup %s", tt.name, got)
+		}
+	}
+	if v := lookupPath(map[string]any{"a": 1}, "a.b"); v != nil {
+		t.Errorf("lookup below a number: %v", v)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var got http.Header
+	var body string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	tests := []struct {
+		name    string
+		msg     OutboxMessage
+		status  int
+		headers map[string]string
+		wantErr bool
+	}{
+		{"ok", OutboxMessage{ID: "m1", Topic: "orders", Payload: json.RawMessage(`{"n":1}`)}, http.StatusOK,
+			map[string]string{"Idempotency-Key": "m1", "X-Outbox-Topic": "orders", "Content-Type": "application/json"}, false},
+		{"headers", OutboxMessage{ID: "m2", Headers: map[string]string{"X-Tenant": "t"}, Payload: json.RawMessage(`{}`)}, http.StatusAccepted,
+			map[string]string{"Idempotency-Key": "m2", "X-Outbox-Topic": "", "X-Tenant": "t"}, false},
+		{"redirect is an error", OutboxMessage{ID: "m3"}, http.StatusNotModified, nil, true},
+		{"server error", OutboxMessage{ID: "m4"}, http.StatusInternalServerError, nil, true},
+	}
+	sink := &WebhookSink{URL: srv.URL}
+	for _, tt := range tests {
+		status = tt.status
+		err := sink.Send(context.Background(), tt.msg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		for name, value := range tt.headers {
+			if got.Get(name) != value {
+				t.Errorf("%s: %s is %q, want %q", tt.name, name, got.Get(name), value)
+			}
+		}
+		if body != string(tt.msg.Payload) {
+			t.Errorf("%s: body %s", tt.name, body)
+		}
+	}
+}
+
+func outboxDoc(id string, msgs ...string) string {
+	var entries []string
+	for _, m := range msgs {
+		topic, msgID := "", m
+		if i := strings.Index(m, "/"); i >= 0 {
+			topic, msgID = m[:i], m[i+1:]
+		}
+		entries = append(entries, fmt.Sprintf(`{"id":%q,"topic":%q,"payload":{"m":%q}}`, msgID, topic, msgID))
+	}
+	return fmt.Sprintf(`{"_id":%q,"outbox":[%s]}`, id, strings.Join(entries, ","))
+}
+
+func TestOutboxRelay(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", outboxDoc("a", "a1", "a2"), outboxDoc("b", "flaky/b1", "b2"), `{"_id":"c"}`, outboxDoc("d"))
+	var mu sync.Mutex
+	var delivered, failed []string
+	flaky := 2 // failing sends of the flaky sink
+	record := OutboxSinkFunc(func(ctx context.Context, msg OutboxMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if msg.Topic == "flaky" && flaky > 0 {
+			flaky--
+			return errors.New("unavailable")
+		}
+		delivered = append(delivered, msg.DocID+" "+msg.ID)
+		return nil
+	})
+	r := &OutboxRelay{API: api, DB: "db", Sinks: map[string]OutboxSink{"": record, "flaky": record},
+		MaxAttempts: 1, RetryInterval: 20 * time.Millisecond, CheckpointInterval: 10 * time.Millisecond,
+		OnError: func(msg OutboxMessage, err error) {
+			mu.Lock()
+			failed = append(failed, msg.DocID+" "+msg.ID+": "+err.Error())
+			mu.Unlock()
+		}}
+	outbox := func(id string) int {
+		entries, _ := fc.doc("db", id)["outbox"].([]any)
+		return len(entries)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() { cancel() })
+	done := make(chan error, 1)
+	go func() { done <- r.Run(ctx) }()
+	// b is retried while running until the flaky sink accepts b1
+	waitFor(t, "outboxes cleared", func() bool { return outbox("a") == 0 && outbox("b") == 0 })
+	// the checkpoint is saved while running
+	since := func() any { return fc.local("db", "_local/outbox-relay")["since"] }
+	waitFor(t, "checkpoint", func() bool { return since() != nil })
+	before := since()
+	fc.put(t, "db", outboxDoc("e", "e1"))
+	waitFor(t, "new document", func() bool { return outbox("e") == 0 })
+	waitFor(t, "checkpoint after e", func() bool { return since() != before })
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run returned %v", err)
+	}
+	mu.Lock()
+	sort.Strings(delivered)
+	if got := strings.Join(delivered, ", "); got != "a a1, a a2, b b1, b b2, e e1" {
+		t.Errorf("delivered %s", got)
+	}
+	if len(failed) != 2 || failed[0] != "b b1: unavailable" {
+		t.Errorf("failed %q", failed)
+	}
+	delivered = nil
+	mu.Unlock()
+	if !strings.HasPrefix(fc.doc("db", "c")["_rev"].(string), "1-") {
+		t.Error("document without an outbox was written")
+	}
+
+	// a restart follows from the checkpoint and delivers only new messages
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { done <- r.Run(ctx) }()
+	fc.put(t, "db", outboxDoc("f", "f1"))
+	waitFor(t, "after the restart", func() bool { return outbox("f") == 0 })
+	cancel()
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(delivered, ", "); got != "f f1" {
+		t.Errorf("delivered after the restart %s", got)
+	}
+}
+
+func TestOutboxRelaySend(t *testing.T) {
+	fail := errors.New("fail")
+	tests := []struct {
+		name     string
+		sinks    map[string]bool // topic and whether its sink fails
+		topic    string
+		attempts int
+		want     int // calls of the sink
+		wantErr  string
+	}{
+		{"ok", map[string]bool{"t": false}, "t", 3, 1, ""},
+		{"retried", map[string]bool{"t": true}, "t", 3, 3, "fail"},
+		{"default sink", map[string]bool{"": false}, "t", 3, 1, ""},
+		{"no sink", map[string]bool{"other": false}, "t", 3, 0, `no sink for topic "t"`},
+	}
+	for _, tt := range tests {
+		calls := 0
+		r := &OutboxRelay{Sinks: map[string]OutboxSink{}, MaxAttempts: tt.attempts, RetryDelay: time.Millisecond}
+		for topic, fails := range tt.sinks {
+			fails := fails
+			r.Sinks[topic] = OutboxSinkFunc(func(context.Context, OutboxMessage) error {
+				calls++
+				if fails {
+					return fail
+				}
+				return nil
+			})
+		}
+		err := r.send(context.Background(), OutboxMessage{Topic: tt.topic})
+		if calls != tt.want || (tt.wantErr == "") != (err == nil) || (err != nil && err.Error() != tt.wantErr) {
+			t.Errorf("%s: %d calls, %v", tt.name, calls, err)
+		}
+	}
+}
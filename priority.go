@@ -0,0 +1,234 @@
+package golangcouchdb
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Priority is the class of a request for the Scheduler
+type Priority int
+
+const (
+	// PriorityInteractive is for requests a user is waiting for
+	PriorityInteractive Priority = iota
+	// PriorityNormal is the default
+	PriorityNormal
+	// PriorityBatch is for background jobs
+	PriorityBatch
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityNormal:
+		return "normal"
+	case PriorityBatch:
+		return "batch"
+	}
+	return "unknown"
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a context whose requests are scheduled with priority p
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFrom returns the priority of ctx, PriorityNormal if none is set
+func PriorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok && p >= 0 && p < numPriorities {
+		return p
+	}
+	return PriorityNormal
+}
+
+// SchedulerConfig configures a Scheduler
+type SchedulerConfig struct {
+	// MaxConcurrent is the number of requests in flight, default 16
+	MaxConcurrent int
+	// Reserved slots can only be used by interactive requests
+	Reserved int
+	// Shares are the weights of the classes when requests are waiting, default 8, 3, 1
+	Shares [3]int
+	// MaxWait protects lower classes from starvation: a request waiting longer is served
+	// next regardless of its class, default 5s
+	MaxWait time.Duration
+}
+
+// Scheduler limits the requests of a CouchDBAPI in flight and decides by priority
+// which waiting request gets the next free slot. Set it as CouchDBAPI.Scheduler.
+//
+// A request holds its slot until its body is closed. Streamed answers, e.g. of
+// FollowChanges, StreamView, BulkGet or GetAttachment, hold it only until the headers
+// arrived, so long running feeds do not use up the slots.
+type Scheduler struct {
+	cfg SchedulerConfig
+
+	mu     sync.Mutex
+	inUse  int
+	queues [numPriorities][]*waiter
+	pass   [numPriorities]float64 // virtual time of every class for weighted fair queuing
+	vtime  float64
+}
+
+type waiter struct {
+	since   time.Time
+	ready   chan struct{}
+	granted bool
+}
+
+// NewScheduler returns a Scheduler, zero values of cfg are set to their defaults
+func NewScheduler(cfg SchedulerConfig) *Scheduler {
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = 16
+	}
+	if cfg.Reserved >= cfg.MaxConcurrent {
+		cfg.Reserved = cfg.MaxConcurrent - 1
+	}
+	if cfg.Shares == [3]int{} {
+		cfg.Shares = [3]int{8, 3, 1}
+	}
+	for i := range cfg.Shares {
+		if cfg.Shares[i] <= 0 {
+			cfg.Shares[i] = 1
+		}
+	}
+	if cfg.MaxWait <= 0 {
+		cfg.MaxWait = 5 * time.Second
+	}
+	return &Scheduler{cfg: cfg}
+}
+
+// InFlight returns the number of requests holding a slot
+func (s *Scheduler) InFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inUse
+}
+
+// Waiting returns the number of waiting requests of class p
+func (s *Scheduler) Waiting(p Priority) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queues[p])
+}
+
+// acquire waits for a slot, the returned func gives it back
+func (s *Scheduler) acquire(ctx context.Context, p Priority) (func(), error) {
+	s.mu.Lock()
+	w := &waiter{since: time.Now(), ready: make(chan struct{})}
+	if len(s.queues[p]) == 0 && s.pass[p] < s.vtime {
+		s.pass[p] = s.vtime
+	}
+	s.queues[p] = append(s.queues[p], w)
+	s.dispatch()
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return s.releaser(), nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if w.granted {
+			s.inUse--
+			s.dispatch()
+		} else {
+			q := s.queues[p]
+			for i := range q {
+				if q[i] == w {
+					s.queues[p] = append(q[:i:i], q[i+1:]...)
+					break
+				}
+			}
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Scheduler) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			s.inUse--
+			s.dispatch()
+			s.mu.Unlock()
+		})
+	}
+}
+
+// allowed reports whether a request of class p may take a free slot now
+func (s *Scheduler) allowed(p Priority) bool {
+	free := s.cfg.MaxConcurrent - s.inUse
+	if p == PriorityInteractive {
+		return free > 0
+	}
+	return free > s.cfg.Reserved
+}
+
+func (s *Scheduler) grant(p Priority) {
+	s.inUse++
+	s.vtime = s.pass[p]
+	s.pass[p] += 1 / float64(s.cfg.Shares[p])
+}
+
+// dispatch hands free slots to waiting requests
+func (s *Scheduler) dispatch() {
+	for {
+		p := s.next()
+		if p < 0 {
+			return
+		}
+		w := s.queues[p][0]
+		s.queues[p] = s.queues[p][1:]
+		s.grant(p)
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// next picks the class served next: a starving request first, else the class with the
+// smallest virtual time
+func (s *Scheduler) next() Priority {
+	best := Priority(-1)
+	var oldest time.Time
+	for p := Priority(0); p < numPriorities; p++ {
+		if len(s.queues[p]) == 0 || !s.allowed(p) {
+			continue
+		}
+		since := s.queues[p][0].since
+		if time.Since(since) > s.cfg.MaxWait && (oldest.IsZero() || since.Before(oldest)) {
+			best, oldest = p, since
+		}
+	}
+	if best >= 0 {
+		return best
+	}
+	for p := Priority(0); p < numPriorities; p++ {
+		if len(s.queues[p]) == 0 || !s.allowed(p) {
+			continue
+		}
+		if best < 0 || s.pass[p] < s.pass[best] {
+			best = p
+		}
+	}
+	return best
+}
+
+// releaseBody gives the slot back when the body of a response is closed
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,188 @@
+package golangcouchdb
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPriorityFrom(t *testing.T) {
+	tests := []struct {
+		ctx  context.Context
+		want Priority
+	}{
+		{context.Background(), PriorityNormal},
+		{WithPriority(context.Background(), PriorityBatch), PriorityBatch},
+		{WithPriority(context.Background(), PriorityInteractive), PriorityInteractive},
+		{WithPriority(context.Background(), Priority(7)), PriorityNormal},
+	}
+	for _, tt := range tests {
+		if got := PriorityFrom(tt.ctx); got != tt.want {
+			t.Errorf("PriorityFrom = %v, want %v", got, tt.want)
+		}
+	}
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     SchedulerConfig
+		waiting []Priority
+		sleep   time.Duration // between the first and the other waiters
+		want    string
+	}{
+		{"shares", SchedulerConfig{MaxConcurrent: 1}, []Priority{2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}, 0, "ibiiiiiiiib"},
+		{"equal shares", SchedulerConfig{MaxConcurrent: 1, Shares: [3]int{1, 1, 1}}, []Priority{2, 2, 0, 0, 1, 1}, 0, "ibinbn"},
+		{"max wait", SchedulerConfig{MaxConcurrent: 1, MaxWait: 10 * time.Millisecond}, []Priority{2, 0, 0}, 30 * time.Millisecond, "bii"},
+	}
+	letters := map[Priority]string{PriorityInteractive: "i", PriorityNormal: "n", PriorityBatch: "b"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScheduler(tt.cfg)
+			release, err := s.acquire(context.Background(), PriorityNormal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var mu sync.Mutex
+			var order strings.Builder
+			var wg sync.WaitGroup
+			for i, p := range tt.waiting {
+				wg.Add(1)
+				go func(p Priority) {
+					defer wg.Done()
+					r, err := s.acquire(context.Background(), p)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					order.WriteString(letters[p])
+					mu.Unlock()
+					r()
+				}(p)
+				waitFor(t, "waiter", func() bool { return s.Waiting(0)+s.Waiting(1)+s.Waiting(2) == i+1 })
+				if i == 0 {
+					time.Sleep(tt.sleep)
+				}
+			}
+			release()
+			wg.Wait()
+			if got := order.String(); got != tt.want {
+				t.Errorf("order %s, want %s", got, tt.want)
+			}
+			if s.InFlight() != 0 {
+				t.Errorf("InFlight = %d after all releases", s.InFlight())
+			}
+		})
+	}
+}
+
+func TestSchedulerReserved(t *testing.T) {
+	s := NewScheduler(SchedulerConfig{MaxConcurrent: 2, Reserved: 1})
+	release, err := s.acquire(context.Background(), PriorityBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.acquire(ctx, PriorityNormal); err == nil {
+		t.Fatal("normal request got the reserved slot")
+	}
+	if s.Waiting(PriorityNormal) != 0 {
+		t.Error("cancelled request still waiting")
+	}
+	r, err := s.acquire(context.Background(), PriorityInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r()
+	r() // releasing twice gives back one slot
+	release()
+	if s.InFlight() != 0 {
+		t.Errorf("InFlight = %d", s.InFlight())
+	}
+}
+
+func TestSchedulerRequests(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"a"}`)
+	api.Scheduler = NewScheduler(SchedulerConfig{MaxConcurrent: 1})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var doc map[string]any
+			if err := api.GetDoc(context.Background(), "db", "a", &doc); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := api.Scheduler.InFlight(); n != 0 {
+		t.Errorf("InFlight = %d after all requests", n)
+	}
+}
+
+func TestSchedulerStreams(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"a"}`)
+	api.Scheduler = NewScheduler(SchedulerConfig{MaxConcurrent: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tests := []struct {
+		name   string
+		stream func(ctx context.Context, started chan<- struct{}) error
+	}{
+		{"feed", func(ctx context.Context, started chan<- struct{}) error {
+			_, err := api.FollowChanges(ctx, "db", ChangesParams{}, func(Change) error {
+				started <- struct{}{}
+				return nil
+			})
+			return err
+		}},
+		{"rows read slowly", func(ctx context.Context, started chan<- struct{}) error {
+			return api.StreamAllDocs(ctx, "db", ViewParams{}, func(ViewRow) error {
+				started <- struct{}{}
+				<-ctx.Done()
+				return ctx.Err()
+			})
+		}},
+	}
+	var wg sync.WaitGroup
+	for _, tt := range tests {
+		started := make(chan struct{}, 1)
+		wg.Add(1)
+		go func(tt func(context.Context, chan<- struct{}) error) {
+			defer wg.Done()
+			tt(ctx, started)
+		}(tt.stream)
+		<-started
+		// the running stream leaves the slot to other requests
+		var doc map[string]any
+		rctx, rcancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if err := api.GetDoc(rctx, "db", "a", &doc); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		rcancel()
+	}
+	cancel()
+	wg.Wait()
+	if n := api.Scheduler.InFlight(); n != 0 {
+		t.Errorf("InFlight = %d after all requests", n)
+	}
+}
@@ -0,0 +1,265 @@
+package golangcouchdb
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheConfig configures a QueryCache
+type CacheConfig struct {
+	// MaxEntries is the number of results kept, the least recently used are dropped, default 1000
+	MaxEntries int
+	// SeqTTL reuses the update_seq of a database read for this long instead of reading it
+	// for every query. Results may be this much out of date. Default 0, databases followed
+	// with Watch never need a read.
+	SeqTTL time.Duration
+}
+
+// CacheStats are the counters of a QueryCache
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	StaleHits int64 `json:"stale_hits"`
+	Misses    int64 `json:"misses"`
+	Refreshes int64 `json:"refreshes"`
+	Entries   int   `json:"entries"`
+}
+
+// QueryCache keeps the results of View, AllDocs and Find and serves them again while the
+// update_seq of the database is unchanged. The key is the server url, the user name of the
+// client and the normalized query, and the user of the context if Masking is set, so a
+// cache can be shared by clients. A query with update=lazy (view) or update=false (_find)
+// gets an out of date result immediately while it is refreshed in the background. Paged
+// reads of all results, e.g. of Join or LiveFind, are not cached.
+//
+// The update_seq is read with GET /{db} before every query, unless it was read less than
+// SeqTTL ago or the database is followed with Watch. Set it as CouchDBAPI.Cache. The
+// update_seq is the one of the primary, so cached queries are not sent to Replicas.
+type QueryCache struct {
+	cfg CacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	dbs     map[string]*cacheDB // by server url and name
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	key        string
+	db         string
+	seq        Seq
+	data       []byte
+	refreshing bool
+}
+
+// cacheDB is the latest known update_seq of a database
+type cacheDB struct {
+	seq     Seq
+	read    time.Time
+	watched int
+}
+
+// NewQueryCache returns a QueryCache, zero values of cfg are set to their defaults
+func NewQueryCache(cfg CacheConfig) *QueryCache {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = 1000
+	}
+	return &QueryCache{cfg: cfg, entries: map[string]*list.Element{}, lru: list.New(), dbs: map[string]*cacheDB{}}
+}
+
+// Stats returns the counters of the cache
+func (q *QueryCache) Stats() CacheStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.stats
+	s.Entries = q.lru.Len()
+	return s
+}
+
+// Invalidate drops all results of db, or of all databases if db is empty
+func (q *QueryCache) Invalidate(db string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for key, el := range q.entries {
+		if e := el.Value.(*cacheEntry); db == "" || e.db == db {
+			q.lru.Remove(el)
+			delete(q.entries, key)
+		}
+	}
+}
+
+// Watch follows the changes feed of db and pushes its update_seq into the cache, so that
+// queries need no read of the update_seq. It returns when ctx is done or the feed fails.
+func (q *QueryCache) Watch(ctx context.Context, api *CouchDBAPI, db string) error {
+	info, err := api.DBInfo(ctx, db)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	state := q.db(api, db)
+	state.seq = info.UpdateSeq
+	state.watched++
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		state.watched--
+		state.read = time.Time{}
+		q.mu.Unlock()
+	}()
+	since := info.UpdateSeq
+	for {
+		since, err = api.FollowChanges(ctx, db, ChangesParams{Since: since}, func(ch Change) error {
+			q.mu.Lock()
+			state.seq = ch.Seq
+			q.mu.Unlock()
+			return nil
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// db returns the state of a database of the server of api, q.mu must be held
+func (q *QueryCache) db(api *CouchDBAPI, name string) *cacheDB {
+	key := api.Url + "\x00" + name
+	state, ok := q.dbs[key]
+	if !ok {
+		state = &cacheDB{}
+		q.dbs[key] = state
+	}
+	return state
+}
+
+// seq returns the current update_seq of db
+func (q *QueryCache) seq(ctx context.Context, api *CouchDBAPI, db string) (Seq, error) {
+	q.mu.Lock()
+	state := q.db(api, db)
+	if state.watched > 0 || (q.cfg.SeqTTL > 0 && time.Since(state.read) < q.cfg.SeqTTL) {
+		seq := state.seq
+		q.mu.Unlock()
+		return seq, nil
+	}
+	q.mu.Unlock()
+	info, err := api.DBInfo(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	q.mu.Lock()
+	if state.watched == 0 {
+		state.seq = info.UpdateSeq
+		state.read = time.Now()
+	}
+	q.mu.Unlock()
+	return info.UpdateSeq, nil
+}
+
+// query answers from the cache or with fetch, which decodes the result into out
+func (q *QueryCache) query(ctx context.Context, api *CouchDBAPI, db, key string, lazy bool, out any, fetch func(ctx context.Context, out any) error) error {
+	// clients of other servers or users see other documents
+	key = api.Url + "\x00" + api.Username + "\x00" + key
+	if api.Masking != nil {
+		u := UserCtxFrom(ctx)
+		roles := append([]string(nil), u.Roles...)
+		sort.Strings(roles)
+		key += "\x00" + u.Name + "\x00" + strings.Join(roles, ",")
+	}
+	if api.Replicas != nil {
+		// a lagging replica would store an old result under the update_seq of the primary
+		ctx = WithPrimary(ctx)
+	}
+	seq, err := q.seq(ctx, api, db)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	if el, ok := q.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if e.seq == seq || lazy {
+			q.lru.MoveToFront(el)
+			if e.seq == seq {
+				q.stats.Hits++
+			} else {
+				q.stats.StaleHits++
+				if !e.refreshing {
+					e.refreshing = true
+					go q.refresh(detached{ctx}, api, db, key, reflect.TypeOf(out).Elem(), fetch)
+				}
+			}
+			data := e.data
+			q.mu.Unlock()
+			return json.Unmarshal(data, out)
+		}
+	}
+	q.stats.Misses++
+	q.mu.Unlock()
+	if err := fetch(ctx, out); err != nil {
+		return err
+	}
+	q.store(db, key, seq, out)
+	return nil
+}
+
+// refresh queries a stale result again in the background
+func (q *QueryCache) refresh(ctx context.Context, api *CouchDBAPI, db, key string, typ reflect.Type, fetch func(ctx context.Context, out any) error) {
+	out := reflect.New(typ).Interface()
+	seq, err := q.seq(ctx, api, db)
+	if err == nil {
+		err = fetch(ctx, out)
+	}
+	q.mu.Lock()
+	q.stats.Refreshes++
+	if el, ok := q.entries[key]; ok {
+		el.Value.(*cacheEntry).refreshing = false
+	}
+	q.mu.Unlock()
+	if err == nil {
+		q.store(db, key, seq, out)
+	}
+}
+
+// store keeps a result, seq is the update_seq read before the query so that a result
+// that includes later updates is only refreshed once more
+func (q *QueryCache) store(db, key string, seq Seq, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if el, ok := q.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		e.seq, e.data = seq, data
+		q.lru.MoveToFront(el)
+		return
+	}
+	q.entries[key] = q.lru.PushFront(&cacheEntry{key: key, db: db, seq: seq, data: data})
+	for q.lru.Len() > q.cfg.MaxEntries {
+		oldest := q.lru.Back()
+		q.lru.Remove(oldest)
+		delete(q.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// viewCacheKey normalizes a view query, url.Values encode sorted by name
+func viewCacheKey(path string, params ViewParams) string {
+	key := path + "?" + params.values().Encode()
+	if len(params.Keys) > 0 {
+		key += "\x00" + string(mustJSON(params.Keys))
+	}
+	return key
+}
+
+// findCacheKey normalizes a _find query, maps are marshaled sorted by key
+func findCacheKey(db string, query FindQuery) string {
+	return dbPath(db) + "/_find\x00" + string(mustJSON(query))
+}
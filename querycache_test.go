@@ -0,0 +1,291 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCacheKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"view params in any order",
+			viewCacheKey("db/_all_docs", ViewParams{Limit: 5, IncludeDocs: true, StartKey: "a"}),
+			viewCacheKey("db/_all_docs", ViewParams{StartKey: "a", IncludeDocs: true, Limit: 5}), true},
+		{"other path", viewCacheKey("db/_all_docs", ViewParams{}), viewCacheKey("other/_all_docs", ViewParams{}), false},
+		{"keys", viewCacheKey("db/_all_docs", ViewParams{Keys: []any{"a"}}), viewCacheKey("db/_all_docs", ViewParams{Keys: []any{"b"}}), false},
+		{"selector in any order",
+			findCacheKey("db", FindQuery{Selector: map[string]any{"a": 1, "b": 2}}),
+			findCacheKey("db", FindQuery{Selector: map[string]any{"b": 2, "a": 1}}), true},
+		{"other limit", findCacheKey("db", FindQuery{Limit: 1}), findCacheKey("db", FindQuery{Limit: 2}), false},
+	}
+	for _, tt := range tests {
+		if (tt.a == tt.b) != tt.same {
+			t.Errorf("%s: %q and %q", tt.name, tt.a, tt.b)
+		}
+	}
+}
+
+// dbInfoReads counts the reads of the update_seq of db
+func dbInfoReads(fc *fakeCouch, db string) int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	n := 0
+	for _, r := range fc.requests {
+		if r == "GET /"+db {
+			n++
+		}
+	}
+	return n
+}
+
+func TestQueryCache(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"a","n":1}`, `{"_id":"b","n":2}`)
+	api.Cache = NewQueryCache(CacheConfig{MaxEntries: 2})
+	ctx := context.Background()
+	allDocs := func(params ViewParams) func() (int, error) {
+		return func() (int, error) {
+			res, err := api.AllDocs(ctx, "db", params)
+			if err != nil {
+				return 0, err
+			}
+			return len(res.Rows), nil
+		}
+	}
+	find := func() (int, error) {
+		res, err := api.Find(ctx, "db", FindQuery{Selector: map[string]any{"n": map[string]any{"$gt": 0}}})
+		if err != nil {
+			return 0, err
+		}
+		return len(res.Docs), nil
+	}
+	write := func(id string) func() (int, error) {
+		return func() (int, error) {
+			_, err := api.PutDoc(ctx, "db", id, map[string]any{"n": 3})
+			return 0, err
+		}
+	}
+	tests := []struct {
+		name              string
+		run               func() (int, error)
+		rows              int
+		hits, misses, len int
+	}{
+		{"first query", allDocs(ViewParams{}), 2, 0, 1, 1},
+		{"same query", allDocs(ViewParams{}), 2, 1, 1, 1},
+		{"find", find, 2, 1, 2, 2},
+		{"find again", find, 2, 2, 2, 2},
+		{"write", write("c"), 0, 2, 2, 2},
+		{"after the write", allDocs(ViewParams{}), 3, 2, 3, 2},
+		{"third query drops the oldest", allDocs(ViewParams{Limit: 1}), 1, 2, 4, 2},
+		{"find was dropped", find, 3, 2, 5, 2},
+	}
+	for _, tt := range tests {
+		rows, err := tt.run()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		s := api.Cache.Stats()
+		if rows != tt.rows || s.Hits != int64(tt.hits) || s.Misses != int64(tt.misses) || s.Entries != tt.len {
+			t.Errorf("%s: %d rows, %+v, want %d rows, %d hits, %d misses, %d entries", tt.name, rows, s, tt.rows, tt.hits, tt.misses, tt.len)
+		}
+	}
+	api.Cache.Invalidate("other")
+	if s := api.Cache.Stats(); s.Entries != 2 {
+		t.Errorf("invalidate of another database: %+v", s)
+	}
+	api.Cache.Invalidate("db")
+	if s := api.Cache.Stats(); s.Entries != 0 {
+		t.Errorf("invalidate: %+v", s)
+	}
+}
+
+func TestQueryCacheLazy(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"a"}`)
+	api.Cache = NewQueryCache(CacheConfig{})
+	ctx := context.Background()
+	lazy := ViewParams{Update: "lazy"}
+	api.AllDocs(ctx, "db", lazy)
+	fc.put(t, "db", `{"_id":"b"}`)
+	// the old result is returned at once and refreshed
+	res, err := api.AllDocs(ctx, "db", lazy)
+	if err != nil || len(res.Rows) != 1 {
+		t.Fatalf("%v, %v", res, err)
+	}
+	waitFor(t, "refresh", func() bool { return api.Cache.Stats().Refreshes == 1 })
+	if res, _ := api.AllDocs(ctx, "db", lazy); len(res.Rows) != 2 {
+		t.Errorf("after the refresh %d rows", len(res.Rows))
+	}
+	if s := api.Cache.Stats(); s.StaleHits != 1 || s.Hits != 1 || s.Misses != 1 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestQueryCacheKey(t *testing.T) {
+	fc1, api := newFakeCouch(t, "db")
+	fc2, other := newFakeCouch(t, "db")
+	// both databases have the same update_seq
+	fc1.put(t, "db", `{"_id":"a","type":"person","ssn":"1"}`, `{"_id":"b"}`)
+	fc2.put(t, "db", `{"_id":"x"}`, `{"_id":"y"}`)
+	cache := NewQueryCache(CacheConfig{SeqTTL: time.Hour})
+	api.Cache, other.Cache = cache, cache
+	sameServer := &CouchDBAPI{Url: api.Url, Username: "other", Cache: cache}
+	masked := &CouchDBAPI{Url: api.Url, Masking: testMasking, Cache: cache}
+	user := WithUserCtx(context.Background(), UserCtx{Name: "u"})
+	hr := WithUserCtx(context.Background(), UserCtx{Name: "h", Roles: []string{"hr"}})
+	tests := []struct {
+		name   string
+		api    *CouchDBAPI
+		ctx    context.Context
+		first  string // id of the first row
+		misses int
+	}{
+		{"first", api, context.Background(), "a", 1},
+		{"same client", api, context.Background(), "a", 1},
+		{"other server", other, context.Background(), "x", 2},
+		{"other user", sameServer, context.Background(), "a", 3},
+		{"masked", masked, user, "a", 4},
+		{"masked, same user", masked, user, "a", 4},
+		{"masked, other user", masked, hr, "a", 5},
+	}
+	for _, tt := range tests {
+		res, err := tt.api.AllDocs(tt.ctx, "db", ViewParams{IncludeDocs: true})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if res.Rows[0].ID != tt.first || cache.Stats().Misses != int64(tt.misses) {
+			t.Errorf("%s: first row %s, %+v", tt.name, res.Rows[0].ID, cache.Stats())
+		}
+		if tt.api == masked {
+			var doc map[string]any
+			json.Unmarshal(res.Rows[0].Doc, &doc)
+			if (doc["ssn"] == nil) != (tt.ctx == user) {
+				t.Errorf("%s: %s", tt.name, res.Rows[0].Doc)
+			}
+		}
+	}
+}
+
+func TestQueryCachePaged(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"a","n":1}`, `{"_id":"b","n":2}`, `{"_id":"c","n":3}`)
+	api.Cache = NewQueryCache(CacheConfig{})
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		read func(fn func()) error
+	}{
+		{"findAll", func(fn func()) error {
+			return api.findAll(ctx, "db", FindQuery{Selector: map[string]any{"n": map[string]any{"$gt": 0}}}, 2, func(json.RawMessage) error {
+				fn()
+				return nil
+			})
+		}},
+		{"pageView", func(fn func()) error {
+			return api.pageView(ctx, dbPath("db")+"/_all_docs", ViewParams{}, 2, func(ViewRow) error {
+				fn()
+				return nil
+			})
+		}},
+	}
+	for _, tt := range tests {
+		n := 0
+		if err := tt.read(func() { n++ }); err != nil || n != 3 {
+			t.Errorf("%s: %d, %v", tt.name, n, err)
+		}
+		if s := api.Cache.Stats(); s.Entries != 0 || s.Misses != 0 {
+			t.Errorf("%s: cached %+v", tt.name, s)
+		}
+	}
+}
+
+func TestQueryCacheSeq(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"a"}`)
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		cfg   CacheConfig
+		watch bool
+		reads int // of the update_seq for three queries
+	}{
+		{"every query", CacheConfig{}, false, 3},
+		{"SeqTTL", CacheConfig{SeqTTL: time.Hour}, false, 1},
+		{"Watch", CacheConfig{}, true, 1}, // the read of Watch itself
+	}
+	for _, tt := range tests {
+		api.Cache = NewQueryCache(tt.cfg)
+		before := dbInfoReads(fc, "db")
+		wctx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		if tt.watch {
+			go func() { done <- api.Cache.Watch(wctx, api, "db") }()
+			waitFor(t, "watch", func() bool { return fc.count(http.MethodPost, "/db/_changes") > 0 })
+		}
+		for i := 0; i < 3; i++ {
+			api.AllDocs(ctx, "db", ViewParams{})
+		}
+		if got := dbInfoReads(fc, "db") - before; got != tt.reads {
+			t.Errorf("%s: %d reads of the update_seq, want %d", tt.name, got, tt.reads)
+		}
+		if tt.watch {
+			// a write reaches the cache through the feed
+			fc.put(t, "db", `{"_id":"w"}`)
+			waitFor(t, "new rows", func() bool {
+				res, err := api.AllDocs(ctx, "db", ViewParams{})
+				return err == nil && len(res.Rows) == 2
+			})
+			cancel()
+			if err := <-done; err != context.Canceled {
+				t.Errorf("watch ended with %v", err)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestQueryCacheReplicas(t *testing.T) {
+	primaryFC, primary := newFakeCouch(t, "db")
+	replicaFC, replica := newFakeCouch(t, "db")
+	primaryFC.put(t, "db", `{"_id":"a"}`, `{"_id":"b"}`)
+	// the replica lags but claims to be current
+	replicaFC.put(t, "db", `{"_id":"a"}`)
+	primaryFC.handle(http.MethodGet, "/_scheduler/docs/_replicator/job", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"state": "running", "info": map[string]any{"checkpointed_source_seq": "100-x"}})
+	})
+	primary.Replicas = &ReplicaRouter{Replicas: []*Replica{{API: replica, Jobs: map[string]string{"db": "job"}}}, MaxLag: 5}
+	tests := []struct {
+		name  string
+		cache bool
+		rows  int
+		from  string
+	}{
+		{"uncached", false, 1, "replica"},
+		{"cached", true, 2, "primary"},
+	}
+	for _, tt := range tests {
+		primary.Cache = nil
+		if tt.cache {
+			primary.Cache = NewQueryCache(CacheConfig{})
+		}
+		before := replicaFC.count(http.MethodGet, "/db/_all_docs")
+		res, err := primary.AllDocs(context.Background(), "db", ViewParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		from := "primary"
+		if replicaFC.count(http.MethodGet, "/db/_all_docs") > before {
+			from = "replica"
+		}
+		if len(res.Rows) != tt.rows || from != tt.from {
+			t.Errorf("%s: %d rows from the %s, want %d from the %s", tt.name, len(res.Rows), from, tt.rows, tt.from)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package golangcouchdb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QueryType is the type a query parameter is converted to
+type QueryType int
+
+const (
+	// QueryString keeps the value as it is
+	QueryString QueryType = iota
+	// QueryNumber parses the value as float
+	QueryNumber
+	// QueryBool parses true and false
+	QueryBool
+	// QueryTime parses RFC 3339, the value is compared as string in UTC
+	QueryTime
+)
+
+// QueryField allows one field to be filtered by query parameters
+type QueryField struct {
+	// Name is the name in the query string
+	Name string
+	// Field is the document field, default Name
+	Field string
+	Type  QueryType
+	// Operators allowed besides eq: ne, gt, gte, lt, lte, in, nin, exists, regex
+	Operators []string
+	// Sortable allows the field in sort=
+	Sortable bool
+	// MaxLen limits string values and regex patterns, default 256
+	MaxLen int
+}
+
+// QuerySchema is the allow list of the query parameters of one resource
+type QuerySchema struct {
+	Fields []QueryField
+	// Base is always part of the selector, e.g. {"type": "order"}
+	Base map[string]any
+	// DefaultLimit and MaxLimit for limit=, default 25 and 200
+	DefaultLimit int
+	MaxLimit     int
+	// MaxConditions limits the number of filters, default 10
+	MaxConditions int
+	// MaxIn limits the values of in and nin, default 50
+	MaxIn int
+	// UseIndex is passed to _find, optional
+	UseIndex any
+}
+
+// QueryError is returned for a query string that is not allowed
+type QueryError struct {
+	Param  string
+	Reason string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("couchdb: query parameter %q: %s", e.Param, e.Reason)
+}
+
+var mangoOperators = map[string]string{
+	"eq": "$eq", "ne": "$ne", "gt": "$gt", "gte": "$gte", "lt": "$lt", "lte": "$lte",
+	"in": "$in", "nin": "$nin", "exists": "$exists", "regex": "$regex",
+}
+
+func (s *QuerySchema) field(name string) (QueryField, bool) {
+	for _, f := range s.Fields {
+		if f.Name == name {
+			if f.Field == "" {
+				f.Field = f.Name
+			}
+			if f.MaxLen <= 0 {
+				f.MaxLen = 256
+			}
+			return f, true
+		}
+	}
+	return QueryField{}, false
+}
+
+// Parse turns a query string like status=open&age[gte]=30&tags[in]=a,b&sort=-created&fields=id,name
+// into a _find query. Only fields and operators of the schema are accepted, values are
+// converted to the type of their field. Reserved parameters are sort, fields, limit and bookmark.
+func (s *QuerySchema) Parse(values url.Values) (FindQuery, error) {
+	maxLimit, limit := s.MaxLimit, s.DefaultLimit
+	if maxLimit <= 0 {
+		maxLimit = 200
+	}
+	if limit <= 0 {
+		limit = 25
+	}
+	maxConditions := s.MaxConditions
+	if maxConditions <= 0 {
+		maxConditions = 10
+	}
+	q := FindQuery{Limit: limit, UseIndex: s.UseIndex}
+	var conditions []any
+	filters := 0
+	if len(s.Base) > 0 {
+		conditions = append(conditions, s.Base)
+	}
+	params := make([]string, 0, len(values))
+	for param := range values {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		vals := values[param]
+		if len(vals) != 1 {
+			return q, &QueryError{Param: param, Reason: "given more than once"}
+		}
+		value := vals[0]
+		switch param {
+		case "sort":
+			fields, err := s.parseSort(value)
+			if err != nil {
+				return q, err
+			}
+			q.Sort = fields
+			continue
+		case "fields":
+			for _, name := range strings.Split(value, ",") {
+				f, ok := s.field(name)
+				if !ok {
+					return q, &QueryError{Param: param, Reason: fmt.Sprintf("field %q is not allowed", name)}
+				}
+				q.Fields = append(q.Fields, f.Field)
+			}
+			continue
+		case "limit":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 || n > maxLimit {
+				return q, &QueryError{Param: param, Reason: fmt.Sprintf("must be between 1 and %d", maxLimit)}
+			}
+			q.Limit = n
+			continue
+		case "bookmark":
+			q.Bookmark = value
+			continue
+		}
+		name, op := param, "eq"
+		if i := strings.IndexByte(param, '['); i > 0 && strings.HasSuffix(param, "]") {
+			name, op = param[:i], param[i+1:len(param)-1]
+		}
+		f, ok := s.field(name)
+		if !ok {
+			return q, &QueryError{Param: param, Reason: "unknown field"}
+		}
+		cond, err := s.condition(f, op, value)
+		if err != nil {
+			return q, &QueryError{Param: param, Reason: err.Error()}
+		}
+		conditions = append(conditions, map[string]any{f.Field: cond})
+		if filters++; filters > maxConditions {
+			return q, &QueryError{Param: param, Reason: "too many filters"}
+		}
+	}
+	q.Selector = map[string]any{}
+	if len(conditions) > 0 {
+		q.Selector["$and"] = conditions
+	}
+	return q, nil
+}
+
+func (s *QuerySchema) parseSort(value string) ([]any, error) {
+	var fields []any
+	for _, name := range strings.Split(value, ",") {
+		dir := "asc"
+		if strings.HasPrefix(name, "-") {
+			name, dir = name[1:], "desc"
+		}
+		f, ok := s.field(name)
+		if !ok || !f.Sortable {
+			return nil, &QueryError{Param: "sort", Reason: fmt.Sprintf("field %q is not sortable", name)}
+		}
+		fields = append(fields, map[string]string{f.Field: dir})
+	}
+	return fields, nil
+}
+
+func (s *QuerySchema) condition(f QueryField, op, value string) (map[string]any, error) {
+	mangoOp, ok := mangoOperators[op]
+	if !ok {
+		return nil, fmt.Errorf("unknown operator %q", op)
+	}
+	if op != "eq" && !containsString(f.Operators, op) {
+		return nil, fmt.Errorf("operator %q is not allowed", op)
+	}
+	switch op {
+	case "in", "nin":
+		maxIn := s.MaxIn
+		if maxIn <= 0 {
+			maxIn = 50
+		}
+		parts := strings.Split(value, ",")
+		if len(parts) > maxIn {
+			return nil, fmt.Errorf("more than %d values", maxIn)
+		}
+		list := make([]any, 0, len(parts))
+		for _, p := range parts {
+			v, err := coerceQueryValue(f, p)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return map[string]any{mangoOp: list}, nil
+	case "exists":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("must be true or false")
+		}
+		return map[string]any{mangoOp: b}, nil
+	case "regex":
+		if f.Type != QueryString {
+			return nil, fmt.Errorf("regex needs a string field")
+		}
+		if err := checkRegex(value, f.MaxLen); err != nil {
+			return nil, err
+		}
+		return map[string]any{mangoOp: value}, nil
+	}
+	v, err := coerceQueryValue(f, value)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{mangoOp: v}, nil
+}
+
+func coerceQueryValue(f QueryField, value string) (any, error) {
+	switch f.Type {
+	case QueryNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return n, nil
+	case QueryBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", value)
+		}
+		return b, nil
+	case QueryTime:
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a RFC 3339 time", value)
+		}
+		return t.UTC().Format(time.RFC3339Nano), nil
+	}
+	if len(value) > f.MaxLen {
+		return nil, fmt.Errorf("longer than %d characters", f.MaxLen)
+	}
+	return value, nil
+}
+
+// checkRegex rejects long patterns, nested repetitions and alternations or optional parts
+// under a repetition, like (a|aa)*, which make the regex engine of Couchdb backtrack
+// exponentially
+func checkRegex(pattern string, maxLen int) error {
+	if len(pattern) > maxLen {
+		return fmt.Errorf("regex longer than %d characters", maxLen)
+	}
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return fmt.Errorf("invalid regex: %v", err)
+	}
+	if nestedRepeat(re, false) {
+		return fmt.Errorf("nested repetitions and alternations under a repetition are not allowed")
+	}
+	return nil
+}
+
+func nestedRepeat(re *syntax.Regexp, inRepeat bool) bool {
+	repeat := re.Op == syntax.OpStar || re.Op == syntax.OpPlus || re.Op == syntax.OpRepeat
+	// the parser factors a|aa into a(?:|a), so a choice shows as alternation or quest
+	choice := re.Op == syntax.OpAlternate || re.Op == syntax.OpQuest
+	if (repeat || choice) && inRepeat {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if nestedRepeat(sub, inRepeat || repeat) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// FindByQuery parses a query string with schema and runs it as _find against db
+func (c *CouchDBAPI) FindByQuery(ctx context.Context, db string, schema *QuerySchema, values url.Values) (*FindResult, error) {
+	q, err := schema.Parse(values)
+	if err != nil {
+		return nil, err
+	}
+	return c.Find(ctx, db, q)
+}
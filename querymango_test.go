@@ -0,0 +1,135 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+)
+
+func TestCheckRegex(t *testing.T) {
+	tests := []struct {
+		pattern string
+		ok      bool
+	}{
+		{`^abc`, true},
+		{`a+b*c?`, true},
+		{`(a|b)*`, true}, // a character class
+		{`(ab)+`, true},
+		{`(a+)+`, false},
+		{`(x+x+)+y`, false},
+		{`(a*)*`, false},
+		{`(?:a{2,}){3}`, false},
+		{`(a|aa)*`, false},
+		{`(a|aa){2,}`, false},
+		{`(foo|bar)+`, false},
+		{`(ab?)*`, false},
+		{`(a|ab)(c)`, true},
+		{`[`, false},
+		{`aaaaaaaaaaaa`, false}, // longer than the limit
+	}
+	for _, tt := range tests {
+		if err := checkRegex(tt.pattern, 10); (err == nil) != tt.ok {
+			t.Errorf("checkRegex(%q) = %v, want ok %v", tt.pattern, err, tt.ok)
+		}
+	}
+}
+
+func TestCoerceQueryValue(t *testing.T) {
+	tests := []struct {
+		typ   QueryType
+		value string
+		want  string // JSON, empty for an error
+	}{
+		{QueryNumber, "42", `42`},
+		{QueryNumber, "-1.5e3", `-1500`},
+		{QueryNumber, "NaN", ``},
+		{QueryNumber, "Inf", ``},
+		{QueryNumber, "-infinity", ``},
+		{QueryNumber, "1e400", ``},
+		{QueryNumber, "x", ``},
+		{QueryBool, "true", `true`},
+		{QueryBool, "yes", ``},
+		{QueryTime, "2024-01-02T03:04:05+02:00", `"2024-01-02T01:04:05Z"`},
+		{QueryTime, "2024-01-02", ``},
+		{QueryString, "abc", `"abc"`},
+		{QueryString, "abcdef", ``},
+	}
+	for _, tt := range tests {
+		v, err := coerceQueryValue(QueryField{Type: tt.typ, MaxLen: 5}, tt.value)
+		got := ""
+		if err == nil {
+			got = string(mustJSON(v))
+		}
+		if got != tt.want {
+			t.Errorf("coerceQueryValue(%d, %q) = %s, %v, want %s", tt.typ, tt.value, got, err, tt.want)
+		}
+	}
+}
+
+var testQuerySchema = &QuerySchema{
+	Fields: []QueryField{
+		{Name: "status"},
+		{Name: "age", Type: QueryNumber, Operators: []string{"gte", "lt", "in"}, Sortable: true},
+		{Name: "name", Field: "profile.name", Operators: []string{"regex"}, Sortable: true},
+	},
+	Base:     map[string]any{"type": "user"},
+	MaxLimit: 50,
+	MaxIn:    3,
+}
+
+func TestQuerySchemaParse(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string // selector, sort, fields and limit as JSON, empty for an error
+	}{
+		{"", `{"selector":{"$and":[{"type":"user"}]},"limit":25}`},
+		{"status=open&age[gte]=30", `{"selector":{"$and":[{"type":"user"},{"age":{"$gte":30}},{"status":{"$eq":"open"}}]},"limit":25}`},
+		{"age[in]=1,2", `{"selector":{"$and":[{"type":"user"},{"age":{"$in":[1,2]}}]},"limit":25}`},
+		{"name[regex]=^jo", `{"selector":{"$and":[{"type":"user"},{"profile.name":{"$regex":"^jo"}}]},"limit":25}`},
+		{"sort=-age,name&fields=name&limit=10", `{"selector":{"$and":[{"type":"user"}]},"fields":["profile.name"],"sort":[{"age":"desc"},{"profile.name":"asc"}],"limit":10}`},
+		{"age=NaN", ``},
+		{"age[in]=1,Inf", ``},
+		{"age[in]=1,2,3,4", ``},
+		{"age[ne]=1", ``},
+		{"status[gt]=a", ``},
+		{"secret=1", ``},
+		{"sort=status", ``},
+		{"fields=secret", ``},
+		{"limit=51", ``},
+		{"status=a&status=b", ``},
+		{"name[regex]=(a|aa)*", ``},
+	}
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		q, err := testQuerySchema.Parse(values)
+		got := ""
+		if err == nil {
+			got = string(mustJSON(q))
+		} else if _, ok := err.(*QueryError); !ok {
+			t.Errorf("%q: error %T is not a *QueryError", tt.query, err)
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %s, %v\nwant %s", tt.query, got, err, tt.want)
+		}
+	}
+}
+
+func TestFindByQuery(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"a","type":"user","age":20}`, `{"_id":"b","type":"user","age":40}`, `{"_id":"c","type":"group","age":50}`)
+	res, err := api.FindByQuery(context.Background(), "db", testQuerySchema, url.Values{"age[gte]": {"30"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Docs) != 1 {
+		t.Fatalf("got %d documents", len(res.Docs))
+	}
+	var doc struct {
+		ID string `json:"_id"`
+	}
+	json.Unmarshal(res.Docs[0], &doc)
+	if doc.ID != "b" {
+		t.Errorf("got %s, want b", doc.ID)
+	}
+}
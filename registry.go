@@ -0,0 +1,216 @@
+package golangcouchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// UnknownTypePolicy decides what a TypeRegistry does with a document of an unregistered type
+type UnknownTypePolicy int
+
+const (
+	// UnknownError fails with an *UnknownTypeError
+	UnknownError UnknownTypePolicy = iota
+	// UnknownSkip leaves the document out, the callbacks of Rows, Changes and BulkGet
+	// are not called for it
+	UnknownSkip
+	// UnknownFallback decodes the document with TypeRegistry.Fallback
+	UnknownFallback
+)
+
+// UnknownTypeError is returned for a document whose type is not registered
+type UnknownTypeError struct {
+	ID   string
+	Type string // empty if the document has no discriminator
+}
+
+func (e *UnknownTypeError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("couchdb: document %q has no type", e.ID)
+	}
+	return fmt.Sprintf("couchdb: document %q has the unknown type %q", e.ID, e.Type)
+}
+
+// TypeRegistry decodes documents of mixed types into the Go type registered for the
+// value of a discriminator field. Decoded documents are pointers to the registered types:
+//
+//	reg := NewTypeRegistry("type", (*Event)(nil))
+//	reg.Register("order_placed", OrderPlaced{})
+//	reg.Register("order_shipped", OrderShipped{})
+//	err := api.StreamAllDocs(ctx, "events", ViewParams{IncludeDocs: true},
+//		reg.Rows(func(row ViewRow, doc any) error {
+//			switch e := doc.(type) {
+//			case *OrderPlaced:
+//			...
+//
+// Design documents and deleted documents are never looked up, they are decoded as nil.
+type TypeRegistry struct {
+	field string
+	iface reflect.Type
+
+	// Unknown is the policy for unregistered types and documents without the field
+	Unknown UnknownTypePolicy
+	// Fallback decodes documents of unknown types for UnknownFallback, e.g. into a map
+	Fallback func(typ string, doc json.RawMessage) (any, error)
+
+	mu    sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+// NewTypeRegistry returns a registry for the discriminator field, which may be a dotted
+// path. If iface is a nil pointer to an interface, e.g. (*Event)(nil), every registered
+// type must implement it.
+func NewTypeRegistry(field string, iface any) *TypeRegistry {
+	if field == "" {
+		field = "type"
+	}
+	r := &TypeRegistry{field: field, types: map[string]reflect.Type{}, names: map[reflect.Type]string{}}
+	if iface != nil {
+		t := reflect.TypeOf(iface)
+		if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Interface {
+			panic("couchdb: NewTypeRegistry needs a nil pointer to an interface")
+		}
+		r.iface = t.Elem()
+	}
+	return r
+}
+
+// Register maps a value of the discriminator to the type of prototype, e.g. Order{}.
+// It panics if the name or the type is registered twice or the type does not implement
+// the interface of the registry.
+func (r *TypeRegistry) Register(name string, prototype any) {
+	typ := reflect.TypeOf(prototype)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if r.iface != nil && !reflect.PtrTo(typ).Implements(r.iface) {
+		panic(fmt.Sprintf("couchdb: *%s does not implement %s", typ, r.iface))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.types[name]; ok {
+		panic(fmt.Sprintf("couchdb: type %q is registered twice", name))
+	}
+	if _, ok := r.names[typ]; ok {
+		panic(fmt.Sprintf("couchdb: %s is registered twice", typ))
+	}
+	r.types[name] = typ
+	r.names[typ] = name
+}
+
+// Name returns the discriminator value of a registered type, v may be a value or a pointer
+func (r *TypeRegistry) Name(v any) (string, bool) {
+	typ := reflect.TypeOf(v)
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name, ok := r.names[typ]
+	return name, ok
+}
+
+// Decode decodes a document into a new value of its registered type and returns the
+// pointer. Nil is returned for null, design and deleted documents, and with UnknownSkip
+// for documents of unknown types.
+func (r *TypeRegistry) Decode(doc json.RawMessage) (any, error) {
+	v, _, err := r.decode(doc)
+	return v, err
+}
+
+// decode also reports whether the document is left out by UnknownSkip
+func (r *TypeRegistry) decode(doc json.RawMessage) (any, bool, error) {
+	if len(doc) == 0 || string(doc) == "null" {
+		return nil, false, nil
+	}
+	var meta struct {
+		ID      string `json:"_id"`
+		Deleted bool   `json:"_deleted"`
+	}
+	if err := json.Unmarshal(doc, &meta); err != nil {
+		return nil, false, err
+	}
+	if meta.Deleted || strings.HasPrefix(meta.ID, "_design/") {
+		return nil, false, nil
+	}
+	var name string
+	if raw, ok := lookupField(doc, r.field); ok {
+		json.Unmarshal(raw, &name)
+	}
+	r.mu.RLock()
+	typ, ok := r.types[name]
+	r.mu.RUnlock()
+	if !ok {
+		switch r.Unknown {
+		case UnknownSkip:
+			return nil, true, nil
+		case UnknownFallback:
+			if r.Fallback != nil {
+				v, err := r.Fallback(name, doc)
+				return v, false, err
+			}
+		}
+		return nil, false, &UnknownTypeError{ID: meta.ID, Type: name}
+	}
+	v := reflect.New(typ)
+	if err := json.Unmarshal(doc, v.Interface()); err != nil {
+		return nil, false, fmt.Errorf("couchdb: document %q of type %q: %w", meta.ID, name, err)
+	}
+	return v.Interface(), false, nil
+}
+
+// Rows adapts fn for StreamView and StreamAllDocs with IncludeDocs, doc is the decoded row.Doc
+func (r *TypeRegistry) Rows(fn func(row ViewRow, doc any) error) func(ViewRow) error {
+	return func(row ViewRow) error {
+		doc, skip, err := r.decode(row.Doc)
+		if err != nil || skip {
+			return err
+		}
+		return fn(row, doc)
+	}
+}
+
+// Changes adapts fn for FollowChanges with IncludeDocs, doc is nil for deletions
+func (r *TypeRegistry) Changes(fn func(ch Change, doc any) error) func(Change) error {
+	return func(ch Change) error {
+		doc, skip, err := r.decode(ch.Doc)
+		if err != nil || skip {
+			return err
+		}
+		return fn(ch, doc)
+	}
+}
+
+// BulkGet adapts fn for BulkGet and BulkRead, doc is nil for documents that were not found
+func (r *TypeRegistry) BulkGet(fn func(res BulkGetResult, doc any) error) func(BulkGetResult) error {
+	return func(res BulkGetResult) error {
+		if res.Err != nil {
+			return fn(res, nil)
+		}
+		doc, skip, err := r.decode(res.Doc)
+		if err != nil || skip {
+			return err
+		}
+		return fn(res, doc)
+	}
+}
+
+// DecodeRows decodes the documents of a ViewResult with IncludeDocs, rows without
+// a document or left out by UnknownSkip are not returned
+func (r *TypeRegistry) DecodeRows(res *ViewResult) ([]any, error) {
+	docs := make([]any, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		doc, _, err := r.decode(row.Doc)
+		if err != nil {
+			return nil, err
+		}
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
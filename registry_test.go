@@ -0,0 +1,201 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type testEvent interface{ event() }
+
+type orderPlaced struct {
+	ID    string `json:"_id"`
+	Total int    `json:"total"`
+}
+
+type orderShipped struct {
+	ID      string `json:"_id"`
+	Carrier string `json:"carrier"`
+}
+
+type notAnEvent struct{}
+
+func (*orderPlaced) event()  {}
+func (*orderShipped) event() {}
+
+func newTestRegistry() *TypeRegistry {
+	reg := NewTypeRegistry("meta.kind", (*testEvent)(nil))
+	reg.Register("placed", orderPlaced{})
+	reg.Register("shipped", &orderShipped{})
+	return reg
+}
+
+func TestTypeRegistryDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		unknown UnknownTypePolicy
+		doc     string
+		want    string // %#v of the result
+		wantErr string
+	}{
+		{"registered", UnknownError, `{"_id":"a","meta":{"kind":"placed"},"total":3}`, `&golangcouchdb.orderPlaced{ID:"a", Total:3}`, ""},
+		{"pointer prototype", UnknownError, `{"_id":"b","meta":{"kind":"shipped"},"carrier":"x"}`, `&golangcouchdb.orderShipped{ID:"b", Carrier:"x"}`, ""},
+		{"null", UnknownError, `null`, `<nil>`, ""},
+		{"design document", UnknownError, `{"_id":"_design/app","views":{}}`, `<nil>`, ""},
+		{"deleted", UnknownError, `{"_id":"c","_deleted":true}`, `<nil>`, ""},
+		{"unknown", UnknownError, `{"_id":"d","meta":{"kind":"returned"}}`, ``, `unknown type "returned"`},
+		{"no type", UnknownError, `{"_id":"e"}`, ``, `has no type`},
+		{"unknown skipped", UnknownSkip, `{"_id":"d","meta":{"kind":"returned"}}`, `<nil>`, ""},
+		{"unknown fallback", UnknownFallback, `{"_id":"d","meta":{"kind":"returned"}}`, `"returned"`, ""},
+		{"wrong field type", UnknownError, `{"_id":"f","meta":{"kind":"placed"},"total":"3"}`, ``, `document "f" of type "placed"`},
+		{"invalid JSON", UnknownError, `{`, ``, `unexpected end`},
+	}
+	for _, tt := range tests {
+		reg := newTestRegistry()
+		reg.Unknown = tt.unknown
+		reg.Fallback = func(typ string, doc json.RawMessage) (any, error) { return typ, nil }
+		got, err := reg.Decode(json.RawMessage(tt.doc))
+		if (tt.wantErr == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && fmt.Sprintf("%#v", got) != tt.want {
+			t.Errorf("%s: %#v, want %s", tt.name, got, tt.want)
+		}
+	}
+	var e *UnknownTypeError
+	if _, err := newTestRegistry().Decode(json.RawMessage(`{"_id":"x","meta":{"kind":"y"}}`)); !errors.As(err, &e) || e.ID != "x" || e.Type != "y" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestTypeRegistryRegister(t *testing.T) {
+	tests := []struct {
+		name  string
+		iface any
+		reg   func(r *TypeRegistry)
+		panic string
+	}{
+		{"twice by name", nil, func(r *TypeRegistry) { r.Register("a", orderPlaced{}); r.Register("a", orderShipped{}) }, `type "a" is registered twice`},
+		{"twice by type", nil, func(r *TypeRegistry) { r.Register("a", orderPlaced{}); r.Register("b", &orderPlaced{}) }, "registered twice"},
+		{"interface missing", (*testEvent)(nil), func(r *TypeRegistry) { r.Register("a", notAnEvent{}) }, "does not implement"},
+		{"no interface", nil, func(r *TypeRegistry) { r.Register("a", notAnEvent{}) }, ""},
+		{"no pointer to an interface", orderPlaced{}, func(r *TypeRegistry) {}, "nil pointer to an interface"},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				got := fmt.Sprint(recover())
+				if tt.panic == "" && got != "<nil>" || !strings.Contains(got, tt.panic) {
+					t.Errorf("%s: panic %s, want %q", tt.name, got, tt.panic)
+				}
+			}()
+			tt.reg(NewTypeRegistry("", tt.iface))
+		}()
+	}
+}
+
+func TestTypeRegistryName(t *testing.T) {
+	reg := newTestRegistry()
+	tests := []struct {
+		v    any
+		want string
+		ok   bool
+	}{
+		{orderPlaced{}, "placed", true},
+		{&orderShipped{}, "shipped", true},
+		{notAnEvent{}, "", false},
+		{nil, "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := reg.Name(tt.v); got != tt.want || ok != tt.ok {
+			t.Errorf("Name(%#v) = %q, %v", tt.v, got, ok)
+		}
+	}
+}
+
+func TestTypeRegistryAdapters(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db", `{"_id":"a","meta":{"kind":"placed"},"total":1}`, `{"_id":"b","meta":{"kind":"shipped"},"carrier":"c"}`,
+		`{"_id":"c","meta":{"kind":"unknown"}}`, `{"_id":"_design/app"}`, `{"_id":"d","_deleted":true}`)
+	reg := newTestRegistry()
+	reg.Unknown = UnknownSkip
+	ctx := context.Background()
+	describe := func(id string, doc any) string {
+		switch d := doc.(type) {
+		case *orderPlaced:
+			return fmt.Sprintf("%s placed %d", id, d.Total)
+		case *orderShipped:
+			return fmt.Sprintf("%s shipped %s", id, d.Carrier)
+		case nil:
+			return id + " nil"
+		}
+		return id + " ?"
+	}
+	tests := []struct {
+		name string
+		read func(add func(string)) error
+		want string
+	}{
+		{"rows", func(add func(string)) error {
+			return api.StreamAllDocs(ctx, "db", ViewParams{IncludeDocs: true}, reg.Rows(func(row ViewRow, doc any) error {
+				add(describe(row.ID, doc))
+				return nil
+			}))
+		}, "_design/app nil, a placed 1, b shipped c"},
+		{"decode rows", func(add func(string)) error {
+			res, err := api.AllDocs(ctx, "db", ViewParams{IncludeDocs: true})
+			if err != nil {
+				return err
+			}
+			docs, err := reg.DecodeRows(res)
+			for _, doc := range docs {
+				add(describe("", doc))
+			}
+			return err
+		}, " placed 1,  shipped c"},
+		{"changes", func(add func(string)) error {
+			res, err := api.Changes(ctx, "db", ChangesParams{IncludeDocs: true})
+			if err != nil {
+				return err
+			}
+			fn := reg.Changes(func(ch Change, doc any) error {
+				add(describe(ch.ID, doc))
+				return nil
+			})
+			for _, ch := range res.Results {
+				if err := fn(ch); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, "_design/app nil, a placed 1, b shipped c, d nil"},
+		{"bulk get", func(add func(string)) error {
+			return api.BulkGet(ctx, "db", []BulkGetDoc{{ID: "a"}, {ID: "c"}, {ID: "missing"}}, false, reg.BulkGet(func(res BulkGetResult, doc any) error {
+				add(describe(res.ID, doc))
+				return nil
+			}))
+		}, "a placed 1, missing nil"},
+	}
+	for _, tt := range tests {
+		var got []string
+		if err := tt.read(func(s string) { got = append(got, s) }); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		sort.Strings(got)
+		if s := strings.Join(got, ", "); s != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, s, tt.want)
+		}
+	}
+	// with UnknownError the read ends at the unknown document
+	reg.Unknown = UnknownError
+	err := api.StreamAllDocs(ctx, "db", ViewParams{IncludeDocs: true}, reg.Rows(func(ViewRow, any) error { return nil }))
+	var e *UnknownTypeError
+	if !errors.As(err, &e) || e.ID != "c" {
+		t.Errorf("got %v", err)
+	}
+}
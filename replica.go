@@ -0,0 +1,250 @@
+package golangcouchdb
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replica is a cluster fed by replication from the primary
+type Replica struct {
+	API *CouchDBAPI
+	// Replicator is the server whose _replicator database holds the jobs, default the primary
+	Replicator *CouchDBAPI
+	// Jobs maps database names to the ids of the _replicator documents feeding them
+	Jobs map[string]string
+}
+
+// ReplicaRouter sends reads to replicas whose replication is close enough to the primary.
+// Set it as CouchDBAPI.Replicas of the primary. Writes, database info, _changes, _local
+// documents and server endpoints always go to the primary, so an update_seq read from
+// GET /{db} matches the _changes feed it is used with.
+type ReplicaRouter struct {
+	Replicas []*Replica
+	// MaxLag is the number of updates a replica may be behind, default 100
+	MaxLag int64
+	// CacheFor is how long sequences are cached, default 2s
+	CacheFor time.Duration
+
+	next  uint32
+	mu    sync.Mutex
+	cache map[string]cachedSeq
+}
+
+type cachedSeq struct {
+	seq int64
+	ok  bool
+	at  time.Time
+}
+
+type primaryKey struct{}
+
+// WithPrimary returns a context whose reads always go to the primary
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// Session tracks the writes of one user session, reads of a session are only sent to
+// replicas that have replicated its last write of the database
+type Session struct {
+	mu     sync.Mutex
+	writes map[string]int64 // database -> sequence of the last write, 0 until it is known
+}
+
+type sessionKey struct{}
+
+// WithSession returns a context with a new Session, or ctx if it has one already
+func WithSession(ctx context.Context) context.Context {
+	if SessionFrom(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, sessionKey{}, &Session{writes: map[string]int64{}})
+}
+
+// SessionFrom returns the Session of ctx or nil
+func SessionFrom(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+func (s *Session) noteWrite(db string) {
+	s.mu.Lock()
+	s.writes[db] = 0
+	s.mu.Unlock()
+}
+
+// splitDBPath returns the unescaped database and the rest of an api path
+func splitDBPath(path string) (string, string) {
+	path = strings.TrimLeft(path, "/")
+	first, rest, _ := strings.Cut(path, "/")
+	db, err := url.PathUnescape(first)
+	if err != nil {
+		return "", ""
+	}
+	return db, rest
+}
+
+// isReplicaRead reports whether a request reads replicated data of a database
+func isReplicaRead(method, path string) (string, bool) {
+	db, rest := splitDBPath(path)
+	if db == "" || strings.HasPrefix(db, "_") {
+		return "", false
+	}
+	second, _, _ := strings.Cut(rest, "/")
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		switch second {
+		case "", "_changes", "_local", "_security", "_revs_limit", "_index", "_shards":
+			return "", false
+		}
+		return db, true
+	case http.MethodPost:
+		switch second {
+		case "_find", "_all_docs", "_bulk_get", "_design_docs":
+			return db, true
+		}
+		return db, strings.Contains(rest, "/_view/")
+	}
+	return "", false
+}
+
+// route returns the server a request is sent to
+func (c *CouchDBAPI) route(ctx context.Context, method, path string) *CouchDBAPI {
+	if c.Replicas == nil {
+		return c
+	}
+	if db, ok := isReplicaRead(method, path); ok {
+		if r := c.Replicas.pick(ctx, c, db); r != nil {
+			return r
+		}
+	}
+	return c
+}
+
+// noteWrite remembers a successful write for read your writes of the session
+func (c *CouchDBAPI) noteWrite(ctx context.Context, method, path string) {
+	s := SessionFrom(ctx)
+	if c.Replicas == nil || s == nil || method == http.MethodGet || method == http.MethodHead {
+		return
+	}
+	if _, read := isReplicaRead(method, path); read {
+		return
+	}
+	db, rest := splitDBPath(path)
+	switch second, _, _ := strings.Cut(rest, "/"); second {
+	case "_changes", "_explain", "_revs_diff", "_missing_revs", "_local":
+		return
+	}
+	if db != "" && !strings.HasPrefix(db, "_") {
+		s.noteWrite(db)
+	}
+}
+
+func (r *ReplicaRouter) cacheFor() time.Duration {
+	if r.CacheFor > 0 {
+		return r.CacheFor
+	}
+	return 2 * time.Second
+}
+
+// cached returns a cached sequence or loads it with load
+func (r *ReplicaRouter) cached(key string, fresh bool, load func() (int64, bool)) (int64, bool) {
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = map[string]cachedSeq{}
+	}
+	c, found := r.cache[key]
+	r.mu.Unlock()
+	if found && !fresh && time.Since(c.at) < r.cacheFor() {
+		return c.seq, c.ok
+	}
+	seq, ok := load()
+	r.mu.Lock()
+	r.cache[key] = cachedSeq{seq: seq, ok: ok, at: time.Now()}
+	r.mu.Unlock()
+	return seq, ok
+}
+
+func (r *ReplicaRouter) primarySeq(ctx context.Context, primary *CouchDBAPI, db string, fresh bool) (int64, bool) {
+	return r.cached("primary\x00"+db, fresh, func() (int64, bool) {
+		info, err := primary.DBInfo(WithPrimary(ctx), db)
+		if err != nil {
+			return 0, false
+		}
+		return info.UpdateSeq.Number(), true
+	})
+}
+
+// replicatedSeq reads the checkpointed source sequence of a replication job
+func (r *ReplicaRouter) replicatedSeq(ctx context.Context, primary *CouchDBAPI, rep *Replica, job string) (int64, bool) {
+	replicator := rep.Replicator
+	if replicator == nil {
+		replicator = primary
+	}
+	return r.cached("job\x00"+replicator.Url+"\x00"+job, false, func() (int64, bool) {
+		var doc struct {
+			State string `json:"state"`
+			Info  struct {
+				CheckpointedSourceSeq Seq `json:"checkpointed_source_seq"`
+			} `json:"info"`
+		}
+		err := replicator.doJSON(WithPrimary(ctx), http.MethodGet, "_scheduler/docs/_replicator/"+url.PathEscape(job), nil, nil, &doc)
+		if err != nil {
+			return 0, false
+		}
+		switch doc.State {
+		case "running", "pending", "completed":
+			return doc.Info.CheckpointedSourceSeq.Number(), true
+		}
+		return 0, false
+	})
+}
+
+// pick returns a replica that may serve a read of db, nil for the primary
+func (r *ReplicaRouter) pick(ctx context.Context, primary *CouchDBAPI, db string) *CouchDBAPI {
+	if force, _ := ctx.Value(primaryKey{}).(bool); force || len(r.Replicas) == 0 {
+		return nil
+	}
+	var need int64
+	if s := SessionFrom(ctx); s != nil {
+		s.mu.Lock()
+		seq, wrote := s.writes[db]
+		s.mu.Unlock()
+		if wrote && seq == 0 {
+			// the first read after a write learns the sequence the write produced
+			var ok bool
+			if seq, ok = r.primarySeq(ctx, primary, db, true); !ok {
+				return nil
+			}
+			s.mu.Lock()
+			s.writes[db] = seq
+			s.mu.Unlock()
+		}
+		need = seq
+	}
+	pseq, ok := r.primarySeq(ctx, primary, db, false)
+	if !ok {
+		return nil
+	}
+	maxLag := r.MaxLag
+	if maxLag <= 0 {
+		maxLag = 100
+	}
+	start := int(atomic.AddUint32(&r.next, 1))
+	for i := range r.Replicas {
+		rep := r.Replicas[(start+i)%len(r.Replicas)]
+		job, ok := rep.Jobs[db]
+		if !ok {
+			continue
+		}
+		rseq, ok := r.replicatedSeq(ctx, primary, rep, job)
+		if ok && pseq-rseq <= maxLag && rseq >= need {
+			return rep.API
+		}
+	}
+	return nil
+}
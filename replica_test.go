@@ -0,0 +1,121 @@
+package golangcouchdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsReplicaRead(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{"GET", "db/doc", true},
+		{"HEAD", "db/doc", true},
+		{"GET", "db/doc/att.txt", true},
+		{"GET", "db/_all_docs", true},
+		{"GET", "db/_design/app/_view/v", true},
+		{"GET", "db", false},
+		{"GET", "db/", false},
+		{"GET", "db/_changes", false},
+		{"GET", "db/_local/x", false},
+		{"GET", "db/_security", false},
+		{"GET", "db/_index", false},
+		{"GET", "_all_dbs", false},
+		{"GET", "_users/org.couchdb.user:a", false},
+		{"POST", "db/_find", true},
+		{"POST", "db/_all_docs", true},
+		{"POST", "db/_bulk_get", true},
+		{"POST", "db/_design/app/_view/v", true},
+		{"POST", "db/_bulk_docs", false},
+		{"POST", "db/_changes", false},
+		{"PUT", "db/doc", false},
+		{"DELETE", "db/doc", false},
+	}
+	for _, tt := range tests {
+		if _, got := isReplicaRead(tt.method, tt.path); got != tt.want {
+			t.Errorf("isReplicaRead(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestReplicaRouter(t *testing.T) {
+	primaryFC, primary := newFakeCouch(t, "db")
+	replicaFC, replica := newFakeCouch(t, "db")
+	for i := 0; i < 10; i++ {
+		doc := fmt.Sprintf(`{"_id":"d%d"}`, i)
+		primaryFC.put(t, "db", doc)
+		replicaFC.put(t, "db", doc)
+	}
+	var replicated int64 = 10
+	primaryFC.handle(http.MethodGet, "/_scheduler/docs/_replicator/job", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"state": "running",
+			"info": map[string]any{"checkpointed_source_seq": fmt.Sprintf("%d-x", atomic.LoadInt64(&replicated))}})
+	})
+	router := &ReplicaRouter{Replicas: []*Replica{{API: replica, Jobs: map[string]string{"db": "job"}}}, MaxLag: 5, CacheFor: time.Nanosecond}
+	primary.Replicas = router
+	ctx := context.Background()
+	read := func(ctx context.Context, what string) {
+		t.Helper()
+		var err error
+		switch what {
+		case "doc":
+			var doc map[string]any
+			err = primary.GetDoc(ctx, "db", "d1", &doc)
+		case "info":
+			_, err = primary.DBInfo(ctx, "db")
+		case "changes":
+			_, err = primary.Changes(ctx, "db", ChangesParams{})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		what       string
+		replicated int64
+		want       string
+	}{
+		{"doc", ctx, "doc", 10, "replica"},
+		{"lag within MaxLag", ctx, "doc", 6, "replica"},
+		{"lag too big", ctx, "doc", 4, "primary"},
+		{"database info", ctx, "info", 10, "primary"},
+		{"changes", ctx, "changes", 10, "primary"},
+		{"forced", WithPrimary(ctx), "doc", 10, "primary"},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt64(&replicated, tt.replicated)
+		before := replicaFC.count("GET", "/db")
+		read(tt.ctx, tt.what)
+		got := "primary"
+		if replicaFC.count("GET", "/db") > before {
+			got = "replica"
+		}
+		if got != tt.want {
+			t.Errorf("%s: read from %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// a session reads its own write from the primary until the replica has it
+	sctx := WithSession(ctx)
+	atomic.StoreInt64(&replicated, 10)
+	if _, err := primary.PutDoc(sctx, "db", "new", map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	before := replicaFC.count("GET", "/db")
+	read(sctx, "doc")
+	if replicaFC.count("GET", "/db") != before {
+		t.Error("session read went to a replica without its write")
+	}
+	atomic.StoreInt64(&replicated, 11)
+	read(sctx, "doc")
+	if replicaFC.count("GET", "/db") == before {
+		t.Error("session read did not use the replica that has its write")
+	}
+}
@@ -0,0 +1,102 @@
+package golangcouchdb
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// sarifLevels maps severities to SARIF result levels
+var sarifLevels = map[Severity]string{
+	SeverityInfo:     "note",
+	SeverityWarning:  "warning",
+	SeverityCritical: "error",
+}
+
+// checkHelp describes the checks of Doctor and ScanSecurity for the rules of a SARIF log,
+// the remediation for one finding is a property of its result
+var checkHelp = map[string]string{
+	"admin_party":             "The server has no admin, every anonymous request has admin rights. Create an admin.",
+	"public_database":         "A database without members can be read by everybody who reaches the server. Set members in its _security object.",
+	"plaintext_password":      "A user document holds a password that was never hashed. Set the password again.",
+	"weak_password_scheme":    "A password is hashed with the simple scheme or too few pbkdf2 iterations. Raise the iterations and set the password again.",
+	"cors_wildcard":           "CORS allows every origin. List the allowed origins.",
+	"require_valid_user":      "Anonymous requests reach the server. Enable require_valid_user.",
+	"plaintext_listener":      "Requests and credentials cross the network without TLS. Serve https, e.g. behind a TLS terminating proxy.",
+	"exposed_utils":           "The Fauxton admin interface is reachable without authentication. Block /_utils or enable require_valid_user.",
+	"replication_credentials": "A replication document stores credentials in clear text. Use a dedicated replication user and restrict reading _replicator to admins.",
+	"tombstones":              "Many deleted documents slow down replication and views. Replicate into a new database without them or purge them.",
+	"fragmentation":           "A large part of the database file is unused. Compact the database.",
+	"revs_limit":              "A high revs_limit keeps many revision ids per document. Lower it.",
+	"security":                "A database without members can be read by everybody who reaches the server. Set members in its _security object.",
+	"doc_size":                "Big documents slow down every read, view and replication. Split them or move big values into attachments.",
+	"attachment_size":         "Big attachments bloat the database and replication. Move them into a blob store.",
+	"conflicts":               "Documents with conflicts keep losing revisions. Merge them and delete the losing revisions.",
+	"stale_index":             "An index is far behind and not updating, the next query waits for it. Query it regularly.",
+	"failing_index":           "Querying a view fails. Fix its map or reduce function.",
+	"unindexed_query":         "A query uses no index and reads every document. Create an index for it.",
+}
+
+// SARIF returns findings as a SARIF 2.1.0 log. Every check becomes a rule, the
+// location of a finding is the server url with the database and subject.
+func SARIF(tool, serverURL string, findings []Finding) ([]byte, error) {
+	type text struct {
+		Text string `json:"text"`
+	}
+	type rule struct {
+		ID               string `json:"id"`
+		ShortDescription text   `json:"shortDescription"`
+		Help             text   `json:"help"`
+	}
+	type location struct {
+		PhysicalLocation struct {
+			ArtifactLocation struct {
+				URI string `json:"uri"`
+			} `json:"artifactLocation"`
+		} `json:"physicalLocation"`
+	}
+	type result struct {
+		RuleID     string            `json:"ruleId"`
+		Level      string            `json:"level"`
+		Message    text              `json:"message"`
+		Locations  []location        `json:"locations"`
+		Properties map[string]string `json:"properties,omitempty"`
+	}
+
+	rules := map[string]rule{}
+	results := make([]result, 0, len(findings))
+	base := strings.TrimRight(serverURL, "/")
+	for _, f := range findings {
+		if _, ok := rules[f.Check]; !ok {
+			help, ok := checkHelp[f.Check]
+			if !ok {
+				help = "See the remediation of the results."
+			}
+			rules[f.Check] = rule{ID: f.Check, ShortDescription: text{f.Check}, Help: text{help}}
+		}
+		var loc location
+		loc.PhysicalLocation.ArtifactLocation.URI = base + "/" + f.DB
+		r := result{RuleID: f.Check, Level: sarifLevels[f.Severity], Message: text{f.Message}, Locations: []location{loc},
+			Properties: map[string]string{"remediation": f.Remediation}}
+		if f.Subject != "" {
+			r.Message.Text += " (" + f.Subject + ")"
+			r.Properties["subject"] = f.Subject
+		}
+		results = append(results, r)
+	}
+	ruleList := make([]rule, 0, len(rules))
+	for _, r := range rules {
+		ruleList = append(ruleList, r)
+	}
+	sort.Slice(ruleList, func(i, j int) bool { return ruleList[i].ID < ruleList[j].ID })
+
+	log := map[string]any{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs": []any{map[string]any{
+			"tool":    map[string]any{"driver": map[string]any{"name": tool, "rules": ruleList}},
+			"results": results,
+		}},
+	}
+	return json.MarshalIndent(log, "", "  ")
+}
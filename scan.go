@@ -0,0 +1,442 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ScanRange is one key range of a parallel scan and its progress
+type ScanRange struct {
+	StartKey   json.RawMessage `json:"start_key,omitempty"`
+	StartDocID string          `json:"start_doc_id,omitempty"`
+	EndKey     json.RawMessage `json:"end_key,omitempty"` // empty for the last range
+	EndDocID   string          `json:"end_doc_id,omitempty"`
+	LastKey    json.RawMessage `json:"last_key,omitempty"`
+	LastDocID  string          `json:"last_doc_id,omitempty"`
+	Rows       int64           `json:"rows"`
+	Done       bool            `json:"done"`
+}
+
+// ScanCheckpointer stores the ranges of a scan, so a stopped scan can be resumed
+type ScanCheckpointer interface {
+	Load(ctx context.Context) ([]ScanRange, error) // nil if there is no checkpoint
+	Save(ctx context.Context, ranges []ScanRange) error
+}
+
+// FileCheckpoint keeps the checkpoint of a scan in a JSON file
+type FileCheckpoint struct {
+	Path string
+}
+
+// Load implements ScanCheckpointer
+func (f FileCheckpoint) Load(ctx context.Context) ([]ScanRange, error) {
+	data, err := os.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ranges []ScanRange
+	return ranges, json.Unmarshal(data, &ranges)
+}
+
+// Save implements ScanCheckpointer, the file is replaced atomically. Every call writes its
+// own temporary file, so concurrent saves do not mix.
+func (f FileCheckpoint) Save(ctx context.Context, ranges []ScanRange) error {
+	data, err := json.MarshalIndent(ranges, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), filepath.Base(f.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.Path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// ScanOptions configure a parallel scan
+type ScanOptions struct {
+	// DDoc and View select a view, empty for _all_docs
+	DDoc string
+	View string
+	// Ranges is the number of ranges scanned at the same time, default 8
+	Ranges int
+	// PageSize is the number of rows per request, default 1000
+	PageSize int
+	// Checkpoint is saved after every page of every range, optional
+	Checkpoint ScanCheckpointer
+}
+
+// Scan reads a whole database (or view) with include_docs. The key space is split into
+// balanced ranges by bisecting the key space, the ranges are read concurrently and fn is
+// called for every row. fn must be safe for concurrent use. A scan with a Checkpoint
+// continues where the last run stopped.
+func (c *CouchDBAPI) Scan(ctx context.Context, db string, opts ScanOptions, fn func(ViewRow) error) error {
+	if opts.Ranges <= 0 {
+		opts.Ranges = 8
+	}
+	if opts.PageSize <= 0 {
+		opts.PageSize = 1000
+	}
+	path := dbPath(db) + "/_all_docs"
+	var base ViewParams
+	if opts.View != "" {
+		path = viewPath(db, opts.DDoc, opts.View)
+		reduce := false
+		base.Reduce = &reduce
+	}
+	var ranges []ScanRange
+	var err error
+	if opts.Checkpoint != nil {
+		if ranges, err = opts.Checkpoint.Load(ctx); err != nil {
+			return err
+		}
+	}
+	if ranges == nil {
+		if ranges, err = c.scanRanges(ctx, path, base, opts.Ranges); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu, saveMu sync.Mutex
+	var firstErr error
+	// saves are serialized, so an older snapshot never replaces a newer one
+	save := func() error {
+		if opts.Checkpoint == nil {
+			return nil
+		}
+		saveMu.Lock()
+		defer saveMu.Unlock()
+		mu.Lock()
+		snapshot := append([]ScanRange(nil), ranges...)
+		mu.Unlock()
+		return opts.Checkpoint.Save(ctx, snapshot)
+	}
+	var wg sync.WaitGroup
+	for i := range ranges {
+		if ranges[i].Done {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := c.scanRange(ctx, path, base, opts.PageSize, &ranges[i], &mu, save, fn); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// scanRanges splits the index into n ranges of about the same number of rows. The
+// boundary keys are found by bisecting the key space with limit=1 range probes, whose
+// offset is the number of rows before the key. A skip would make Couchdb walk over all
+// skipped rows. Keys that cannot be interpolated (see splitKeys) give one range. Ids of
+// _all_docs are compared raw, view keys by collation.
+func (c *CouchDBAPI) scanRanges(ctx context.Context, path string, base ViewParams, n int) ([]ScanRange, error) {
+	params := base
+	params.Limit = 1
+	first, err := c.queryView(ctx, path, params)
+	if err != nil {
+		return nil, err
+	}
+	total := first.TotalRows
+	if len(first.Rows) == 0 || total < n*2 {
+		return []ScanRange{{}}, nil
+	}
+	params.Descending = true
+	last, err := c.queryView(ctx, path, params)
+	if err != nil {
+		return nil, err
+	}
+	if len(last.Rows) == 0 {
+		return []ScanRange{{}}, nil
+	}
+	raw := strings.HasSuffix(path, "/_all_docs")
+	compare := func(a, b ViewRow) int {
+		if raw {
+			return strings.Compare(a.ID, b.ID)
+		}
+		if c := collate(a.Key, b.Key); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	}
+	// probe returns the first row at or after key and the number of rows before it
+	probe := func(key json.RawMessage) (*ViewRow, int, error) {
+		params := base
+		params.Limit, params.StartKey = 1, key
+		res, err := c.queryView(ctx, path, params)
+		if err != nil || len(res.Rows) == 0 {
+			return nil, total, err
+		}
+		return &res.Rows[0], res.Offset, nil
+	}
+	var bounds []ViewRow
+	lo := first.Rows[0].Key
+	for i := 1; i < n; i++ {
+		target, hi := i*total/n, last.Rows[0].Key
+		var best *ViewRow
+		bestOff := 0
+		// about 40 probes narrow 2^48 interpolation steps down to one
+		for step := 0; step < 48; step++ {
+			mid := splitKeys(lo, hi, 2)
+			if len(mid) == 0 || string(mid[0]) == string(lo) || string(mid[0]) == string(hi) {
+				break
+			}
+			row, off, err := probe(mid[0])
+			if err != nil {
+				return nil, err
+			}
+			if row != nil && (best == nil || abs(off-target) < abs(bestOff-target)) {
+				best, bestOff = row, off
+			}
+			if abs(off-target) <= total/(n*20) {
+				break
+			}
+			if off < target {
+				lo = mid[0]
+			} else {
+				hi = mid[0]
+			}
+		}
+		if best != nil && compare(*best, first.Rows[0]) > 0 {
+			bounds = append(bounds, *best)
+			lo = best.Key
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return compare(bounds[i], bounds[j]) < 0 })
+	ranges := make([]ScanRange, 0, n)
+	var start ScanRange
+	for i, row := range bounds {
+		if i > 0 && compare(row, bounds[i-1]) == 0 {
+			continue
+		}
+		start.EndKey, start.EndDocID = row.Key, row.ID
+		ranges = append(ranges, start)
+		start = ScanRange{StartKey: row.Key, StartDocID: row.ID}
+	}
+	return append(ranges, start), nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// splitKeys returns n-1 keys spread evenly between the JSON keys first and last. Strings
+// and numbers are interpolated, arrays at their first differing element. Other keys give
+// none.
+func splitKeys(first, last json.RawMessage, n int) []json.RawMessage {
+	var a, b any
+	if json.Unmarshal(first, &a) != nil || json.Unmarshal(last, &b) != nil {
+		return nil
+	}
+	var keys []json.RawMessage
+	switch a := a.(type) {
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return nil
+		}
+		for _, s := range splitStrings(a, b, n) {
+			keys = append(keys, mustJSON(s))
+		}
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return nil
+		}
+		for i := 1; i < n; i++ {
+			keys = append(keys, mustJSON(a+(b-a)*float64(i)/float64(n)))
+		}
+	case []any:
+		var ea, eb []json.RawMessage
+		json.Unmarshal(first, &ea)
+		if json.Unmarshal(last, &eb) != nil {
+			return nil
+		}
+		i := 0
+		for i < len(ea) && i < len(eb) && joinKey(ea[i]) == joinKey(eb[i]) {
+			i++
+		}
+		if i == len(ea) || i == len(eb) {
+			return nil
+		}
+		for _, k := range splitKeys(ea[i], eb[i], n) {
+			key := append(append([]json.RawMessage(nil), ea[:i]...), k)
+			keys = append(keys, mustJSON(key))
+		}
+	}
+	return keys
+}
+
+// splitStrings interpolates n-1 strings between a and b. Behind their common prefix three
+// code points are read as digits of base 0x10000, so the results sort between a and b by
+// code points as well as by bytes of UTF-8.
+func splitStrings(a, b string, n int) []string {
+	ra, rb := []rune(a), []rune(b)
+	p := 0
+	for p < len(ra) && p < len(rb) && ra[p] == rb[p] {
+		p++
+	}
+	const digits = 3
+	number := func(r []rune) uint64 {
+		var v uint64
+		for i := 0; i < digits; i++ {
+			d := uint64(0)
+			if p+i < len(r) {
+				d = uint64(r[p+i])
+				if d > 0xffff {
+					d = 0xffff
+				}
+			}
+			v = v<<16 | d
+		}
+		return v
+	}
+	va, vb := number(ra), number(rb)
+	if vb <= va {
+		return nil
+	}
+	var list []string
+	for i := 1; i < n; i++ {
+		v := va + (vb-va)/uint64(n)*uint64(i)
+		s := make([]rune, 0, p+digits)
+		s = append(s, ra[:p]...)
+		for shift := 16 * (digits - 1); shift >= 0; shift -= 16 {
+			d := rune(v >> uint(shift) & 0xffff)
+			if d >= 0xd800 && d <= 0xdfff {
+				d = 0xe000 // surrogates are no code points, the next one sorts after them
+			}
+			s = append(s, d)
+		}
+		for len(s) > p && s[len(s)-1] == 0 {
+			s = s[:len(s)-1]
+		}
+		list = append(list, string(s))
+	}
+	return list
+}
+
+func (c *CouchDBAPI) scanRange(ctx context.Context, path string, params ViewParams, pageSize int, r *ScanRange, mu *sync.Mutex, save func() error, fn func(ViewRow) error) error {
+	mu.Lock()
+	inclusiveEnd := false
+	params.IncludeDocs = true
+	if r.StartKey != nil {
+		params.StartKey, params.StartKeyDocID = r.StartKey, r.StartDocID
+	}
+	if r.LastKey != nil {
+		params.StartKey, params.StartKeyDocID, params.Skip = r.LastKey, r.LastDocID, 1
+	}
+	if r.EndKey != nil {
+		params.EndKey, params.EndKeyDocID, params.InclusiveEnd = r.EndKey, r.EndDocID, &inclusiveEnd
+	}
+	mu.Unlock()
+
+	n := 0
+	err := c.pageView(ctx, path, params, pageSize, func(row ViewRow) error {
+		if err := fn(row); err != nil {
+			return err
+		}
+		mu.Lock()
+		r.LastKey, r.LastDocID = row.Key, row.ID
+		r.Rows++
+		mu.Unlock()
+		if n++; n%pageSize == 0 {
+			return save()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	r.Done = true
+	mu.Unlock()
+	return save()
+}
+
+// ScanIterator delivers the rows of a parallel scan one by one
+type ScanIterator struct {
+	rows   chan ViewRow
+	row    ViewRow
+	err    error
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// ScanIter starts a Scan and returns an iterator over its rows. The order of the rows
+// is not defined. Close must be called if the iteration is stopped early.
+func (c *CouchDBAPI) ScanIter(ctx context.Context, db string, opts ScanOptions) *ScanIterator {
+	ctx, cancel := context.WithCancel(ctx)
+	it := &ScanIterator{rows: make(chan ViewRow, opts.PageSize), cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(it.done)
+		defer close(it.rows)
+		it.err = c.Scan(ctx, db, opts, func(row ViewRow) error {
+			select {
+			case it.rows <- row:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return it
+}
+
+// Next advances to the next row, it returns false at the end or on an error
+func (it *ScanIterator) Next() bool {
+	row, ok := <-it.rows
+	it.row = row
+	return ok
+}
+
+// Row returns the current row
+func (it *ScanIterator) Row() ViewRow {
+	return it.row
+}
+
+// Err returns the error of the scan after Next returned false
+func (it *ScanIterator) Err() error {
+	<-it.done
+	return it.err
+}
+
+// Close stops the scan
+func (it *ScanIterator) Close() {
+	it.cancel()
+	for range it.rows {
+	}
+	<-it.done
+}
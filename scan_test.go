@@ -0,0 +1,214 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileCheckpointConcurrentSave(t *testing.T) {
+	dir := t.TempDir()
+	cp := FileCheckpoint{Path: filepath.Join(dir, "scan.json")}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := cp.Save(context.Background(), []ScanRange{{Rows: int64(i)}}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	ranges, err := cp.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 1 {
+		t.Fatalf("loaded %v", ranges)
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("temporary files left: %d files in %s", len(files), dir)
+	}
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		name     string
+		docs     int
+		ranges   int
+		pageSize int
+	}{
+		{"empty", 0, 4, 2},
+		{"one range", 5, 4, 2},
+		{"ranges", 23, 4, 2},
+		{"more ranges than rows per range", 9, 8, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc, api := newFakeCouch(t, "db")
+			var want []string
+			for i := 0; i < tt.docs; i++ {
+				id := fmt.Sprintf("doc%02d", i)
+				fc.put(t, "db", fmt.Sprintf(`{"_id":%q}`, id))
+				want = append(want, id)
+			}
+			var mu sync.Mutex
+			var got []string
+			err := api.Scan(context.Background(), "db", ScanOptions{Ranges: tt.ranges, PageSize: tt.pageSize}, func(row ViewRow) error {
+				mu.Lock()
+				got = append(got, row.ID)
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestScanResume(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	var want []string
+	for i := 0; i < 30; i++ {
+		id := fmt.Sprintf("doc%02d", i)
+		fc.put(t, "db", fmt.Sprintf(`{"_id":%q}`, id))
+		want = append(want, id)
+	}
+	opts := ScanOptions{Ranges: 3, PageSize: 4, Checkpoint: FileCheckpoint{Path: filepath.Join(t.TempDir(), "scan.json")}}
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	stop := errors.New("stop")
+	err := api.Scan(context.Background(), "db", opts, func(row ViewRow) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(seen) == 10 {
+			return stop
+		}
+		seen[row.ID] = true
+		return nil
+	})
+	if err != stop {
+		t.Fatalf("first run returned %v", err)
+	}
+	err = api.Scan(context.Background(), "db", opts, func(row ViewRow) error {
+		mu.Lock()
+		seen[row.ID] = true
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for id := range seen {
+		got = append(got, id)
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	ranges, _ := opts.Checkpoint.Load(context.Background())
+	for _, r := range ranges {
+		if !r.Done {
+			t.Errorf("range %s not done", r.StartKey)
+		}
+	}
+}
+
+func TestSplitKeys(t *testing.T) {
+	tests := []struct {
+		first, last string
+		n           int
+		want        string // keys as JSON, joined by spaces
+	}{
+		{`"a"`, `"e"`, 4, `"b" "c" "d"`},
+		{`"doc0"`, `"doc8"`, 2, `"doc4"`},
+		{`"00"`, `"ff"`, 2, `"KK"`},
+		{`0`, `100`, 4, `25 50 75`},
+		{`["a",1]`, `["a",9]`, 2, `["a",5]`},
+		{`["x","a"]`, `["z","a"]`, 2, `["y"]`},
+		{`"a"`, `1`, 4, ``},
+		{`{"a":1}`, `{"a":2}`, 4, ``},
+		{`["a"]`, `["a","b"]`, 4, ``},
+		{`"b"`, `"a"`, 4, ``},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, k := range splitKeys(json.RawMessage(tt.first), json.RawMessage(tt.last), tt.n) {
+			got = append(got, string(k))
+		}
+		if s := strings.Join(got, " "); s != tt.want {
+			t.Errorf("splitKeys(%s, %s, %d) = %s, want %s", tt.first, tt.last, tt.n, s, tt.want)
+		}
+	}
+}
+
+func TestScanRanges(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	rnd := rand.New(rand.NewSource(1))
+	var ids []string
+	for i := 0; i < 400; i++ {
+		ids = append(ids, fmt.Sprintf("%016x", rnd.Uint64()))
+		fc.put(t, "db", fmt.Sprintf(`{"_id":%q}`, ids[i]))
+	}
+	var mu sync.Mutex
+	var queries []string
+	fc.handle(http.MethodGet, "/db/_all_docs", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		mu.Unlock()
+		fc.serve(w, r)
+	})
+	tests := []struct {
+		n, want int
+	}{
+		{1, 1},
+		{4, 4},
+		{8, 8},
+		{300, 1}, // fewer than two rows per range
+	}
+	for _, tt := range tests {
+		queries = nil
+		ranges, err := api.scanRanges(context.Background(), "db/_all_docs", ViewParams{}, tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ranges) != tt.want {
+			t.Errorf("%d ranges: got %d", tt.n, len(ranges))
+		}
+		for _, q := range queries {
+			if strings.Contains(q, "skip") {
+				t.Errorf("%d ranges: query %s", tt.n, q)
+			}
+		}
+		// evenly spread ids give even ranges
+		for _, r := range ranges {
+			rows := 0
+			for _, id := range ids {
+				if (r.StartDocID == "" || id >= r.StartDocID) && (r.EndDocID == "" || id < r.EndDocID) {
+					rows++
+				}
+			}
+			if avg := 400 / len(ranges); rows < avg*3/4 || rows > avg*5/4 {
+				t.Errorf("%d ranges: %d rows from %s to %s", tt.n, rows, r.StartDocID, r.EndDocID)
+			}
+		}
+	}
+}
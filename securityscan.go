@@ -0,0 +1,247 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ScanSecurity checks a server for insecure settings. c must have admin credentials,
+// the checks for anonymous access are made with the same url and no credentials.
+func (c *CouchDBAPI) ScanSecurity(ctx context.Context) ([]Finding, error) {
+	s := &securityScan{api: c, anon: &CouchDBAPI{Url: c.Url, clientMaxWaitTime: c.clientMaxWaitTime}}
+	for _, check := range []func(context.Context) error{s.adminParty, s.databases, s.users, s.nodes, s.utils, s.transport, s.replicator} {
+		if err := check(ctx); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(s.findings, func(i, j int) bool { return s.findings[i].Severity > s.findings[j].Severity })
+	return s.findings, nil
+}
+
+type securityScan struct {
+	api      *CouchDBAPI
+	anon     *CouchDBAPI
+	findings []Finding
+}
+
+func (s *securityScan) add(f Finding) {
+	s.findings = append(s.findings, f)
+}
+
+func (s *securityScan) adminParty(ctx context.Context) error {
+	var session struct {
+		UserCtx struct {
+			Roles []string `json:"roles"`
+		} `json:"userCtx"`
+	}
+	err := s.anon.doJSON(ctx, http.MethodGet, "_session", nil, nil, &session)
+	if e, ok := err.(*Error); ok && e.StatusCode == http.StatusUnauthorized {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if containsString(session.UserCtx.Roles, "_admin") {
+		s.add(Finding{Check: "admin_party", Severity: SeverityCritical,
+			Message:     "the server is in admin party mode, every anonymous request is an admin request",
+			Remediation: "create an admin in the [admins] section of local.ini or with PUT /_node/_local/_config/admins/<name>"})
+	}
+	return nil
+}
+
+// databases reports databases that anonymous requests can read
+func (s *securityScan) databases(ctx context.Context) error {
+	dbs, err := s.api.AllDBs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		_, err := s.anon.DBInfo(ctx, db)
+		if err == nil {
+			s.add(Finding{DB: db, Check: "public_database", Severity: SeverityCritical, Subject: db,
+				Message:     "the database can be read without authentication",
+				Remediation: `set members with PUT /` + db + `/_security, e.g. {"members":{"roles":["<role>"]}}`})
+			continue
+		}
+		// a database deleted since AllDBs is gone
+		if e, ok := err.(*Error); !ok || (e.StatusCode != http.StatusUnauthorized && e.StatusCode != http.StatusForbidden && e.StatusCode != http.StatusNotFound) {
+			return fmt.Errorf("%s: %w", db, err)
+		}
+	}
+	return nil
+}
+
+// users reports weak password schemes of _users
+func (s *securityScan) users(ctx context.Context) error {
+	err := s.api.StreamAllDocs(ctx, "_users", ViewParams{IncludeDocs: true}, func(row ViewRow) error {
+		if strings.HasPrefix(row.ID, "_design/") {
+			return nil
+		}
+		var user struct {
+			Name       string          `json:"name"`
+			Password   *string         `json:"password"`
+			Scheme     string          `json:"password_scheme"`
+			Iterations json.RawMessage `json:"iterations"`
+		}
+		if json.Unmarshal(row.Doc, &user) != nil {
+			return nil
+		}
+		iterations, _ := strconv.Atoi(strings.Trim(string(user.Iterations), `"`))
+		switch {
+		case user.Password != nil:
+			s.add(Finding{DB: "_users", Check: "plaintext_password", Severity: SeverityCritical, Subject: row.ID,
+				Message:     "the user document holds a plaintext password that was never hashed",
+				Remediation: "check that the _users database is not replicated from an untrusted source and set the password again"})
+		case user.Scheme == "simple":
+			s.add(Finding{DB: "_users", Check: "weak_password_scheme", Severity: SeverityCritical, Subject: row.ID,
+				Message:     "the password is hashed with the simple scheme (one round of SHA-1)",
+				Remediation: "set the password again, Couchdb hashes new passwords with pbkdf2"})
+		case user.Scheme == "pbkdf2" && iterations > 0 && iterations < 10000:
+			s.add(Finding{DB: "_users", Check: "weak_password_scheme", Severity: SeverityWarning, Subject: row.ID,
+				Message:     fmt.Sprintf("the password is hashed with only %d pbkdf2 iterations", iterations),
+				Remediation: "raise [chttpd_auth] iterations and set the password again"})
+		}
+		return nil
+	})
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// nodes checks the configuration of every node
+func (s *securityScan) nodes(ctx context.Context) error {
+	m, err := s.api.Membership(ctx)
+	if err != nil {
+		return err
+	}
+	for _, node := range m.ClusterNodes {
+		cfg, err := s.api.NodeConfig(ctx, node)
+		if err != nil {
+			return fmt.Errorf("%s: %w", node, err)
+		}
+		get := func(section, key string) string { return cfg[section][key] }
+		corsEnabled := get("chttpd", "enable_cors") == "true" || get("httpd", "enable_cors") == "true"
+		if corsEnabled && strings.Contains(get("cors", "origins"), "*") {
+			f := Finding{Check: "cors_wildcard", Severity: SeverityWarning, Subject: node,
+				Message:     "CORS allows every origin",
+				Remediation: "list the allowed origins in [cors] origins"}
+			if get("cors", "credentials") == "true" {
+				f.Severity = SeverityCritical
+				f.Message = "CORS allows every origin with credentials, any web site can make requests as the logged in user"
+			}
+			s.add(f)
+		}
+		if get("chttpd", "require_valid_user") != "true" && get("chttpd_auth", "require_valid_user") != "true" {
+			s.add(Finding{Check: "require_valid_user", Severity: SeverityWarning, Subject: node,
+				Message:     "require_valid_user is off, anonymous requests reach the server",
+				Remediation: "set [chttpd] require_valid_user = true (and [chttpd_auth] on Couchdb 3)"})
+		}
+		bind := get("chttpd", "bind_address")
+		if get("ssl", "enable") != "true" && bind != "" && !isLoopback(bind) {
+			s.add(Finding{Check: "plaintext_listener", Severity: SeverityWarning, Subject: node,
+				Message:     fmt.Sprintf("the node listens without TLS on %s:%s", bind, get("chttpd", "port")),
+				Remediation: "bind to 127.0.0.1 behind a TLS proxy, or enable [ssl] and close the plain port"})
+		}
+	}
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// utils reports a Fauxton reachable without authentication
+func (s *securityScan) utils(ctx context.Context) error {
+	resp, err := s.anon.do(ctx, http.MethodGet, "_utils/", nil, nil)
+	if err != nil {
+		if _, ok := err.(*Error); ok {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	s.add(Finding{Check: "exposed_utils", Severity: SeverityWarning, Subject: s.api.Url + "/_utils/",
+		Message:     "the Fauxton admin interface is reachable without authentication",
+		Remediation: "block /_utils on the proxy or enable require_valid_user"})
+	return nil
+}
+
+// transport reports that the scanner itself talks plain http to a remote server
+func (s *securityScan) transport(ctx context.Context) error {
+	u, err := url.Parse(s.api.Url)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "http" && !isLoopback(u.Hostname()) {
+		s.add(Finding{Check: "plaintext_listener", Severity: SeverityWarning, Subject: s.api.Url,
+			Message:     "the server is reached over plain http, credentials cross the network unencrypted",
+			Remediation: "serve https, e.g. with a TLS terminating proxy"})
+	}
+	return nil
+}
+
+// replicator reports replication documents with credentials in clear text
+func (s *securityScan) replicator(ctx context.Context) error {
+	err := s.api.StreamAllDocs(ctx, "_replicator", ViewParams{IncludeDocs: true}, func(row ViewRow) error {
+		if strings.HasPrefix(row.ID, "_design/") {
+			return nil
+		}
+		var doc map[string]any
+		if json.Unmarshal(row.Doc, &doc) != nil {
+			return nil
+		}
+		for _, side := range []string{"source", "target"} {
+			if where := plaintextCredentials(doc[side]); where != "" {
+				s.add(Finding{DB: "_replicator", Check: "replication_credentials", Severity: SeverityCritical, Subject: row.ID,
+					Message:     fmt.Sprintf("the %s of the replication carries credentials in %s", side, where),
+					Remediation: "use a dedicated replication user with minimal rights, and restrict reading _replicator to admins"})
+			}
+		}
+		return nil
+	})
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// plaintextCredentials returns where a replication endpoint holds credentials
+func plaintextCredentials(endpoint any) string {
+	switch e := endpoint.(type) {
+	case string:
+		if u, err := url.Parse(e); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				return "the url"
+			}
+		}
+	case map[string]any:
+		if where := plaintextCredentials(e["url"]); where != "" {
+			return where
+		}
+		if headers, ok := e["headers"].(map[string]any); ok {
+			for name := range headers {
+				if strings.EqualFold(name, "authorization") {
+					return "an Authorization header"
+				}
+			}
+		}
+		if auth, ok := e["auth"].(map[string]any); ok {
+			if basic, ok := auth["basic"].(map[string]any); ok && basic["password"] != nil {
+				return "auth.basic.password"
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,181 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPlaintextCredentials(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{`"https://host/db"`, ""},
+		{`"https://user@host/db"`, ""},
+		{`"https://user:pw@host/db"`, "the url"},
+		{`{"url":"https://user:pw@host/db"}`, "the url"},
+		{`{"url":"https://host/db","headers":{"authorization":"Basic eA=="}}`, "an Authorization header"},
+		{`{"url":"https://host/db","headers":{"Accept":"*/*"}}`, ""},
+		{`{"url":"https://host/db","auth":{"basic":{"username":"u","password":"p"}}}`, "auth.basic.password"},
+		{`{"url":"https://host/db","auth":{"iam":{"api_key":"k"}}}`, ""},
+		{`null`, ""},
+	}
+	for _, tt := range tests {
+		var endpoint any
+		json.Unmarshal([]byte(tt.endpoint), &endpoint)
+		if got := plaintextCredentials(endpoint); got != tt.want {
+			t.Errorf("plaintextCredentials(%s) = %q, want %q", tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"localhost", true},
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"0.0.0.0", false},
+		{"10.0.0.1", false},
+		{"couch.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := isLoopback(tt.host); got != tt.want {
+			t.Errorf("isLoopback(%s) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestSARIF(t *testing.T) {
+	data, err := SARIF("scan", "http://host/", []Finding{
+		{DB: "db", Check: "public_database", Severity: SeverityCritical, Subject: "db", Message: "readable", Remediation: "set members of db"},
+		{DB: "other", Check: "public_database", Severity: SeverityCritical, Subject: "other", Message: "readable", Remediation: "set members of other"},
+		{Check: "custom", Severity: SeverityInfo, Message: "note", Remediation: "do it"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log struct {
+		Runs []struct {
+			Tool struct {
+				Driver struct {
+					Rules []struct {
+						ID   string `json:"id"`
+						Help struct {
+							Text string `json:"text"`
+						} `json:"help"`
+					} `json:"rules"`
+				} `json:"driver"`
+			} `json:"tool"`
+			Results []struct {
+				RuleID    string `json:"ruleId"`
+				Level     string `json:"level"`
+				Message   struct{ Text string }
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct{ URI string }
+					}
+				}
+				Properties map[string]string
+			} `json:"results"`
+		} `json:"runs"`
+	}
+	if err := json.Unmarshal(data, &log); err != nil || len(log.Runs) != 1 {
+		t.Fatalf("%s, %v", data, err)
+	}
+	run := log.Runs[0]
+	rules := run.Tool.Driver.Rules
+	if len(rules) != 2 || rules[0].ID != "custom" || rules[1].ID != "public_database" {
+		t.Fatalf("rules %+v", rules)
+	}
+	// the help of a rule is the same for all findings, not the remediation of the first one
+	if help := rules[1].Help.Text; help != checkHelp["public_database"] || strings.Contains(help, "members of") {
+		t.Errorf("help %q", help)
+	}
+	if rules[0].Help.Text == "" {
+		t.Error("no help for an unknown check")
+	}
+	tests := []struct {
+		i                                int
+		level, message, uri, remediation string
+	}{
+		{0, "error", "readable (db)", "http://host/db", "set members of db"},
+		{1, "error", "readable (other)", "http://host/other", "set members of other"},
+		{2, "note", "note", "http://host/", "do it"},
+	}
+	for _, tt := range tests {
+		r := run.Results[tt.i]
+		if r.Level != tt.level || r.Message.Text != tt.message || r.Locations[0].PhysicalLocation.ArtifactLocation.URI != tt.uri ||
+			r.Properties["remediation"] != tt.remediation {
+			t.Errorf("result %d: %+v", tt.i, r)
+		}
+	}
+}
+
+// scanServer answers admin requests from answers and anonymous ones with 401, except for
+// the paths in public
+func scanServer(t *testing.T, answers map[string]string, public map[string]bool) *CouchDBAPI {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok && !public[r.URL.Path] {
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized", "You are not authorized to access this db.")
+			return
+		}
+		body, ok := answers[r.URL.Path]
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "not_found", "missing")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return &CouchDBAPI{Url: srv.URL, Username: "admin", Passwort: "pw"}
+}
+
+func TestScanSecurity(t *testing.T) {
+	api := scanServer(t, map[string]string{
+		"/_session":    `{"userCtx":{"name":null,"roles":[]}}`,
+		"/_all_dbs":    `["_replicator","_users","closed","gone","open"]`,
+		"/open":        `{"db_name":"open"}`,
+		"/_membership": `{"all_nodes":["n1"],"cluster_nodes":["n1"]}`,
+		"/_node/n1/_config": `{"chttpd":{"require_valid_user":"true","bind_address":"0.0.0.0","port":"5984","enable_cors":"true"},
+			"cors":{"origins":"*","credentials":"true"}}`,
+		"/_users/_all_docs": `{"rows":[{"id":"_design/auth","doc":{}},
+			{"id":"org.couchdb.user:a","doc":{"name":"a","password":"pw"}},
+			{"id":"org.couchdb.user:b","doc":{"name":"b","password_scheme":"simple"}},
+			{"id":"org.couchdb.user:c","doc":{"name":"c","password_scheme":"pbkdf2","iterations":10}},
+			{"id":"org.couchdb.user:d","doc":{"name":"d","password_scheme":"pbkdf2","iterations":"50000"}}]}`,
+		"/_replicator/_all_docs": `{"rows":[{"id":"r1","doc":{"source":"http://u:p@remote/db","target":"db"}},
+			{"id":"r2","doc":{"source":"db","target":{"url":"http://remote/db","auth":{"basic":{"username":"u","password":"p"}}}}}]}`,
+		"/_utils/": `<html></html>`,
+	}, map[string]bool{"/_session": true, "/open": true, "/gone": true, "/_utils/": true})
+	findings, err := api.ScanSecurity(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "critical public_database open, critical plaintext_password org.couchdb.user:a, critical weak_password_scheme org.couchdb.user:b, " +
+		"critical cors_wildcard n1, critical replication_credentials r1, critical replication_credentials r2, " +
+		"warning weak_password_scheme org.couchdb.user:c, warning plaintext_listener n1, warning exposed_utils " + api.Url + "/_utils/"
+	if got := findingList(findings); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestScanSecurityAdminParty(t *testing.T) {
+	api := scanServer(t, map[string]string{
+		"/_session":    `{"userCtx":{"name":null,"roles":["_admin"]}}`,
+		"/_all_dbs":    `[]`,
+		"/_membership": `{"all_nodes":[],"cluster_nodes":[]}`,
+	}, map[string]bool{"/_session": true})
+	findings, err := api.ScanSecurity(context.Background())
+	if err != nil || findingList(findings) != "critical admin_party " {
+		t.Errorf("%s, %v", findingList(findings), err)
+	}
+}
@@ -0,0 +1,185 @@
+package golangcouchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const defaultStreamIdleTimeout = 60 * time.Second
+
+// StreamStalledError is returned when a streaming response sent no data for longer than
+// the idle timeout. The stream is aborted, followers should reconnect.
+type StreamStalledError struct {
+	Path string
+	Idle time.Duration
+}
+
+func (e *StreamStalledError) Error() string {
+	return fmt.Sprintf("couchdb: stream %s stalled, no data for %s", e.Path, e.Idle)
+}
+
+// Timeout reports true, like net.Error
+func (e *StreamStalledError) Timeout() bool {
+	return true
+}
+
+// IsStreamStalled reports whether err is a *StreamStalledError
+func IsStreamStalled(err error) bool {
+	var e *StreamStalledError
+	return errors.As(err, &e)
+}
+
+func (c *CouchDBAPI) streamIdleTimeout() time.Duration {
+	if c.StreamIdleTimeout > 0 {
+		return c.StreamIdleTimeout
+	}
+	return defaultStreamIdleTimeout
+}
+
+// idleWatch cancels a request when its timer is not stopped in time, idleReader runs the timer
+type idleWatch struct {
+	idle    time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	stalled int32
+	path    string
+}
+
+func newIdleWatch(idle time.Duration, cancel context.CancelFunc, path string) *idleWatch {
+	w := &idleWatch{idle: idle, cancel: cancel, path: path}
+	w.timer = time.AfterFunc(idle, func() {
+		atomic.StoreInt32(&w.stalled, 1)
+		cancel()
+	})
+	w.timer.Stop()
+	return w
+}
+
+func (w *idleWatch) err(err error) error {
+	if err != nil && err != io.EOF && atomic.LoadInt32(&w.stalled) == 1 {
+		return &StreamStalledError{Path: w.path, Idle: w.idle}
+	}
+	return err
+}
+
+func (w *idleWatch) stop() {
+	w.timer.Stop()
+	w.cancel()
+}
+
+// idleReader runs the watch only while a Read waits for data, so a slow consumer
+// is not taken for a stalled stream
+type idleReader struct {
+	io.ReadCloser
+	watch *idleWatch
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.watch.timer.Reset(r.watch.idle)
+	n, err := r.ReadCloser.Read(p)
+	r.watch.timer.Stop()
+	return n, r.watch.err(err)
+}
+
+func (r *idleReader) Close() error {
+	r.watch.stop()
+	return r.ReadCloser.Close()
+}
+
+// doStream sends a request whose answer is read as a stream. The request is not limited by
+// clientMaxWaitTime, but aborted with a *StreamStalledError if the headers or data do not
+// arrive for StreamIdleTimeout. The wait for a Scheduler slot does not count as idle, and
+// neither does a slow consumer.
+func (c *CouchDBAPI) doStream(ctx context.Context, method, path string, query url.Values, body any, accept string) (*http.Response, error) {
+	if target := c.route(ctx, method, path); target != c {
+		return target.doStream(ctx, method, path, query, body, accept)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := c.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	w := newIdleWatch(c.streamIdleTimeout(), cancel, path)
+	resp, err := c.send(&http.Client{}, req, w)
+	if err != nil {
+		w.stop()
+		return nil, err
+	}
+	resp.Body = &idleReader{ReadCloser: resp.Body, watch: w}
+	return resp, nil
+}
+
+// StreamView reads the rows of a view while they arrive and calls fn for every row.
+// Big results are never held in memory.
+func (c *CouchDBAPI) StreamView(ctx context.Context, db, ddoc, view string, params ViewParams, fn func(ViewRow) error) error {
+	return c.streamRows(ctx, viewPath(db, ddoc, view), params, fn)
+}
+
+// StreamAllDocs reads the rows of _all_docs while they arrive and calls fn for every row
+func (c *CouchDBAPI) StreamAllDocs(ctx context.Context, db string, params ViewParams, fn func(ViewRow) error) error {
+	return c.streamRows(ctx, dbPath(db)+"/_all_docs", params, fn)
+}
+
+func (c *CouchDBAPI) streamRows(ctx context.Context, path string, params ViewParams, fn func(ViewRow) error) error {
+	var resp *http.Response
+	var err error
+	if len(params.Keys) > 0 {
+		resp, err = c.doStream(ctx, http.MethodPost, path, params.values(), map[string]any{"keys": params.Keys}, "")
+	} else {
+		resp, err = c.doStream(ctx, http.MethodGet, path, params.values(), nil, "")
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeRows(json.NewDecoder(resp.Body), func(row ViewRow) error {
+		return fn(c.maskRow(ctx, row))
+	})
+}
+
+// decodeRows reads {"total_rows": ..., "rows": [...]} and decodes the rows one by one
+func decodeRows(dec *json.Decoder, fn func(ViewRow) error) error {
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok != "rows" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		for dec.More() {
+			var row ViewRow
+			if err := dec.Decode(&row); err != nil {
+				return err
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
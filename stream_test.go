@@ -0,0 +1,87 @@
+package golangcouchdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStreamIdle(t *testing.T) {
+	const idle = 50 * time.Millisecond
+	tests := []struct {
+		name        string
+		headerDelay time.Duration // before the server answers
+		stall       bool          // the server stops after the first row
+		consume     time.Duration // per row in the callback
+		holdSlot    time.Duration // the only Scheduler slot is taken for this long
+		wantStalled bool
+	}{
+		{"fast", 0, false, 0, 0, false},
+		{"stalled", 0, true, 0, 0, true},
+		{"slow consumer", 0, false, 2 * idle, 0, false},
+		{"slow headers", 3 * idle, false, 0, 0, true},
+		{"waiting for a slot", 0, false, 0, 3 * idle, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.headerDelay)
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"total_rows":3,"offset":0,"rows":[`+"\n"+`{"id":"a","key":"a","value":1}`)
+				w.(http.Flusher).Flush()
+				if tt.stall {
+					<-r.Context().Done()
+					return
+				}
+				fmt.Fprint(w, `,`+"\n"+`{"id":"b","key":"b","value":1},`+"\n"+`{"id":"c","key":"c","value":1}`+"\n]}")
+			}))
+			api.StreamIdleTimeout = idle
+			if tt.holdSlot > 0 {
+				api.Scheduler = NewScheduler(SchedulerConfig{MaxConcurrent: 1})
+				release, err := api.Scheduler.acquire(context.Background(), PriorityNormal)
+				if err != nil {
+					t.Fatal(err)
+				}
+				time.AfterFunc(tt.holdSlot, release)
+			}
+			rows := 0
+			err := api.StreamAllDocs(context.Background(), "db", ViewParams{}, func(row ViewRow) error {
+				rows++
+				time.Sleep(tt.consume)
+				return nil
+			})
+			if IsStreamStalled(err) != tt.wantStalled {
+				t.Fatalf("err = %v, want stalled %v", err, tt.wantStalled)
+			}
+			if !tt.wantStalled && (err != nil || rows != 3) {
+				t.Errorf("got %d rows, err %v", rows, err)
+			}
+		})
+	}
+}
+
+func TestFollowChangesHeartbeat(t *testing.T) {
+	fc, api := newFakeCouch(t, "db")
+	api.StreamIdleTimeout = 60 * time.Millisecond
+	fc.put(t, "db", `{"_id":"a"}`)
+	time.AfterFunc(200*time.Millisecond, func() { fc.put(t, "db", `{"_id":"b"}`) })
+	var ids []string
+	last, err := api.FollowChanges(context.Background(), "db", ChangesParams{}, func(ch Change) error {
+		ids = append(ids, ch.ID)
+		if len(ids) == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Fatalf("FollowChanges returned %v", err)
+	}
+	// the change that fn rejected is not counted as seen
+	if fmt.Sprint(ids) != "[a b]" || last.Number() != 1 {
+		t.Errorf("got %v up to %s", ids, last)
+	}
+}
+
+var errStop = fmt.Errorf("stop")
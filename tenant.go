@@ -0,0 +1,344 @@
+package golangcouchdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TenantDB is the view of one tenant on a database shared by many tenants. Document ids
+// are stored as "<tenant>:<id>" and every document carries the tenant in a field. All
+// reads are limited to the tenant and return the ids without prefix, so a TenantDB
+// cannot reach documents of other tenants.
+//
+// Views queried through a TenantDB must emit keys of the form [tenant, key...]; the
+// tenant element is added to the key parameters and removed from the rows.
+type TenantDB struct {
+	api    *CouchDBAPI
+	db     string
+	tenant string
+	field  string
+}
+
+// NewTenantDB returns the handle of tenant on db. field is the document field holding
+// the tenant, default "tenant".
+func NewTenantDB(api *CouchDBAPI, db, tenant, field string) (*TenantDB, error) {
+	if tenant == "" || strings.ContainsAny(tenant, ":") || strings.HasPrefix(tenant, "_") {
+		return nil, fmt.Errorf("couchdb: invalid tenant %q", tenant)
+	}
+	if field == "" {
+		field = "tenant"
+	}
+	return &TenantDB{api: api, db: db, tenant: tenant, field: field}, nil
+}
+
+// Tenant returns the name of the tenant
+func (t *TenantDB) Tenant() string { return t.tenant }
+
+func (t *TenantDB) prefix() string { return t.tenant + ":" }
+
+// docID returns the stored id of a tenant document id
+func (t *TenantDB) docID(id string) (string, error) {
+	if id == "" || strings.HasPrefix(id, "_") {
+		return "", fmt.Errorf("couchdb: invalid document id %q for a tenant", id)
+	}
+	return t.prefix() + id, nil
+}
+
+// ownID reports whether a stored id belongs to the tenant and returns it without prefix
+func (t *TenantDB) ownID(id string) (string, bool) {
+	if !strings.HasPrefix(id, t.prefix()) {
+		return "", false
+	}
+	return strings.TrimPrefix(id, t.prefix()), true
+}
+
+// stripDoc removes the prefix from the _id of a stored document
+func (t *TenantDB) stripDoc(raw json.RawMessage) (json.RawMessage, bool) {
+	var doc map[string]json.RawMessage
+	if json.Unmarshal(raw, &doc) != nil {
+		return nil, false
+	}
+	var id string
+	json.Unmarshal(doc["_id"], &id)
+	own, ok := t.ownID(id)
+	if !ok {
+		return nil, false
+	}
+	doc["_id"] = mustJSON(own)
+	return mustJSON(doc), true
+}
+
+// storedDoc converts a document for writing: the id gets the prefix and the tenant field is set
+func (t *TenantDB) storedDoc(doc any, id string) (map[string]any, error) {
+	var fields map[string]any
+	if err := json.Unmarshal(mustJSON(doc), &fields); err != nil || fields == nil {
+		return nil, errors.New("couchdb: a tenant document must be a JSON object")
+	}
+	if id == "" {
+		id, _ = fields["_id"].(string)
+	}
+	if id == "" {
+		id = newDocID()
+	}
+	stored, err := t.docID(id)
+	if err != nil {
+		return nil, err
+	}
+	fields["_id"] = stored
+	fields[t.field] = t.tenant
+	return fields, nil
+}
+
+func newDocID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// GetDoc reads a document of the tenant into out
+func (t *TenantDB) GetDoc(ctx context.Context, id string, out any) error {
+	stored, err := t.docID(id)
+	if err != nil {
+		return err
+	}
+	var raw json.RawMessage
+	if err := t.api.GetDoc(ctx, t.db, stored, &raw); err != nil {
+		return err
+	}
+	doc, ok := t.stripDoc(raw)
+	if !ok {
+		return &Error{StatusCode: http.StatusNotFound, ErrorName: "not_found", Reason: "missing"}
+	}
+	return json.Unmarshal(doc, out)
+}
+
+// PutDoc creates or updates a document of the tenant and returns the new revision
+func (t *TenantDB) PutDoc(ctx context.Context, id string, doc any) (string, error) {
+	fields, err := t.storedDoc(doc, id)
+	if err != nil {
+		return "", err
+	}
+	return t.api.PutDoc(ctx, t.db, fields["_id"].(string), fields)
+}
+
+// DeleteDoc deletes revision rev of a document of the tenant
+func (t *TenantDB) DeleteDoc(ctx context.Context, id, rev string) (string, error) {
+	stored, err := t.docID(id)
+	if err != nil {
+		return "", err
+	}
+	return t.api.DeleteDoc(ctx, t.db, stored, rev)
+}
+
+// UpdateDoc is CouchDBAPI.UpdateDoc for a document of the tenant
+func (t *TenantDB) UpdateDoc(ctx context.Context, id string, fn func(doc map[string]any) (bool, error)) (string, error) {
+	stored, err := t.docID(id)
+	if err != nil {
+		return "", err
+	}
+	return t.api.UpdateDoc(ctx, t.db, stored, func(doc map[string]any) (bool, error) {
+		doc["_id"] = id
+		changed, err := fn(doc)
+		doc["_id"] = stored
+		doc[t.field] = t.tenant
+		return changed, err
+	})
+}
+
+// BulkDocs writes documents of the tenant, documents without _id get a random id
+func (t *TenantDB) BulkDocs(ctx context.Context, docs []any) ([]BulkResult, error) {
+	stored := make([]any, len(docs))
+	for i, doc := range docs {
+		fields, err := t.storedDoc(doc, "")
+		if err != nil {
+			return nil, err
+		}
+		stored[i] = fields
+	}
+	res, err := t.api.BulkDocs(ctx, t.db, stored)
+	for i := range res {
+		res[i].ID, _ = t.ownID(res[i].ID)
+	}
+	return res, err
+}
+
+// Find runs a mango query limited to the documents of the tenant
+func (t *TenantDB) Find(ctx context.Context, query FindQuery) (*FindResult, error) {
+	tenantSel := map[string]any{t.field: t.tenant, "_id": map[string]any{"$gt": t.prefix(), "$lt": t.prefix() + "\ufff0"}}
+	if len(query.Selector) == 0 {
+		query.Selector = tenantSel
+	} else {
+		query.Selector = map[string]any{"$and": []any{tenantSel, query.Selector}}
+	}
+	if len(query.Fields) > 0 && !containsString(query.Fields, "_id") {
+		query.Fields = append(append([]string(nil), query.Fields...), "_id")
+	}
+	res, err := t.api.Find(ctx, t.db, query)
+	if err != nil {
+		return nil, err
+	}
+	docs := res.Docs[:0]
+	for _, raw := range res.Docs {
+		if doc, ok := t.stripDoc(raw); ok {
+			docs = append(docs, doc)
+		}
+	}
+	res.Docs = docs
+	return res, nil
+}
+
+// AllDocs reads _all_docs limited to the ids of the tenant. Keys and key ranges are
+// tenant ids without prefix.
+func (t *TenantDB) AllDocs(ctx context.Context, params ViewParams) (*ViewResult, error) {
+	prefixKey := func(key any) (any, error) {
+		s, ok := key.(string)
+		if !ok {
+			return nil, errors.New("couchdb: _all_docs keys must be strings")
+		}
+		return t.prefix() + s, nil
+	}
+	var err error
+	if params.Key != nil {
+		if params.Key, err = prefixKey(params.Key); err != nil {
+			return nil, err
+		}
+	}
+	keys := make([]any, len(params.Keys))
+	for i, k := range params.Keys {
+		if keys[i], err = prefixKey(k); err != nil {
+			return nil, err
+		}
+	}
+	params.Keys = keys
+	if params.Key == nil && len(keys) == 0 {
+		low, high := any(t.prefix()), any(t.prefix()+"\ufff0")
+		if params.Descending {
+			low, high = high, low
+		}
+		if params.StartKey != nil {
+			if low, err = prefixKey(params.StartKey); err != nil {
+				return nil, err
+			}
+		}
+		if params.EndKey != nil {
+			if high, err = prefixKey(params.EndKey); err != nil {
+				return nil, err
+			}
+		}
+		params.StartKey, params.EndKey = low, high
+	} else {
+		params.StartKey, params.EndKey = nil, nil
+	}
+	params.StartKeyDocID, params.EndKeyDocID = "", ""
+	res, err := t.api.AllDocs(ctx, t.db, params)
+	if err != nil {
+		return nil, err
+	}
+	t.stripRows(res, func(row *ViewRow) bool {
+		var key string
+		json.Unmarshal(row.Key, &key)
+		own, ok := t.ownID(key)
+		row.Key = mustJSON(own)
+		return ok
+	})
+	return res, nil
+}
+
+// View queries a view whose keys start with the tenant, see TenantDB
+func (t *TenantDB) View(ctx context.Context, ddoc, view string, params ViewParams) (*ViewResult, error) {
+	wrap := func(key any) []any {
+		// an array key is continued, so [a, b] becomes [tenant, a, b]
+		if arr, ok := key.([]any); ok {
+			return append([]any{t.tenant}, arr...)
+		}
+		return []any{t.tenant, key}
+	}
+	if params.Key != nil {
+		params.Key = wrap(params.Key)
+	}
+	keys := make([]any, len(params.Keys))
+	for i, k := range params.Keys {
+		keys[i] = wrap(k)
+	}
+	params.Keys = keys
+	if params.Key == nil && len(keys) == 0 {
+		low, high := any([]any{t.tenant}), any([]any{t.tenant, map[string]any{}})
+		if params.Descending {
+			low, high = high, low
+		}
+		if params.StartKey != nil {
+			low = wrap(params.StartKey)
+		}
+		if params.EndKey != nil {
+			high = wrap(params.EndKey)
+		}
+		params.StartKey, params.EndKey = low, high
+	} else {
+		params.StartKey, params.EndKey = nil, nil
+	}
+	for _, id := range []*string{&params.StartKeyDocID, &params.EndKeyDocID} {
+		if *id != "" {
+			*id = t.prefix() + *id
+		}
+	}
+	if params.GroupLevel > 0 {
+		params.GroupLevel++
+	}
+	res, err := t.api.View(ctx, t.db, ddoc, view, params)
+	if err != nil {
+		return nil, err
+	}
+	t.stripRows(res, func(row *ViewRow) bool {
+		var key []json.RawMessage
+		if json.Unmarshal(row.Key, &key) != nil || len(key) == 0 {
+			// the reduce of the whole tenant range has a null key
+			return row.ID == "" && string(row.Key) == "null"
+		}
+		var tenant string
+		if json.Unmarshal(key[0], &tenant) != nil || tenant != t.tenant {
+			return false
+		}
+		if len(key) == 2 {
+			row.Key = key[1]
+		} else {
+			row.Key = mustJSON(key[1:])
+		}
+		return true
+	})
+	return res, nil
+}
+
+// stripRows drops rows of other tenants and removes the prefixes of ids and docs
+func (t *TenantDB) stripRows(res *ViewResult, key func(*ViewRow) bool) {
+	rows := res.Rows[:0]
+	for _, row := range res.Rows {
+		if row.ID != "" {
+			id, ok := t.ownID(row.ID)
+			if !ok {
+				continue
+			}
+			row.ID = id
+		}
+		if !key(&row) {
+			continue
+		}
+		if len(row.Doc) > 0 && string(row.Doc) != "null" {
+			doc, ok := t.stripDoc(row.Doc)
+			if !ok {
+				continue
+			}
+			row.Doc = doc
+		}
+		rows = append(rows, row)
+	}
+	res.Rows = rows
+	// the totals count the documents of all tenants
+	res.TotalRows = 0
+	res.Offset = 0
+}
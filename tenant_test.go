@@ -0,0 +1,213 @@
+package golangcouchdb
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNewTenantDB(t *testing.T) {
+	tests := []struct {
+		tenant  string
+		wantErr bool
+	}{
+		{"acme", false},
+		{"", true},
+		{"a:b", true},
+		{"_admin", true},
+	}
+	for _, tt := range tests {
+		if _, err := NewTenantDB(&CouchDBAPI{}, "db", tt.tenant, ""); (err != nil) != tt.wantErr {
+			t.Errorf("NewTenantDB(%q): %v", tt.tenant, err)
+		}
+	}
+}
+
+func newTestTenants(t *testing.T) (*fakeCouch, *TenantDB, *TenantDB) {
+	fc, api := newFakeCouch(t, "db")
+	fc.put(t, "db",
+		`{"_id":"acme:a","tenant":"acme","n":1}`, `{"_id":"acme:b","tenant":"acme","n":2}`,
+		`{"_id":"other:a","tenant":"other","n":3}`, `{"_id":"acmeX:a","tenant":"acmeX","n":4}`,
+		`{"_id":"acme:c","tenant":"other","n":5}`, `{"_id":"plain","n":6}`)
+	acme, err := NewTenantDB(api, "db", "acme", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewTenantDB(api, "db", "other", "")
+	return fc, acme, other
+}
+
+func TestTenantDocs(t *testing.T) {
+	fc, acme, other := newTestTenants(t)
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		db   *TenantDB
+		id   string
+		want string // the _id read, empty for not found
+	}{
+		{"own", acme, "a", "a"},
+		{"same id of other tenant", other, "a", "a"},
+		{"missing", other, "b", ""},
+		{"prefix of other tenant", acme, "X:a", ""},
+		{"unprefixed", acme, "plain", ""},
+		{"design doc", acme, "_design/app", ""},
+	}
+	for _, tt := range tests {
+		var doc map[string]any
+		err := tt.db.GetDoc(ctx, tt.id, &doc)
+		got, _ := doc["_id"].(string)
+		if got != tt.want || (tt.want == "" && err == nil) {
+			t.Errorf("%s: got %v, %v", tt.name, doc, err)
+		}
+	}
+
+	rev, err := acme.PutDoc(ctx, "new", map[string]any{"_id": "ignored", "tenant": "other", "n": 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc := fc.doc("db", "acme:new"); doc == nil || doc["tenant"] != "acme" {
+		t.Errorf("stored %v", doc)
+	}
+	if _, err := acme.UpdateDoc(ctx, "new", func(doc map[string]any) (bool, error) {
+		if doc["_id"] != "new" {
+			t.Errorf("UpdateDoc sees %v", doc["_id"])
+		}
+		doc["tenant"], doc["n"] = "other", 8
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if doc := fc.doc("db", "acme:new"); doc["tenant"] != "acme" || doc["n"] != 8.0 {
+		t.Errorf("updated %v", doc)
+	}
+	if _, err := other.DeleteDoc(ctx, "new", rev); err == nil {
+		t.Error("other tenant deleted the document")
+	}
+	res, err := acme.BulkDocs(ctx, []any{map[string]any{"_id": "x"}, map[string]any{"n": 1}})
+	if err != nil || res[0].ID != "x" || res[1].ID == "" || strings.Contains(res[1].ID, ":") {
+		t.Errorf("BulkDocs %v, %v", res, err)
+	}
+	if _, err := acme.BulkDocs(ctx, []any{map[string]any{"_id": "_design/x"}}); err == nil {
+		t.Error("BulkDocs wrote a design document")
+	}
+}
+
+func TestTenantFind(t *testing.T) {
+	_, acme, other := newTestTenants(t)
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		db    *TenantDB
+		query FindQuery
+		want  string
+	}{
+		{"all", acme, FindQuery{}, "a,b"},
+		{"selector", acme, FindQuery{Selector: map[string]any{"n": map[string]any{"$gt": 1}}}, "b"},
+		{"or cannot escape", acme, FindQuery{Selector: map[string]any{"$or": []any{map[string]any{"n": 3}, map[string]any{"n": 5}}}}, ""},
+		{"fields", acme, FindQuery{Fields: []string{"n"}}, "a,b"},
+		{"other tenant", other, FindQuery{}, "a"},
+	}
+	for _, tt := range tests {
+		res, err := tt.db.Find(ctx, tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, doc := range res.Docs {
+			id, _ := docIDRev(doc)
+			ids = append(ids, id)
+		}
+		if got := strings.Join(ids, ","); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTenantAllDocs(t *testing.T) {
+	_, acme, _ := newTestTenants(t)
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		params ViewParams
+		want   string
+	}{
+		{"all", ViewParams{IncludeDocs: true}, "a,b,c"},
+		{"descending", ViewParams{Descending: true}, "c,b,a"},
+		{"start key", ViewParams{StartKey: "b"}, "b,c"},
+		{"key", ViewParams{Key: "a"}, "a"},
+		{"keys", ViewParams{Keys: []any{"b", "nope"}}, "b"},
+	}
+	for _, tt := range tests {
+		res, err := acme.AllDocs(ctx, tt.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, row := range res.Rows {
+			if row.Error != "" {
+				continue
+			}
+			if row.ID != string(row.Key[1:len(row.Key)-1]) {
+				t.Errorf("%s: row %s with key %s", tt.name, row.ID, row.Key)
+			}
+			if len(row.Doc) > 0 {
+				if id, _ := docIDRev(row.Doc); id != row.ID {
+					t.Errorf("%s: doc id %s", tt.name, id)
+				}
+			}
+			ids = append(ids, row.ID)
+		}
+		if got := strings.Join(ids, ","); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	if _, err := acme.AllDocs(ctx, ViewParams{Key: 1}); err == nil {
+		t.Error("a number key was accepted")
+	}
+}
+
+func TestTenantView(t *testing.T) {
+	fc, acme, _ := newTestTenants(t)
+	var queries []string
+	fc.handle(http.MethodGet, "/db/_design/app/_view/v", fakeView([]ViewRow{
+		viewRow("acme:a", `["acme",1]`, `1`),
+		viewRow("acme:b", `["acme",2,"x"]`, `2`),
+		viewRow("other:a", `["other",1]`, `3`),
+		viewRow("acme:c", `["other",2]`, `5`),
+	}, &queries))
+	tests := []struct {
+		name      string
+		params    ViewParams
+		want      string
+		wantQuery string
+	}{
+		{"all", ViewParams{}, `a=1 b=[2,"x"]`, `end_key=["acme",{}]&start_key=["acme"]`},
+		{"key", ViewParams{Key: 1}, `a=1`, `key=["acme",1]`},
+		{"array start key", ViewParams{StartKey: []any{2}}, `b=[2,"x"]`, `end_key=["acme",{}]&start_key=["acme",2]`},
+	}
+	for _, tt := range tests {
+		queries = nil
+		res, err := acme.View(context.Background(), "app", "v", tt.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rows []string
+		for _, row := range res.Rows {
+			rows = append(rows, row.ID+"="+string(row.Key))
+		}
+		if got := strings.Join(rows, " "); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+		if len(queries) != 1 || !strings.Contains(queryUnescape(queries[0]), tt.wantQuery) {
+			t.Errorf("%s: queries %v", tt.name, queries)
+		}
+	}
+}
+
+func queryUnescape(s string) string {
+	u, _ := url.QueryUnescape(s)
+	return u
+}
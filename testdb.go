@@ -0,0 +1,150 @@
+package golangcouchdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TestingT is the part of testing.TB used by NewTestDB
+type TestingT interface {
+	Helper()
+	Name() string
+	Cleanup(func())
+	Errorf(format string, args ...any)
+	Fatalf(format string, args ...any)
+}
+
+// TestDBOptions configure NewTestDB
+type TestDBOptions struct {
+	// Prefix of the database name, default "test_". SweepTestDBs removes by this prefix.
+	Prefix string
+	// DesignDocs and Fixtures are written into the new database, every document needs an _id
+	DesignDocs []any
+	Fixtures   []any
+	// Keep skips the deletion at the end of the test
+	Keep bool
+}
+
+// TestDB is a database that exists for the duration of one test
+type TestDB struct {
+	API  *CouchDBAPI
+	Name string
+}
+
+// NewTestDB creates a uniquely named database for the test t, loads the design documents
+// and fixtures of opts and deletes the database when the test ends. The name contains the
+// creation time, so databases of crashed tests can be removed by SweepTestDBs. A failed
+// setup ends the test with Fatalf, a failed deletion is reported with Errorf so the other
+// cleanups still run.
+func NewTestDB(t TestingT, api *CouchDBAPI, opts TestDBOptions) *TestDB {
+	t.Helper()
+	ctx := context.Background()
+	name := testDBName(opts.Prefix, t.Name(), time.Now())
+	if err := api.CreateDB(ctx, name); err != nil {
+		t.Fatalf("create test database %s: %v", name, err)
+	}
+	if !opts.Keep {
+		t.Cleanup(func() {
+			if err := api.DeleteDB(context.Background(), name); err != nil && !IsNotFound(err) {
+				t.Errorf("delete test database %s: %v", name, err)
+			}
+		})
+	}
+	docs := append(append([]any(nil), opts.DesignDocs...), opts.Fixtures...)
+	if len(docs) > 0 {
+		results, err := api.BulkDocs(ctx, name, docs)
+		if err != nil {
+			t.Fatalf("load fixtures into %s: %v", name, err)
+		}
+		for _, r := range results {
+			if err := r.Err(); err != nil {
+				t.Fatalf("load fixture %s into %s: %v", r.ID, name, err)
+			}
+		}
+	}
+	return &TestDB{API: api, Name: name}
+}
+
+// testDBName builds <prefix><unix seconds>_<random>_<test name>, valid as a database name
+func testDBName(prefix, test string, now time.Time) string {
+	if prefix == "" {
+		prefix = "test_"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	var clean strings.Builder
+	for _, r := range strings.ToLower(test) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			clean.WriteRune(r)
+		default:
+			clean.WriteByte('_')
+		}
+		if clean.Len() >= 60 {
+			break
+		}
+	}
+	return fmt.Sprintf("%s%d_%s_%s", prefix, now.Unix(), hex.EncodeToString(b), clean.String())
+}
+
+// testDBCreated returns the creation time encoded in the name of a test database. Only
+// names of the exact shape <prefix><unix seconds>_<8 hex digits>_<test name> match, so
+// databases that merely share the prefix, like test_2024_orders, are never taken.
+func testDBCreated(prefix, name string) (time.Time, bool) {
+	rest := strings.TrimPrefix(name, prefix)
+	if rest == name {
+		return time.Time{}, false
+	}
+	parts := strings.SplitN(rest, "_", 3)
+	if len(parts) != 3 || parts[2] == "" || !isDigits(parts[0]) || len(parts[1]) != 8 {
+		return time.Time{}, false
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil || strings.ToLower(parts[1]) != parts[1] {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// SweepTestDBs deletes test databases with the given prefix (default "test_") that were
+// created before now minus olderThan, left over by crashed or killed test runs.
+// It returns the names of the deleted databases.
+func SweepTestDBs(ctx context.Context, api *CouchDBAPI, prefix string, olderThan time.Duration) ([]string, error) {
+	if prefix == "" {
+		prefix = "test_"
+	}
+	dbs, err := api.AllDBs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-olderThan)
+	var deleted []string
+	for _, db := range dbs {
+		created, ok := testDBCreated(prefix, db)
+		if !ok || !created.Before(cutoff) {
+			continue
+		}
+		if err := api.DeleteDB(ctx, db); err != nil && !IsNotFound(err) {
+			return deleted, err
+		}
+		deleted = append(deleted, db)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,178 @@
+package golangcouchdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestTestDBCreated(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   int64
+		wantOK bool
+	}{
+		{"test_1700000000_0a1b2c3d_testfoo", 1700000000, true},
+		{"test_1700000000_0a1b2c3d_a_b_c", 1700000000, true},
+		{"test_2024_orders", 0, false},
+		{"test_2024_orders_archive", 0, false},
+		{"test_1700000000_0a1b2c3_x", 0, false},
+		{"test_1700000000_0A1B2C3D_x", 0, false},
+		{"test_1700000000_0a1b2c3g_x", 0, false},
+		{"test_1700000000_0a1b2c3d_", 0, false},
+		{"test_1700000000_0a1b2c3d", 0, false},
+		{"test__0a1b2c3d_x", 0, false},
+		{"test_-1_0a1b2c3d_x", 0, false},
+		{"prod_1700000000_0a1b2c3d_x", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := testDBCreated("test_", tt.name)
+		if ok != tt.wantOK || (ok && got.Unix() != tt.want) {
+			t.Errorf("testDBCreated(%q) = %v, %v, want %d, %v", tt.name, got.Unix(), ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestTestDBName(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		prefix, test string
+		want         string
+	}{
+		{"", "TestFoo/sub case", `^test_1700000000_[0-9a-f]{8}_testfoo_sub_case$`},
+		{"it_", "TestX", `^it_1700000000_[0-9a-f]{8}_testx$`},
+	}
+	for _, tt := range tests {
+		name := testDBName(tt.prefix, tt.test, now)
+		if !regexp.MustCompile(tt.want).MatchString(name) {
+			t.Errorf("testDBName(%q, %q) = %q, want %s", tt.prefix, tt.test, name, tt.want)
+		}
+		prefix := tt.prefix
+		if prefix == "" {
+			prefix = "test_"
+		}
+		if created, ok := testDBCreated(prefix, name); !ok || !created.Equal(now) {
+			t.Errorf("testDBCreated(%q) = %v, %v", name, created, ok)
+		}
+	}
+}
+
+// fakeT is a TestingT that records failures and runs cleanups on demand. Fatalf panics
+// like runtime.Goexit ends a test, so later code of the failing function does not run.
+type fakeT struct {
+	cleanups []func()
+	errors   []string
+	fatals   []string
+}
+
+type fakeFatal struct{}
+
+func (f *fakeT) Helper()           {}
+func (f *fakeT) Name() string      { return "TestFake" }
+func (f *fakeT) Cleanup(fn func()) { f.cleanups = append(f.cleanups, fn) }
+func (f *fakeT) Errorf(format string, args ...any) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+func (f *fakeT) Fatalf(format string, args ...any) {
+	f.fatals = append(f.fatals, fmt.Sprintf(format, args...))
+	panic(fakeFatal{})
+}
+
+// run calls fn and reports whether it ended with Fatalf
+func (f *fakeT) run(fn func()) (fatal bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(fakeFatal); !ok {
+				panic(r)
+			}
+			fatal = true
+		}
+	}()
+	fn()
+	return false
+}
+
+// cleanup runs the cleanups like testing does, last registered first
+func (f *fakeT) cleanup() {
+	for i := len(f.cleanups) - 1; i >= 0; i-- {
+		f.run(f.cleanups[i])
+	}
+}
+
+func TestNewTestDB(t *testing.T) {
+	fc, api := newFakeCouch(t)
+	ft := &fakeT{}
+	var db *TestDB
+	ft.run(func() {
+		db = NewTestDB(ft, api, TestDBOptions{
+			DesignDocs: []any{map[string]any{"_id": "_design/app"}},
+			Fixtures:   []any{map[string]any{"_id": "a", "n": 1}},
+		})
+	})
+	if len(ft.fatals) > 0 || len(ft.errors) > 0 {
+		t.Fatal(ft.fatals, ft.errors)
+	}
+	if fc.doc(db.Name, "a") == nil || fc.doc(db.Name, "_design/app") == nil {
+		t.Error("fixtures not loaded")
+	}
+	ft.cleanup()
+	if dbs, _ := api.AllDBs(context.Background()); len(dbs) != 0 {
+		t.Errorf("databases left after cleanup: %v", dbs)
+	}
+}
+
+func TestNewTestDBFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string // requests that fail
+		prefix     string
+		wantFatals int
+		wantErrors int
+	}{
+		{"create", http.MethodPut, "/test_", 1, 0},
+		{"fixtures", http.MethodPost, "/test_", 1, 0},
+		{"delete", http.MethodDelete, "/test_", 0, 1},
+	}
+	for _, tt := range tests {
+		fc, api := newFakeCouch(t)
+		fc.handle(tt.method, tt.prefix, func(w http.ResponseWriter, r *http.Request) {
+			writeJSONError(w, http.StatusInternalServerError, "unknown_error", "broken")
+		})
+		ft := &fakeT{}
+		ft.run(func() {
+			NewTestDB(ft, api, TestDBOptions{Fixtures: []any{map[string]any{"_id": "a"}}})
+		})
+		// a cleanup of the test registered before runs after the one of the database
+		ran := false
+		ft.cleanups = append([]func(){func() { ran = true }}, ft.cleanups...)
+		ft.cleanup()
+		if len(ft.fatals) != tt.wantFatals || len(ft.errors) != tt.wantErrors {
+			t.Errorf("%s: fatals %q, errors %q", tt.name, ft.fatals, ft.errors)
+		}
+		if !ran {
+			t.Errorf("%s: later cleanup did not run", tt.name)
+		}
+	}
+}
+
+func TestSweepTestDBs(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	recent := time.Now().Unix()
+	stale := fmt.Sprintf("test_%d_0a1b2c3d_old", old)
+	_, api := newFakeCouch(t, stale, fmt.Sprintf("test_%d_0a1b2c3d_new", recent), "test_2024_orders", "orders")
+	deleted, err := SweepTestDBs(context.Background(), api, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deleted, []string{stale}) {
+		t.Errorf("deleted %v, want %v", deleted, []string{stale})
+	}
+	dbs, _ := api.AllDBs(context.Background())
+	if len(dbs) != 3 {
+		t.Errorf("databases left: %v", dbs)
+	}
+}